@@ -0,0 +1,115 @@
+package xdp
+
+import (
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Backend Umem/Socket 用到的 AF_XDP 内核操作. 默认直接走系统调用,
+// 单元测试可替换为进程内模拟的内核(见 xdpsim 包), 无需 root 与网卡
+type Backend interface {
+	Socket() (int, error)
+	RegisterUmem(fd int, data []byte, reg unix.XDPUmemReg) error
+	// SetRingSize ring 为 XDP_RX_RING XDP_TX_RING XDP_UMEM_FILL_RING XDP_UMEM_COMPLETION_RING
+	SetRingSize(fd int, ring int, size uint32) error
+	MmapOffsets(fd int) (unix.XDPMmapOffsets, error)
+	Mmap(fd int, pgoff int64, length int) ([]byte, error)
+	Munmap(b []byte) error
+	Bind(fd int, sa *unix.SockaddrXDP) error
+	// Wakeup 通知内核处理 TX ring (sendto MSG_DONTWAIT)
+	Wakeup(fd int)
+	Poll(fd int, events int16, timeout int) error
+	Statistics(fd int) (unix.XDPStatistics, error)
+	Close(fd int) error
+}
+
+type linuxBackend struct{}
+
+func (linuxBackend) Socket() (int, error) {
+	return syscall.Socket(unix.AF_XDP, unix.SOCK_RAW|unix.SOCK_CLOEXEC, 0)
+}
+
+func (linuxBackend) RegisterUmem(fd int, data []byte, reg unix.XDPUmemReg) error {
+	_, _, errno := unix.Syscall6(syscall.SYS_SETSOCKOPT, uintptr(fd),
+		unix.SOL_XDP, unix.XDP_UMEM_REG,
+		uintptr(unsafe.Pointer(&reg)), unsafe.Sizeof(reg), 0,
+	)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (linuxBackend) SetRingSize(fd int, ring int, size uint32) error {
+	return syscall.SetsockoptInt(fd, unix.SOL_XDP, ring, int(size))
+}
+
+func (linuxBackend) MmapOffsets(fd int) (unix.XDPMmapOffsets, error) {
+	return xsk_get_mmap_offsets(fd)
+}
+
+func (linuxBackend) Mmap(fd int, pgoff int64, length int) ([]byte, error) {
+	return syscall.Mmap(fd, pgoff, length,
+		unix.PROT_READ|unix.PROT_WRITE,
+		unix.MAP_SHARED|unix.MAP_POPULATE)
+}
+
+func (linuxBackend) Munmap(b []byte) error {
+	return syscall.Munmap(b)
+}
+
+func (linuxBackend) Bind(fd int, sa *unix.SockaddrXDP) error {
+	return unix.Bind(fd, sa)
+}
+
+func (linuxBackend) Wakeup(fd int) {
+	sendto(fd)
+}
+
+func (linuxBackend) Poll(fd int, events int16, timeout int) error {
+	fds := []unix.PollFd{{Fd: int32(fd), Events: events}}
+	_, err := unix.Poll(fds, timeout)
+	if err == unix.EINTR {
+		return nil
+	}
+	return err
+}
+
+func (linuxBackend) Statistics(fd int) (unix.XDPStatistics, error) {
+	var stats unix.XDPStatistics
+	size := uint32(unsafe.Sizeof(stats))
+	_, _, errno := syscall.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), unix.SOL_XDP, unix.XDP_STATISTICS, uintptr(unsafe.Pointer(&stats)), uintptr(unsafe.Pointer(&size)), 0)
+	if errno != 0 {
+		return stats, errno
+	}
+	return stats, nil
+}
+
+func (linuxBackend) Close(fd int) error {
+	return syscall.Close(fd)
+}
+
+func isLinuxBackend(b Backend) bool {
+	_, ok := b.(linuxBackend)
+	return ok
+}
+
+// mmapRing 映射一个 ring 并填好 xsk_ring 的各指针
+func mmapRing[T any](b Backend, fd int, pgoff int64, off unix.XDPRingOffset, size uint32) (*xsk_ring[T], []byte, error) {
+	var zero T
+	m, err := b.Mmap(fd, pgoff, int(off.Desc)+int(size)*int(unsafe.Sizeof(zero)))
+	if err != nil {
+		return nil, nil, errors.WithMessage(err, "Mmap")
+	}
+	r := new(xsk_ring[T])
+	r.Mask = size - 1
+	r.Size = size
+	r.Producer = (*uint32)(unsafe.Pointer(&m[off.Producer]))
+	r.Consumer = (*uint32)(unsafe.Pointer(&m[off.Consumer]))
+	r.Flags = (*uint32)(unsafe.Pointer(&m[off.Flags]))
+	r.Ring = unsafe.Slice((*T)(unsafe.Pointer(&m[off.Desc])), size)
+	return r, m, nil
+}
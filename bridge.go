@@ -0,0 +1,307 @@
+package xdp
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cilium/ebpf/link"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+type BridgeConfig struct {
+	Queues      []int               // 两侧转发的队列, 默认只用队列 0
+	AttachFlags link.XDPAttachFlags // 挂载 XDP 程序的模式, 0 表示由内核选择
+	Umem        *UmemConfig         // nil 为默认配置, 共享 umem 时大小加倍
+	Socket      *SocketConfig       // nil 为默认配置并按网卡能力选择绑定模式, QueueID 与 Poll 被忽略
+
+	// Copy 为 true 时两侧各用一个 umem, 转发时拷贝. 默认同一队列的两个 socket 共享 umem 零拷贝转发,
+	// 内核不支持跨网卡共享 umem (5.10 之前) 时自动退回拷贝
+	Copy bool
+
+	// AtoB BtoA 转发前调用, 可原地改写头部 (如 RewriteMAC), 返回 false 丢弃
+	AtoB, BtoA func(data []byte) bool
+}
+
+// BridgeStats 一个方向的转发统计
+type BridgeStats struct {
+	Packets uint64
+	Bytes   uint64
+	Dropped uint64 // hook 丢弃或对端 TX ring 已满
+}
+
+// Bridge 在两个网卡之间转发: A 收到的包从 B 发出, B 收到的包从 A 发出.
+// 每个队列一个 goroutine 同时处理两个方向
+type Bridge struct {
+	cfg     BridgeConfig
+	progs   [2]*Program
+	links   [2]link.Link
+	pairs   []*bridgePair
+	ab, ba  BridgeStats
+	closed  int32
+	running sync.WaitGroup
+}
+
+type bridgePair struct {
+	a, b  *Socket
+	umems []*Umem
+	copy  bool // a b 使用不同的 umem
+	descs []unix.XDPDesc
+	bufs  [][]byte
+}
+
+// NewBridge 在两个网卡上挂载 XDP 程序并打开各队列的 socket, 调用 Run 开始转发
+func NewBridge(ifindexA, ifindexB int, cfg *BridgeConfig) (_ *Bridge, err error) {
+	br := &Bridge{}
+	if cfg != nil {
+		br.cfg = *cfg
+	}
+	if len(br.cfg.Queues) == 0 {
+		br.cfg.Queues = []int{0}
+	}
+	defer func() {
+		if err != nil {
+			br.Close()
+		}
+	}()
+	pcfg := defaultProgramConfig
+	for _, q := range br.cfg.Queues {
+		if uint32(q) >= pcfg.MaxQueues {
+			pcfg.MaxQueues = uint32(q) + 1
+		}
+	}
+	for i := range br.progs {
+		if br.progs[i], err = NewProgram(&pcfg); err != nil {
+			return nil, err
+		}
+	}
+	for _, q := range br.cfg.Queues {
+		p, err := br.openPair(ifindexA, ifindexB, q)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "queue %d", q)
+		}
+		br.pairs = append(br.pairs, p)
+		if err = br.progs[0].Register(q, p.a); err == nil {
+			err = br.progs[1].Register(q, p.b)
+		}
+		if err != nil {
+			return nil, errors.WithMessage(err, "XSKMap")
+		}
+	}
+	for i, ifindex := range []int{ifindexA, ifindexB} {
+		if br.links[i], err = br.progs[i].Attach(ifindex, br.cfg.AttachFlags); err != nil {
+			return nil, errors.WithMessage(err, "attach XDP program")
+		}
+	}
+	return br, nil
+}
+
+func (br *Bridge) socketConfig(ifindex, queue int) *SocketConfig {
+	var sc SocketConfig
+	if br.cfg.Socket != nil {
+		sc = *br.cfg.Socket
+	} else if caps, err := probeNetdev(ifindex); err == nil {
+		sc.BindFlags = caps.BindFlags()
+	}
+	if sc.RxSize == 0 {
+		sc.RxSize = DEFAULT_RX_SIZE
+	}
+	if sc.TxSize == 0 {
+		sc.TxSize = DEFAULT_TX_SIZE
+	}
+	sc.QueueID = queue
+	sc.Poll = false
+	return &sc
+}
+
+func (br *Bridge) openPair(ifindexA, ifindexB, queue int) (_ *bridgePair, err error) {
+	p := &bridgePair{copy: br.cfg.Copy}
+	defer func() {
+		if err != nil {
+			p.close()
+		}
+	}()
+	ucfg := defaultUmemConfig
+	if br.cfg.Umem != nil {
+		ucfg = *br.cfg.Umem
+	} else if !p.copy {
+		ucfg.Size *= 2 // 两个 fill ring 与两个方向在途的帧
+	}
+	umem, err := NewUmem(&ucfg)
+	if err != nil {
+		return nil, errors.WithMessage(err, "NewUmem")
+	}
+	p.umems = append(p.umems, umem)
+	if p.a, err = NewSocket(ifindexA, umem, br.socketConfig(ifindexA, queue)); err != nil {
+		return nil, err
+	}
+	bcfg := br.socketConfig(ifindexB, queue)
+	if !p.copy {
+		if p.b, err = NewSocket(ifindexB, umem, bcfg); err == nil {
+			p.init()
+			return p, nil
+		}
+		p.copy = true
+	}
+	if umem, err = NewUmem(&ucfg); err != nil {
+		return nil, errors.WithMessage(err, "NewUmem")
+	}
+	p.umems = append(p.umems, umem)
+	if p.b, err = NewSocket(ifindexB, umem, bcfg); err != nil {
+		return nil, err
+	}
+	p.init()
+	return p, nil
+}
+
+func (p *bridgePair) init() {
+	p.descs = make([]unix.XDPDesc, len(p.a.descs))
+	p.bufs = make([][]byte, 0, len(p.descs))
+}
+
+func (p *bridgePair) close() {
+	for _, s := range []*Socket{p.a, p.b} {
+		if s != nil {
+			s.Close()
+		}
+	}
+	for _, u := range p.umems {
+		u.Close()
+	}
+}
+
+// ZeroCopy 报告所有队列是否都共享 umem 转发, 否则至少有一个队列在两个 umem 之间拷贝
+func (br *Bridge) ZeroCopy() bool {
+	for _, p := range br.pairs {
+		if p.copy {
+			return false
+		}
+	}
+	return true
+}
+
+// Run 开始转发, 直到 Close
+func (br *Bridge) Run() {
+	for _, p := range br.pairs {
+		p := p
+		br.running.Add(1)
+		go func() {
+			defer br.running.Done()
+			br.run(p)
+		}()
+	}
+	br.running.Wait()
+}
+
+func (br *Bridge) run(p *bridgePair) {
+	for atomic.LoadInt32(&br.closed) == 0 {
+		n := p.forward(p.a, p.b, br.cfg.AtoB, &br.ab)
+		n += p.forward(p.b, p.a, br.cfg.BtoA, &br.ba)
+		if n == 0 {
+			pollSockets(pollTimeout, p.a, p.b)
+		}
+	}
+}
+
+// forward 从 src 收一批包经 dst 发出, 返回收到的个数
+func (p *bridgePair) forward(src, dst *Socket, hook func([]byte) bool, st *BridgeStats) int {
+	n := src.Recv(p.descs)
+	if n == 0 {
+		return 0
+	}
+	kept := p.descs[:0]
+	for _, d := range p.descs[:n] {
+		if hook != nil && !hook(src.umem.DescData(d)) {
+			src.umem.putFrame(d.Addr)
+			continue
+		}
+		kept = append(kept, d)
+	}
+	var sent uint32
+	if p.copy {
+		bufs := p.bufs[:0]
+		for _, d := range kept {
+			bufs = append(bufs, src.umem.DescData(d))
+		}
+		sent = dst.Write(bufs...)
+		src.Release(kept...)
+	} else {
+		sent = dst.WriteDescs(kept...)
+		src.Release(kept[sent:]...)
+	}
+	var bytes uint64
+	for _, d := range kept[:sent] {
+		bytes += uint64(d.Len)
+	}
+	atomic.AddUint64(&st.Packets, uint64(sent))
+	atomic.AddUint64(&st.Bytes, bytes)
+	atomic.AddUint64(&st.Dropped, uint64(n)-uint64(sent))
+	return n
+}
+
+// pollSockets 等待任一 socket 收到包
+func pollSockets(timeout int, socks ...*Socket) {
+	b := socks[0].umem.backend
+	if !isLinuxBackend(b) {
+		for _, s := range socks {
+			b.Poll(s.fd, unix.POLLIN, timeout/len(socks))
+		}
+		return
+	}
+	fds := make([]unix.PollFd, len(socks))
+	for i, s := range socks {
+		fds[i] = unix.PollFd{Fd: int32(s.fd), Events: unix.POLLIN}
+	}
+	unix.Poll(fds, timeout)
+}
+
+// Stats 两个方向的转发统计
+func (br *Bridge) Stats() (ab, ba BridgeStats) {
+	load := func(s *BridgeStats) BridgeStats {
+		return BridgeStats{
+			Packets: atomic.LoadUint64(&s.Packets),
+			Bytes:   atomic.LoadUint64(&s.Bytes),
+			Dropped: atomic.LoadUint64(&s.Dropped),
+		}
+	}
+	return load(&br.ab), load(&br.ba)
+}
+
+// Close 停止转发, 卸载 XDP 程序并释放 socket 与 umem
+func (br *Bridge) Close() error {
+	if !atomic.CompareAndSwapInt32(&br.closed, 0, 1) {
+		return nil
+	}
+	br.running.Wait()
+	for i := range br.links {
+		if br.links[i] != nil {
+			br.links[i].Close()
+		}
+	}
+	for _, p := range br.pairs {
+		p.close()
+	}
+	for i := range br.progs {
+		if br.progs[i] != nil {
+			br.progs[i].Close()
+		}
+	}
+	return nil
+}
+
+// RewriteMAC 返回把以太网源/目的 MAC 改为 src/dst 的 hook, 为 nil 的地址不改
+func RewriteMAC(src, dst net.HardwareAddr) func(data []byte) bool {
+	return func(data []byte) bool {
+		if len(data) < 14 {
+			return false
+		}
+		if dst != nil {
+			copy(data[0:6], dst)
+		}
+		if src != nil {
+			copy(data[6:12], src)
+		}
+		return true
+	}
+}
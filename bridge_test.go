@@ -0,0 +1,141 @@
+package xdp
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lixiangzhong/xdp/xdpsim"
+)
+
+const simIfindexB = 2
+
+type simTx struct {
+	ifindex int
+	data    []byte
+}
+
+// newSimBridge 在 xdpsim 的网卡 1 与 2 的队列 0 之间转发, 不挂载 XDP 程序. 返回从两侧发出的帧
+func newSimBridge(t *testing.T, cfg BridgeConfig) (*xdpsim.Kernel, *Bridge, func() []simTx) {
+	t.Helper()
+	var mu sync.Mutex
+	var sent []simTx
+	k := xdpsim.New(&xdpsim.Config{OnTransmit: func(ifindex, queue int, data []byte) {
+		mu.Lock()
+		sent = append(sent, simTx{ifindex, data})
+		mu.Unlock()
+	}})
+	ucfg := simUmemConfig(128, 32)
+	ucfg.Backend = k
+	cfg.Umem = &ucfg
+	cfg.Socket = &SocketConfig{RxSize: 32, TxSize: 32}
+	cfg.Queues = []int{0}
+	br := &Bridge{cfg: cfg}
+	p, err := br.openPair(simIfindex, simIfindexB, 0)
+	if err != nil {
+		k.Stop()
+		t.Fatalf("openPair: %v", err)
+	}
+	br.pairs = append(br.pairs, p)
+	ran := make(chan struct{})
+	go func() {
+		defer close(ran)
+		br.Run()
+	}()
+	t.Cleanup(func() {
+		br.Close()
+		select {
+		case <-ran:
+		case <-time.After(2 * time.Second):
+			t.Error("Run did not return after Close")
+		}
+		k.Stop()
+	})
+	return k, br, func() []simTx {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]simTx(nil), sent...)
+	}
+}
+
+func TestBridge(t *testing.T) {
+	const (
+		rounds = 20
+		batch  = 16 // 总数超过 umem 的 frame 数, 帧必须被回收
+		size   = 64
+	)
+	macB := net.HardwareAddr{2, 0, 0, 0, 0, 0xb}
+	for _, copyMode := range []bool{false, true} {
+		t.Run(map[bool]string{false: "shared", true: "copy"}[copyMode], func(t *testing.T) {
+			k, br, sent := newSimBridge(t, BridgeConfig{
+				Copy: copyMode,
+				AtoB: RewriteMAC(macB, nil),
+				BtoA: func(data []byte) bool { return data[0]%3 != 0 },
+			})
+			if br.ZeroCopy() == copyMode {
+				t.Fatalf("ZeroCopy %v with Copy %v", br.ZeroCopy(), copyMode)
+			}
+			if n := len(br.pairs[0].umems); n != map[bool]int{false: 1, true: 2}[copyMode] {
+				t.Fatalf("%d umems", n)
+			}
+
+			var wantA, wantB [][]byte // 从 A 与 B 发出的帧
+			var ab, ba BridgeStats
+			for r := 0; r < rounds; r++ {
+				for i := 0; i < batch; i++ {
+					f := simFrame(r*batch+i, size)
+					k.Inject(simIfindex, 0, f)
+					w := append([]byte(nil), f...)
+					copy(w[6:12], macB)
+					wantB = append(wantB, w)
+					ab.Packets++
+					ab.Bytes += size
+
+					f = simFrame(r*batch+i+1, size)
+					k.Inject(simIfindexB, 0, f)
+					if f[0]%3 != 0 {
+						wantA = append(wantA, f)
+						ba.Packets++
+						ba.Bytes += size
+					} else {
+						ba.Dropped++
+					}
+				}
+				waitFor(t, "forwarded frames", func() bool {
+					return len(sent()) == len(wantA)+len(wantB)
+				})
+			}
+
+			var gotA, gotB [][]byte
+			for _, tx := range sent() {
+				switch tx.ifindex {
+				case simIfindex:
+					gotA = append(gotA, tx.data)
+				case simIfindexB:
+					gotB = append(gotB, tx.data)
+				default:
+					t.Fatalf("frame sent on ifindex %d", tx.ifindex)
+				}
+			}
+			for dir, c := range map[string]struct{ got, want [][]byte }{"A->B": {gotB, wantB}, "B->A": {gotA, wantA}} {
+				if len(c.got) != len(c.want) {
+					t.Errorf("%s: %d frames, want %d", dir, len(c.got), len(c.want))
+					continue
+				}
+				for i := range c.want {
+					if !bytes.Equal(c.got[i], c.want[i]) {
+						t.Errorf("%s frame %d: % x, want % x", dir, i, c.got[i][:16], c.want[i][:16])
+						break
+					}
+				}
+			}
+			// 统计在 Write 返回后才更新, 可能晚于发出
+			waitFor(t, "stats", func() bool {
+				gotAB, gotBA := br.Stats()
+				return gotAB == ab && gotBA == ba
+			})
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package xdp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// cilium/ebpf v0.9 无法解析新内核 BTF 中的 ENUM64 等类型, 这里只遍历类型表查找函数的 ID
+const (
+	btfMagic = 0xeb9f
+
+	btfKindInt      = 1
+	btfKindArray    = 3
+	btfKindStruct   = 4
+	btfKindUnion    = 5
+	btfKindEnum     = 6
+	btfKindFunc     = 12
+	btfKindFuncProt = 13
+	btfKindVar      = 14
+	btfKindDatasec  = 15
+	btfKindDeclTag  = 17
+	btfKindEnum64   = 19
+)
+
+var vmlinuxBTF = "/sys/kernel/btf/vmlinux"
+
+// kernelFuncIDs 在内核 BTF 中查找函数 (kfunc) 的类型 ID, 不存在的函数不在结果中
+func kernelFuncIDs(names ...string) (map[string]uint32, error) {
+	b, err := os.ReadFile(vmlinuxBTF)
+	if err != nil {
+		return nil, errors.WithMessage(err, "kernel BTF")
+	}
+	ids, err := btfFuncIDs(b, names)
+	return ids, errors.WithMessage(err, "kernel BTF")
+}
+
+func btfFuncIDs(b []byte, names []string) (map[string]uint32, error) {
+	if len(b) < 24 || binary.LittleEndian.Uint16(b) != btfMagic {
+		return nil, errors.New("bad magic")
+	}
+	le := binary.LittleEndian
+	hdrLen := le.Uint32(b[4:])
+	typeOff, typeLen := hdrLen+le.Uint32(b[8:]), le.Uint32(b[12:])
+	strOff, strLen := hdrLen+le.Uint32(b[16:]), le.Uint32(b[20:])
+	if uint64(typeOff)+uint64(typeLen) > uint64(len(b)) || uint64(strOff)+uint64(strLen) > uint64(len(b)) {
+		return nil, errors.New("truncated")
+	}
+	types, strs := b[typeOff:typeOff+typeLen], b[strOff:strOff+strLen]
+	want := make(map[string]bool, len(names))
+	for _, n := range names {
+		want[n] = true
+	}
+	ids := make(map[string]uint32)
+	for id := uint32(1); len(types) > 0; id++ {
+		if len(types) < 12 {
+			return nil, errors.New("truncated type")
+		}
+		nameOff, info := le.Uint32(types), le.Uint32(types[4:])
+		kind, vlen := info>>24&0x1f, int(info&0xffff)
+		n := 12
+		switch kind {
+		case btfKindInt, btfKindVar, btfKindDeclTag:
+			n += 4
+		case btfKindArray:
+			n += 12
+		case btfKindStruct, btfKindUnion, btfKindDatasec, btfKindEnum64:
+			n += 12 * vlen
+		case btfKindEnum, btfKindFuncProt:
+			n += 8 * vlen
+		}
+		if n > len(types) {
+			return nil, errors.New("truncated type")
+		}
+		if kind == btfKindFunc && int(nameOff) < len(strs) {
+			name := strs[nameOff:]
+			if i := bytes.IndexByte(name, 0); i >= 0 {
+				name = name[:i]
+			}
+			if want[string(name)] {
+				ids[string(name)] = id
+			}
+		}
+		types = types[n:]
+	}
+	return ids, nil
+}
@@ -0,0 +1,124 @@
+package xdp
+
+import (
+	"net"
+
+	"github.com/lixiangzhong/xdp/internal/netlink"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// netdev generic netlink family (include/uapi/linux/netdev.h)
+const (
+	_NETDEV_CMD_DEV_GET = 1
+
+	_NETDEV_A_DEV_IFINDEX                  = 1
+	_NETDEV_A_DEV_XDP_FEATURES             = 3
+	_NETDEV_A_DEV_XDP_ZC_MAX_SEGS          = 4
+	_NETDEV_A_DEV_XDP_RX_METADATA_FEATURES = 5
+	_NETDEV_A_DEV_XSK_FEATURES             = 6
+)
+
+// xdp-features 各比特位
+const (
+	NETDEV_XDP_ACT_BASIC        = 1 << 0
+	NETDEV_XDP_ACT_REDIRECT     = 1 << 1
+	NETDEV_XDP_ACT_NDO_XMIT     = 1 << 2
+	NETDEV_XDP_ACT_XSK_ZEROCOPY = 1 << 3
+	NETDEV_XDP_ACT_HW_OFFLOAD   = 1 << 4
+	NETDEV_XDP_ACT_RX_SG        = 1 << 5
+	NETDEV_XDP_ACT_NDO_XMIT_SG  = 1 << 6
+)
+
+// xsk-features 各比特位
+const (
+	NETDEV_XSK_FLAGS_TX_TIMESTAMP = 1 << 0
+	NETDEV_XSK_FLAGS_TX_CHECKSUM  = 1 << 1
+)
+
+// xdp-rx-metadata-features 各比特位
+const (
+	NETDEV_XDP_RX_METADATA_TIMESTAMP = 1 << 0
+	NETDEV_XDP_RX_METADATA_HASH      = 1 << 1
+	NETDEV_XDP_RX_METADATA_VLAN_TAG  = 1 << 2
+)
+
+// XDP_USE_SG bind flag, 旧版 x/sys 中没有
+const XDP_USE_SG = 1 << 4
+
+type NicCapabilities struct {
+	XDPFeatures        uint64 // netdev xdp-features 原始值
+	XSKFeatures        uint64 // netdev xsk-features 原始值
+	RxMetadataFeatures uint64 // netdev xdp-rx-metadata-features 原始值
+	ZCMaxSegs          uint32 // 零拷贝模式下单个包最多的 frame 数
+
+	NativeXDP      bool // 驱动模式 XDP
+	ZeroCopy       bool // AF_XDP 零拷贝
+	MultiBuffer    bool // 多 buffer (jumbo frame)
+	RedirectTarget bool // 可作为 bpf_redirect 的目标 (ndo_xdp_xmit)
+	TxMetadata     bool // AF_XDP TX metadata (校验和卸载或 TX 时间戳)
+}
+
+// ErrCapabilitiesUnknown 内核不支持 netdev netlink (6.3 之前), 无法得知网卡能力.
+// 不以试探 bind 代替: 在运行中的网卡上零拷贝 bind 会重建队列, 短暂中断收发
+var ErrCapabilitiesUnknown = errors.New("xdp: NIC capabilities unknown without netdev netlink")
+
+// BindFlags 根据能力给出 SocketConfig.BindFlags 的建议值. 支持零拷贝时为 0, 由内核先试零拷贝再退回复制模式,
+// 程序以 generic 模式挂载时也能 bind; 强制 XDP_ZEROCOPY 须由调用者显式指定
+func (c NicCapabilities) BindFlags() uint16 {
+	if c.ZeroCopy {
+		return 0
+	}
+	return unix.XDP_COPY
+}
+
+// GetNicCapabilities 查询网卡的 XDP 能力, 内核不支持 netdev netlink 时返回 ErrCapabilitiesUnknown,
+// 此时 SocketConfig.BindFlags 可留为 0, 由内核先试零拷贝再退回复制模式
+func GetNicCapabilities(ifname string) (NicCapabilities, error) {
+	iface, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return NicCapabilities{}, err
+	}
+	caps, err := probeNetdev(iface.Index)
+	if err != nil {
+		return NicCapabilities{}, ErrCapabilitiesUnknown
+	}
+	return caps, nil
+}
+
+// probeNetdev 通过 netdev generic netlink 查询 (Linux 6.3+)
+func probeNetdev(ifindex int) (NicCapabilities, error) {
+	var caps NicCapabilities
+	c, err := netlink.Dial(unix.NETLINK_GENERIC)
+	if err != nil {
+		return caps, err
+	}
+	defer c.Close()
+	family, err := netlink.GenlFamilyID(c, "netdev")
+	if err != nil {
+		return caps, err
+	}
+	req := []byte{_NETDEV_CMD_DEV_GET, 1, 0, 0}
+	req = netlink.AppendAttrU32(req, _NETDEV_A_DEV_IFINDEX, uint32(ifindex))
+	msgs, err := c.Request(family, 0, req)
+	if err != nil {
+		return caps, errors.WithMessage(err, "NETDEV_CMD_DEV_GET")
+	}
+	if len(msgs) == 0 || len(msgs[0].Data) < unix.GENL_HDRLEN {
+		return caps, errors.New("NETDEV_CMD_DEV_GET: empty reply")
+	}
+	attrs := netlink.ParseAttrs(msgs[0].Data[unix.GENL_HDRLEN:])
+	if _, ok := attrs[_NETDEV_A_DEV_XDP_FEATURES]; !ok {
+		return caps, errors.New("NETDEV_CMD_DEV_GET: no xdp-features")
+	}
+	caps.XDPFeatures = netlink.AttrU64(attrs, _NETDEV_A_DEV_XDP_FEATURES)
+	caps.XSKFeatures = netlink.AttrU64(attrs, _NETDEV_A_DEV_XSK_FEATURES)
+	caps.RxMetadataFeatures = netlink.AttrU64(attrs, _NETDEV_A_DEV_XDP_RX_METADATA_FEATURES)
+	caps.ZCMaxSegs = netlink.AttrU32(attrs, _NETDEV_A_DEV_XDP_ZC_MAX_SEGS)
+	caps.NativeXDP = caps.XDPFeatures&NETDEV_XDP_ACT_BASIC != 0
+	caps.ZeroCopy = caps.XDPFeatures&NETDEV_XDP_ACT_XSK_ZEROCOPY != 0
+	caps.MultiBuffer = caps.XDPFeatures&NETDEV_XDP_ACT_RX_SG != 0
+	caps.RedirectTarget = caps.XDPFeatures&NETDEV_XDP_ACT_NDO_XMIT != 0
+	caps.TxMetadata = caps.XSKFeatures != 0
+	return caps, nil
+}
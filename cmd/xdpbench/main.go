@@ -0,0 +1,422 @@
+// xdpbench 类似内核 samples 中的 xdpsock, 测量网卡与本库的收发性能:
+//
+//	xdpbench -i eth0 -m rxdrop          收包后直接回收
+//	xdpbench -i eth0 -m txonly -s 64    发送固定长度的 UDP 包, -pps/-bps 限速
+//	xdpbench -i eth0 -m l2fwd           交换 MAC 后从原队列发回
+//
+// 每个队列一个 goroutine, 按 -t 间隔输出每个队列的 pps
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/rlimit"
+	"github.com/lixiangzhong/xdp"
+	"github.com/lixiangzhong/xdp/internal/cliutil"
+	"github.com/lixiangzhong/xdp/packet"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	ifname     string
+	queueList  string
+	mode       string
+	batch      uint
+	rxSize     uint
+	txSize     uint
+	fillSize   uint
+	compSize   uint
+	umemsize   uint64
+	pktSize    int
+	dstMAC     string
+	txPPS      float64
+	txBPS      float64
+	zerocopy   bool
+	copyMode   bool
+	generic    bool
+	needWakeup bool
+	usePoll    bool
+	busyPoll   int
+	budget     int
+	duration   time.Duration
+	interval   time.Duration
+)
+
+func init() {
+	flag.StringVar(&ifname, "i", "", "网卡")
+	flag.StringVar(&queueList, "q", "0", "队列, 如 0,2,3 或 0-3, all 为全部")
+	flag.StringVar(&mode, "m", "rxdrop", "rxdrop txonly l2fwd")
+	flag.UintVar(&batch, "b", 64, "每批处理的帧数")
+	flag.UintVar(&rxSize, "rx", xdp.DEFAULT_RX_SIZE, "RX ring 大小")
+	flag.UintVar(&txSize, "tx", xdp.DEFAULT_TX_SIZE, "TX ring 大小")
+	flag.UintVar(&fillSize, "fill", xdp.DEFAULT_FILL_SIZE, "fill ring 大小")
+	flag.UintVar(&compSize, "comp", xdp.DEFAULT_COMP_SIZE, "completion ring 大小")
+	flag.Uint64Var(&umemsize, "u", 16, "-u 16 表示每网卡队列分配16M内存")
+	flag.IntVar(&pktSize, "s", 64, "txonly 发送的帧长度(不含 FCS)")
+	flag.StringVar(&dstMAC, "dmac", "ff:ff:ff:ff:ff:ff", "txonly 的目的 MAC, auto 为按路由查内核邻居表")
+	flag.Float64Var(&txPPS, "pps", 0, "txonly 的包速率上限, 0 不限")
+	flag.Float64Var(&txBPS, "bps", 0, "txonly 的比特率上限(含前导码与帧间隔), 0 不限")
+	flag.BoolVar(&zerocopy, "z", false, "XDP_ZEROCOPY")
+	flag.BoolVar(&copyMode, "c", false, "XDP_COPY")
+	flag.BoolVar(&generic, "g", false, "generic(SKB) 模式挂载 XDP 程序, 隐含 -c")
+	flag.BoolVar(&needWakeup, "N", false, "XDP_USE_NEED_WAKEUP")
+	flag.BoolVar(&usePoll, "p", false, "使用 poll() 等待, 隐含 -N")
+	flag.IntVar(&busyPoll, "B", 0, "SO_BUSY_POLL 微秒, 0 不启用")
+	flag.IntVar(&budget, "budget", 0, "SO_BUSY_POLL_BUDGET, 0 为内核默认")
+	flag.DurationVar(&duration, "d", 0, "运行时长, 0 为直到 Ctrl-C")
+	flag.DurationVar(&interval, "t", time.Second, "输出间隔")
+}
+
+type worker struct {
+	queue int
+	umem  *xdp.Umem
+	sock  *xdp.Socket
+	pacer *xdp.Pacer // txonly 限速时非 nil
+	rx    uint64
+	tx    uint64
+}
+
+var stop int32
+
+func main() {
+	flag.Parse()
+	log.SetFlags(log.Lshortfile | log.LstdFlags)
+	if ifname == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if mode != "rxdrop" && mode != "txonly" && mode != "l2fwd" {
+		log.Fatalf("unknown mode %q", mode)
+	}
+	// 出错时先执行 run 中的 defer (关闭 socket, 卸载程序) 再退出
+	if err := run(); err != nil {
+		log.Print(err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	if err := rlimit.RemoveMemlock(); err != nil {
+		return err
+	}
+	iface, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return err
+	}
+	queues, err := cliutil.ParseQueues(ifname, queueList)
+	if err != nil {
+		return err
+	}
+
+	// txonly 不需要重定向程序
+	var prog *xdp.Program
+	if mode != "txonly" {
+		prog, err = xdp.NewProgram(nil)
+		if err != nil {
+			return err
+		}
+		defer prog.Close()
+		var flags link.XDPAttachFlags
+		if generic {
+			flags = link.XDPGenericMode
+		}
+		l, err := prog.Attach(iface.Index, flags)
+		if err != nil {
+			return fmt.Errorf("could not attach XDP program: %v", err)
+		}
+		defer l.Close()
+	}
+	workers, err := openWorkers(iface, queues, prog)
+	if err != nil {
+		return err
+	}
+	defer closeWorkers(workers)
+	return bench(workers)
+}
+
+func openWorkers(iface *net.Interface, queues []int, prog *xdp.Program) ([]*worker, error) {
+	var bindFlags uint16
+	switch {
+	case zerocopy:
+		bindFlags = unix.XDP_ZEROCOPY
+	case copyMode || generic:
+		bindFlags = unix.XDP_COPY
+	default:
+		if caps, err := xdp.GetNicCapabilities(iface.Name); err == nil {
+			bindFlags = caps.BindFlags()
+		}
+	}
+	if needWakeup {
+		bindFlags |= unix.XDP_USE_NEED_WAKEUP
+	}
+	cfg := xdp.SocketConfig{
+		RxSize:         uint32(rxSize),
+		TxSize:         uint32(txSize),
+		BindFlags:      bindFlags,
+		Poll:           usePoll,
+		BatchSize:      uint32(batch),
+		BusyPoll:       busyPoll,
+		BusyPollBudget: budget,
+	}
+	switch mode {
+	case "rxdrop":
+		cfg.TxSize = 0
+	case "txonly":
+		cfg.RxSize = 0
+	}
+	var workers []*worker
+	for _, q := range queues {
+		umem, err := xdp.NewUmem(&xdp.UmemConfig{
+			FillSize: uint32(fillSize),
+			CompSize: uint32(compSize),
+			Size:     uint32(umemsize << 20),
+		})
+		if err != nil {
+			closeWorkers(workers)
+			return nil, fmt.Errorf("queue %d: NewUmem: %v", q, err)
+		}
+		cfg.QueueID = q
+		sock, err := xdp.NewSocket(iface.Index, umem, &cfg)
+		if err != nil {
+			umem.Close()
+			closeWorkers(workers)
+			return nil, fmt.Errorf("queue %d: NewSocket: %v", q, err)
+		}
+		w := &worker{queue: q, umem: umem, sock: sock}
+		workers = append(workers, w)
+		if prog != nil {
+			if err := prog.Register(q, sock); err != nil {
+				closeWorkers(workers)
+				return nil, fmt.Errorf("queue %d: Register: %v", q, err)
+			}
+		}
+	}
+	return workers, nil
+}
+
+func closeWorkers(workers []*worker) {
+	for _, w := range workers {
+		w.sock.Close()
+		w.umem.Close()
+	}
+}
+
+// bench 运行直到 Ctrl-C 或 -d 到期, 由调用者关闭 workers
+func bench(workers []*worker) error {
+	var frame []byte
+	if mode == "txonly" {
+		var err error
+		frame, err = udpFrame()
+		if err == nil && (txPPS > 0 || txBPS > 0) {
+			err = openPacers(workers)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	var wg sync.WaitGroup
+	for _, w := range workers {
+		w := w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runtime.LockOSThread()
+			switch mode {
+			case "rxdrop":
+				w.rxdrop()
+			case "txonly":
+				w.txonly(frame)
+			case "l2fwd":
+				w.l2fwd()
+			}
+		}()
+	}
+	log.Printf("%s on %s queues %d, Ctrl-C to exit", mode, ifname, len(workers))
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	var deadline <-chan time.Time
+	if duration > 0 {
+		deadline = time.After(duration)
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	start := time.Now()
+	last := make([][2]uint64, len(workers))
+	prev := start
+loop:
+	for {
+		select {
+		case now := <-t.C:
+			printRates(workers, last, now.Sub(prev))
+			prev = now
+		case <-sig:
+			break loop
+		case <-deadline:
+			break loop
+		}
+	}
+	for _, w := range workers {
+		if st, err := w.sock.Stats(); err == nil {
+			log.Printf("q%d rx_dropped %d rx_invalid_descs %d tx_invalid_descs %d rx_ring_full %d fill_ring_empty %d tx_ring_empty %d",
+				w.queue, st.Rx_dropped, st.Rx_invalid_descs, st.Tx_invalid_descs, st.Rx_ring_full, st.Rx_fill_ring_empty_descs, st.Tx_ring_empty_descs)
+		}
+	}
+	atomic.StoreInt32(&stop, 1)
+	// rxdrop 阻塞在 HandleRecv 中, Close 后返回
+	if mode == "rxdrop" {
+		for _, w := range workers {
+			w.sock.Close()
+		}
+	}
+	wg.Wait()
+	elapsed := time.Since(start).Seconds()
+	var rx, tx uint64
+	for _, w := range workers {
+		rx += w.rx
+		tx += w.tx
+	}
+	log.Printf("total rx %d (%.0f pps) tx %d (%.0f pps) in %.1fs", rx, float64(rx)/elapsed, tx, float64(tx)/elapsed, elapsed)
+	return nil
+}
+
+func (w *worker) rxdrop() {
+	w.sock.HandleRecv(func(unix.XDPDesc, []byte) bool {
+		atomic.AddUint64(&w.rx, 1)
+		return true
+	})
+}
+
+// openPacers 速率平均分给各队列, BPS 计入以太网前导码, 帧间隔与 FCS
+func openPacers(workers []*worker) error {
+	n := float64(len(workers))
+	for _, w := range workers {
+		var err error
+		w.pacer, err = xdp.NewPacer(w.sock, &xdp.PacerConfig{PPS: txPPS / n, BPS: txBPS / n, Overhead: 24})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *worker) txonly(frame []byte) {
+	frames := make([][]byte, batch)
+	for i := range frames {
+		frames[i] = frame
+	}
+	write := w.sock.Write
+	if w.pacer != nil {
+		write = w.pacer.Write
+	}
+	for atomic.LoadInt32(&stop) == 0 {
+		n := write(frames...)
+		atomic.AddUint64(&w.tx, uint64(n))
+		if n == 0 && usePoll {
+			w.poll(unix.POLLOUT)
+		}
+	}
+}
+
+func (w *worker) l2fwd() {
+	descs := make([]unix.XDPDesc, batch)
+	for atomic.LoadInt32(&stop) == 0 {
+		if usePoll {
+			w.poll(unix.POLLIN)
+		}
+		n := w.sock.Recv(descs)
+		if n == 0 {
+			continue
+		}
+		atomic.AddUint64(&w.rx, uint64(n))
+		for _, d := range descs[:n] {
+			b := w.umem.DescData(d)
+			var tmp [6]byte
+			copy(tmp[:], b[0:6])
+			copy(b[0:6], b[6:12])
+			copy(b[6:12], tmp[:])
+		}
+		// TX ring 满时等待内核发送后重试, 不丢包
+		sent := 0
+		for sent < n && atomic.LoadInt32(&stop) == 0 {
+			sent += int(w.sock.WriteDescs(descs[sent:n]...))
+		}
+		w.sock.Release(descs[sent:n]...)
+		atomic.AddUint64(&w.tx, uint64(sent))
+	}
+}
+
+func (w *worker) poll(events int16) {
+	fds := []unix.PollFd{{Fd: int32(w.sock.FD()), Events: events}}
+	unix.Poll(fds, 100)
+}
+
+// udpFrame 10.0.0.1:1234 -> 10.0.0.2:4321, 长度 pktSize
+func udpFrame() ([]byte, error) {
+	const hdrs = packet.EthernetLen + packet.IPv4MinLen + packet.UDPLen
+	if pktSize < hdrs {
+		return nil, fmt.Errorf("packet size must be at least %d", hdrs)
+	}
+	iface, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := frameDstMAC(iface, net.IPv4(10, 0, 0, 2))
+	if err != nil {
+		return nil, err
+	}
+	b := packet.NewBuffer(make([]byte, pktSize), hdrs, 0)
+	if _, err := b.Extend(pktSize - hdrs); err != nil {
+		return nil, err
+	}
+	if err := b.PushUDP(1234, 4321); err != nil {
+		return nil, err
+	}
+	if err := b.PushIPv4(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), 0, 64); err != nil {
+		return nil, err
+	}
+	if err := b.PushEthernet(dst, iface.HardwareAddr, 0); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func frameDstMAC(iface *net.Interface, ip net.IP) (net.HardwareAddr, error) {
+	if dstMAC != "auto" {
+		return net.ParseMAC(dstMAC)
+	}
+	n, err := xdp.NewNeighbors(&xdp.NeighborConfig{Ifindex: iface.Index})
+	if err != nil {
+		return nil, err
+	}
+	defer n.Close()
+	mac, err := n.Resolve(ip)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %v: %w", ip, err)
+	}
+	return mac, nil
+}
+
+func printRates(workers []*worker, last [][2]uint64, d time.Duration) {
+	secs := d.Seconds()
+	var sb strings.Builder
+	for i, w := range workers {
+		rx, tx := atomic.LoadUint64(&w.rx), atomic.LoadUint64(&w.tx)
+		fmt.Fprintf(&sb, "q%d rx %.0f pps tx %.0f pps  ", w.queue,
+			float64(rx-last[i][0])/secs, float64(tx-last[i][1])/secs)
+		last[i] = [2]uint64{rx, tx}
+	}
+	fmt.Println(strings.TrimSpace(sb.String()))
+}
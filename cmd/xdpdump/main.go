@@ -0,0 +1,282 @@
+// xdpdump 在网卡的全部或指定队列上打开 AF_XDP socket 抓包, 打印摘要或写入 pcap/pcapng.
+//
+//	xdpdump -i eth0 -q 0,1 -w rx.pcapng 'udp port 53'
+//
+// 抓包期间网卡上的报文全部被重定向到用户态, 不再进入内核协议栈
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/rlimit"
+	"github.com/lixiangzhong/xdp"
+	"github.com/lixiangzhong/xdp/filter"
+	"github.com/lixiangzhong/xdp/internal/cliutil"
+	"github.com/lixiangzhong/xdp/pcap"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	ifname     string
+	queueList  string
+	generic    bool
+	umemsize   uint64
+	output     string
+	snaplen    int
+	rotateSize int64
+	rotateTime time.Duration
+	noPromisc  bool
+	quiet      bool
+	interval   time.Duration
+	zerocopy   bool
+)
+
+func init() {
+	flag.StringVar(&ifname, "i", "", "网卡")
+	flag.StringVar(&queueList, "q", "", "队列, 如 0,2,3, 默认全部")
+	flag.BoolVar(&generic, "g", false, "generic(SKB) 模式挂载 XDP 程序")
+	flag.Uint64Var(&umemsize, "s", 16, "-s 16 表示每网卡队列分配16M内存")
+	flag.StringVar(&output, "w", "", "写入文件, 扩展名为 .pcapng 时使用 pcapng 格式")
+	flag.IntVar(&snaplen, "snaplen", pcap.DefaultSnaplen, "每个包最多保存的字节数")
+	flag.Int64Var(&rotateSize, "C", 0, "文件达到 N MB 后轮转")
+	flag.DurationVar(&rotateTime, "G", 0, "文件每隔一段时间轮转, 如 10m")
+	flag.BoolVar(&noPromisc, "p", false, "不开启混杂模式")
+	flag.BoolVar(&quiet, "quiet", false, "不打印报文摘要")
+	flag.DurationVar(&interval, "t", time.Second, "统计速率的间隔, 0 不统计")
+	flag.BoolVar(&zerocopy, "z", false, "强制 XDP_ZEROCOPY, 默认按网卡能力选择")
+}
+
+type queueStats struct {
+	queue   int
+	packets uint64
+	bytes   uint64
+	matched uint64
+	sock    *xdp.Socket
+}
+
+func main() {
+	flag.Parse()
+	log.SetFlags(log.Lshortfile | log.LstdFlags)
+	if ifname == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	// 出错时先执行 run 中的 defer (恢复混杂模式, 卸载程序) 再退出
+	if err := run(); err != nil {
+		log.Print(err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	if err := rlimit.RemoveMemlock(); err != nil {
+		return err
+	}
+	iface, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return err
+	}
+	queues, err := cliutil.ParseQueues(ifname, queueList)
+	if err != nil {
+		return err
+	}
+
+	var f *filter.Filter
+	if expr := strings.Join(flag.Args(), " "); expr != "" {
+		f, err = filter.New(expr)
+		if err != nil {
+			return err
+		}
+	}
+
+	var w *pcap.Writer
+	if output != "" {
+		cfg := &pcap.Config{
+			Snaplen:        uint32(snaplen),
+			Interface:      ifname,
+			RotateSize:     rotateSize << 20,
+			RotateInterval: rotateTime,
+		}
+		if strings.HasSuffix(output, ".pcapng") {
+			cfg.Format = pcap.FormatPcapng
+		}
+		w, err = pcap.Create(output, cfg)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !noPromisc {
+		promisc, err := xdp.GetNicPromisc(ifname)
+		if err != nil {
+			return err
+		}
+		if !promisc {
+			if err := xdp.SetNicPromisc(ifname, true); err != nil {
+				return err
+			}
+			defer xdp.SetNicPromisc(ifname, false)
+		}
+	}
+
+	prog, err := xdp.NewProgram(nil)
+	if err != nil {
+		return err
+	}
+	defer prog.Close()
+	var flags link.XDPAttachFlags
+	if generic {
+		flags = link.XDPGenericMode
+	}
+	l, err := prog.Attach(iface.Index, flags)
+	if err != nil {
+		return fmt.Errorf("could not attach XDP program: %w", err)
+	}
+	defer l.Close()
+
+	stats := make([]*queueStats, len(queues))
+	for i, q := range queues {
+		stats[i], err = openQueue(iface.Index, q, prog)
+		if err != nil {
+			// 程序在 defer 中卸载
+			closeQueues(stats[:i])
+			return fmt.Errorf("queue %d: %w", q, err)
+		}
+	}
+	log.Printf("capturing on %s queues %v, Ctrl-C to exit", ifname, queues)
+
+	var printMu sync.Mutex
+	var wg sync.WaitGroup
+	for _, st := range stats {
+		st := st
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			st.sock.HandleRecv(func(d unix.XDPDesc, b []byte) bool {
+				atomic.AddUint64(&st.packets, 1)
+				atomic.AddUint64(&st.bytes, uint64(d.Len))
+				if f != nil && !f.Match(b) {
+					return true
+				}
+				atomic.AddUint64(&st.matched, 1)
+				now := time.Now()
+				if w != nil {
+					w.WritePacket(st.queue, now, b)
+				}
+				if !quiet && w == nil {
+					s := summary(now, st.queue, b)
+					printMu.Lock()
+					fmt.Println(s)
+					printMu.Unlock()
+				}
+				return true
+			})
+		}()
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	var tick <-chan time.Time
+	if interval > 0 {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		tick = t.C
+	}
+	last := make([]queueStats, len(stats))
+loop:
+	for {
+		select {
+		case <-tick:
+			printRates(stats, last)
+		case <-sig:
+			break loop
+		}
+	}
+	closeQueues(stats)
+	wg.Wait()
+	if w != nil {
+		if err := w.Close(); err != nil {
+			log.Println(err)
+		}
+		log.Printf("%d packets written to %s", w.Packets, output)
+	}
+	var total, matched uint64
+	for _, st := range stats {
+		total += st.packets
+		matched += st.matched
+	}
+	log.Printf("%d packets received, %d matched", total, matched)
+	return nil
+}
+
+func openQueue(ifindex, queue int, prog *xdp.Program) (*queueStats, error) {
+	umem, err := xdp.NewUmem(&xdp.UmemConfig{
+		FillSize: xdp.DEFAULT_FILL_SIZE,
+		CompSize: xdp.DEFAULT_COMP_SIZE,
+		Size:     uint32(umemsize << 20),
+	})
+	if err != nil {
+		return nil, err
+	}
+	cfg := &xdp.SocketConfig{
+		RxSize:  xdp.DEFAULT_RX_SIZE,
+		TxSize:  0,
+		QueueID: queue,
+		Poll:    true,
+	}
+	switch {
+	case zerocopy:
+		cfg.BindFlags = unix.XDP_ZEROCOPY
+	case generic:
+		cfg.BindFlags = unix.XDP_COPY
+	default:
+		caps, err := xdp.GetNicCapabilities(ifname)
+		if err == nil {
+			cfg.BindFlags = caps.BindFlags()
+		}
+	}
+	sock, err := xdp.NewSocket(ifindex, umem, cfg)
+	if err != nil {
+		umem.Close()
+		return nil, err
+	}
+	if err := prog.Register(queue, sock); err != nil {
+		sock.Close()
+		umem.Close()
+		return nil, err
+	}
+	return &queueStats{queue: queue, sock: sock}, nil
+}
+
+func closeQueues(stats []*queueStats) {
+	for _, st := range stats {
+		st.sock.Close()
+	}
+}
+
+func printRates(stats []*queueStats, last []queueStats) {
+	secs := interval.Seconds()
+	var sb strings.Builder
+	for i, st := range stats {
+		pkts, bytes := atomic.LoadUint64(&st.packets), atomic.LoadUint64(&st.bytes)
+		fmt.Fprintf(&sb, "q%d %.0f pps %s", st.queue,
+			float64(pkts-last[i].packets)/secs, FormatBps(uint64(float64(bytes-last[i].bytes)/secs)))
+		if xs, err := st.sock.Stats(); err == nil && xs.Rx_dropped+xs.Rx_ring_full > 0 {
+			fmt.Fprintf(&sb, " (dropped %d, ring full %d)", xs.Rx_dropped, xs.Rx_ring_full)
+		}
+		sb.WriteString("  ")
+		last[i].packets, last[i].bytes = pkts, bytes
+	}
+	fmt.Fprintln(os.Stderr, strings.TrimSpace(sb.String()))
+}
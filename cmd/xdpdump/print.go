@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/lixiangzhong/xdp/packet"
+)
+
+// summary tcpdump 风格的一行摘要
+func summary(ts time.Time, queue int, data []byte) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s q%d ", ts.Format("15:04:05.000000"), queue)
+	var p packet.Packet
+	err := p.Parse(data)
+	if p.NumVLANs > 0 {
+		for _, v := range p.VLANs[:p.NumVLANs] {
+			fmt.Fprintf(&sb, "vlan %d ", v)
+		}
+	}
+	if err != nil && p.L3Off < 0 {
+		fmt.Fprintf(&sb, "[%v] length %d", err, len(data))
+		return sb.String()
+	}
+	var src, dst net.IP
+	switch {
+	case p.IPv4() != nil:
+		ip := p.IPv4()
+		src, dst = ip.Src(), ip.Dst()
+		sb.WriteString("IP ")
+	case p.IPv6() != nil:
+		ip := p.IPv6()
+		src, dst = ip.Src(), ip.Dst()
+		sb.WriteString("IP6 ")
+	default:
+		eth := p.Ethernet()
+		fmt.Fprintf(&sb, "%s > %s ethertype 0x%04x, length %d", eth.Src(), eth.Dst(), p.EtherType, len(data))
+		return sb.String()
+	}
+	switch {
+	case p.TCP() != nil:
+		t := p.TCP()
+		fmt.Fprintf(&sb, "%s.%d > %s.%d: Flags [%s], seq %d, ack %d, win %d, length %d",
+			src, t.SrcPort(), dst, t.DstPort(), tcpFlags(t.Flags()), t.Seq(), t.Ack(), t.Window(), len(p.Payload()))
+	case p.UDP() != nil:
+		u := p.UDP()
+		fmt.Fprintf(&sb, "%s.%d > %s.%d: UDP, length %d", src, u.SrcPort(), dst, u.DstPort(), len(p.Payload()))
+	case p.ICMP() != nil:
+		c := p.ICMP()
+		name := "ICMP"
+		if p.L4Proto == packet.IPProtocolICMPv6 {
+			name = "ICMP6"
+		}
+		fmt.Fprintf(&sb, "%s > %s: %s type %d code %d, length %d", src, dst, name, c.Type(), c.Code(), len(p.L4()))
+	default:
+		fmt.Fprintf(&sb, "%s > %s: proto %d", src, dst, p.L4Proto)
+		if p.Fragment {
+			sb.WriteString(" (frag)")
+		}
+		fmt.Fprintf(&sb, ", length %d", len(data))
+	}
+	return sb.String()
+}
+
+func tcpFlags(f uint8) string {
+	const names = "FSRP.UEW"
+	var b []byte
+	for i := 0; i < len(names); i++ {
+		if f&(1<<i) != 0 {
+			b = append(b, names[i])
+		}
+	}
+	if len(b) == 0 {
+		return "none"
+	}
+	return string(b)
+}
+
+// FormatBps bytes 为每秒字节数
+func FormatBps(bytes uint64) string {
+	bps := bytes * 8
+	if bps < 1<<10 {
+		return fmt.Sprintf("%v bps", bps)
+	}
+	if bps < 1<<20 {
+		return fmt.Sprintf("%v kbps", bps>>10)
+	}
+	if bps < 1<<30 {
+		return fmt.Sprintf("%v mbps", bps>>20)
+	}
+	return fmt.Sprintf("%v gbps", bps>>30)
+}
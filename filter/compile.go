@@ -0,0 +1,918 @@
+package filter
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/bpf"
+)
+
+// Snaplen 匹配时 BPF 程序的返回值
+const Snaplen = 262144
+
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeARP  = 0x0806
+	etherTypeVLAN = 0x8100
+	etherTypeQinQ = 0x88a8
+	etherTypeIPv6 = 0x86dd
+
+	ipProtoICMP   = 1
+	ipProtoTCP    = 6
+	ipProtoUDP    = 17
+	ipProtoICMPv6 = 58
+	ipProtoSCTP   = 132
+)
+
+// Compile 把 pcap-filter(7) 表达式编译为以太网帧上的 cBPF 程序, 匹配时返回 Snaplen, 否则返回 0.
+//
+// 支持的原语: [ether|ip|ip6|arp|tcp|udp|sctp] [src|dst|src or dst|src and dst] host|net|port|portrange ID,
+// net ADDR mask MASK, ether|ip|ip6 proto N, ip ip6 arp tcp udp sctp icmp icmp6, vlan [ID],
+// broadcast multicast, less N, greater N, len RELOP N, PROTO[OFF:SIZE] [& MASK] RELOP VALUE,
+// 以及 and(&&) or(||) not(!) 与括号. 与 tcpdump 相同, vlan 之后的原语按内层头部偏移匹配
+func Compile(expr string) ([]bpf.Instruction, error) {
+	toks, err := lex(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(toks) == 0 {
+		return []bpf.Instruction{bpf.RetConstant{Val: Snaplen}}, nil
+	}
+	p := &parser{toks: toks}
+	n, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if !p.eof() {
+		return nil, p.errorf("unexpected %q", p.peek())
+	}
+	var g codegen
+	g.gen(n, labelAccept, labelReject)
+	return g.assemble()
+}
+
+// ---- 词法
+
+func lex(s string) ([]string, error) {
+	var toks []string
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case strings.ContainsRune("()[]", rune(c)):
+			toks = append(toks, s[i:i+1])
+			i++
+		case i+1 < len(s) && (s[i:i+2] == "&&" || s[i:i+2] == "||" || s[i:i+2] == "==" ||
+			s[i:i+2] == "!=" || s[i:i+2] == "<=" || s[i:i+2] == ">="):
+			toks = append(toks, s[i:i+2])
+			i += 2
+		case strings.ContainsRune("!&|=<>", rune(c)):
+			toks = append(toks, s[i:i+1])
+			i++
+		case isIDChar(c):
+			j := i
+			for j < len(s) && isIDChar(s[j]) {
+				j++
+			}
+			toks = append(toks, s[i:j])
+			i = j
+		default:
+			return nil, fmt.Errorf("filter: unexpected character %q", c)
+		}
+	}
+	return toks, nil
+}
+
+func isIDChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '.' || c == ':' || c == '-' || c == '/' || c == '_' || c == '\\'
+}
+
+// ---- 语法树
+
+type node interface{}
+
+type andNode struct{ a, b node }
+type orNode struct{ a, b node }
+type notNode struct{ a node }
+
+const (
+	loadAbs = iota
+	loadInd // X = IPv4 头长度
+	loadLen
+)
+
+// atom 一次加载与比较
+type atom struct {
+	load int
+	off  uint32
+	size int
+	xoff uint32 // loadInd 时 IPv4 头的偏移
+	mask uint32 // 非 0 时先与 mask 做 and
+	cond bpf.JumpTest
+	val  uint32
+}
+
+func and(ns ...node) node {
+	n := ns[0]
+	for _, m := range ns[1:] {
+		n = andNode{n, m}
+	}
+	return n
+}
+
+func or(ns ...node) node {
+	n := ns[0]
+	for _, m := range ns[1:] {
+		n = orNode{n, m}
+	}
+	return n
+}
+
+func eq(off uint32, size int, val uint32) node {
+	return atom{load: loadAbs, off: off, size: size, cond: bpf.JumpEqual, val: val}
+}
+
+// ---- 语法
+
+var protoQuals = map[string]bool{
+	"ether": true, "ip": true, "ip6": true, "arp": true, "tcp": true, "udp": true,
+	"sctp": true, "icmp": true, "icmp6": true,
+}
+
+var keywords = map[string]bool{
+	"and": true, "or": true, "not": true, "src": true, "dst": true, "host": true, "net": true,
+	"port": true, "portrange": true, "proto": true, "mask": true, "vlan": true, "less": true,
+	"greater": true, "len": true, "broadcast": true, "multicast": true,
+}
+
+type qual struct {
+	proto string
+	dir   string // "" "src" "dst" "src or dst" "src and dst"
+	typ   string // host net port portrange
+}
+
+type parser struct {
+	toks    []string
+	i       int
+	linkOff uint32 // vlan 增加的偏移
+	last    qual   // 上一个带 ID 的原语的限定词, 用于 "host a or b"
+}
+
+func (p *parser) eof() bool { return p.i >= len(p.toks) }
+
+func (p *parser) peek() string {
+	if p.eof() {
+		return ""
+	}
+	return p.toks[p.i]
+}
+
+func (p *parser) peekN(n int) string {
+	if p.i+n >= len(p.toks) {
+		return ""
+	}
+	return p.toks[p.i+n]
+}
+
+func (p *parser) next() string {
+	t := p.peek()
+	p.i++
+	return t
+}
+
+func (p *parser) expect(t string) error {
+	if p.peek() != t {
+		return p.errorf("expected %q", t)
+	}
+	p.i++
+	return nil
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("filter: "+format+" at token %d", append(args, p.i+1)...)
+}
+
+// nl 网络层头部偏移, et ethertype 偏移
+func (p *parser) nl() uint32 { return 14 + p.linkOff }
+func (p *parser) et() uint32 { return 12 + p.linkOff }
+
+// expr 与 pcap-filter(7) 相同, and 与 or 优先级相同, 从左到右结合
+func (p *parser) expr() (node, error) {
+	n, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch p.peek() {
+		case "and", "&&":
+			p.next()
+			m, err := p.unary()
+			if err != nil {
+				return nil, err
+			}
+			n = andNode{n, m}
+		case "or", "||":
+			p.next()
+			m, err := p.unary()
+			if err != nil {
+				return nil, err
+			}
+			n = orNode{n, m}
+		default:
+			return n, nil
+		}
+	}
+}
+
+func (p *parser) unary() (node, error) {
+	switch p.peek() {
+	case "not", "!":
+		p.next()
+		n, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{n}, nil
+	case "(":
+		p.next()
+		n, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return n, p.expect(")")
+	case "":
+		return nil, p.errorf("unexpected end of expression")
+	}
+	return p.primitive()
+}
+
+func (p *parser) primitive() (node, error) {
+	switch t := p.peek(); t {
+	case "vlan":
+		p.next()
+		return p.vlan()
+	case "less", "greater":
+		p.next()
+		v, err := p.number()
+		if err != nil {
+			return nil, err
+		}
+		if t == "less" {
+			return atom{load: loadLen, cond: bpf.JumpLessOrEqual, val: v}, nil
+		}
+		return atom{load: loadLen, cond: bpf.JumpGreaterOrEqual, val: v}, nil
+	case "len":
+		p.next()
+		return p.relation(atom{load: loadLen})
+	case "broadcast":
+		p.next()
+		return etherBroadcast(), nil
+	case "multicast":
+		p.next()
+		return etherMulticast(), nil
+	case "proto":
+		p.next()
+		return p.protoNumber("")
+	}
+
+	var q qual
+	if protoQuals[p.peek()] {
+		q.proto = p.next()
+		switch p.peek() {
+		case "[":
+			return p.byteAccess(q.proto)
+		case "proto":
+			p.next()
+			return p.protoNumber(q.proto)
+		case "broadcast":
+			if q.proto == "ether" {
+				p.next()
+				return etherBroadcast(), nil
+			}
+		case "multicast":
+			p.next()
+			return p.multicast(q.proto)
+		}
+	}
+	if t := p.peek(); t == "src" || t == "dst" {
+		q.dir = p.next()
+		if c := p.peek(); (c == "or" || c == "and") && (p.peekN(1) == "src" || p.peekN(1) == "dst") && p.peekN(1) != q.dir {
+			q.dir = "src " + c + " dst"
+			p.i += 2
+		}
+	}
+	switch t := p.peek(); t {
+	case "host", "net", "port", "portrange":
+		q.typ = p.next()
+	}
+	if q.typ == "" && q.dir == "" {
+		if q.proto != "" {
+			return p.protoPrimitive(q.proto)
+		}
+		// 沿用上一个原语的限定词: "host a or b", "port 53 or 80", 没有时为 host
+		if keywords[p.peek()] || !isID(p.peek()) {
+			return nil, p.errorf("unexpected %q", p.peek())
+		}
+		q = p.last
+	}
+	if q.typ == "" {
+		q.typ = "host"
+	}
+	if !isID(p.peek()) {
+		return nil, p.errorf("expected %s", q.typ)
+	}
+	id := p.next()
+	p.last = q
+	switch q.typ {
+	case "host":
+		return p.host(q, id)
+	case "net":
+		if p.peek() == "mask" {
+			p.next()
+			mask := net.ParseIP(p.next()).To4()
+			if mask == nil {
+				return nil, p.errorf("bad mask")
+			}
+			id = id + "/" + strconv.Itoa(maskBits(mask))
+		}
+		return p.net(q, id)
+	case "port":
+		port, err := parsePort(id, q.proto)
+		if err != nil {
+			return nil, err
+		}
+		return p.port(q, port, port)
+	default: // portrange
+		lo, hi, ok := strings.Cut(id, "-")
+		if !ok {
+			return nil, p.errorf("bad portrange %q", id)
+		}
+		a, err := parsePort(lo, q.proto)
+		if err != nil {
+			return nil, err
+		}
+		b, err := parsePort(hi, q.proto)
+		if err != nil {
+			return nil, err
+		}
+		if a > b {
+			a, b = b, a
+		}
+		return p.port(q, a, b)
+	}
+}
+
+func isID(t string) bool {
+	return t != "" && isIDChar(t[0])
+}
+
+func (p *parser) number() (uint32, error) {
+	t := p.next()
+	v, err := strconv.ParseUint(t, 0, 32)
+	if err != nil {
+		return 0, p.errorf("expected number, got %q", t)
+	}
+	return uint32(v), nil
+}
+
+// ---- 原语
+
+func (p *parser) etherType(t uint32) node {
+	return eq(p.et(), 2, t)
+}
+
+func (p *parser) ipProto(proto uint32) node {
+	return and(p.etherType(etherTypeIPv4), eq(p.nl()+9, 1, proto))
+}
+
+func (p *parser) ip6Next(proto uint32) node {
+	return and(p.etherType(etherTypeIPv6), eq(p.nl()+6, 1, proto))
+}
+
+// ipNotFragment IPv4 非分片或首片
+func (p *parser) ipNotFragment() node {
+	return atom{load: loadAbs, off: p.nl() + 6, size: 2, mask: 0x1fff, cond: bpf.JumpEqual, val: 0}
+}
+
+func (p *parser) vlan() (node, error) {
+	n := or(p.etherType(etherTypeVLAN), p.etherType(etherTypeQinQ), p.etherType(0x9100))
+	if isID(p.peek()) && !keywords[p.peek()] {
+		id, err := p.number()
+		if err != nil {
+			return nil, err
+		}
+		n = and(n, atom{load: loadAbs, off: p.nl(), size: 2, mask: 0x0fff, cond: bpf.JumpEqual, val: id})
+	}
+	p.linkOff += 4
+	return n, nil
+}
+
+func etherBroadcast() node {
+	return and(eq(0, 4, 0xffffffff), eq(4, 2, 0xffff))
+}
+
+func etherMulticast() node {
+	return atom{load: loadAbs, off: 0, size: 1, mask: 1, cond: bpf.JumpEqual, val: 1}
+}
+
+func (p *parser) multicast(proto string) (node, error) {
+	switch proto {
+	case "ether":
+		return etherMulticast(), nil
+	case "ip":
+		return and(p.etherType(etherTypeIPv4), atom{load: loadAbs, off: p.nl() + 16, size: 1, cond: bpf.JumpGreaterOrEqual, val: 224}), nil
+	case "ip6":
+		return and(p.etherType(etherTypeIPv6), eq(p.nl()+24, 1, 0xff)), nil
+	}
+	return nil, p.errorf("%s multicast not supported", proto)
+}
+
+// protoPrimitive 单独的 ip ip6 arp tcp udp sctp icmp icmp6
+func (p *parser) protoPrimitive(proto string) (node, error) {
+	switch proto {
+	case "ip":
+		return p.etherType(etherTypeIPv4), nil
+	case "ip6":
+		return p.etherType(etherTypeIPv6), nil
+	case "arp":
+		return p.etherType(etherTypeARP), nil
+	case "icmp":
+		return p.ipProto(ipProtoICMP), nil
+	case "icmp6":
+		return p.ip6Next(ipProtoICMPv6), nil
+	case "tcp", "udp", "sctp":
+		n := ipProtocols[proto]
+		return or(p.ipProto(n), p.ip6Next(n)), nil
+	}
+	return nil, p.errorf("%q needs a qualifier", proto)
+}
+
+var ipProtocols = map[string]uint32{
+	"icmp": ipProtoICMP, "igmp": 2, "tcp": ipProtoTCP, "udp": ipProtoUDP, "gre": 47,
+	"esp": 50, "ah": 51, "icmp6": ipProtoICMPv6, "pim": 103, "vrrp": 112, "sctp": ipProtoSCTP,
+}
+
+var etherTypes = map[string]uint32{
+	"ip": etherTypeIPv4, "ip6": etherTypeIPv6, "arp": etherTypeARP, "rarp": 0x8035, "vlan": etherTypeVLAN,
+}
+
+// protoNumber ether proto N, ip proto N, ip6 proto N, 或不带限定的 proto N (ip 或 ip6)
+func (p *parser) protoNumber(qual string) (node, error) {
+	t := strings.TrimPrefix(p.next(), "\\")
+	table := ipProtocols
+	if qual == "ether" {
+		table = etherTypes
+	}
+	v, ok := table[t]
+	if !ok {
+		n, err := strconv.ParseUint(t, 0, 16)
+		if err != nil {
+			return nil, p.errorf("unknown protocol %q", t)
+		}
+		v = uint32(n)
+	}
+	switch qual {
+	case "ether":
+		return p.etherType(v), nil
+	case "ip":
+		return p.ipProto(v), nil
+	case "ip6":
+		return p.ip6Next(v), nil
+	case "":
+		return or(p.ipProto(v), p.ip6Next(v)), nil
+	}
+	return nil, p.errorf("%s proto not supported", qual)
+}
+
+func dirNode(dir string, src, dst node) node {
+	switch dir {
+	case "src":
+		return src
+	case "dst":
+		return dst
+	case "src and dst":
+		return and(src, dst)
+	}
+	return or(src, dst)
+}
+
+func (p *parser) host(q qual, id string) (node, error) {
+	if q.proto == "ether" {
+		mac, err := net.ParseMAC(id)
+		if err != nil || len(mac) != 6 {
+			return nil, p.errorf("bad ether host %q", id)
+		}
+		return dirNode(q.dir, macNode(6, mac), macNode(0, mac)), nil
+	}
+	ips := []net.IP{net.ParseIP(id)}
+	if ips[0] == nil {
+		var err error
+		if ips, err = net.LookupIP(id); err != nil {
+			return nil, errors.WithMessage(err, "filter")
+		}
+	}
+	var ns []node
+	for _, ip := range ips {
+		bits := 32
+		if ip.To4() == nil {
+			bits = 128
+		}
+		n, err := p.addr(q, ip, bits)
+		if err != nil {
+			return nil, err
+		}
+		if n != nil {
+			ns = append(ns, n)
+		}
+	}
+	if len(ns) == 0 {
+		return nil, p.errorf("%s host %q: no address of that family", q.proto, id)
+	}
+	return or(ns...), nil
+}
+
+func (p *parser) net(q qual, id string) (node, error) {
+	if !strings.Contains(id, "/") {
+		if ip := net.ParseIP(id); ip != nil {
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			return p.addr(q, ip, bits)
+		}
+		// net 10.1 表示 10.1.0.0/16
+		parts := strings.Split(id, ".")
+		for len(parts) < 4 {
+			parts = append(parts, "0")
+		}
+		id = strings.Join(parts, ".") + "/" + strconv.Itoa(8*len(strings.Split(id, ".")))
+	}
+	ip, ipnet, err := net.ParseCIDR(id)
+	if err != nil {
+		return nil, p.errorf("bad net %q", id)
+	}
+	bits, _ := ipnet.Mask.Size()
+	if ip.To4() != nil {
+		ip = ip.To4()
+	}
+	n, err := p.addr(q, ip.Mask(ipnet.Mask), bits)
+	if err == nil && n == nil {
+		err = p.errorf("%s net %q: wrong address family", q.proto, id)
+	}
+	return n, err
+}
+
+// addr 匹配地址的前 bits 位, 地址族与 q.proto 不符时返回 nil
+func (p *parser) addr(q qual, ip net.IP, bits int) (node, error) {
+	if ip4 := ip.To4(); ip4 != nil {
+		var ns []node
+		if q.proto == "" || q.proto == "ip" {
+			ns = append(ns, and(p.etherType(etherTypeIPv4),
+				dirNode(q.dir, words(p.nl()+12, ip4, bits), words(p.nl()+16, ip4, bits))))
+		}
+		if q.proto == "" || q.proto == "arp" {
+			ns = append(ns, and(p.etherType(etherTypeARP),
+				dirNode(q.dir, words(p.nl()+14, ip4, bits), words(p.nl()+24, ip4, bits))))
+		}
+		if len(ns) == 0 {
+			return nil, nil
+		}
+		return or(ns...), nil
+	}
+	if q.proto != "" && q.proto != "ip6" {
+		return nil, nil
+	}
+	return and(p.etherType(etherTypeIPv6),
+		dirNode(q.dir, words(p.nl()+8, ip.To16(), bits), words(p.nl()+24, ip.To16(), bits))), nil
+}
+
+// words 按 32 位逐段比较地址前 bits 位
+func words(off uint32, addr []byte, bits int) node {
+	var ns []node
+	for i := 0; i < len(addr) && bits > 0; i += 4 {
+		v := uint32(addr[i])<<24 | uint32(addr[i+1])<<16 | uint32(addr[i+2])<<8 | uint32(addr[i+3])
+		a := atom{load: loadAbs, off: off + uint32(i), size: 4, cond: bpf.JumpEqual, val: v}
+		if bits < 32 {
+			a.mask = ^uint32(0) << (32 - bits)
+			a.val &= a.mask
+		}
+		ns = append(ns, a)
+		bits -= 32
+	}
+	if len(ns) == 0 {
+		return atom{load: loadLen, cond: bpf.JumpGreaterOrEqual, val: 0} // /0 总是匹配
+	}
+	return and(ns...)
+}
+
+func macNode(off uint32, mac net.HardwareAddr) node {
+	hi := uint32(mac[0])<<8 | uint32(mac[1])
+	lo := uint32(mac[2])<<24 | uint32(mac[3])<<16 | uint32(mac[4])<<8 | uint32(mac[5])
+	return and(eq(off+2, 4, lo), eq(off, 2, hi))
+}
+
+func maskBits(mask net.IP) int {
+	ones, _ := net.IPMask(mask).Size()
+	return ones
+}
+
+func parsePort(s, proto string) (uint32, error) {
+	if v, err := strconv.ParseUint(s, 10, 16); err == nil {
+		return uint32(v), nil
+	}
+	network := "tcp"
+	if proto == "udp" {
+		network = "udp"
+	}
+	v, err := net.LookupPort(network, s)
+	if err != nil {
+		return 0, fmt.Errorf("filter: unknown port %q", s)
+	}
+	return uint32(v), nil
+}
+
+func (p *parser) port(q qual, lo, hi uint32) (node, error) {
+	var protos []uint32
+	switch q.proto {
+	case "":
+		protos = []uint32{ipProtoTCP, ipProtoUDP, ipProtoSCTP}
+	case "tcp", "udp", "sctp":
+		protos = []uint32{ipProtocols[q.proto]}
+	case "ip", "ip6":
+		protos = []uint32{ipProtoTCP, ipProtoUDP, ipProtoSCTP}
+	default:
+		return nil, p.errorf("%s port not supported", q.proto)
+	}
+	cmp := func(a atom) node {
+		if lo == hi {
+			a.cond, a.val = bpf.JumpEqual, lo
+			return a
+		}
+		b := a
+		a.cond, a.val = bpf.JumpGreaterOrEqual, lo
+		b.cond, b.val = bpf.JumpLessOrEqual, hi
+		return and(a, b)
+	}
+	var ns []node
+	if q.proto != "ip6" {
+		var ps []node
+		for _, proto := range protos {
+			ps = append(ps, eq(p.nl()+9, 1, proto))
+		}
+		src := atom{load: loadInd, off: p.nl(), size: 2, xoff: p.nl()}
+		dst := src
+		dst.off += 2
+		ns = append(ns, and(p.etherType(etherTypeIPv4), or(ps...), p.ipNotFragment(),
+			dirNode(q.dir, cmp(src), cmp(dst))))
+	}
+	if q.proto != "ip" {
+		var ps []node
+		for _, proto := range protos {
+			ps = append(ps, eq(p.nl()+6, 1, proto))
+		}
+		src := atom{load: loadAbs, off: p.nl() + 40, size: 2}
+		dst := src
+		dst.off += 2
+		ns = append(ns, and(p.etherType(etherTypeIPv6), or(ps...), dirNode(q.dir, cmp(src), cmp(dst))))
+	}
+	return or(ns...), nil
+}
+
+// ---- 字节访问与关系表达式
+
+var constants = map[string]uint32{
+	"tcpflags": 13, "tcp-fin": 0x01, "tcp-syn": 0x02, "tcp-rst": 0x04, "tcp-push": 0x08,
+	"tcp-ack": 0x10, "tcp-urg": 0x20, "tcp-ece": 0x40, "tcp-cwr": 0x80,
+	"icmptype": 0, "icmpcode": 1, "icmp-echoreply": 0, "icmp-unreach": 3, "icmp-redirect": 5,
+	"icmp-echo": 8, "icmp-timxceed": 11,
+	"icmp6type": 0, "icmp6code": 1, "icmp6-echo": 128, "icmp6-echoreply": 129,
+	"icmp6-neighborsolicit": 135, "icmp6-neighboradvert": 136,
+}
+
+// byteAccess proto[off] 或 proto[off:size], 之后是可选的 & mask 与关系运算
+func (p *parser) byteAccess(proto string) (node, error) {
+	p.next() // [
+	t := p.next()
+	offStr, sizeStr, hasSize := strings.Cut(t, ":")
+	size := 1
+	if hasSize {
+		switch sizeStr {
+		case "1", "2", "4":
+			size = int(sizeStr[0] - '0')
+		default:
+			return nil, p.errorf("bad size %q", sizeStr)
+		}
+	}
+	off, ok := constants[offStr]
+	if !ok {
+		v, err := strconv.ParseUint(offStr, 0, 32)
+		if err != nil {
+			return nil, p.errorf("bad offset %q", offStr)
+		}
+		off = uint32(v)
+	}
+	if err := p.expect("]"); err != nil {
+		return nil, err
+	}
+	a := atom{load: loadAbs, size: size}
+	var guard node
+	switch proto {
+	case "ether":
+		a.off = off
+	case "ip":
+		guard, a.off = p.etherType(etherTypeIPv4), p.nl()+off
+	case "ip6":
+		guard, a.off = p.etherType(etherTypeIPv6), p.nl()+off
+	case "arp":
+		guard, a.off = p.etherType(etherTypeARP), p.nl()+off
+	case "tcp", "udp", "sctp", "icmp":
+		guard = and(p.ipProto(ipProtocols[proto]), p.ipNotFragment())
+		a.load, a.off, a.xoff = loadInd, p.nl()+off, p.nl()
+	case "icmp6":
+		guard, a.off = p.ip6Next(ipProtoICMPv6), p.nl()+40+off
+	}
+	n, err := p.relation(a)
+	if err != nil || guard == nil {
+		return n, err
+	}
+	return and(guard, n), nil
+}
+
+var relops = map[string]bpf.JumpTest{
+	"=": bpf.JumpEqual, "==": bpf.JumpEqual, "!=": bpf.JumpNotEqual,
+	"<": bpf.JumpLessThan, ">": bpf.JumpGreaterThan, "<=": bpf.JumpLessOrEqual, ">=": bpf.JumpGreaterOrEqual,
+}
+
+func (p *parser) relation(a atom) (node, error) {
+	if p.peek() == "&" {
+		p.next()
+		m, err := p.constFactor()
+		if err != nil {
+			return nil, err
+		}
+		if m == 0 {
+			return nil, p.errorf("zero mask")
+		}
+		a.mask = m
+	}
+	op, ok := relops[p.peek()]
+	if !ok {
+		return nil, p.errorf("expected relational operator, got %q", p.peek())
+	}
+	p.next()
+	v, err := p.constExpr()
+	if err != nil {
+		return nil, err
+	}
+	a.cond, a.val = op, v
+	return a, nil
+}
+
+func (p *parser) constExpr() (uint32, error) {
+	v, err := p.constTerm()
+	for err == nil && p.peek() == "|" {
+		p.next()
+		var w uint32
+		w, err = p.constTerm()
+		v |= w
+	}
+	return v, err
+}
+
+func (p *parser) constTerm() (uint32, error) {
+	v, err := p.constFactor()
+	for err == nil && p.peek() == "&" {
+		p.next()
+		var w uint32
+		w, err = p.constFactor()
+		v &= w
+	}
+	return v, err
+}
+
+func (p *parser) constFactor() (uint32, error) {
+	if p.peek() == "(" {
+		p.next()
+		v, err := p.constExpr()
+		if err != nil {
+			return 0, err
+		}
+		return v, p.expect(")")
+	}
+	if v, ok := constants[p.peek()]; ok {
+		p.next()
+		return v, nil
+	}
+	return p.number()
+}
+
+// ---- 代码生成
+
+const (
+	labelAccept = iota
+	labelReject
+)
+
+type item struct {
+	ins   bpf.Instruction // 普通指令
+	cond  *bpf.JumpIf     // 条件跳转, 目标为 jt/jf
+	jt    int
+	jf    int
+	label int // 非负时为标签
+}
+
+type codegen struct {
+	items  []item
+	labels int
+}
+
+func (g *codegen) newLabel() int {
+	if g.labels < 2 {
+		g.labels = 2
+	}
+	g.labels++
+	return g.labels - 1
+}
+
+func (g *codegen) emit(ins bpf.Instruction) {
+	g.items = append(g.items, item{ins: ins, label: -1})
+}
+
+func (g *codegen) place(l int) {
+	g.items = append(g.items, item{label: l})
+}
+
+// gen 生成 n 的代码, 为真时跳到 t, 否则跳到 f
+func (g *codegen) gen(n node, t, f int) {
+	switch n := n.(type) {
+	case andNode:
+		mid := g.newLabel()
+		g.gen(n.a, mid, f)
+		g.place(mid)
+		g.gen(n.b, t, f)
+	case orNode:
+		mid := g.newLabel()
+		g.gen(n.a, t, mid)
+		g.place(mid)
+		g.gen(n.b, t, f)
+	case notNode:
+		g.gen(n.a, f, t)
+	case atom:
+		switch n.load {
+		case loadAbs:
+			g.emit(bpf.LoadAbsolute{Off: n.off, Size: n.size})
+		case loadInd:
+			g.emit(bpf.LoadMemShift{Off: n.xoff})
+			g.emit(bpf.LoadIndirect{Off: n.off, Size: n.size})
+		case loadLen:
+			g.emit(bpf.LoadExtension{Num: bpf.ExtLen})
+		}
+		if n.mask != 0 {
+			g.emit(bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: n.mask})
+		}
+		g.items = append(g.items, item{cond: &bpf.JumpIf{Cond: n.cond, Val: n.val}, jt: t, jf: f, label: -1})
+	}
+}
+
+// assemble 解析标签, 末尾为 accept 与 reject
+func (g *codegen) assemble() ([]bpf.Instruction, error) {
+	g.place(labelAccept)
+	g.emit(bpf.RetConstant{Val: Snaplen})
+	g.place(labelReject)
+	g.emit(bpf.RetConstant{Val: 0})
+
+	pos := make(map[int]int)
+	n := 0
+	for _, it := range g.items {
+		if it.label >= 0 {
+			pos[it.label] = n
+			continue
+		}
+		n++
+	}
+	out := make([]bpf.Instruction, 0, n)
+	for _, it := range g.items {
+		if it.label >= 0 {
+			continue
+		}
+		pc := len(out)
+		switch {
+		case it.cond != nil:
+			jt, jf := pos[it.jt]-pc-1, pos[it.jf]-pc-1
+			if jt > 255 || jf > 255 {
+				return nil, errors.New("filter: expression too complex")
+			}
+			j := *it.cond
+			j.SkipTrue, j.SkipFalse = uint8(jt), uint8(jf)
+			out = append(out, j)
+		default:
+			out = append(out, it.ins)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,457 @@
+package filter
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/bpf"
+)
+
+func mac(s string) []byte {
+	m, err := net.ParseMAC(s)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+func ether(dst, src string, typ uint16, payload []byte) []byte {
+	b := append(mac(dst), mac(src)...)
+	b = append(b, byte(typ>>8), byte(typ))
+	return append(b, payload...)
+}
+
+// vlanTag 在 ethertype 之前插入一层 tag
+func vlanTag(frame []byte, tpid, tci uint16) []byte {
+	b := append([]byte{}, frame[:12]...)
+	b = append(b, byte(tpid>>8), byte(tpid), byte(tci>>8), byte(tci))
+	return append(b, frame[12:]...)
+}
+
+// ipv4 带 opts 个 32 位选项字的 IPv4 头, frag 为 flags 与 fragment offset 字段
+func ipv4(proto byte, src, dst string, opts int, frag uint16, l4 []byte) []byte {
+	hl := 20 + 4*opts
+	b := make([]byte, hl, hl+len(l4))
+	b[0] = 0x40 | byte(hl/4)
+	binary.BigEndian.PutUint16(b[2:], uint16(hl+len(l4)))
+	binary.BigEndian.PutUint16(b[6:], frag)
+	b[8] = 64
+	b[9] = proto
+	copy(b[12:], net.ParseIP(src).To4())
+	copy(b[16:], net.ParseIP(dst).To4())
+	return append(b, l4...)
+}
+
+func ipv6(next byte, src, dst string, l4 []byte) []byte {
+	b := make([]byte, 40, 40+len(l4))
+	b[0] = 0x60
+	binary.BigEndian.PutUint16(b[4:], uint16(len(l4)))
+	b[6] = next
+	b[7] = 64
+	copy(b[8:], net.ParseIP(src))
+	copy(b[24:], net.ParseIP(dst))
+	return append(b, l4...)
+}
+
+// l4Ports hl 字节的传输层头, 前 4 字节为端口
+func l4Ports(sport, dport uint16, hl int, payload []byte) []byte {
+	b := make([]byte, hl, hl+len(payload))
+	binary.BigEndian.PutUint16(b, sport)
+	binary.BigEndian.PutUint16(b[2:], dport)
+	return append(b, payload...)
+}
+
+const (
+	macA = "02:00:00:00:00:01"
+	macB = "02:00:00:00:00:02"
+)
+
+// testFrames 每个表达式都在全部帧上检查
+func testFrames() map[string][]byte {
+	udp4 := ether(macB, macA, etherTypeIPv4,
+		ipv4(ipProtoUDP, "10.0.0.1", "10.0.0.2", 0, 0, l4Ports(1000, 53, 8, []byte("abcd"))))
+	tcp := l4Ports(40000, 80, 20, nil)
+	tcp[12], tcp[13] = 0x50, 0x02 // SYN
+	arp := make([]byte, 28)
+	binary.BigEndian.PutUint16(arp[0:], 1)
+	binary.BigEndian.PutUint16(arp[2:], etherTypeIPv4)
+	arp[4], arp[5], arp[7] = 6, 4, 1
+	copy(arp[8:], mac(macA))
+	copy(arp[14:], net.ParseIP("10.0.0.1").To4())
+	copy(arp[24:], net.ParseIP("10.0.0.2").To4())
+	return map[string][]byte{
+		"udp4": udp4,
+		// IPv4 选项使传输层偏移依赖 IHL
+		"tcp4": ether(macB, macA, etherTypeIPv4, ipv4(ipProtoTCP, "10.0.0.1", "192.168.1.10", 1, 0, tcp)),
+		"udp6": ether("33:33:00:00:00:fb", "02:00:00:00:00:03", etherTypeIPv6,
+			ipv6(ipProtoUDP, "2001:db8::1", "ff02::fb", l4Ports(5353, 5353, 8, []byte("abcd")))),
+		"icmp4": ether("01:00:5e:00:00:01", macA, etherTypeIPv4,
+			ipv4(ipProtoICMP, "10.0.0.3", "224.0.0.1", 0, 0, []byte{8, 0, 0, 0, 0, 1, 0, 1})),
+		"icmp6": ether(macB, macA, etherTypeIPv6,
+			ipv6(ipProtoICMPv6, "2001:db8::1", "2001:db8::2", []byte{128, 0, 0, 0, 0, 1, 0, 1})),
+		"arp": ether("ff:ff:ff:ff:ff:ff", macA, etherTypeARP, arp),
+		// 非首片, 负载恰好像端口 1000 -> 53
+		"frag4": ether(macB, macA, etherTypeIPv4,
+			ipv4(ipProtoUDP, "10.0.0.1", "10.0.0.2", 0, 185, l4Ports(1000, 53, 8, []byte("abcd")))),
+		"vlan":  vlanTag(udp4, etherTypeVLAN, 3<<13|100),
+		"qinq":  vlanTag(vlanTag(udp4, etherTypeVLAN, 100), etherTypeQinQ, 200),
+		"sctp4": ether(macB, macA, etherTypeIPv4, ipv4(ipProtoSCTP, "10.0.0.1", "10.0.0.2", 0, 0, l4Ports(3868, 3868, 12, nil))),
+		"big": ether(macB, macA, etherTypeIPv4,
+			ipv4(ipProtoUDP, "10.0.0.1", "10.0.0.2", 0, 0, l4Ports(1000, 53, 8, make([]byte, 1000)))),
+	}
+}
+
+func frameNames(frames map[string][]byte) []string {
+	var names []string
+	for name := range frames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestCompileMatch(t *testing.T) {
+	const all = "udp4 tcp4 udp6 icmp4 icmp6 arp frag4 vlan qinq sctp4 big"
+	tests := []struct {
+		expr  string
+		match string // 匹配的帧, 其余帧都不匹配
+	}{
+		{"", all},
+
+		// 协议
+		{"ip", "udp4 tcp4 icmp4 frag4 sctp4 big"},
+		{"ip6", "udp6 icmp6"},
+		{"arp", "arp"},
+		{"tcp", "tcp4"},
+		{"udp", "udp4 udp6 frag4 big"},
+		{"sctp", "sctp4"},
+		{"icmp", "icmp4"},
+		{"icmp6", "icmp6"},
+		{"ip proto 17", "udp4 frag4 big"},
+		{`ip proto \udp`, "udp4 frag4 big"},
+		{"ip6 proto 58", "icmp6"},
+		{"proto 17", "udp4 udp6 frag4 big"},
+		{"ether proto 0x806", "arp"},
+		{`ether proto \arp`, "arp"},
+
+		// host
+		{"host 10.0.0.1", "udp4 tcp4 arp frag4 sctp4 big"},
+		{"dst host 10.0.0.2", "udp4 arp frag4 sctp4 big"},
+		{"src host 10.0.0.2", ""},
+		{"src or dst host 10.0.0.2", "udp4 arp frag4 sctp4 big"},
+		{"src and dst host 10.0.0.1", ""},
+		{"src 10.0.0.1 and dst 10.0.0.2", "udp4 arp frag4 sctp4 big"},
+		{"ip host 10.0.0.1", "udp4 tcp4 frag4 sctp4 big"},
+		{"arp host 10.0.0.2", "arp"},
+		{"host 2001:db8::2", "icmp6"},
+		{"ip6 src host 2001:db8::1", "udp6 icmp6"},
+		{"ether host " + macB, "udp4 tcp4 icmp6 frag4 vlan qinq sctp4 big"},
+		{"ether src 02:00:00:00:00:03", "udp6"},
+		{"ether dst " + macA, ""},
+
+		// net
+		{"net 10.0.0.0/24", "udp4 tcp4 icmp4 arp frag4 sctp4 big"},
+		{"dst net 192.168", "tcp4"},
+		{"net 192.168.1.0 mask 255.255.255.0", "tcp4"},
+		{"dst net 224.0.0.0/4", "icmp4"},
+		{"net 2001:db8::/32", "udp6 icmp6"},
+		{"net 0.0.0.0/0", "udp4 tcp4 icmp4 arp frag4 sctp4 big"},
+
+		// port 与 portrange, 非首片不匹配
+		{"port 53", "udp4 big"},
+		{"tcp port 80", "tcp4"},
+		{"udp port 80", ""},
+		{"src port 40000", "tcp4"},
+		{"port 5353", "udp6"},
+		{"ip6 port 5353", "udp6"},
+		{"ip port 5353", ""},
+		{"sctp port 3868", "sctp4"},
+		{"udp port domain", "udp4 big"},
+		{"portrange 50-60", "udp4 big"},
+		{"portrange 60-50", "udp4 big"},
+		{"portrange 3000-6000", "udp6 sctp4"},
+		{"dst portrange 79-81", "tcp4"},
+		{"src portrange 79-81", ""},
+
+		// 长度
+		{"less 46", "udp4 icmp4 arp frag4 sctp4"},
+		{"greater 1000", "big"},
+		{"len >= 60", "udp6 icmp6 big"},
+		{"len == 58", "tcp4"},
+		{"len != 58 and len < 50", "udp4 icmp4 arp frag4 sctp4"},
+
+		// broadcast 与 multicast
+		{"broadcast", "arp"},
+		{"ether broadcast", "arp"},
+		{"multicast", "udp6 icmp4 arp"},
+		{"ether multicast", "udp6 icmp4 arp"},
+		{"ip multicast", "icmp4"},
+		{"ip6 multicast", "udp6"},
+
+		// vlan 之后的原语按内层偏移匹配
+		{"vlan", "vlan qinq"},
+		{"vlan 100", "vlan"},
+		{"vlan 200", "qinq"},
+		{"vlan 100 and udp", "vlan"},
+		{"vlan and udp", "vlan"},
+		{"vlan and vlan and udp", "qinq"},
+		{"vlan 200 and vlan 100 and dst port 53", "qinq"},
+		{"vlan and host 10.0.0.1", "vlan"},
+		{"vlan and ip[9] = 17", "vlan"},
+		{"udp and vlan", ""},
+
+		// 优先级: not 最高, and 与 or 相同且从左到右结合
+		{"tcp or udp and port 53", "udp4 big"},
+		{"tcp or (udp and port 53)", "tcp4 udp4 big"},
+		{"udp and port 53 or tcp", "udp4 tcp4 big"},
+		{"not ip", "udp6 icmp6 arp vlan qinq"},
+		{"! ip and not arp", "udp6 icmp6 vlan qinq"},
+		{"not (ip or arp)", "udp6 icmp6 vlan qinq"},
+		{"not tcp or udp", "udp4 udp6 icmp4 icmp6 arp frag4 vlan qinq sctp4 big"},
+		{"not not tcp", "tcp4"},
+		{"udp && (dst port 53 || dst port 5353)", "udp4 udp6 big"},
+
+		// 沿用上一个原语的限定词
+		{"host 10.0.0.3 or 192.168.1.10", "tcp4 icmp4"},
+		{"port 53 or 80", "udp4 tcp4 big"},
+		{"tcp port 80 or 53", "tcp4"},
+
+		// 字节访问
+		{"ip[9] = 17", "udp4 frag4 big"},
+		{"ip[6:2] & 0x1fff != 0", "frag4"},
+		{"ip[16:4] > 0xc0000000", "tcp4 icmp4"},
+		{"ip[0] & 0xf > 5", "tcp4"},
+		{"ip6[6] = 17", "udp6"},
+		{"ether[0] & 1 != 0", "udp6 icmp4 arp"},
+		{"ether[12:2] = 0x8100", "vlan"},
+		{"arp[7] = 1", "arp"},
+		{"udp[2:2] = 53", "udp4 big"},
+		{"tcp[0:2] >= 40000", "tcp4"},
+		{"tcp[tcpflags] & tcp-syn != 0", "tcp4"},
+		{"tcp[tcpflags] & (tcp-syn|tcp-ack) == tcp-syn", "tcp4"},
+		{"tcp[13] & tcp-ack != 0", ""},
+		{"icmp[icmptype] = icmp-echo", "icmp4"},
+		{"icmp[icmptype] != icmp-echo", ""},
+		{"icmp6[icmp6type] == icmp6-echo", "icmp6"},
+		{"sctp[2:2] <= 3868", "sctp4"},
+	}
+	frames := testFrames()
+	names := frameNames(frames)
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			f, err := New(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := make(map[string]bool)
+			for _, name := range strings.Fields(tt.match) {
+				if frames[name] == nil {
+					t.Fatalf("unknown frame %q", name)
+				}
+				want[name] = true
+			}
+			for _, name := range names {
+				if got := f.Match(frames[name]); got != want[name] {
+					t.Errorf("%s: Match = %v, want %v", name, got, want[name])
+				}
+			}
+		})
+	}
+}
+
+// tcpdump -d 的输出 (DLT_EN10MB, libpcap 1.10)
+var tcpdumpPrograms = map[string]string{
+	"ip": `
+(000) ldh      [12]
+(001) jeq      #0x800           jt 2	jf 3
+(002) ret      #262144
+(003) ret      #0`,
+	"udp and dst port 53": `
+(000) ldh      [12]
+(001) jeq      #0x86dd          jt 2	jf 6
+(002) ldb      [20]
+(003) jeq      #0x11            jt 4	jf 15
+(004) ldh      [56]
+(005) jeq      #0x35            jt 14	jf 15
+(006) jeq      #0x800           jt 7	jf 15
+(007) ldb      [23]
+(008) jeq      #0x11            jt 9	jf 15
+(009) ldh      [20]
+(010) jset     #0x1fff          jt 15	jf 11
+(011) ldxb     4*([14]&0xf)
+(012) ldh      [x + 16]
+(013) jeq      #0x35            jt 14	jf 15
+(014) ret      #262144
+(015) ret      #0`,
+	"tcp port 80": `
+(000) ldh      [12]
+(001) jeq      #0x86dd          jt 2	jf 8
+(002) ldb      [20]
+(003) jeq      #0x6             jt 4	jf 19
+(004) ldh      [54]
+(005) jeq      #0x50            jt 18	jf 6
+(006) ldh      [56]
+(007) jeq      #0x50            jt 18	jf 19
+(008) jeq      #0x800           jt 9	jf 19
+(009) ldb      [23]
+(010) jeq      #0x6             jt 11	jf 19
+(011) ldh      [20]
+(012) jset     #0x1fff          jt 19	jf 13
+(013) ldxb     4*([14]&0xf)
+(014) ldh      [x + 14]
+(015) jeq      #0x50            jt 18	jf 16
+(016) ldh      [x + 16]
+(017) jeq      #0x50            jt 18	jf 19
+(018) ret      #262144
+(019) ret      #0`,
+	"host 10.0.0.1": `
+(000) ldh      [12]
+(001) jeq      #0x800           jt 2	jf 6
+(002) ld       [26]
+(003) jeq      #0xa000001       jt 12	jf 4
+(004) ld       [30]
+(005) jeq      #0xa000001       jt 12	jf 13
+(006) jeq      #0x806           jt 8	jf 7
+(007) jeq      #0x8035          jt 8	jf 13
+(008) ld       [28]
+(009) jeq      #0xa000001       jt 12	jf 10
+(010) ld       [38]
+(011) jeq      #0xa000001       jt 12	jf 13
+(012) ret      #262144
+(013) ret      #0`,
+	"tcp[tcpflags] & tcp-syn != 0": `
+(000) ldh      [12]
+(001) jeq      #0x800           jt 2	jf 10
+(002) ldb      [23]
+(003) jeq      #0x6             jt 4	jf 10
+(004) ldh      [20]
+(005) jset     #0x1fff          jt 10	jf 6
+(006) ldxb     4*([14]&0xf)
+(007) ldb      [x + 27]
+(008) jset     #0x2             jt 9	jf 10
+(009) ret      #262144
+(010) ret      #0`,
+	"less 46": `
+(000) ld       #pktlen
+(001) jgt      #0x2e            jt 2	jf 3
+(002) ret      #0
+(003) ret      #262144`,
+}
+
+// parseTcpdump 解析 tcpdump -d 的输出, 只支持上面用到的指令
+func parseTcpdump(t *testing.T, s string) []bpf.Instruction {
+	t.Helper()
+	num := func(s string) uint32 {
+		v, err := strconv.ParseUint(s, 0, 32)
+		if err != nil {
+			t.Fatalf("bad number %q", s)
+		}
+		return uint32(v)
+	}
+	sizes := map[string]int{"ld": 4, "ldh": 2, "ldb": 1}
+	conds := map[string]bpf.JumpTest{"jeq": bpf.JumpEqual, "jgt": bpf.JumpGreaterThan, "jge": bpf.JumpGreaterOrEqual, "jset": bpf.JumpBitsSet}
+	var insts []bpf.Instruction
+	for _, line := range strings.Split(strings.TrimSpace(s), "\n") {
+		f := strings.Fields(line)
+		pc := uint32(len(insts))
+		op, args := f[1], f[2:]
+		cond, jump := conds[op]
+		switch {
+		case op == "ld" && args[0] == "#pktlen":
+			insts = append(insts, bpf.LoadExtension{Num: bpf.ExtLen})
+		case sizes[op] != 0 && args[0] == "[x":
+			insts = append(insts, bpf.LoadIndirect{Off: num(strings.TrimSuffix(args[2], "]")), Size: sizes[op]})
+		case sizes[op] != 0:
+			insts = append(insts, bpf.LoadAbsolute{Off: num(strings.Trim(args[0], "[]")), Size: sizes[op]})
+		case op == "ldxb":
+			insts = append(insts, bpf.LoadMemShift{Off: num(strings.TrimSuffix(strings.TrimPrefix(args[0], "4*(["), "]&0xf)"))})
+		case jump:
+			insts = append(insts, bpf.JumpIf{Cond: cond, Val: num(strings.TrimPrefix(args[0], "#")),
+				SkipTrue: uint8(num(args[2]) - pc - 1), SkipFalse: uint8(num(args[4]) - pc - 1)})
+		case op == "ret":
+			insts = append(insts, bpf.RetConstant{Val: num(strings.TrimPrefix(args[0], "#"))})
+		default:
+			t.Fatalf("unsupported instruction %q", line)
+		}
+	}
+	return insts
+}
+
+// 与 tcpdump 生成的程序在全部帧上结果相同. 没有 RARP 帧, 因此 host 只比较 IPv4 与 ARP
+func TestCompileTcpdump(t *testing.T) {
+	frames := testFrames()
+	names := frameNames(frames)
+	for expr, listing := range tcpdumpPrograms {
+		t.Run(expr, func(t *testing.T) {
+			ref, err := FromInstructions(parseTcpdump(t, listing))
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := New(expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var matched int
+			for _, name := range names {
+				want := ref.Match(frames[name])
+				if got := f.Match(frames[name]); got != want {
+					t.Errorf("%s: Match = %v, tcpdump %v", name, got, want)
+				}
+				if want {
+					matched++
+				}
+			}
+			if matched == 0 {
+				t.Errorf("no frame matches")
+			}
+		})
+	}
+	// 简单表达式的指令与 tcpdump 完全相同
+	insts, err := Compile("ip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := parseTcpdump(t, tcpdumpPrograms["ip"]); !reflect.DeepEqual(insts, want) {
+		t.Errorf("Compile(ip) = %v, want %v", insts, want)
+	}
+}
+
+func TestCompileError(t *testing.T) {
+	tests := []string{
+		"tcp and",
+		"(udp",
+		"udp)",
+		"and",
+		"ether",
+		"ip $",
+		"port",
+		"port 70000",
+		"portrange 10",
+		"icmp port 1",
+		"tcp proto 6",
+		"arp multicast",
+		"less",
+		"vlan 100x",
+		"ether host 10.0.0.1",
+		"ip6 host 10.0.0.1",
+		"ip net 2001:db8::/32",
+		"net 10.0.0.0 mask 255.0.0.x",
+		"ip[1:3] = 0",
+		"ip[x] = 0",
+		"ip[9] 17",
+		"ip[9] & 0 = 0",
+		"len",
+		// 跳转距离超过 255
+		strings.Repeat("host 10.0.0.1 or ", 40) + "host 10.0.0.1",
+	}
+	for _, expr := range tests {
+		if insts, err := Compile(expr); err == nil {
+			t.Errorf("Compile(%q) = %d instructions, want error", expr, len(insts))
+		}
+	}
+}
@@ -0,0 +1,58 @@
+// Package filter 在用户态对收到的帧执行 cBPF 过滤, 表达式语法与 tcpdump 相同.
+//
+//	f, err := filter.New("udp and dst port 53")
+//	sock, err := xdp.NewSocket(ifindex, umem, &xdp.SocketConfig{..., Filter: f.Match})
+//
+// 不匹配的帧在交给 handler 之前归还 fill ring
+package filter
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// Filter 可被多个 goroutine 同时使用
+type Filter struct {
+	insts []bpf.Instruction
+	vm    *bpf.VM
+}
+
+// New 编译 pcap 过滤表达式, 见 Compile
+func New(expr string) (*Filter, error) {
+	insts, err := Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	return FromInstructions(insts)
+}
+
+// FromInstructions 使用已有的 cBPF 程序, 如 tcpdump -d 的输出. 返回值非 0 为匹配
+func FromInstructions(insts []bpf.Instruction) (*Filter, error) {
+	vm, err := bpf.NewVM(insts)
+	if err != nil {
+		return nil, errors.WithMessage(err, "filter")
+	}
+	return &Filter{insts: insts, vm: vm}, nil
+}
+
+// Instructions 返回 cBPF 程序
+func (f *Filter) Instructions() []bpf.Instruction {
+	return f.insts
+}
+
+// Match 报告帧是否匹配
+func (f *Filter) Match(data []byte) bool {
+	n, err := f.vm.Run(data)
+	return err == nil && n > 0
+}
+
+// Handler 包装 Socket.HandleRecv 的 handler, 不匹配的帧直接归还
+func (f *Filter) Handler(next func(unix.XDPDesc, []byte) bool) func(unix.XDPDesc, []byte) bool {
+	return func(d unix.XDPDesc, data []byte) bool {
+		if !f.Match(data) {
+			return true
+		}
+		return next(d, data)
+	}
+}
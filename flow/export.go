@@ -0,0 +1,412 @@
+package flow
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// 导出格式
+const (
+	NetFlowV9 = 9
+	IPFIX     = 10 // RFC 7011
+)
+
+type ExporterConfig struct {
+	Collector string   // 收集器地址 host:port, 经 UDP 发送
+	Conn      net.Conn // 非 nil 时代替 Collector, Close 时一并关闭
+	Version   int      // NetFlowV9 或 IPFIX, 默认 IPFIX
+
+	// ObservationDomain IPFIX 的 Observation Domain ID / NetFlow v9 的 Source ID, 默认为 Ifindex.
+	// 每个接口一个 Exporter, 序列号按 ObservationDomain 各自计数
+	ObservationDomain uint32
+	Ifindex           uint32 // 记录中的 ingressInterface
+
+	MaxSize         int           // 一个 UDP 报文的最大字节数, 默认 1400
+	FlushInterval   time.Duration // 未满的报文最多等待多久发送, 默认 1s, 负数只在报文满或 Flush 时发送
+	TemplateRefresh time.Duration // 重发模板的间隔, 默认 1m
+	TemplatePackets int           // 每发送多少个报文重发模板, 0 不按报文数重发
+}
+
+const (
+	defaultExportMaxSize   = 1400
+	defaultFlushInterval   = time.Second
+	defaultTemplateRefresh = time.Minute
+
+	templateIPv4 = 256
+	templateIPv6 = 257
+)
+
+// 信息元素 ID, NetFlow v9 与 IPFIX 相同
+const (
+	ieOctetDeltaCount          = 1
+	iePacketDeltaCount         = 2
+	ieProtocolIdentifier       = 4
+	ieTCPControlBits           = 6
+	ieSourceTransportPort      = 7
+	ieSourceIPv4Address        = 8
+	ieIngressInterface         = 10
+	ieDestinationTransportPort = 11
+	ieDestinationIPv4Address   = 12
+	ieSourceIPv6Address        = 27
+	ieDestinationIPv6Address   = 28
+	ieVlanID                   = 58
+)
+
+// 只用于 IPFIX
+const (
+	ieFlowEndReason         = 136
+	ieFlowStartMilliseconds = 152
+	ieFlowEndMilliseconds   = 153
+)
+
+// 只用于 NetFlow v9 (RFC 3954): 相对 sysUptime 的毫秒
+const (
+	ieLastSwitched  = 21
+	ieFirstSwitched = 22
+)
+
+type templateField struct{ id, len uint16 }
+
+type templateSpec struct {
+	id     uint16
+	fields []templateField
+}
+
+func template(version int, addrLen uint16, src, dst uint16) []templateField {
+	fields := []templateField{
+		{src, addrLen},
+		{dst, addrLen},
+		{ieSourceTransportPort, 2},
+		{ieDestinationTransportPort, 2},
+		{ieProtocolIdentifier, 1},
+		{ieTCPControlBits, 1}, // IPFIX 中为 unsigned16, 按 reduced-size 编码
+		{ieVlanID, 2},
+		{ieIngressInterface, 4},
+		{iePacketDeltaCount, 8},
+		{ieOctetDeltaCount, 8},
+	}
+	if version == NetFlowV9 {
+		// v9 没有绝对时间与 flowEndReason
+		return append(fields, templateField{ieFirstSwitched, 4}, templateField{ieLastSwitched, 4})
+	}
+	return append(fields,
+		templateField{ieFlowStartMilliseconds, 8},
+		templateField{ieFlowEndMilliseconds, 8},
+		templateField{ieFlowEndReason, 1})
+}
+
+func templates(version int) []templateSpec {
+	return []templateSpec{
+		{templateIPv4, template(version, 4, ieSourceIPv4Address, ieDestinationIPv4Address)},
+		{templateIPv6, template(version, 16, ieSourceIPv6Address, ieDestinationIPv6Address)},
+	}
+}
+
+// recordLen 模板 id 的一条数据记录的长度
+func (e *Exporter) recordLen(id uint16) int {
+	n := 0
+	for _, f := range e.templates[id-templateIPv4].fields {
+		n += int(f.len)
+	}
+	return n
+}
+
+func (e *Exporter) templateSetLen() int {
+	n := 4
+	for _, t := range e.templates {
+		n += 4 + 4*len(t.fields)
+	}
+	return n
+}
+
+type ExporterStats struct {
+	Packets uint64 // 发送的 UDP 报文数
+	Records uint64 // 发送的流记录数
+	Errors  uint64 // 发送失败的报文数, 其中的记录丢失
+}
+
+// Exporter 把 Table 导出的流按 NetFlow v9 或 IPFIX 经 UDP 发给收集器.
+// Export 可直接作为 Config.Expired, 可并发调用
+type Exporter struct {
+	cfg       ExporterConfig
+	conn      net.Conn
+	templates []templateSpec // 按模板 ID 顺序
+
+	mu        sync.Mutex
+	buf       []byte
+	setOff    int    // 当前数据 set 的起始位置, 没有时为 0
+	setID     uint16 // 当前数据 set 的模板 ID
+	count     int    // 报文中的记录数, v9 含模板记录
+	records   int    // 报文中的流记录数
+	seq       uint32 // v9 为已发送的报文数, IPFIX 为已发送的流记录数
+	lastTmpl  time.Time
+	sinceTmpl int // 上次发送模板后的报文数
+	tmplSent  bool
+	start     time.Time // v9 sysUptime 的起点
+
+	packets, sent, errs uint64
+
+	done    chan struct{}
+	running sync.WaitGroup
+	once    sync.Once
+}
+
+func NewExporter(cfg *ExporterConfig) (*Exporter, error) {
+	e := &Exporter{done: make(chan struct{})}
+	if cfg != nil {
+		e.cfg = *cfg
+	}
+	c := &e.cfg
+	if c.Version == 0 {
+		c.Version = IPFIX
+	}
+	if c.Version != NetFlowV9 && c.Version != IPFIX {
+		return nil, errors.Errorf("flow: unsupported export version %d", c.Version)
+	}
+	if c.ObservationDomain == 0 {
+		c.ObservationDomain = c.Ifindex
+	}
+	if c.MaxSize <= 0 {
+		c.MaxSize = defaultExportMaxSize
+	}
+	e.templates = templates(c.Version)
+	// 报文头, 模板与一条 IPv6 记录 (含 set 头与填充)
+	if min := e.headerLen() + e.templateSetLen() + 4 + e.recordLen(templateIPv6) + 3; c.MaxSize < min {
+		return nil, errors.Errorf("flow: MaxSize %d too small, need at least %d", c.MaxSize, min)
+	}
+	if c.FlushInterval == 0 {
+		c.FlushInterval = defaultFlushInterval
+	}
+	if c.TemplateRefresh <= 0 {
+		c.TemplateRefresh = defaultTemplateRefresh
+	}
+	e.conn = c.Conn
+	if e.conn == nil {
+		conn, err := net.Dial("udp", c.Collector)
+		if err != nil {
+			return nil, errors.WithMessage(err, "flow: dial collector")
+		}
+		e.conn = conn
+	}
+	e.buf = make([]byte, 0, c.MaxSize)
+	e.start = time.Now()
+	if c.FlushInterval > 0 {
+		e.running.Add(1)
+		go e.flushLoop()
+	}
+	return e, nil
+}
+
+func (e *Exporter) flushLoop() {
+	defer e.running.Done()
+	tick := time.NewTicker(e.cfg.FlushInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			e.Flush()
+		case <-e.done:
+			return
+		}
+	}
+}
+
+func (e *Exporter) headerLen() int {
+	if e.cfg.Version == NetFlowV9 {
+		return 20
+	}
+	return 16
+}
+
+// Export 把 r 加入待发送的报文, 报文满时发送
+func (e *Exporter) Export(r Record) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	id, addrLen := uint16(templateIPv4), 4
+	if r.IPVersion == 6 {
+		id, addrLen = templateIPv6, 16
+	}
+	n := e.recordLen(id)
+	if e.setID != id {
+		n += 4 // 新的 set 头
+	}
+	if len(e.buf) > 0 && len(e.buf)+n+3 > e.cfg.MaxSize {
+		e.send()
+	}
+	if len(e.buf) == 0 {
+		e.begin()
+	}
+	if e.setID != id {
+		e.endSet()
+		e.setOff = len(e.buf)
+		e.setID = id
+		e.buf = append(e.buf, 0, 0, 0, 0)
+		binary.BigEndian.PutUint16(e.buf[e.setOff:], id)
+	}
+	e.appendRecord(&r, addrLen)
+	e.count++
+	e.records++
+}
+
+func (e *Exporter) appendRecord(r *Record, addrLen int) {
+	b := e.buf
+	b = append(b, r.Src[16-addrLen:]...)
+	b = append(b, r.Dst[16-addrLen:]...)
+	b = binary.BigEndian.AppendUint16(b, r.SrcPort)
+	b = binary.BigEndian.AppendUint16(b, r.DstPort)
+	b = append(b, r.Proto, r.TCPFlags)
+	b = binary.BigEndian.AppendUint16(b, r.VLAN)
+	b = binary.BigEndian.AppendUint32(b, e.cfg.Ifindex)
+	b = binary.BigEndian.AppendUint64(b, r.Packets)
+	b = binary.BigEndian.AppendUint64(b, r.Bytes)
+	if e.cfg.Version == NetFlowV9 {
+		b = binary.BigEndian.AppendUint32(b, e.uptime(r.First))
+		b = binary.BigEndian.AppendUint32(b, e.uptime(r.Last))
+	} else {
+		b = binary.BigEndian.AppendUint64(b, uint64(r.First.UnixMilli()))
+		b = binary.BigEndian.AppendUint64(b, uint64(r.Last.UnixMilli()))
+		b = append(b, endReason(r.Reason))
+	}
+	e.buf = b
+}
+
+// uptime v9 的 sysUptime 毫秒, 早于 Exporter 创建的时间记为 0
+func (e *Exporter) uptime(t time.Time) uint32 {
+	d := t.Sub(e.start)
+	if d < 0 {
+		return 0
+	}
+	return uint32(d.Milliseconds())
+}
+
+// endReason IPFIX flowEndReason
+func endReason(r Reason) uint8 {
+	switch r {
+	case ReasonIdle:
+		return 1
+	case ReasonActive:
+		return 2
+	case ReasonFlush:
+		return 4 // forced end
+	}
+	return 0
+}
+
+// begin 写入报文头占位, 需要时写入模板
+func (e *Exporter) begin() {
+	e.buf = e.buf[:e.headerLen()]
+	now := time.Now()
+	if !e.tmplSent || now.Sub(e.lastTmpl) >= e.cfg.TemplateRefresh ||
+		(e.cfg.TemplatePackets > 0 && e.sinceTmpl >= e.cfg.TemplatePackets) {
+		e.appendTemplates()
+		e.tmplSent = true
+		e.lastTmpl = now
+		e.sinceTmpl = 0
+	}
+}
+
+func (e *Exporter) appendTemplates() {
+	off := len(e.buf)
+	setID := uint16(2)
+	if e.cfg.Version == NetFlowV9 {
+		setID = 0
+	}
+	b := binary.BigEndian.AppendUint16(e.buf, setID)
+	b = append(b, 0, 0)
+	for _, t := range e.templates {
+		b = binary.BigEndian.AppendUint16(b, t.id)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(t.fields)))
+		for _, f := range t.fields {
+			b = binary.BigEndian.AppendUint16(b, f.id)
+			b = binary.BigEndian.AppendUint16(b, f.len)
+		}
+		e.count++
+	}
+	binary.BigEndian.PutUint16(b[off+2:], uint16(len(b)-off))
+	e.buf = b
+}
+
+// endSet 填写当前数据 set 的长度, 补齐到 4 字节
+func (e *Exporter) endSet() {
+	if e.setOff == 0 {
+		return
+	}
+	for len(e.buf)%4 != 0 {
+		e.buf = append(e.buf, 0)
+	}
+	binary.BigEndian.PutUint16(e.buf[e.setOff+2:], uint16(len(e.buf)-e.setOff))
+	e.setOff = 0
+	e.setID = 0
+}
+
+// send 填写报文头并发送, 调用者持有 mu
+func (e *Exporter) send() error {
+	if len(e.buf) == 0 {
+		return nil
+	}
+	e.endSet()
+	b := e.buf
+	now := time.Now()
+	if e.cfg.Version == NetFlowV9 {
+		binary.BigEndian.PutUint16(b[0:], NetFlowV9)
+		binary.BigEndian.PutUint16(b[2:], uint16(e.count))
+		binary.BigEndian.PutUint32(b[4:], e.uptime(now))
+		binary.BigEndian.PutUint32(b[8:], uint32(now.Unix()))
+		binary.BigEndian.PutUint32(b[12:], e.seq)
+		binary.BigEndian.PutUint32(b[16:], e.cfg.ObservationDomain)
+		e.seq++
+	} else {
+		binary.BigEndian.PutUint16(b[0:], IPFIX)
+		binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+		binary.BigEndian.PutUint32(b[4:], uint32(now.Unix()))
+		binary.BigEndian.PutUint32(b[8:], e.seq)
+		binary.BigEndian.PutUint32(b[12:], e.cfg.ObservationDomain)
+		e.seq += uint32(e.records)
+	}
+	records := e.records
+	e.buf = e.buf[:0]
+	e.count = 0
+	e.records = 0
+	e.sinceTmpl++
+	if _, err := e.conn.Write(b); err != nil {
+		atomic.AddUint64(&e.errs, 1)
+		return errors.WithMessage(err, "flow: export")
+	}
+	atomic.AddUint64(&e.packets, 1)
+	atomic.AddUint64(&e.sent, uint64(records))
+	return nil
+}
+
+// Flush 立即发送未满的报文
+func (e *Exporter) Flush() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.send()
+}
+
+func (e *Exporter) Stats() ExporterStats {
+	return ExporterStats{
+		Packets: atomic.LoadUint64(&e.packets),
+		Records: atomic.LoadUint64(&e.sent),
+		Errors:  atomic.LoadUint64(&e.errs),
+	}
+}
+
+// Close 发送剩余的记录并关闭连接. 应在 Table.Close 之后调用, 以免丢失 Flush 导出的流
+func (e *Exporter) Close() error {
+	var err error
+	e.once.Do(func() {
+		close(e.done)
+		e.running.Wait()
+		err = e.Flush()
+		if cerr := e.conn.Close(); err == nil {
+			err = cerr
+		}
+	})
+	return err
+}
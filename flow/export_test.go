@@ -0,0 +1,249 @@
+package flow
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// exportPacket 收集器解码出的一个报文
+type exportPacket struct {
+	version  uint16
+	count    uint16 // v9 的记录数, 含模板记录
+	uptime   uint32 // v9 sysUptime
+	unixSecs uint32
+	seq      uint32
+	domain   uint32
+	tmplIDs  []uint16            // 本报文中的模板
+	records  []map[uint16][]byte // 数据记录, 按信息元素 ID 取值
+}
+
+// decodeExport 按 RFC 3954 / RFC 7011 解码, 模板保存在 tmpls 中供之后的报文使用
+func decodeExport(t *testing.T, b []byte, tmpls map[uint16][]templateField) exportPacket {
+	t.Helper()
+	var p exportPacket
+	if len(b) < 16 {
+		t.Fatalf("short packet: %d bytes", len(b))
+	}
+	p.version = binary.BigEndian.Uint16(b)
+	off, tmplSet := 0, uint16(0)
+	switch p.version {
+	case NetFlowV9:
+		p.count = binary.BigEndian.Uint16(b[2:])
+		p.uptime = binary.BigEndian.Uint32(b[4:])
+		p.unixSecs = binary.BigEndian.Uint32(b[8:])
+		p.seq = binary.BigEndian.Uint32(b[12:])
+		p.domain = binary.BigEndian.Uint32(b[16:])
+		off = 20
+	case IPFIX:
+		if n := binary.BigEndian.Uint16(b[2:]); int(n) != len(b) {
+			t.Fatalf("IPFIX length %d, packet %d bytes", n, len(b))
+		}
+		p.unixSecs = binary.BigEndian.Uint32(b[4:])
+		p.seq = binary.BigEndian.Uint32(b[8:])
+		p.domain = binary.BigEndian.Uint32(b[12:])
+		off, tmplSet = 16, 2
+	default:
+		t.Fatalf("version %d", p.version)
+	}
+	for off < len(b) {
+		if off+4 > len(b) {
+			t.Fatalf("truncated set header at %d", off)
+		}
+		id, n := binary.BigEndian.Uint16(b[off:]), int(binary.BigEndian.Uint16(b[off+2:]))
+		if n < 4 || off+n > len(b) || (p.version == IPFIX && n%4 != 0 && id >= 256) {
+			t.Fatalf("set %d at %d: bad length %d", id, off, n)
+		}
+		set := b[off+4 : off+n]
+		off += n
+		if id == tmplSet {
+			for len(set) >= 4 {
+				tid, fc := binary.BigEndian.Uint16(set), int(binary.BigEndian.Uint16(set[2:]))
+				set = set[4:]
+				if len(set) < 4*fc {
+					t.Fatalf("template %d truncated", tid)
+				}
+				var fields []templateField
+				for i := 0; i < fc; i++ {
+					fields = append(fields, templateField{binary.BigEndian.Uint16(set[4*i:]), binary.BigEndian.Uint16(set[4*i+2:])})
+				}
+				set = set[4*fc:]
+				tmpls[tid] = fields
+				p.tmplIDs = append(p.tmplIDs, tid)
+			}
+			continue
+		}
+		fields, ok := tmpls[id]
+		if !ok {
+			t.Fatalf("data set %d before its template", id)
+		}
+		rl := 0
+		for _, f := range fields {
+			rl += int(f.len)
+		}
+		for len(set) >= rl {
+			r := make(map[uint16][]byte)
+			for _, f := range fields {
+				r[f.id], set = set[:f.len], set[f.len:]
+			}
+			p.records = append(p.records, r)
+		}
+		for _, c := range set {
+			if c != 0 {
+				t.Fatalf("set %d: non-zero padding", id)
+			}
+		}
+	}
+	return p
+}
+
+func field(t *testing.T, r map[uint16][]byte, id uint16) uint64 {
+	t.Helper()
+	b, ok := r[id]
+	if !ok {
+		t.Fatalf("record has no field %d", id)
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+func TestExporter(t *testing.T) {
+	for _, version := range []int{IPFIX, NetFlowV9} {
+		t.Run(map[int]string{IPFIX: "ipfix", NetFlowV9: "v9"}[version], func(t *testing.T) {
+			pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pc.Close()
+			e, err := NewExporter(&ExporterConfig{Collector: pc.LocalAddr().String(), Version: version, Ifindex: 7, FlushInterval: -1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer e.Close()
+
+			time.Sleep(20 * time.Millisecond)
+			first := time.Now()
+			r4 := Record{Packets: 3, Bytes: 300, First: first, Last: first.Add(1500 * time.Millisecond), Reason: ReasonIdle}
+			r4.IPVersion, r4.Proto, r4.SrcPort, r4.DstPort, r4.VLAN = 4, 17, 1234, 53, 100
+			copy(r4.Src[:], net.ParseIP("10.0.0.1").To16())
+			copy(r4.Dst[:], net.ParseIP("10.0.0.2").To16())
+			r6 := Record{Packets: 5, Bytes: 5000, First: first, Last: first.Add(time.Second), TCPFlags: 0x12, Reason: ReasonActive}
+			r6.IPVersion, r6.Proto, r6.SrcPort, r6.DstPort = 6, 6, 40000, 443
+			copy(r6.Src[:], net.ParseIP("2001:db8::1"))
+			copy(r6.Dst[:], net.ParseIP("2001:db8::2"))
+
+			buf := make([]byte, 65536)
+			tmpls := make(map[uint16][]templateField)
+			read := func() exportPacket {
+				pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+				n, err := pc.Read(buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return decodeExport(t, buf[:n], tmpls)
+			}
+
+			e.Export(r4)
+			e.Export(r6)
+			if err := e.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			p := read()
+			if int(p.version) != version || p.seq != 0 || p.domain != 7 {
+				t.Errorf("header: version %d seq %d domain %d", p.version, p.seq, p.domain)
+			}
+			if d := time.Since(time.Unix(int64(p.unixSecs), 0)); d < 0 || d > 2*time.Second {
+				t.Errorf("export time %d is %v ago", p.unixSecs, d)
+			}
+			if len(p.tmplIDs) != 2 || p.tmplIDs[0] != templateIPv4 || p.tmplIDs[1] != templateIPv6 {
+				t.Fatalf("templates %v", p.tmplIDs)
+			}
+			for _, id := range p.tmplIDs {
+				has := make(map[uint16]bool)
+				for _, f := range tmpls[id] {
+					has[f.id] = true
+				}
+				v9 := version == NetFlowV9
+				if has[ieFirstSwitched] != v9 || has[ieLastSwitched] != v9 ||
+					has[ieFlowStartMilliseconds] == v9 || has[ieFlowEndMilliseconds] == v9 || has[ieFlowEndReason] == v9 {
+					t.Errorf("template %d fields %v", id, tmpls[id])
+				}
+			}
+			if version == NetFlowV9 && p.count != 4 {
+				t.Errorf("v9 count %d, want 2 templates + 2 records", p.count)
+			}
+			if len(p.records) != 2 {
+				t.Fatalf("%d records", len(p.records))
+			}
+			for i, r := range []Record{r4, r6} {
+				got := p.records[i]
+				src, dst := uint16(ieSourceIPv4Address), uint16(ieDestinationIPv4Address)
+				if r.IPVersion == 6 {
+					src, dst = ieSourceIPv6Address, ieDestinationIPv6Address
+				}
+				if !net.IP(got[src]).Equal(r.SrcIP()) || !net.IP(got[dst]).Equal(r.DstIP()) {
+					t.Errorf("record %d: %v -> %v", i, net.IP(got[src]), net.IP(got[dst]))
+				}
+				for _, c := range []struct {
+					id   uint16
+					want uint64
+				}{
+					{ieSourceTransportPort, uint64(r.SrcPort)},
+					{ieDestinationTransportPort, uint64(r.DstPort)},
+					{ieProtocolIdentifier, uint64(r.Proto)},
+					{ieTCPControlBits, uint64(r.TCPFlags)},
+					{ieVlanID, uint64(r.VLAN)},
+					{ieIngressInterface, 7},
+					{iePacketDeltaCount, r.Packets},
+					{ieOctetDeltaCount, r.Bytes},
+				} {
+					if v := field(t, got, c.id); v != c.want {
+						t.Errorf("record %d: field %d = %d, want %d", i, c.id, v, c.want)
+					}
+				}
+				if version == IPFIX {
+					if v := field(t, got, ieFlowStartMilliseconds); v != uint64(r.First.UnixMilli()) {
+						t.Errorf("record %d: flowStartMilliseconds %d, want %d", i, v, r.First.UnixMilli())
+					}
+					if v := field(t, got, ieFlowEndMilliseconds); v != uint64(r.Last.UnixMilli()) {
+						t.Errorf("record %d: flowEndMilliseconds %d, want %d", i, v, r.Last.UnixMilli())
+					}
+					if v := field(t, got, ieFlowEndReason); v != uint64(endReason(r.Reason)) {
+						t.Errorf("record %d: flowEndReason %d", i, v)
+					}
+					continue
+				}
+				// v9 的时间相对 sysUptime
+				fs, ls := field(t, got, ieFirstSwitched), field(t, got, ieLastSwitched)
+				if want := uint64(r.Last.Sub(r.First).Milliseconds()); ls-fs != want || len(got[ieFirstSwitched]) != 4 {
+					t.Errorf("record %d: FIRST_SWITCHED %d LAST_SWITCHED %d", i, fs, ls)
+				}
+				if fs < 20 || fs > uint64(p.uptime) {
+					t.Errorf("record %d: FIRST_SWITCHED %d, sysUptime %d", i, fs, p.uptime)
+				}
+			}
+
+			// 第二个报文不重发模板, 序列号 v9 按报文, IPFIX 按流记录计数
+			e.Export(r4)
+			e.Flush()
+			p = read()
+			wantSeq := uint32(2)
+			if version == NetFlowV9 {
+				wantSeq = 1
+				if p.count != 1 {
+					t.Errorf("v9 count %d, want 1", p.count)
+				}
+			}
+			if p.seq != wantSeq || len(p.tmplIDs) != 0 || len(p.records) != 1 {
+				t.Errorf("second packet: seq %d, %d templates, %d records", p.seq, len(p.tmplIDs), len(p.records))
+			}
+			if st := e.Stats(); st.Packets != 2 || st.Records != 3 || st.Errors != 0 {
+				t.Errorf("stats %+v", st)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+// Package flow 在 RX 路径上按 5 元组统计流量, 流空闲或持续过久时经回调导出, 类似 NetFlow 的流缓存.
+//
+//	t := flow.New(&flow.Config{Expired: func(r flow.Record) { ... }})
+//	defer t.Close()
+//	sock.HandleRecv(t.Handler(func(unix.XDPDesc, []byte) bool { return true }))
+//
+// 多个 RX goroutine 可同时更新同一个 Table, 更新不加锁也不分配内存
+package flow
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Key 流的 5 元组. 地址为 16 字节, IPv4 为 IPv4-mapped 形式.
+// ICMP/ICMPv6 的 SrcPort 为 0, DstPort 为 type<<8|code
+type Key struct {
+	Src, Dst         [16]byte
+	SrcPort, DstPort uint16
+	Proto            uint8
+	IPVersion        uint8  // 4 或 6
+	VLAN             uint16 // 最外层 VLAN ID, 无 tag 为 0
+}
+
+func (k *Key) SrcIP() net.IP { return net.IP(k.Src[:]) }
+func (k *Key) DstIP() net.IP { return net.IP(k.Dst[:]) }
+
+func (k Key) String() string {
+	return fmt.Sprintf("%d %s -> %s", k.Proto,
+		net.JoinHostPort(k.SrcIP().String(), fmt.Sprint(k.SrcPort)),
+		net.JoinHostPort(k.DstIP().String(), fmt.Sprint(k.DstPort)))
+}
+
+// Reason 流被导出的原因
+type Reason uint8
+
+const (
+	ReasonIdle   Reason = iota + 1 // 超过 IdleTimeout 没有报文
+	ReasonActive                   // 持续超过 ActiveTimeout, 之后的报文计入新的流
+	ReasonFlush                    // Flush 或 Close
+)
+
+func (r Reason) String() string {
+	switch r {
+	case ReasonIdle:
+		return "idle"
+	case ReasonActive:
+		return "active"
+	case ReasonFlush:
+		return "flush"
+	}
+	return fmt.Sprintf("Reason(%d)", uint8(r))
+}
+
+// Record 导出的一条流
+type Record struct {
+	Key
+	Packets  uint64
+	Bytes    uint64 // IP 层字节数 (IPv4 总长度, IPv6 负载长度加 40)
+	First    time.Time
+	Last     time.Time
+	TCPFlags uint8 // 所有报文 TCP 标志的或
+	Reason   Reason
+}
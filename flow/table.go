@@ -0,0 +1,357 @@
+package flow
+
+import (
+	"encoding/binary"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lixiangzhong/xdp/packet"
+	"golang.org/x/sys/unix"
+)
+
+type Config struct {
+	Size          int           // 最多同时跟踪的流数, 默认 65536, 满时新流的报文不计入 (Stats.Dropped)
+	IdleTimeout   time.Duration // 默认 15s
+	ActiveTimeout time.Duration // 默认 30m
+	ScanInterval  time.Duration // 检查超时的间隔, 默认 1s, 负数不启动后台检查, 由调用者执行 Expire
+
+	// Expired 在检查超时的 goroutine 中调用, 不要阻塞太久
+	Expired func(Record)
+}
+
+const (
+	defaultSize          = 65536
+	defaultIdleTimeout   = 15 * time.Second
+	defaultActiveTimeout = 30 * time.Minute
+	defaultScanInterval  = time.Second
+	maxProbe             = 64 // 线性探测的最大长度
+)
+
+// 槽位状态, 低 3 位为状态, 其余为版本号. 每次状态变化版本号加 1, CAS 不会出现 ABA
+const (
+	stEmpty    = 0
+	stInit     = 1 // 已占用, 正在写入 key
+	stActive   = 2
+	stExpiring = 3 // 正在导出, 之后变为 stDeleted
+	stDeleted  = 4 // 可被新流重用, 查找时需越过
+
+	stMask = 7
+)
+
+func nextState(st uint32, s uint32) uint32 {
+	return (st&^stMask + stMask + 1) | s
+}
+
+type slot struct {
+	packets  uint64
+	bytes    uint64
+	first    int64
+	last     int64
+	state    uint32
+	refs     int32  // 正在读 key 或更新计数的 goroutine 数, 改 key 或导出前须等其为 0
+	tcpFlags uint32 // 原子 OR
+	hash     uint32
+	key      Key
+}
+
+type Stats struct {
+	Active  uint64 // 当前跟踪的流数
+	Created uint64
+	Expired uint64
+	Dropped uint64 // 表满而未计入的报文数
+}
+
+// Table 开放寻址的流表, 容量固定为 Size 的 2 倍 (向上取 2 的幂)
+type Table struct {
+	cfg   Config
+	slots []slot
+	mask  uint64
+
+	active, created, expired, dropped uint64
+
+	scanMu  sync.Mutex // Expire 与 Flush 互斥, 只有持有者会把 stActive 改为 stExpiring
+	done    chan struct{}
+	running sync.WaitGroup
+	once    sync.Once
+}
+
+func New(cfg *Config) *Table {
+	t := &Table{done: make(chan struct{})}
+	if cfg != nil {
+		t.cfg = *cfg
+	}
+	if t.cfg.Size <= 0 {
+		t.cfg.Size = defaultSize
+	}
+	if t.cfg.IdleTimeout <= 0 {
+		t.cfg.IdleTimeout = defaultIdleTimeout
+	}
+	if t.cfg.ActiveTimeout <= 0 {
+		t.cfg.ActiveTimeout = defaultActiveTimeout
+	}
+	if t.cfg.ScanInterval == 0 {
+		t.cfg.ScanInterval = defaultScanInterval
+	}
+	n := 1
+	for n < 2*t.cfg.Size {
+		n <<= 1
+	}
+	t.slots = make([]slot, n)
+	t.mask = uint64(n - 1)
+	if t.cfg.ScanInterval > 0 {
+		t.running.Add(1)
+		go t.scan()
+	}
+	return t
+}
+
+func (t *Table) scan() {
+	defer t.running.Done()
+	tick := time.NewTicker(t.cfg.ScanInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case now := <-tick.C:
+			t.Expire(now)
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// Handler 包装 Socket.HandleRecv 的 handler, 统计后交给 next
+func (t *Table) Handler(next func(unix.XDPDesc, []byte) bool) func(unix.XDPDesc, []byte) bool {
+	return func(d unix.XDPDesc, data []byte) bool {
+		t.Add(data)
+		return next(d, data)
+	}
+}
+
+// Add 统计一个以太网帧, 非 IP 帧或表满时返回 false
+func (t *Table) Add(data []byte) bool {
+	var p packet.Packet
+	if p.Parse(data) != nil {
+		return false
+	}
+	return t.AddPacket(&p, time.Now())
+}
+
+// AddPacket 统计已解析的帧, 时间为 ts
+func (t *Table) AddPacket(p *packet.Packet, ts time.Time) bool {
+	var k Key
+	var bytes uint64
+	if ip := p.IPv4(); ip != nil {
+		k.IPVersion = 4
+		k.Src[10], k.Src[11] = 0xff, 0xff
+		k.Dst[10], k.Dst[11] = 0xff, 0xff
+		copy(k.Src[12:], ip[12:16])
+		copy(k.Dst[12:], ip[16:20])
+		k.Proto = ip.Protocol()
+		bytes = uint64(ip.TotalLen())
+	} else if ip := p.IPv6(); ip != nil {
+		k.IPVersion = 6
+		copy(k.Src[:], ip[8:24])
+		copy(k.Dst[:], ip[24:40])
+		k.Proto = p.L4Proto
+		bytes = uint64(ip.PayloadLen()) + packet.IPv6Len
+	} else {
+		return false
+	}
+	if p.NumVLANs > 0 {
+		k.VLAN = p.VLANs[0] & 0x0fff
+	}
+	var flags uint8
+	if !p.Fragment && p.L4Off >= 0 {
+		switch k.Proto {
+		case packet.IPProtocolTCP, packet.IPProtocolUDP:
+			l4 := p.Data[p.L4Off:]
+			k.SrcPort = binary.BigEndian.Uint16(l4[0:])
+			k.DstPort = binary.BigEndian.Uint16(l4[2:])
+			if tcp := p.TCP(); tcp != nil {
+				flags = tcp.Flags()
+			}
+		case packet.IPProtocolICMP, packet.IPProtocolICMPv6:
+			icmp := p.ICMP()
+			k.DstPort = uint16(icmp.Type())<<8 | uint16(icmp.Code())
+		}
+	}
+	return t.update(&k, bytes, flags, ts.UnixNano())
+}
+
+func hashKey(k *Key) uint64 {
+	h := uint64(0x9e3779b97f4a7c15)
+	for _, w := range [...]uint64{
+		binary.LittleEndian.Uint64(k.Src[0:]), binary.LittleEndian.Uint64(k.Src[8:]),
+		binary.LittleEndian.Uint64(k.Dst[0:]), binary.LittleEndian.Uint64(k.Dst[8:]),
+		uint64(k.SrcPort)<<48 | uint64(k.DstPort)<<32 | uint64(k.Proto)<<24 | uint64(k.IPVersion)<<16 | uint64(k.VLAN),
+	} {
+		h ^= w
+		h ^= h >> 33
+		h *= 0xff51afd7ed558ccd
+		h ^= h >> 33
+		h *= 0xc4ceb9fe1a85ec53
+		h ^= h >> 33
+	}
+	return h
+}
+
+func (t *Table) update(k *Key, bytes uint64, flags uint8, now int64) bool {
+	h := hashKey(k)
+	h32 := uint32(h >> 32)
+	for retry := 0; retry < maxProbe; retry++ {
+		var free *slot
+		var freeSt uint32
+		i := h & t.mask
+	probe:
+		for n := 0; n < maxProbe; {
+			s := &t.slots[i]
+			st := atomic.LoadUint32(&s.state)
+			switch st & stMask {
+			case stEmpty:
+				if free == nil {
+					free, freeSt = s, st
+				}
+				break probe // 槽位不会回到 stEmpty, 之后不会再有此 key
+			case stDeleted:
+				if free == nil {
+					free, freeSt = s, st
+				}
+			case stInit:
+				// 可能是另一个 goroutine 正在插入同一个 key, 等写完再比较
+				for atomic.LoadUint32(&s.state) == st {
+					runtime.Gosched()
+				}
+				continue
+			case stActive:
+				if s.add(st, k, h32, bytes, flags, now) {
+					return true
+				}
+			}
+			i = (i + 1) & t.mask
+			n++
+		}
+		if free == nil {
+			break
+		}
+		initSt := nextState(freeSt, stInit)
+		if !atomic.CompareAndSwapUint32(&free.state, freeSt, initSt) {
+			continue // 槽位被抢占, 重新查找
+		}
+		for atomic.LoadInt32(&free.refs) != 0 {
+			runtime.Gosched()
+		}
+		free.key = *k
+		free.hash = h32
+		atomic.StoreUint64(&free.packets, 1)
+		atomic.StoreUint64(&free.bytes, bytes)
+		atomic.StoreInt64(&free.first, now)
+		atomic.StoreInt64(&free.last, now)
+		atomic.StoreUint32(&free.tcpFlags, uint32(flags))
+		atomic.StoreUint32(&free.state, nextState(initSt, stActive))
+		atomic.AddUint64(&t.active, 1)
+		atomic.AddUint64(&t.created, 1)
+		return true
+	}
+	atomic.AddUint64(&t.dropped, 1)
+	return false
+}
+
+// add 槽位仍为状态 st 且 key 相同时累加计数
+func (s *slot) add(st uint32, k *Key, h32 uint32, bytes uint64, flags uint8, now int64) bool {
+	atomic.AddInt32(&s.refs, 1)
+	defer atomic.AddInt32(&s.refs, -1)
+	// refs 非 0 时 key 不会被改写, 状态未变说明 key 可以安全读取
+	if atomic.LoadUint32(&s.state) != st || s.hash != h32 || s.key != *k {
+		return false
+	}
+	atomic.AddUint64(&s.packets, 1)
+	atomic.AddUint64(&s.bytes, bytes)
+	if atomic.LoadInt64(&s.last) < now {
+		atomic.StoreInt64(&s.last, now)
+	}
+	for flags != 0 {
+		old := atomic.LoadUint32(&s.tcpFlags)
+		if old|uint32(flags) == old || atomic.CompareAndSwapUint32(&s.tcpFlags, old, old|uint32(flags)) {
+			break
+		}
+	}
+	return true
+}
+
+// Expire 导出在 now 时已超时的流, 返回导出的个数. 后台检查已启动时无需调用
+func (t *Table) Expire(now time.Time) int {
+	idle := now.Add(-t.cfg.IdleTimeout).UnixNano()
+	active := now.Add(-t.cfg.ActiveTimeout).UnixNano()
+	return t.expire(func(s *slot) Reason {
+		switch {
+		case atomic.LoadInt64(&s.last) <= idle:
+			return ReasonIdle
+		case atomic.LoadInt64(&s.first) <= active:
+			return ReasonActive
+		}
+		return 0
+	})
+}
+
+// Flush 导出所有流
+func (t *Table) Flush() int {
+	return t.expire(func(*slot) Reason { return ReasonFlush })
+}
+
+func (t *Table) expire(reason func(*slot) Reason) int {
+	t.scanMu.Lock()
+	defer t.scanMu.Unlock()
+	n := 0
+	for i := range t.slots {
+		s := &t.slots[i]
+		st := atomic.LoadUint32(&s.state)
+		if st&stMask != stActive {
+			continue
+		}
+		r := reason(s)
+		if r == 0 || !atomic.CompareAndSwapUint32(&s.state, st, nextState(st, stExpiring)) {
+			continue
+		}
+		for atomic.LoadInt32(&s.refs) != 0 {
+			runtime.Gosched()
+		}
+		rec := Record{
+			Key:      s.key,
+			Packets:  atomic.LoadUint64(&s.packets),
+			Bytes:    atomic.LoadUint64(&s.bytes),
+			First:    time.Unix(0, atomic.LoadInt64(&s.first)),
+			Last:     time.Unix(0, atomic.LoadInt64(&s.last)),
+			TCPFlags: uint8(atomic.LoadUint32(&s.tcpFlags)),
+			Reason:   r,
+		}
+		atomic.StoreUint32(&s.state, nextState(nextState(st, stExpiring), stDeleted))
+		atomic.AddUint64(&t.active, ^uint64(0))
+		atomic.AddUint64(&t.expired, 1)
+		n++
+		if t.cfg.Expired != nil {
+			t.cfg.Expired(rec)
+		}
+	}
+	return n
+}
+
+func (t *Table) Stats() Stats {
+	return Stats{
+		Active:  atomic.LoadUint64(&t.active),
+		Created: atomic.LoadUint64(&t.created),
+		Expired: atomic.LoadUint64(&t.expired),
+		Dropped: atomic.LoadUint64(&t.dropped),
+	}
+}
+
+// Close 停止后台检查并导出所有流, 之后不应再调用 Add
+func (t *Table) Close() error {
+	t.once.Do(func() {
+		close(t.done)
+		t.running.Wait()
+		t.Flush()
+	})
+	return nil
+}
@@ -0,0 +1,291 @@
+package flow
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lixiangzhong/xdp/packet"
+)
+
+var (
+	macA = net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	macB = net.HardwareAddr{0x02, 0, 0, 0, 0, 2}
+	ip4A = net.IPv4(10, 0, 0, 1)
+	ip4B = net.IPv4(10, 0, 0, 2)
+	ip6A = net.ParseIP("2001:db8::1")
+	ip6B = net.ParseIP("2001:db8::2")
+)
+
+// frame 构造以太网帧并解析, push 由内向外压入 L4 与 IP 头
+func frame(t testing.TB, payload int, vlan uint16, push func(b *packet.Buffer) error) *packet.Packet {
+	t.Helper()
+	b := packet.NewBuffer(make([]byte, 2048), 256, 0)
+	if err := b.Append(make([]byte, payload)); err != nil {
+		t.Fatal(err)
+	}
+	if err := push(&b); err != nil {
+		t.Fatal(err)
+	}
+	if vlan != 0 {
+		if err := b.PushVLAN(vlan); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.PushEthernet(macB, macA, 0); err != nil {
+		t.Fatal(err)
+	}
+	p := new(packet.Packet)
+	if err := p.Parse(b.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func udp4(t testing.TB, srcPort uint16, payload int) *packet.Packet {
+	return frame(t, payload, 0, func(b *packet.Buffer) error {
+		if err := b.PushUDP(srcPort, 53); err != nil {
+			return err
+		}
+		return b.PushIPv4(ip4A, ip4B, 0, 64)
+	})
+}
+
+func tcp6(t testing.TB, flags uint8, payload int) *packet.Packet {
+	return frame(t, payload, 5<<13|100, func(b *packet.Buffer) error {
+		if err := b.PushTCP(packet.TCPHeader{SrcPort: 40000, DstPort: 443, Flags: flags}); err != nil {
+			return err
+		}
+		return b.PushIPv6(ip6A, ip6B, 0, 64)
+	})
+}
+
+// collect 返回收集导出记录的 Table, 不启动后台检查
+func collect(cfg Config) (*Table, *[]Record) {
+	var recs []Record
+	cfg.ScanInterval = -1
+	cfg.Expired = func(r Record) { recs = append(recs, r) }
+	return New(&cfg), &recs
+}
+
+func TestTableCounts(t *testing.T) {
+	tb, recs := collect(Config{})
+	base := time.Unix(1700000000, 0)
+	for i, f := range []uint8{packet.TCPFlagSYN, packet.TCPFlagACK, packet.TCPFlagACK | packet.TCPFlagFIN} {
+		if !tb.AddPacket(tcp6(t, f, 10*i), base.Add(time.Duration(i)*time.Second)) {
+			t.Fatal("AddPacket failed")
+		}
+	}
+	for i := 0; i < 2; i++ {
+		tb.AddPacket(udp4(t, 1234, 100), base)
+	}
+	icmp := frame(t, 8, 0, func(b *packet.Buffer) error {
+		if err := b.PushICMP(packet.ICMPEchoRequest, 0, 1); err != nil {
+			return err
+		}
+		return b.PushIPv4(ip4A, ip4B, 0, 64)
+	})
+	tb.AddPacket(icmp, base)
+	if s := tb.Stats(); s != (Stats{Active: 3, Created: 3}) {
+		t.Errorf("Stats = %+v", s)
+	}
+	if n := tb.Flush(); n != 3 || len(*recs) != 3 {
+		t.Fatalf("Flush = %d, %d records", n, len(*recs))
+	}
+	got := make(map[uint8]Record)
+	for _, r := range *recs {
+		if r.Reason != ReasonFlush {
+			t.Errorf("%v: reason %v", r.Key, r.Reason)
+		}
+		got[r.Proto] = r
+	}
+
+	r := got[packet.IPProtocolTCP]
+	if r.IPVersion != 6 || !r.SrcIP().Equal(ip6A) || !r.DstIP().Equal(ip6B) || r.SrcPort != 40000 || r.DstPort != 443 || r.VLAN != 100 {
+		t.Errorf("tcp key %v vlan %d", r.Key, r.VLAN)
+	}
+	if r.Packets != 3 || r.Bytes != 3*(packet.IPv6Len+packet.TCPMinLen)+0+10+20 {
+		t.Errorf("tcp packets %d bytes %d", r.Packets, r.Bytes)
+	}
+	if r.TCPFlags != packet.TCPFlagSYN|packet.TCPFlagACK|packet.TCPFlagFIN {
+		t.Errorf("tcp flags %#x", r.TCPFlags)
+	}
+	if !r.First.Equal(base) || !r.Last.Equal(base.Add(2*time.Second)) {
+		t.Errorf("tcp first %v last %v", r.First, r.Last)
+	}
+
+	r = got[packet.IPProtocolUDP]
+	if r.IPVersion != 4 || !r.SrcIP().Equal(ip4A) || !r.DstIP().Equal(ip4B) || r.SrcPort != 1234 || r.DstPort != 53 || r.VLAN != 0 {
+		t.Errorf("udp key %v", r.Key)
+	}
+	if r.Packets != 2 || r.Bytes != 2*(packet.IPv4MinLen+packet.UDPLen+100) {
+		t.Errorf("udp packets %d bytes %d", r.Packets, r.Bytes)
+	}
+
+	r = got[packet.IPProtocolICMP]
+	if r.SrcPort != 0 || r.DstPort != uint16(packet.ICMPEchoRequest)<<8 || r.Packets != 1 {
+		t.Errorf("icmp key %v packets %d", r.Key, r.Packets)
+	}
+	if s := tb.Stats(); s != (Stats{Created: 3, Expired: 3}) {
+		t.Errorf("Stats after Flush = %+v", s)
+	}
+}
+
+func TestTableExpire(t *testing.T) {
+	tb, recs := collect(Config{IdleTimeout: 10 * time.Second, ActiveTimeout: time.Minute})
+	base := time.Unix(1700000000, 0)
+	short, long := udp4(t, 1, 0), udp4(t, 2, 0)
+	tb.AddPacket(short, base)
+	tb.AddPacket(long, base)
+	if n := tb.Expire(base.Add(10*time.Second - 1)); n != 0 {
+		t.Fatalf("Expire before IdleTimeout = %d", n)
+	}
+	tb.AddPacket(long, base.Add(8*time.Second))
+	if n := tb.Expire(base.Add(12 * time.Second)); n != 1 || (*recs)[0].SrcPort != 1 || (*recs)[0].Reason != ReasonIdle {
+		t.Fatalf("idle Expire = %d, records %+v", n, *recs)
+	}
+	// long 一直有报文, 超过 ActiveTimeout 后导出, 之后的报文计入新的流
+	for d := 16 * time.Second; d <= time.Minute; d += 8 * time.Second {
+		tb.AddPacket(long, base.Add(d))
+		if n := tb.Expire(base.Add(d)); n != 0 {
+			t.Fatalf("Expire at %v = %d", d, n)
+		}
+	}
+	if n := tb.Expire(base.Add(time.Minute + time.Second)); n != 1 {
+		t.Fatalf("active Expire = %d", n)
+	}
+	if r := (*recs)[1]; r.SrcPort != 2 || r.Reason != ReasonActive || r.Packets != 8 || !r.First.Equal(base) {
+		t.Errorf("active record %+v", r)
+	}
+	tb.AddPacket(long, base.Add(61*time.Second))
+	tb.Close()
+	if r := (*recs)[2]; r.SrcPort != 2 || r.Reason != ReasonFlush || r.Packets != 1 || !r.First.Equal(base.Add(61*time.Second)) {
+		t.Errorf("record after active timeout %+v", r)
+	}
+	if s := tb.Stats(); s != (Stats{Created: 3, Expired: 3}) {
+		t.Errorf("Stats = %+v", s)
+	}
+}
+
+func TestTableFull(t *testing.T) {
+	tb, recs := collect(Config{Size: 4})
+	n := len(tb.slots)
+	base := time.Unix(1700000000, 0)
+	for i := 0; i < n; i++ {
+		if !tb.AddPacket(udp4(t, uint16(i), 0), base) {
+			t.Fatalf("flow %d dropped with %d slots", i, n)
+		}
+	}
+	extra := udp4(t, uint16(n), 0)
+	if tb.AddPacket(extra, base) || tb.AddPacket(extra, base) {
+		t.Error("AddPacket succeeded on a full table")
+	}
+	// 已有的流仍可更新
+	if !tb.AddPacket(udp4(t, 0, 0), base) {
+		t.Error("existing flow dropped")
+	}
+	if s := tb.Stats(); s.Dropped != 2 || s.Active != uint64(n) {
+		t.Errorf("Stats = %+v", s)
+	}
+	// 导出后槽位可被新流重用
+	tb.Expire(base.Add(time.Hour))
+	if !tb.AddPacket(extra, base) {
+		t.Error("AddPacket failed after Expire")
+	}
+	tb.Flush()
+	if len(*recs) != n+1 {
+		t.Errorf("%d records", len(*recs))
+	}
+}
+
+// 多个 goroutine 同时更新重叠的流, 同时 Expire 导出其中一半
+func TestTableConcurrent(t *testing.T) {
+	const (
+		workers = 8
+		keys    = 32
+		rounds  = 64 * keys
+	)
+	var mu sync.Mutex
+	var recs []Record
+	tb := New(&Config{Size: 64, ScanInterval: -1, Expired: func(r Record) {
+		mu.Lock()
+		recs = append(recs, r)
+		mu.Unlock()
+	}})
+	flows := make([]*packet.Packet, keys)
+	for i := range flows {
+		flows[i] = udp4(t, uint16(i), i)
+	}
+	// 偶数 key 的报文时间较早, 每次 Expire 都会导出; 奇数 key 不会在 Close 之前导出
+	base := time.Unix(1700000000, 0)
+	now := base.Add(time.Hour)
+	ts := func(i int) time.Time {
+		if i%2 == 0 {
+			return base
+		}
+		return now
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				tb.Expire(now)
+			}
+		}
+	}()
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for n := 0; n < rounds; n++ {
+				i := (w + n) % keys
+				if !tb.AddPacket(flows[i], ts(i)) {
+					t.Errorf("flow %d dropped", i)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(stop)
+	<-done
+	tb.Close()
+
+	packets := make(map[uint16]uint64)
+	bytes := make(map[uint16]uint64)
+	odd := make(map[uint16]int)
+	for _, r := range recs {
+		packets[r.SrcPort] += r.Packets
+		bytes[r.SrcPort] += r.Bytes
+		if r.SrcPort%2 == 1 {
+			odd[r.SrcPort]++
+			if r.Reason != ReasonFlush {
+				t.Errorf("flow %d expired with reason %v", r.SrcPort, r.Reason)
+			}
+		}
+	}
+	for i := 0; i < keys; i++ {
+		want := uint64(workers * rounds / keys)
+		if packets[uint16(i)] != want {
+			t.Errorf("flow %d: %d packets, want %d", i, packets[uint16(i)], want)
+		}
+		if size := uint64(packet.IPv4MinLen + packet.UDPLen + i); bytes[uint16(i)] != want*size {
+			t.Errorf("flow %d: %d bytes, want %d", i, bytes[uint16(i)], want*size)
+		}
+		if i%2 == 1 && odd[uint16(i)] != 1 {
+			t.Errorf("flow %d: %d records, want 1", i, odd[uint16(i)])
+		}
+	}
+	s := tb.Stats()
+	if s.Active != 0 || s.Dropped != 0 || s.Created != s.Expired || s.Expired != uint64(len(recs)) {
+		t.Errorf("Stats = %+v, %d records", s, len(recs))
+	}
+}
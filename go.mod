@@ -4,8 +4,7 @@ go 1.19
 
 require (
 	github.com/cilium/ebpf v0.9.3
-	github.com/google/gopacket v1.1.19
 	github.com/pkg/errors v0.9.1
-	github.com/rcrowley/go-metrics v0.0.0-20201227073835-cf1acfcdf475
+	golang.org/x/net v0.0.0-20220927171203-f486391704dc
 	golang.org/x/sys v0.0.0-20220928140112-f11e5e49a4ec
 )
@@ -41,9 +41,53 @@ type ethtoolchannels struct {
 	combinedcount uint32
 }
 
+// ethtool_drvinfo
+type ethtooldrvinfo struct {
+	cmd         uint32
+	driver      [32]byte
+	version     [32]byte
+	fwversion   [32]byte
+	businfo     [32]byte
+	eromversion [32]byte
+	reserved2   [12]byte
+	nprivflags  uint32
+	nstats      uint32
+	testinfolen uint32
+	eedumplen   uint32
+	regdumplen  uint32
+}
+
+// ethtool_link_settings, link_mode_masks 按最大 nwords(127) 预留
+type ethtoollinksettings struct {
+	cmd                 uint32
+	speed               uint32
+	duplex              uint8
+	port                uint8
+	phyaddress          uint8
+	autoneg             uint8
+	mdiosupport         uint8
+	ethtpmdix           uint8
+	ethtpmdixctrl       uint8
+	linkmodemasksnwords int8
+	transceiver         uint8
+	masterslavecfg      uint8
+	masterslavestate    uint8
+	ratematching        uint8
+	reserved            [7]uint32
+	linkmodemasks       [3 * 127]uint32
+}
+
+// ethtool_value
+type ethtoolvalue struct {
+	cmd  uint32
+	data uint32
+}
+
+// ifreq 内核中 struct ifreq 为 40 字节, ioctl 会完整拷贝, 故补齐
 type ifreq struct {
 	ifrn [unix.IFNAMSIZ]byte
 	ifru uintptr
+	_    [16]byte
 }
 
 func (i *ifreq) SetIfrn(name string) syscall.Errno {
@@ -0,0 +1,43 @@
+// Package cliutil cmd 下各工具共用的参数解析
+package cliutil
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lixiangzhong/xdp"
+)
+
+// ParseQueues 解析 "0,2,3" 或 "0-3", 为空或 all 时为网卡 ifname 的全部队列
+func ParseQueues(ifname, s string) ([]int, error) {
+	if s == "" || s == "all" {
+		n, _, err := xdp.GetNicQueues(ifname)
+		if err != nil {
+			return nil, err
+		}
+		queues := make([]int, n)
+		for i := range queues {
+			queues[i] = i
+		}
+		return queues, nil
+	}
+	var queues []int
+	for _, f := range strings.Split(s, ",") {
+		lo, hi, isRange := strings.Cut(f, "-")
+		a, err := strconv.Atoi(strings.TrimSpace(lo))
+		if err != nil {
+			return nil, fmt.Errorf("bad queue %q", f)
+		}
+		b := a
+		if isRange {
+			if b, err = strconv.Atoi(strings.TrimSpace(hi)); err != nil || b < a {
+				return nil, fmt.Errorf("bad queue range %q", f)
+			}
+		}
+		for q := a; q <= b; q++ {
+			queues = append(queues, q)
+		}
+	}
+	return queues, nil
+}
@@ -0,0 +1,189 @@
+// Package netlink 最小的 netlink 请求/应答与属性编解码, 供 genl(netdev), rtnetlink 与 xdptest 共用
+package netlink
+
+import (
+	"encoding/binary"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Conn netlink 请求/应答的简单封装
+type Conn struct {
+	fd  int
+	seq uint32
+}
+
+type Message struct {
+	Header unix.NlMsghdr
+	Data   []byte
+}
+
+// Dial 打开 proto (如 unix.NETLINK_ROUTE) 的 netlink socket
+func Dial(proto int) (*Conn, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, errors.WithMessage(err, "netlink.Socket")
+	}
+	err = unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK})
+	if err != nil {
+		unix.Close(fd)
+		return nil, errors.WithMessage(err, "netlink.Bind")
+	}
+	return &Conn{fd: fd}, nil
+}
+
+func (c *Conn) FD() int { return c.fd }
+
+func (c *Conn) Close() {
+	unix.Close(c.fd)
+}
+
+// Request 发送一条消息并读取全部应答, dump 请求读到 NLMSG_DONE 为止, NLM_F_ACK 请求读到 ack 为止
+func (c *Conn) Request(typ uint16, flags uint16, payload []byte) ([]Message, error) {
+	c.seq++
+	b := make([]byte, unix.NLMSG_HDRLEN, unix.NLMSG_HDRLEN+len(payload))
+	hdr := (*unix.NlMsghdr)(unsafe.Pointer(&b[0]))
+	hdr.Len = uint32(unix.NLMSG_HDRLEN + len(payload))
+	hdr.Type = typ
+	hdr.Flags = unix.NLM_F_REQUEST | flags
+	hdr.Seq = c.seq
+	b = append(b, payload...)
+	err := unix.Sendto(c.fd, b, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK})
+	if err != nil {
+		return nil, errors.WithMessage(err, "netlink.Sendto")
+	}
+	var msgs []Message
+	for {
+		batch, err := c.Recv()
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range batch {
+			if m.Header.Seq != c.seq {
+				continue
+			}
+			switch m.Header.Type {
+			case unix.NLMSG_DONE:
+				return msgs, nil
+			case unix.NLMSG_ERROR:
+				if len(m.Data) < 4 {
+					return nil, errors.New("netlink: short NLMSG_ERROR")
+				}
+				errno := int32(binary.LittleEndian.Uint32(m.Data))
+				if errno != 0 {
+					return nil, syscall.Errno(-errno)
+				}
+				return msgs, nil
+			}
+			msgs = append(msgs, m)
+			if m.Header.Flags&unix.NLM_F_MULTI == 0 && flags&unix.NLM_F_ACK == 0 {
+				return msgs, nil
+			}
+		}
+	}
+}
+
+// Recv 读取一批消息
+func (c *Conn) Recv() ([]Message, error) {
+	buf := make([]byte, 1<<16)
+	n, _, err := unix.Recvfrom(c.fd, buf, 0)
+	if err != nil {
+		return nil, errors.WithMessage(err, "netlink.Recvfrom")
+	}
+	return parseMessages(buf[:n])
+}
+
+func parseMessages(b []byte) ([]Message, error) {
+	var msgs []Message
+	for len(b) >= unix.NLMSG_HDRLEN {
+		hdr := *(*unix.NlMsghdr)(unsafe.Pointer(&b[0]))
+		if hdr.Len < unix.NLMSG_HDRLEN || int(hdr.Len) > len(b) {
+			return nil, errors.New("netlink: malformed message")
+		}
+		msgs = append(msgs, Message{Header: hdr, Data: b[unix.NLMSG_HDRLEN:hdr.Len]})
+		b = b[nlmsgAlign(int(hdr.Len)):]
+	}
+	return msgs, nil
+}
+
+func nlmsgAlign(n int) int {
+	return (n + unix.NLMSG_ALIGNTO - 1) &^ (unix.NLMSG_ALIGNTO - 1)
+}
+
+func nlaAlign(n int) int {
+	return (n + unix.NLA_ALIGNTO - 1) &^ (unix.NLA_ALIGNTO - 1)
+}
+
+// AppendAttr 追加一个 netlink 属性(按 4 字节对齐)
+func AppendAttr(b []byte, typ uint16, val []byte) []byte {
+	l := unix.NLA_HDRLEN + len(val)
+	b = binary.LittleEndian.AppendUint16(b, uint16(l))
+	b = binary.LittleEndian.AppendUint16(b, typ)
+	b = append(b, val...)
+	return append(b, make([]byte, nlaAlign(l)-l)...)
+}
+
+func AppendAttrU32(b []byte, typ uint16, v uint32) []byte {
+	return AppendAttr(b, typ, binary.LittleEndian.AppendUint32(nil, v))
+}
+
+func AppendAttrString(b []byte, typ uint16, s string) []byte {
+	return AppendAttr(b, typ, append([]byte(s), 0))
+}
+
+// ParseAttrs 解析属性列表, 去掉 NLA_F_NESTED 等标志位
+func ParseAttrs(b []byte) map[uint16][]byte {
+	attrs := make(map[uint16][]byte)
+	for len(b) >= unix.NLA_HDRLEN {
+		l := int(binary.LittleEndian.Uint16(b))
+		typ := binary.LittleEndian.Uint16(b[2:]) &^ (unix.NLA_F_NESTED | unix.NLA_F_NET_BYTEORDER)
+		if l < unix.NLA_HDRLEN || l > len(b) {
+			break
+		}
+		attrs[typ] = b[unix.NLA_HDRLEN:l]
+		if nlaAlign(l) > len(b) {
+			break
+		}
+		b = b[nlaAlign(l):]
+	}
+	return attrs
+}
+
+func AttrU32(attrs map[uint16][]byte, typ uint16) uint32 {
+	v := attrs[typ]
+	if len(v) < 4 {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(v)
+}
+
+func AttrU64(attrs map[uint16][]byte, typ uint16) uint64 {
+	v := attrs[typ]
+	if len(v) < 8 {
+		return uint64(AttrU32(attrs, typ))
+	}
+	return binary.LittleEndian.Uint64(v)
+}
+
+// GenlFamilyID 通过 nlctrl 查询 generic netlink family id
+func GenlFamilyID(c *Conn, name string) (uint16, error) {
+	req := []byte{unix.CTRL_CMD_GETFAMILY, 1, 0, 0}
+	req = AppendAttrString(req, unix.CTRL_ATTR_FAMILY_NAME, name)
+	msgs, err := c.Request(unix.GENL_ID_CTRL, 0, req)
+	if err != nil {
+		return 0, errors.WithMessage(err, "CTRL_CMD_GETFAMILY "+name)
+	}
+	for _, m := range msgs {
+		if len(m.Data) < unix.GENL_HDRLEN {
+			continue
+		}
+		attrs := ParseAttrs(m.Data[unix.GENL_HDRLEN:])
+		if id, ok := attrs[unix.CTRL_ATTR_FAMILY_ID]; ok && len(id) >= 2 {
+			return binary.LittleEndian.Uint16(id), nil
+		}
+	}
+	return 0, errors.New("genl family " + name + " not found")
+}
@@ -0,0 +1,146 @@
+package xdp
+
+import (
+	"encoding/binary"
+
+	"github.com/cilium/ebpf/asm"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// RX 元数据由 ProgramConfig.Metadata 的程序经 bpf_xdp_adjust_meta 写在帧数据之前 (XDP_PACKET_HEADROOM 内),
+// 布局: timestamp u64, hash u32, hash_type u32, vlan_proto u16, vlan_tci u16, flags u32
+const (
+	rxMetaLen       = 24
+	rxMetaMagic     = 0x584d0000 // flags 高 16 位. 启用 Metadata 的程序注册后 frame 放入 fill ring 时 flags 被清零, 没有魔数即本帧没有元数据
+	rxMetaTimestamp = 1 << 0
+	rxMetaHash      = 1 << 1
+	rxMetaVLAN      = 1 << 2
+
+	xdpMdData     = 0 // xdp_md 中 data 与 data_meta 的偏移
+	xdpMdDataMeta = 8
+
+	stackMeta = -48 // 元数据先写在栈上, 不与 rule.go 的栈变量重叠
+	regCtx    = asm.R9
+	regFlags  = asm.R8
+
+	// BPF_PSEUDO_KFUNC_CALL, call 指令的 imm 为内核 BTF 中的函数 ID
+	pseudoKfuncCall = asm.R2
+)
+
+// RxMetadata 网卡经 XDP 元数据 kfunc 提供的信息, 网卡驱动不支持的项 Has* 为 false
+type RxMetadata struct {
+	Timestamp uint64 // 硬件 RX 时间戳, 纳秒, 网卡 PHC 时钟
+	Hash      uint32 // RSS 哈希
+	HashType  uint32 // enum xdp_rss_hash_type
+	VLANProto uint16 // 网卡剥离的 VLAN 标签的 TPID, 如 0x8100
+	VLANTCI   uint16
+
+	HasTimestamp bool
+	HasHash      bool
+	HasVLAN      bool
+}
+
+// RxMetadata 读取 RX desc 之前的元数据, 程序未启用 Metadata 或没有为此帧写入时返回 false
+func (u *Umem) RxMetadata(d unix.XDPDesc) (RxMetadata, bool) {
+	base := d.Addr &^ uint64(_DEFAULT_FRAME_SIZE-1)
+	if d.Addr-base < rxMetaLen {
+		return RxMetadata{}, false
+	}
+	b := u.data[d.Addr-rxMetaLen : d.Addr]
+	flags := binary.LittleEndian.Uint32(b[20:])
+	if flags&0xffff0000 != rxMetaMagic {
+		return RxMetadata{}, false
+	}
+	return RxMetadata{
+		Timestamp:    binary.LittleEndian.Uint64(b),
+		Hash:         binary.LittleEndian.Uint32(b[8:]),
+		HashType:     binary.LittleEndian.Uint32(b[12:]),
+		VLANProto:    binary.BigEndian.Uint16(b[16:]), // __be16
+		VLANTCI:      binary.LittleEndian.Uint16(b[18:]),
+		HasTimestamp: flags&rxMetaTimestamp != 0,
+		HasHash:      flags&rxMetaHash != 0,
+		HasVLAN:      flags&rxMetaVLAN != 0,
+	}, true
+}
+
+// rxKfuncs 元数据 kfunc 的 BTF ID, 内核没有的为 0
+type rxKfuncs struct {
+	timestamp, hash, vlan uint32
+}
+
+func loadRxKfuncs() (*rxKfuncs, error) {
+	ids, err := kernelFuncIDs("bpf_xdp_metadata_rx_timestamp", "bpf_xdp_metadata_rx_hash", "bpf_xdp_metadata_rx_vlan_tag")
+	if err != nil {
+		return nil, err
+	}
+	k := &rxKfuncs{
+		timestamp: ids["bpf_xdp_metadata_rx_timestamp"],
+		hash:      ids["bpf_xdp_metadata_rx_hash"],
+		vlan:      ids["bpf_xdp_metadata_rx_vlan_tag"], // 6.8
+	}
+	if k.timestamp == 0 && k.hash == 0 {
+		return nil, errors.New("kernel has no XDP metadata kfuncs (requires 6.3)")
+	}
+	return k, nil
+}
+
+func kfuncCall(id uint32) asm.Instruction {
+	return asm.Instruction{
+		OpCode:   asm.OpCode(asm.JumpClass).SetJumpOp(asm.Call),
+		Src:      pseudoKfuncCall,
+		Constant: int64(id),
+	}
+}
+
+// instructions 在 bpf_redirect_map 之前调用, ctx 在 regCtx 中. 只使用 R0-R5 与 regFlags,
+// 元数据区放不下时不写入, 不影响重定向
+func (k *rxKfuncs) instructions() asm.Instructions {
+	insns := asm.Instructions{
+		asm.Mov.Reg(asm.R1, regCtx),
+		asm.Mov.Imm(asm.R2, -rxMetaLen),
+		asm.FnXdpAdjustMeta.Call(),
+		asm.JNE.Imm(asm.R0, 0, "meta_done"),
+		asm.StoreImm(asm.RFP, stackMeta, 0, asm.DWord),
+		asm.StoreImm(asm.RFP, stackMeta+8, 0, asm.DWord),
+		asm.StoreImm(asm.RFP, stackMeta+16, 0, asm.DWord),
+		asm.Mov.Imm32(regFlags, rxMetaMagic),
+	}
+	// kfunc(ctx, fp+off1[, fp+off2]) 成功时 flags |= bit
+	call := func(id uint32, bit int32, label string, offs ...int16) {
+		if id == 0 {
+			return
+		}
+		insns = append(insns, asm.Mov.Reg(asm.R1, regCtx))
+		for i, off := range offs {
+			r := asm.R2 + asm.Register(i)
+			insns = append(insns, asm.Mov.Reg(r, asm.RFP), asm.Add.Imm(r, int32(stackMeta+off)))
+		}
+		insns = append(insns,
+			kfuncCall(id),
+			asm.JNE.Imm(asm.R0, 0, label),
+			asm.Or.Imm32(regFlags, bit),
+		)
+		// 下一条指令作为跳转目标
+		insns = append(insns, asm.Mov.Imm(asm.R0, 0).WithSymbol(label))
+	}
+	call(k.timestamp, rxMetaTimestamp, "meta_hash", 0)
+	call(k.hash, rxMetaHash, "meta_vlan", 8, 12)
+	call(k.vlan, rxMetaVLAN, "meta_copy", 16, 18)
+	insns = append(insns,
+		asm.StoreMem(asm.RFP, stackMeta+20, regFlags, asm.Word),
+		// adjust_meta 后包指针失效, 重新读取 data_meta 与 data
+		asm.LoadMem(asm.R2, regCtx, xdpMdDataMeta, asm.Word),
+		asm.LoadMem(asm.R3, regCtx, xdpMdData, asm.Word),
+		asm.Mov.Reg(asm.R4, asm.R2),
+		asm.Add.Imm(asm.R4, rxMetaLen),
+		asm.JGT.Reg(asm.R4, asm.R3, "meta_done"),
+	)
+	for off := int16(0); off < rxMetaLen; off += 4 {
+		insns = append(insns,
+			asm.LoadMem(asm.R5, asm.RFP, stackMeta+off, asm.Word),
+			asm.StoreMem(asm.R2, off, asm.R5, asm.Word),
+		)
+	}
+	return append(insns, asm.Mov.Imm(asm.R0, 0).WithSymbol("meta_done"))
+}
@@ -0,0 +1,96 @@
+package xdp
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// frame 回到 fill ring 后, 上次收到时的元数据不再被 RxMetadata 读到
+func TestRxMetadataRecycled(t *testing.T) {
+	const frames = 4
+	k, u, s := newSimSocket(t, nil, simUmemConfig(frames, frames), SocketConfig{RxSize: 8, TxSize: 8})
+	// 同 Program.Register 注册到启用 Metadata 的程序
+	u.rxMeta = true
+	descs := make([]unix.XDPDesc, 8)
+	recv := func(n int) []unix.XDPDesc {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			k.Inject(simIfindex, 0, simFrame(i, 60))
+		}
+		var got []unix.XDPDesc
+		waitFor(t, "frames", func() bool {
+			m := s.Recv(descs[:n-len(got)])
+			got = append(got, descs[:m]...)
+			return len(got) == n
+		})
+		return got
+	}
+
+	d := recv(1)[0]
+	if _, ok := u.RxMetadata(d); ok {
+		t.Fatal("metadata on a fresh frame")
+	}
+	// 模拟程序写入的元数据
+	b := u.data[d.Addr-rxMetaLen : d.Addr]
+	binary.LittleEndian.PutUint64(b, 12345)
+	binary.LittleEndian.PutUint32(b[20:], rxMetaMagic|rxMetaTimestamp)
+	if m, ok := u.RxMetadata(d); !ok || !m.HasTimestamp || m.Timestamp != 12345 {
+		t.Fatalf("RxMetadata = %+v, %v", m, ok)
+	}
+
+	s.Release(d)
+	reused := false
+	for _, e := range recv(frames) {
+		if e.Addr == d.Addr {
+			reused = true
+		}
+		if m, ok := u.RxMetadata(e); ok {
+			t.Errorf("frame %#x: stale metadata %+v", e.Addr, m)
+		}
+	}
+	if !reused {
+		t.Fatalf("frame %#x was not received again", d.Addr)
+	}
+}
+
+// 没有注册到启用 Metadata 的程序时, fill_fr 不写 frame 的 headroom
+func TestFillKeepsHeadroom(t *testing.T) {
+	const frames, fill = 8, 4
+	k, u, s := newSimSocket(t, nil, simUmemConfig(frames, fill), SocketConfig{RxSize: 8, TxSize: 8})
+	var addrs []uint64
+	for {
+		b, ok := u.AllocFrame()
+		if !ok {
+			break
+		}
+		for i := range b.Frame()[:b.Headroom()] {
+			b.Frame()[i] = 0xab
+		}
+		addrs = append(addrs, u.BufferDesc(b).Addr)
+	}
+	for _, a := range addrs {
+		u.FreeFrame(a)
+	}
+	// 收到 fill 个帧后, 写过 headroom 的 frame 全部进入 fill ring
+	for i := 0; i < fill; i++ {
+		k.Inject(simIfindex, 0, simFrame(i, 60))
+	}
+	descs := make([]unix.XDPDesc, fill)
+	got := 0
+	waitFor(t, "frames", func() bool {
+		got += s.Recv(descs[got:])
+		return got == fill
+	})
+	if n := freeFrames(u); n != 0 {
+		t.Fatalf("%d frames not refilled", n)
+	}
+	for _, a := range addrs {
+		for i, c := range u.data[a-XDP_PACKET_HEADROOM : a] {
+			if c != 0xab {
+				t.Fatalf("frame %#x: headroom byte %d changed to %#x", a, i, c)
+			}
+		}
+	}
+}
@@ -0,0 +1,652 @@
+package xdp
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/lixiangzhong/xdp/internal/netlink"
+	"github.com/lixiangzhong/xdp/packet"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+type NeighborConfig struct {
+	Ifindex int // 只跟踪该网卡的邻居与路由, 0 为全部网卡
+
+	// NoKernel 为 true 时不读取也不订阅内核的邻居表与路由表, 只用 AddRoute/Add 与学习到的邻居
+	NoKernel bool
+
+	// Addrs 本机地址, 作为 ARP 请求/NS 的源地址, 也用于判断收到的 ARP/NS 是否发给本机.
+	// MAC 本机 MAC. 二者默认取 Ifindex 网卡的配置
+	Addrs []net.IP
+	MAC   net.HardwareAddr
+
+	// Send 发送主动解析的 ARP 请求/NS, 如包装 Socket.Write. nil 时只查表不主动解析.
+	// 应答由 RX 循环交给 Input (或 Handler) 学习
+	Send func(frame []byte) bool
+
+	Timeout time.Duration // Resolve 的超时, 默认 1s
+}
+
+const (
+	defaultResolve = time.Second
+	resolveRetry   = 200 * time.Millisecond
+	neighTimeout   = 5 * time.Minute // 学习到的邻居的有效期, 内核表中的邻居随内核更新
+)
+
+var (
+	errNoNeighbor = errors.New("next hop unresolved")
+	broadcastMAC  = [6]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+)
+
+// Neighbors 为构造 TX 报文解析下一跳 MAC: 按路由表选下一跳, 依次查内核邻居表 (RTM_GETNEIGH,
+// 并订阅 RTNLGRP_NEIGH/ROUTE 更新), 从 RX 学习到的 ARP/NDP, 最后经 Send 主动发送 ARP 请求/NS.
+// 网卡挂载了重定向程序时内核通常收不到 ARP 应答, 其邻居表只有挂载之前的条目
+type Neighbors struct {
+	cfg   NeighborConfig
+	addrs [][]byte // v4 为 4 字节
+	mac   [6]byte
+
+	mu     sync.Mutex
+	neigh  map[[16]byte]neighEntry
+	routes []neighRoute
+	update chan struct{} // 每次邻居变化时关闭并替换
+
+	nl, mon *netlink.Conn
+	done    chan struct{}
+	running sync.WaitGroup
+	once    sync.Once
+}
+
+type neighEntry struct {
+	mac     [6]byte
+	updated time.Time
+	origin  uint8
+}
+
+const (
+	neighLearned = iota // Input 学习, neighTimeout 后过期
+	neighKernel         // 内核邻居表, 随 RTM_DELNEIGH 删除
+	neighStatic         // Add
+)
+
+type neighRoute struct {
+	dst      net.IPNet
+	gw       net.IP // nil 为直连
+	priority uint32
+	kernel   bool
+}
+
+func NewNeighbors(cfg *NeighborConfig) (_ *Neighbors, err error) {
+	n := &Neighbors{
+		neigh:  make(map[[16]byte]neighEntry),
+		update: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if cfg != nil {
+		n.cfg = *cfg
+	}
+	if n.cfg.Timeout == 0 {
+		n.cfg.Timeout = defaultResolve
+	}
+	if err = n.initAddrs(); err != nil {
+		return nil, err
+	}
+	if n.cfg.NoKernel {
+		return n, nil
+	}
+	defer func() {
+		if err != nil {
+			n.Close()
+		}
+	}()
+	// 先订阅再读全表, 不丢失其间的更新
+	if n.mon, err = netlink.Dial(unix.NETLINK_ROUTE); err != nil {
+		return nil, err
+	}
+	for _, g := range []int{unix.RTNLGRP_NEIGH, unix.RTNLGRP_IPV4_ROUTE, unix.RTNLGRP_IPV6_ROUTE} {
+		if err = unix.SetsockoptInt(n.mon.FD(), unix.SOL_NETLINK, unix.NETLINK_ADD_MEMBERSHIP, g); err != nil {
+			return nil, errors.WithMessage(err, "NETLINK_ADD_MEMBERSHIP")
+		}
+	}
+	if n.nl, err = netlink.Dial(unix.NETLINK_ROUTE); err != nil {
+		return nil, err
+	}
+	if err = n.sync(); err != nil {
+		return nil, err
+	}
+	n.running.Add(1)
+	go n.monitor()
+	return n, nil
+}
+
+func (n *Neighbors) initAddrs() error {
+	var iface *net.Interface
+	if n.cfg.Ifindex != 0 && (n.cfg.Addrs == nil || n.cfg.MAC == nil) {
+		var err error
+		if iface, err = net.InterfaceByIndex(n.cfg.Ifindex); err != nil {
+			return errors.WithMessage(err, "neighbor")
+		}
+	}
+	addrs, mac := n.cfg.Addrs, n.cfg.MAC
+	if addrs == nil && iface != nil {
+		ifaddrs, err := iface.Addrs()
+		if err != nil {
+			return errors.WithMessage(err, "neighbor")
+		}
+		for _, a := range ifaddrs {
+			if ipn, ok := a.(*net.IPNet); ok {
+				addrs = append(addrs, ipn.IP)
+			}
+		}
+	}
+	if mac == nil && iface != nil {
+		mac = iface.HardwareAddr
+	}
+	for _, ip := range addrs {
+		if ip4 := ip.To4(); ip4 != nil {
+			n.addrs = append(n.addrs, ip4)
+		} else if ip6 := ip.To16(); ip6 != nil {
+			n.addrs = append(n.addrs, ip6)
+		} else {
+			return errors.Errorf("neighbor: bad IP %v", ip)
+		}
+	}
+	if mac != nil && len(mac) != 6 {
+		return errors.Errorf("neighbor: bad MAC %v", mac)
+	}
+	copy(n.mac[:], mac)
+	return nil
+}
+
+func ipKey(ip []byte) (key [16]byte) {
+	copy(key[:], ip)
+	return key
+}
+
+// normIP IPv4 为 4 字节, IPv6 为 16 字节, 无效地址为 nil
+func normIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip.To16()
+}
+
+// Add 添加静态邻居, 不会过期
+func (n *Neighbors) Add(ip net.IP, mac net.HardwareAddr) {
+	if ip = normIP(ip); ip != nil && len(mac) == 6 {
+		n.set(ip, mac, neighStatic)
+	}
+}
+
+// AddRoute 添加一条路由, gw 为 nil 表示直连. 与内核路由一起按最长前缀匹配
+func (n *Neighbors) AddRoute(dst *net.IPNet, gw net.IP) {
+	r := neighRoute{gw: normIP(gw)}
+	r.dst.IP = normIP(dst.IP.Mask(dst.Mask))
+	r.dst.Mask = dst.Mask
+	if len(r.dst.IP) != len(r.dst.Mask) {
+		return
+	}
+	n.mu.Lock()
+	n.routes = append(n.routes, r)
+	n.mu.Unlock()
+}
+
+func (n *Neighbors) set(ip, mac []byte, origin uint8) {
+	key := ipKey(ip)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	e, ok := n.neigh[key]
+	if ok && e.origin > origin {
+		return
+	}
+	changed := !ok || string(e.mac[:]) != string(mac)
+	copy(e.mac[:], mac)
+	e.updated = time.Now()
+	e.origin = origin
+	n.neigh[key] = e
+	if changed {
+		close(n.update)
+		n.update = make(chan struct{})
+	}
+}
+
+// Lookup 只查表, 不解析路由也不主动解析
+func (n *Neighbors) Lookup(ip net.IP) (net.HardwareAddr, bool) {
+	mac, ok, _ := n.lookup(normIP(ip))
+	if !ok {
+		return nil, false
+	}
+	return net.HardwareAddr(mac[:]), true
+}
+
+// lookup 同时返回下次邻居变化时关闭的 channel
+func (n *Neighbors) lookup(ip net.IP) (mac [6]byte, ok bool, update chan struct{}) {
+	key := ipKey(ip)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	e, ok := n.neigh[key]
+	if ok && e.origin == neighLearned && time.Since(e.updated) > neighTimeout {
+		delete(n.neigh, key)
+		ok = false
+	}
+	return e.mac, ok, n.update
+}
+
+// NextHop 按路由表返回 dst 的下一跳, 直连时为 dst 本身. 没有任何路由时视为直连, 有路由但都不匹配时返回 nil
+func (n *Neighbors) NextHop(dst net.IP) net.IP {
+	dst = normIP(dst)
+	hop, _ := n.route(dst)
+	return hop
+}
+
+// route 最长前缀匹配, 同前缀取 priority 最小的. 同时返回匹配的路由
+func (n *Neighbors) route(dst net.IP) (net.IP, *neighRoute) {
+	if dst == nil {
+		return nil, nil
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(n.routes) == 0 {
+		return dst, nil
+	}
+	var best *neighRoute
+	bestLen := -1
+	for i := range n.routes {
+		r := &n.routes[i]
+		if len(r.dst.IP) != len(dst) || !r.dst.Contains(dst) {
+			continue
+		}
+		l, _ := r.dst.Mask.Size()
+		if l > bestLen || l == bestLen && r.priority < best.priority {
+			best, bestLen = r, l
+		}
+	}
+	if best == nil {
+		return nil, nil
+	}
+	rt := *best
+	if rt.gw != nil {
+		return rt.gw, &rt
+	}
+	return dst, &rt
+}
+
+// onLink dst 不经网关可达
+func (n *Neighbors) onLink(dst net.IP) bool {
+	hop, _ := n.route(dst)
+	return hop != nil && hop.Equal(dst)
+}
+
+// Resolve 返回发往 dst 的报文的目的 MAC: 组播与广播地址直接映射, 其它地址解析下一跳
+func (n *Neighbors) Resolve(dst net.IP) (net.HardwareAddr, error) {
+	mac, err := n.resolve(normIP(dst), n.cfg.Timeout, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return net.HardwareAddr(mac[:]), nil
+}
+
+// resolve deadline 关闭时返回 os.ErrDeadlineExceeded, done 或 Neighbors 关闭时返回 net.ErrClosed
+func (n *Neighbors) resolve(dst net.IP, timeout time.Duration, deadline, done <-chan struct{}) ([6]byte, error) {
+	if dst == nil {
+		return [6]byte{}, unix.EAFNOSUPPORT
+	}
+	if dst.IsMulticast() {
+		return multicastMAC(dst), nil
+	}
+	// 受限广播不经路由, 即使有默认网关
+	if dst.Equal(net.IPv4bcast) {
+		return broadcastMAC, nil
+	}
+	hop, rt := n.route(dst)
+	if hop == nil {
+		return [6]byte{}, unix.EHOSTUNREACH
+	}
+	if len(hop) == net.IPv4len && rt != nil && rt.gw == nil && isBroadcast(hop, &rt.dst) {
+		return broadcastMAC, nil
+	}
+	mac, ok, update := n.lookup(hop)
+	if ok {
+		return mac, nil
+	}
+	if n.cfg.Send == nil {
+		return mac, errNoNeighbor
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	retry := time.NewTicker(resolveRetry)
+	defer retry.Stop()
+	n.solicit(hop)
+	for {
+		select {
+		case <-update:
+		case <-retry.C:
+			n.solicit(hop)
+		case <-t.C:
+			return mac, errNoNeighbor
+		case <-deadline:
+			return mac, os.ErrDeadlineExceeded
+		case <-done:
+			return mac, net.ErrClosed
+		case <-n.done:
+			return mac, net.ErrClosed
+		}
+		if mac, ok, update = n.lookup(hop); ok {
+			return mac, nil
+		}
+	}
+}
+
+func multicastMAC(ip net.IP) (mac [6]byte) {
+	if len(ip) == net.IPv4len {
+		mac = [6]byte{0x01, 0x00, 0x5e, ip[1] & 0x7f, ip[2], ip[3]}
+	} else {
+		mac = [6]byte{0x33, 0x33, ip[12], ip[13], ip[14], ip[15]}
+	}
+	return mac
+}
+
+// isBroadcast ip 是否为 IPv4 子网 n 的广播地址
+func isBroadcast(ip net.IP, n *net.IPNet) bool {
+	if len(n.Mask) != net.IPv4len || !n.Contains(ip) {
+		return false
+	}
+	if ones, _ := n.Mask.Size(); ones >= 31 {
+		return false
+	}
+	for i, m := range n.Mask {
+		if ip[i]|m != 0xff {
+			return false
+		}
+	}
+	return true
+}
+
+// srcAddr 同族的第一个本机地址, IPv6 优先 link-local
+func (n *Neighbors) srcAddr(v4 bool) []byte {
+	var src []byte
+	for _, a := range n.addrs {
+		if (len(a) == net.IPv4len) != v4 {
+			continue
+		}
+		if v4 || net.IP(a).IsLinkLocalUnicast() {
+			return a
+		}
+		if src == nil {
+			src = a
+		}
+	}
+	return src
+}
+
+// solicit 广播 ARP 请求或向 solicited-node 地址发送 NS
+func (n *Neighbors) solicit(target net.IP) {
+	v4 := len(target) == net.IPv4len
+	src := n.srcAddr(v4)
+	if src == nil {
+		return
+	}
+	// 头部预留以太网+IPv6+ICMPv6, 之后是 ARP 或 NS 的正文
+	const head = packet.EthernetLen + packet.IPv6Len + packet.ICMPLen
+	var frame [head + arpLen]byte
+	b := packet.NewBuffer(frame[:], head, 0)
+	var err error
+	if v4 {
+		var arp [arpLen]byte
+		binary.BigEndian.PutUint16(arp[0:], 1)
+		binary.BigEndian.PutUint16(arp[2:], packet.EtherTypeIPv4)
+		arp[4], arp[5] = 6, 4
+		binary.BigEndian.PutUint16(arp[6:], 1)
+		copy(arp[8:14], n.mac[:])
+		copy(arp[14:18], src)
+		copy(arp[24:28], target)
+		if err = b.Append(arp[:]); err == nil {
+			err = b.PushEthernet(broadcastMAC[:], n.mac[:], packet.EtherTypeARP)
+		}
+	} else {
+		snm := net.IP{0xff, 0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0xff, target[13], target[14], target[15]}
+		var ns [24]byte
+		copy(ns[0:16], target)
+		ns[16], ns[17] = ndpOptSLLA, 1
+		copy(ns[18:24], n.mac[:])
+		dst := multicastMAC(snm)
+		if err = b.Append(ns[:]); err == nil {
+			err = b.PushICMPv6(packet.ICMPv6NeighborSol, 0, 0)
+		}
+		if err == nil {
+			err = b.PushIPv6(src, snm, 0, ndpHopLimit)
+		}
+		if err == nil {
+			err = b.PushEthernet(dst[:], n.mac[:], 0)
+		}
+	}
+	if err == nil {
+		n.cfg.Send(b.Bytes())
+	}
+}
+
+func (n *Neighbors) isLocal(ip []byte) bool {
+	for _, a := range n.addrs {
+		if string(a) == string(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler 包装 HandleRecv 的 handler, 学习经过的 ARP/NDP 报文后交给 next
+func (n *Neighbors) Handler(next func(unix.XDPDesc, []byte) bool) func(unix.XDPDesc, []byte) bool {
+	return func(d unix.XDPDesc, data []byte) bool {
+		n.Input(data)
+		return next(d, data)
+	}
+}
+
+// Input 从收到的帧中学习邻居: 发给本机的 ARP 请求与应答, NA 的目标链路层地址, 发给本机的 NS 的源链路层地址
+func (n *Neighbors) Input(data []byte) {
+	var p packet.Packet
+	if p.Parse(data) != nil {
+		return
+	}
+	switch {
+	case p.EtherType == packet.EtherTypeARP:
+		n.inputARP(&p)
+	case p.L4Proto == packet.IPProtocolICMPv6 && !p.Fragment:
+		n.inputNDP(&p)
+	}
+}
+
+func (n *Neighbors) inputARP(p *packet.Packet) {
+	b := p.Data[p.L3Off:]
+	if len(b) < arpLen || binary.BigEndian.Uint16(b[0:]) != 1 ||
+		binary.BigEndian.Uint16(b[2:]) != packet.EtherTypeIPv4 || b[4] != 6 || b[5] != 4 {
+		return
+	}
+	if n.isLocal(b[24:28]) {
+		n.set(b[14:18], b[8:14], neighLearned)
+	}
+}
+
+func (n *Neighbors) inputNDP(p *packet.Packet) {
+	ip, icmp := p.IPv6(), p.ICMP()
+	if icmp == nil || len(icmp) < 24 || ip.HopLimit() != ndpHopLimit {
+		return
+	}
+	var target []byte
+	var opt byte
+	switch icmp.Type() {
+	case packet.ICMPv6NeighborAdv:
+		target, opt = icmp[8:24], ndpOptTLLA
+	case packet.ICMPv6NeighborSol:
+		if net.IP(ip.Src()).IsUnspecified() || !n.isLocal(icmp[8:24]) {
+			return
+		}
+		target, opt = ip.Src(), ndpOptSLLA
+	default:
+		return
+	}
+	for o := icmp[24:]; len(o) >= 8 && o[1] != 0 && len(o) >= int(o[1])*8; o = o[int(o[1])*8:] {
+		if o[0] == opt {
+			n.set(target, o[2:8], neighLearned)
+			return
+		}
+	}
+}
+
+// sync 读取内核邻居表与 main 路由表, 替换已有的内核条目
+func (n *Neighbors) sync() error {
+	nd := unix.NdMsg{Family: unix.AF_UNSPEC}
+	msgs, err := n.nl.Request(unix.RTM_GETNEIGH, unix.NLM_F_DUMP,
+		(*[unix.SizeofNdMsg]byte)(unsafe.Pointer(&nd))[:])
+	if err != nil {
+		return errors.WithMessage(err, "RTM_GETNEIGH")
+	}
+	rt := unix.RtMsg{Family: unix.AF_UNSPEC}
+	rmsgs, err := n.nl.Request(unix.RTM_GETROUTE, unix.NLM_F_DUMP,
+		(*[unix.SizeofRtMsg]byte)(unsafe.Pointer(&rt))[:])
+	if err != nil {
+		return errors.WithMessage(err, "RTM_GETROUTE")
+	}
+	n.mu.Lock()
+	for k, e := range n.neigh {
+		if e.origin == neighKernel {
+			delete(n.neigh, k)
+		}
+	}
+	routes := n.routes[:0]
+	for _, r := range n.routes {
+		if !r.kernel {
+			routes = append(routes, r)
+		}
+	}
+	n.routes = routes
+	n.mu.Unlock()
+	for _, m := range append(msgs, rmsgs...) {
+		n.handle(m)
+	}
+	return nil
+}
+
+// monitor 处理订阅的更新, 接收缓冲区溢出丢失更新时重新读全表
+func (n *Neighbors) monitor() {
+	defer n.running.Done()
+	for {
+		select {
+		case <-n.done:
+			return
+		default:
+		}
+		fds := []unix.PollFd{{Fd: int32(n.mon.FD()), Events: unix.POLLIN}}
+		if k, _ := unix.Poll(fds, pollTimeout); k <= 0 {
+			continue
+		}
+		msgs, err := n.mon.Recv()
+		if errors.Cause(err) == unix.ENOBUFS {
+			n.sync()
+			continue
+		}
+		for _, m := range msgs {
+			n.handle(m)
+		}
+	}
+}
+
+func (n *Neighbors) handle(m netlink.Message) {
+	switch m.Header.Type {
+	case unix.RTM_NEWNEIGH, unix.RTM_DELNEIGH:
+		n.handleNeigh(m)
+	case unix.RTM_NEWROUTE, unix.RTM_DELROUTE:
+		n.handleRoute(m)
+	}
+}
+
+func (n *Neighbors) handleNeigh(m netlink.Message) {
+	if len(m.Data) < unix.SizeofNdMsg {
+		return
+	}
+	nd := *(*unix.NdMsg)(unsafe.Pointer(&m.Data[0]))
+	if n.cfg.Ifindex != 0 && int(nd.Ifindex) != n.cfg.Ifindex {
+		return
+	}
+	attrs := netlink.ParseAttrs(m.Data[unix.SizeofNdMsg:])
+	ip, mac := normIP(attrs[unix.NDA_DST]), attrs[unix.NDA_LLADDR]
+	if ip == nil {
+		return
+	}
+	const valid = unix.NUD_REACHABLE | unix.NUD_STALE | unix.NUD_DELAY | unix.NUD_PROBE | unix.NUD_PERMANENT | unix.NUD_NOARP
+	if m.Header.Type == unix.RTM_NEWNEIGH && nd.State&valid != 0 && len(mac) == 6 {
+		n.set(ip, mac, neighKernel)
+		return
+	}
+	key := ipKey(ip)
+	n.mu.Lock()
+	if e, ok := n.neigh[key]; ok && e.origin == neighKernel {
+		delete(n.neigh, key)
+	}
+	n.mu.Unlock()
+}
+
+func (n *Neighbors) handleRoute(m netlink.Message) {
+	if len(m.Data) < unix.SizeofRtMsg {
+		return
+	}
+	rtm := *(*unix.RtMsg)(unsafe.Pointer(&m.Data[0]))
+	attrs := netlink.ParseAttrs(m.Data[unix.SizeofRtMsg:])
+	table := uint32(rtm.Table)
+	if _, ok := attrs[unix.RTA_TABLE]; ok {
+		table = netlink.AttrU32(attrs, unix.RTA_TABLE)
+	}
+	if table != unix.RT_TABLE_MAIN || rtm.Type != unix.RTN_UNICAST {
+		return
+	}
+	if n.cfg.Ifindex != 0 && int(netlink.AttrU32(attrs, unix.RTA_OIF)) != n.cfg.Ifindex {
+		return
+	}
+	if _, ok := attrs[unix.RTA_MULTIPATH]; ok {
+		return // 不支持多路径路由
+	}
+	bits := 8 * net.IPv6len
+	if rtm.Family == unix.AF_INET {
+		bits = 8 * net.IPv4len
+	} else if rtm.Family != unix.AF_INET6 {
+		return
+	}
+	r := neighRoute{priority: netlink.AttrU32(attrs, unix.RTA_PRIORITY), kernel: true}
+	r.dst.IP = make(net.IP, bits/8)
+	copy(r.dst.IP, attrs[unix.RTA_DST])
+	r.dst.Mask = net.CIDRMask(int(rtm.Dst_len), bits)
+	if gw := attrs[unix.RTA_GATEWAY]; len(gw) == bits/8 {
+		r.gw = net.IP(append([]byte(nil), gw...))
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for i, o := range n.routes {
+		if o.kernel && o.priority == r.priority && o.dst.String() == r.dst.String() {
+			n.routes = append(n.routes[:i], n.routes[i+1:]...)
+			break
+		}
+	}
+	if m.Header.Type == unix.RTM_NEWROUTE {
+		n.routes = append(n.routes, r)
+	}
+}
+
+// Close 停止订阅内核更新, 正在 Resolve 的调用返回 net.ErrClosed
+func (n *Neighbors) Close() error {
+	n.once.Do(func() {
+		close(n.done)
+		n.running.Wait()
+		if n.mon != nil {
+			n.mon.Close()
+		}
+		if n.nl != nil {
+			n.nl.Close()
+		}
+	})
+	return nil
+}
@@ -0,0 +1,343 @@
+package xdp
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/lixiangzhong/xdp/internal/netlink"
+	"github.com/lixiangzhong/xdp/packet"
+	"github.com/lixiangzhong/xdp/xdpsim"
+	"golang.org/x/sys/unix"
+)
+
+// age 把学习到的邻居的更新时间提前 d
+func age(n *Neighbors, ip net.IP, d time.Duration) {
+	key := ipKey(normIP(ip))
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if e, ok := n.neigh[key]; ok {
+		e.updated = e.updated.Add(-d)
+		n.neigh[key] = e
+	}
+}
+
+// 经 xdpsim 的 socket 主动解析, 对端 peerIP4/peerIP6 应答 ARP 请求与 NS
+func TestNeighborsResolve(t *testing.T) {
+	sent := make(chan []byte, 64)
+	var k *xdpsim.Kernel
+	kcfg := &xdpsim.Config{OnTransmit: func(ifindex, queue int, data []byte) {
+		sent <- data
+		var p packet.Packet
+		if p.Parse(data) != nil {
+			return
+		}
+		if p.EtherType == packet.EtherTypeARP && bytes.Equal(data[p.L3Off+24:p.L3Off+28], peerIP4) {
+			k.Inject(ifindex, queue, arpReply(t))
+		} else if p.L4Proto == packet.IPProtocolICMPv6 && net.IP(p.ICMP()[8:24]).Equal(peerIP6) {
+			k.Inject(ifindex, queue, neighborAdv(t))
+		}
+	}}
+	k, _, s := newSimSocket(t, kcfg, simUmemConfig(64, 32), SocketConfig{RxSize: 32, TxSize: 32, Poll: true})
+	n, err := NewNeighbors(&NeighborConfig{
+		NoKernel: true,
+		Addrs:    []net.IP{localIP4, localIP6},
+		MAC:      localMAC,
+		Send:     func(frame []byte) bool { return s.Write(frame) == 1 },
+		Timeout:  300 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	go s.HandleRecv(n.Handler(func(unix.XDPDesc, []byte) bool { return true }))
+
+	solicits := func() (frames [][]byte) {
+		for {
+			select {
+			case f := <-sent:
+				frames = append(frames, f)
+			default:
+				return frames
+			}
+		}
+	}
+	resolve := func(ip net.IP) {
+		t.Helper()
+		mac, err := n.Resolve(ip)
+		if err != nil || !bytes.Equal(mac, peerMAC) {
+			t.Fatalf("Resolve(%v) = %v, %v", ip, mac, err)
+		}
+	}
+
+	resolve(peerIP4)
+	f := solicits()
+	if len(f) != 1 {
+		t.Fatalf("%d ARP requests", len(f))
+	}
+	arp := f[0][packet.EthernetLen:]
+	if !bytes.Equal(f[0][0:6], broadcastMAC[:]) || !bytes.Equal(f[0][6:12], localMAC) ||
+		!bytes.Equal(arp[8:14], localMAC) || !bytes.Equal(arp[14:18], localIP4) || !bytes.Equal(arp[24:28], peerIP4) {
+		t.Errorf("ARP request % x", f[0])
+	}
+
+	resolve(peerIP6)
+	if f = solicits(); len(f) != 1 {
+		t.Fatalf("%d NS", len(f))
+	}
+	var p packet.Packet
+	if err := p.Parse(f[0]); err != nil {
+		t.Fatal(err)
+	}
+	ip, ns := p.IPv6(), p.ICMP()
+	if !bytes.Equal(f[0][0:6], []byte{0x33, 0x33, 0xff, 0, 0, 2}) || !ip.Dst().Equal(net.ParseIP("ff02::1:ff00:2")) ||
+		!ip.Src().Equal(localIP6) || ip.HopLimit() != ndpHopLimit || ns.Type() != packet.ICMPv6NeighborSol ||
+		!net.IP(ns[8:24]).Equal(peerIP6) || ns[24] != ndpOptSLLA || !bytes.Equal(ns[26:32], localMAC) || !p.ValidL4Checksum() {
+		t.Errorf("NS % x", f[0])
+	}
+
+	// 已解析的地址不再发送
+	resolve(peerIP4)
+	resolve(peerIP6)
+	if f = solicits(); len(f) != 0 {
+		t.Errorf("%d solicitations for resolved neighbors", len(f))
+	}
+
+	// 学习到的邻居过期后重新解析
+	age(n, peerIP4, neighTimeout+time.Second)
+	if _, ok := n.Lookup(peerIP4); ok {
+		t.Error("expired neighbor found")
+	}
+	resolve(peerIP4)
+	if f = solicits(); len(f) != 1 {
+		t.Errorf("%d ARP requests after expiry", len(f))
+	}
+	age(n, peerIP6, neighTimeout-time.Second)
+	if _, ok := n.Lookup(peerIP6); !ok {
+		t.Error("neighbor expired early")
+	}
+
+	// 不应答时每 resolveRetry 重发, 超时后失败
+	start := time.Now()
+	if _, err := n.Resolve(otherIP4); err != errNoNeighbor {
+		t.Errorf("Resolve(%v): %v", otherIP4, err)
+	}
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Errorf("Resolve returned after %v", d)
+	}
+	if f = solicits(); len(f) != 2 {
+		t.Errorf("%d ARP requests in 300ms", len(f))
+	}
+}
+
+func TestNeighborsRoute(t *testing.T) {
+	n, err := NewNeighbors(&NeighborConfig{NoKernel: true, Addrs: []net.IP{localIP4, localIP6}, MAC: localMAC})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	gw := net.IPv4(10, 0, 0, 254).To4()
+	gwMAC := net.HardwareAddr{2, 0, 0, 0, 0, 0xfe}
+	remote := net.IPv4(192, 0, 2, 1)
+
+	// 没有路由时都视为直连
+	if hop := n.NextHop(remote); !hop.Equal(remote) {
+		t.Errorf("NextHop without routes = %v", hop)
+	}
+	n.AddRoute(mustCIDR("10.0.0.0/24"), nil)
+	n.AddRoute(mustCIDR("0.0.0.0/0"), gw)
+	n.AddRoute(mustCIDR("2001:db8::/64"), nil)
+	for _, c := range []struct{ dst, hop net.IP }{
+		{peerIP4, peerIP4},
+		{remote, gw},
+		{peerIP6, peerIP6},
+		{net.ParseIP("2001:db9::1"), nil},
+	} {
+		if hop := n.NextHop(c.dst); !hop.Equal(c.hop) {
+			t.Errorf("NextHop(%v) = %v, want %v", c.dst, hop, c.hop)
+		}
+	}
+
+	for _, c := range []struct {
+		dst net.IP
+		mac net.HardwareAddr
+		err error
+	}{
+		{net.IPv4(224, 1, 2, 3), net.HardwareAddr{0x01, 0x00, 0x5e, 0x01, 0x02, 0x03}, nil},
+		{net.ParseIP("ff02::1:ff00:2"), net.HardwareAddr{0x33, 0x33, 0xff, 0, 0, 2}, nil},
+		{net.IPv4bcast, broadcastMAC[:], nil},
+		{net.IPv4(10, 0, 0, 255), broadcastMAC[:], nil}, // 直连子网的广播地址
+		{peerIP4, nil, errNoNeighbor},                   // Send 为 nil 时不主动解析
+		{remote, nil, errNoNeighbor},
+		{net.ParseIP("2001:db9::1"), nil, unix.EHOSTUNREACH},
+	} {
+		mac, err := n.Resolve(c.dst)
+		if err != c.err || !bytes.Equal(mac, c.mac) {
+			t.Errorf("Resolve(%v) = %v, %v, want %v, %v", c.dst, mac, err, c.mac, c.err)
+		}
+	}
+
+	// 经网关的地址解析为网关的 MAC, 静态邻居不过期也不被学习覆盖
+	n.Add(gw, gwMAC)
+	if mac, err := n.Resolve(remote); err != nil || !bytes.Equal(mac, gwMAC) {
+		t.Errorf("Resolve(%v) = %v, %v", remote, mac, err)
+	}
+	n.set(gw, peerMAC, neighLearned)
+	age(n, gw, 2*neighTimeout)
+	if mac, ok := n.Lookup(gw); !ok || !bytes.Equal(mac, gwMAC) {
+		t.Errorf("static neighbor = %v, %v", mac, ok)
+	}
+}
+
+// Input 只学习发给本机的 ARP 与 NS, 以及 NA
+func TestNeighborsInput(t *testing.T) {
+	n, err := NewNeighbors(&NeighborConfig{NoKernel: true, Addrs: []net.IP{localIP4, localIP6}, MAC: localMAC})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	found := func(ip net.IP) bool {
+		mac, ok := n.Lookup(ip)
+		return ok && bytes.Equal(mac, peerMAC)
+	}
+
+	n.Input(arpRequest(t, otherIP4))
+	n.Input(neighborSol(t, peerIP6, otherIP6, ndpHopLimit))
+	n.Input(neighborSol(t, peerIP6, localIP6, 64)) // 不是链路本地的报文
+	if found(peerIP4) || found(peerIP6) {
+		t.Fatal("learned from frames for another address")
+	}
+	n.Input(arpRequest(t, localIP4))
+	n.Input(neighborSol(t, peerIP6, localIP6, ndpHopLimit))
+	if !found(peerIP4) || !found(peerIP6) {
+		t.Error("not learned from ARP request or NS")
+	}
+
+	n2, _ := NewNeighbors(&NeighborConfig{NoKernel: true, Addrs: []net.IP{localIP4, localIP6}, MAC: localMAC})
+	defer n2.Close()
+	n2.Input(arpReply(t))
+	n2.Input(neighborAdv(t))
+	for _, ip := range []net.IP{peerIP4, peerIP6} {
+		if mac, ok := n2.Lookup(ip); !ok || !bytes.Equal(mac, peerMAC) {
+			t.Errorf("Lookup(%v) = %v, %v after a reply", ip, mac, ok)
+		}
+	}
+}
+
+// Close 时正在解析的调用返回 net.ErrClosed
+func TestNeighborsClose(t *testing.T) {
+	n, err := NewNeighbors(&NeighborConfig{
+		NoKernel: true,
+		Addrs:    []net.IP{localIP4},
+		MAC:      localMAC,
+		Send:     func([]byte) bool { return true },
+		Timeout:  time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := n.Resolve(peerIP4)
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	n.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("Resolve: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Resolve did not return after Close")
+	}
+}
+
+func neighMsg(typ uint16, ifindex int, state uint16, ip net.IP, mac net.HardwareAddr) netlink.Message {
+	nd := unix.NdMsg{Family: unix.AF_INET, Ifindex: int32(ifindex), State: state}
+	if ip.To4() == nil {
+		nd.Family = unix.AF_INET6
+	}
+	data := append([]byte(nil), (*[unix.SizeofNdMsg]byte)(unsafe.Pointer(&nd))[:]...)
+	data = netlink.AppendAttr(data, unix.NDA_DST, normIP(ip))
+	if mac != nil {
+		data = netlink.AppendAttr(data, unix.NDA_LLADDR, mac)
+	}
+	return netlink.Message{Header: unix.NlMsghdr{Type: typ}, Data: data}
+}
+
+func routeMsg(typ uint16, ifindex int, dst *net.IPNet, gw net.IP, table uint8) netlink.Message {
+	ones, _ := dst.Mask.Size()
+	rt := unix.RtMsg{Family: unix.AF_INET, Dst_len: uint8(ones), Table: table, Type: unix.RTN_UNICAST}
+	data := append([]byte(nil), (*[unix.SizeofRtMsg]byte)(unsafe.Pointer(&rt))[:]...)
+	data = netlink.AppendAttr(data, unix.RTA_DST, dst.IP.To4())
+	data = netlink.AppendAttrU32(data, unix.RTA_OIF, uint32(ifindex))
+	if gw != nil {
+		data = netlink.AppendAttr(data, unix.RTA_GATEWAY, gw.To4())
+	}
+	return netlink.Message{Header: unix.NlMsghdr{Type: typ}, Data: data}
+}
+
+// 内核邻居表与路由表的更新, 只接受 Ifindex 网卡的条目
+func TestNeighborsKernel(t *testing.T) {
+	const ifindex = 3
+	n, err := NewNeighbors(&NeighborConfig{Ifindex: ifindex, NoKernel: true, Addrs: []net.IP{localIP4}, MAC: localMAC})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	otherMAC := net.HardwareAddr{2, 0, 0, 0, 0, 9}
+
+	n.handle(neighMsg(unix.RTM_NEWNEIGH, ifindex+1, unix.NUD_REACHABLE, peerIP4, peerMAC))
+	n.handle(neighMsg(unix.RTM_NEWNEIGH, ifindex, unix.NUD_INCOMPLETE, peerIP4, nil))
+	if _, ok := n.Lookup(peerIP4); ok {
+		t.Fatal("neighbor from another interface or incomplete")
+	}
+	n.handle(neighMsg(unix.RTM_NEWNEIGH, ifindex, unix.NUD_STALE, peerIP4, peerMAC))
+	// 内核条目不过期, 也不被学习覆盖
+	n.set(peerIP4, otherMAC, neighLearned)
+	age(n, peerIP4, 2*neighTimeout)
+	if mac, ok := n.Lookup(peerIP4); !ok || !bytes.Equal(mac, peerMAC) {
+		t.Fatalf("kernel neighbor = %v, %v", mac, ok)
+	}
+	n.handle(neighMsg(unix.RTM_NEWNEIGH, ifindex, unix.NUD_FAILED, peerIP4, nil))
+	if _, ok := n.Lookup(peerIP4); ok {
+		t.Error("failed neighbor still found")
+	}
+	n.handle(neighMsg(unix.RTM_NEWNEIGH, ifindex, unix.NUD_PERMANENT, peerIP4, peerMAC))
+	n.handle(neighMsg(unix.RTM_DELNEIGH, ifindex, 0, peerIP4, nil))
+	if _, ok := n.Lookup(peerIP4); ok {
+		t.Error("deleted neighbor still found")
+	}
+	// 删除内核条目不影响静态邻居
+	n.Add(otherIP4, otherMAC)
+	n.handle(neighMsg(unix.RTM_DELNEIGH, ifindex, 0, otherIP4, nil))
+	if _, ok := n.Lookup(otherIP4); !ok {
+		t.Error("static neighbor deleted")
+	}
+
+	gw := net.IPv4(10, 0, 0, 254).To4()
+	remote := net.IPv4(192, 0, 2, 1)
+	n.handle(routeMsg(unix.RTM_NEWROUTE, ifindex, mustCIDR("10.0.0.0/24"), nil, unix.RT_TABLE_MAIN))
+	n.handle(routeMsg(unix.RTM_NEWROUTE, ifindex, mustCIDR("0.0.0.0/0"), gw, unix.RT_TABLE_MAIN))
+	n.handle(routeMsg(unix.RTM_NEWROUTE, ifindex, mustCIDR("192.0.2.0/24"), nil, unix.RT_TABLE_LOCAL))
+	n.handle(routeMsg(unix.RTM_NEWROUTE, ifindex+1, mustCIDR("192.0.2.0/25"), nil, unix.RT_TABLE_MAIN))
+	if hop := n.NextHop(remote); !hop.Equal(gw) {
+		t.Errorf("NextHop(%v) = %v, want %v", remote, hop, gw)
+	}
+	if hop := n.NextHop(peerIP4); !hop.Equal(peerIP4) {
+		t.Errorf("NextHop(%v) = %v", peerIP4, hop)
+	}
+	// 同一条路由的更新替换旧的
+	n.handle(routeMsg(unix.RTM_NEWROUTE, ifindex, mustCIDR("0.0.0.0/0"), otherIP4, unix.RT_TABLE_MAIN))
+	if hop := n.NextHop(remote); !hop.Equal(otherIP4) {
+		t.Errorf("NextHop(%v) = %v after replace", remote, hop)
+	}
+	n.handle(routeMsg(unix.RTM_DELROUTE, ifindex, mustCIDR("0.0.0.0/0"), nil, unix.RT_TABLE_MAIN))
+	if hop := n.NextHop(remote); hop != nil {
+		t.Errorf("NextHop(%v) = %v after delete", remote, hop)
+	}
+}
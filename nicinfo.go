@@ -0,0 +1,176 @@
+package xdp
+
+import (
+	"bytes"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	DUPLEX_HALF    = 0x00
+	DUPLEX_FULL    = 0x01
+	DUPLEX_UNKNOWN = 0xff
+)
+
+type NicInfo struct {
+	Driver          string
+	Version         string
+	FirmwareVersion string
+	BusInfo         string
+	MTU             int
+	Speed           uint32 // Mb/s, 未知时为 0
+	Duplex          uint8  // DUPLEX_HALF DUPLEX_FULL DUPLEX_UNKNOWN
+	Autoneg         bool
+	Carrier         bool // 链路是否 up
+}
+
+// ethtool 对网卡执行一次 SIOCETHTOOL, data 指向 ethtool_* 结构体
+func ethtool(ifname string, data unsafe.Pointer) syscall.Errno {
+	var ifr ifreq
+	errno := ifr.SetIfrn(ifname)
+	if errno != 0 {
+		return errno
+	}
+	ifr.ifru = uintptr(data)
+	fd, err := syscall.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err.(syscall.Errno)
+	}
+	defer syscall.Close(fd)
+	return ioctl(fd, unix.SIOCETHTOOL, uintptr(unsafe.Pointer(&ifr)))
+}
+
+// GetNicInfo 获取驱动信息, MTU, 速率/双工与链路状态
+func GetNicInfo(ifname string) (NicInfo, error) {
+	var info NicInfo
+	var drv ethtooldrvinfo
+	drv.cmd = unix.ETHTOOL_GDRVINFO
+	if errno := ethtool(ifname, unsafe.Pointer(&drv)); errno != 0 {
+		return info, errors.WithMessage(errno, "ETHTOOL_GDRVINFO")
+	}
+	info.Driver = cstring(drv.driver[:])
+	info.Version = cstring(drv.version[:])
+	info.FirmwareVersion = cstring(drv.fwversion[:])
+	info.BusInfo = cstring(drv.businfo[:])
+
+	mtu, err := GetNicMTU(ifname)
+	if err != nil {
+		return info, err
+	}
+	info.MTU = mtu
+
+	info.Duplex = DUPLEX_UNKNOWN
+	ls, errno := getLinkSettings(ifname)
+	if errno != 0 && errno != syscall.EOPNOTSUPP {
+		return info, errors.WithMessage(errno, "ETHTOOL_GLINKSETTINGS")
+	}
+	if errno == 0 {
+		if ls.speed != 0 && ls.speed != 0xffffffff {
+			info.Speed = ls.speed
+		}
+		info.Duplex = ls.duplex
+		info.Autoneg = ls.autoneg != 0
+	}
+
+	carrier, err := getCarrier(ifname)
+	if err != nil {
+		return info, err
+	}
+	info.Carrier = carrier
+	return info, nil
+}
+
+// GetNicMTU SIOCGIFMTU
+func GetNicMTU(ifname string) (int, error) {
+	ifreq, err := unix.NewIfreq(ifname)
+	if err != nil {
+		return 0, err
+	}
+	fd, err := syscall.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer syscall.Close(fd)
+	err = unix.IoctlIfreq(fd, unix.SIOCGIFMTU, ifreq)
+	if err != nil {
+		return 0, errors.WithMessage(err, "SIOCGIFMTU")
+	}
+	return int(ifreq.Uint32()), nil
+}
+
+// getLinkSettings ETHTOOL_GLINKSETTINGS 需两次调用: 第一次由内核返回 -nwords
+func getLinkSettings(ifname string) (*ethtoollinksettings, syscall.Errno) {
+	ls := new(ethtoollinksettings)
+	ls.cmd = unix.ETHTOOL_GLINKSETTINGS
+	if errno := ethtool(ifname, unsafe.Pointer(ls)); errno != 0 {
+		return nil, errno
+	}
+	if ls.linkmodemasksnwords >= 0 {
+		return nil, syscall.EOPNOTSUPP
+	}
+	nwords := -ls.linkmodemasksnwords
+	*ls = ethtoollinksettings{}
+	ls.cmd = unix.ETHTOOL_GLINKSETTINGS
+	ls.linkmodemasksnwords = nwords
+	if errno := ethtool(ifname, unsafe.Pointer(ls)); errno != 0 {
+		return nil, errno
+	}
+	return ls, 0
+}
+
+// getCarrier 优先 ETHTOOL_GLINK, 不支持时看 IFF_RUNNING
+func getCarrier(ifname string) (bool, error) {
+	v := ethtoolvalue{cmd: unix.ETHTOOL_GLINK}
+	errno := ethtool(ifname, unsafe.Pointer(&v))
+	if errno == 0 {
+		return v.data != 0, nil
+	}
+	if errno != syscall.EOPNOTSUPP {
+		return false, errors.WithMessage(errno, "ETHTOOL_GLINK")
+	}
+	ifreq, err := unix.NewIfreq(ifname)
+	if err != nil {
+		return false, err
+	}
+	fd, err := syscall.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return false, err
+	}
+	defer syscall.Close(fd)
+	err = unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifreq)
+	if err != nil {
+		return false, errors.WithMessage(err, "SIOCGIFFLAGS")
+	}
+	return ifreq.Uint16()&unix.IFF_RUNNING != 0, nil
+}
+
+// checkMTU 未开启多 buffer 时, 一个 frame 必须放得下 MTU 大小的以太网帧. 只约束 RX, TX 的帧由调用者构造
+func checkMTU(ifindex int, umem *Umem, cfg *SocketConfig) error {
+	if cfg.BindFlags&XDP_USE_SG != 0 {
+		return nil
+	}
+	iface, err := net.InterfaceByIndex(ifindex)
+	if err != nil {
+		return err
+	}
+	mtu, err := GetNicMTU(iface.Name)
+	if err != nil {
+		return err
+	}
+	room := int(_DEFAULT_FRAME_SIZE) - XDP_PACKET_HEADROOM - int(umem.config.FrameHeadroom)
+	if mtu+14+4 > room {
+		return errors.Errorf("mtu %d of %s exceeds frame room %d, see SocketConfig.NoMTUCheck", mtu, iface.Name, room)
+	}
+	return nil
+}
+
+func cstring(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
@@ -0,0 +1,144 @@
+package xdp
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	_ETH_SS_STATS     = 1
+	_ETH_GSTRING_LEN  = 32
+	_ETHTOOL_HDR_SIZE = 12 // ethtool_gstrings 中 data 之前的部分
+)
+
+// ethtool_sset_info, 只查询一个 string set 所以 data 只有一个元素
+type ethtoolssetinfo struct {
+	cmd      uint32
+	reserved uint32
+	ssetmask uint64
+	data     uint32
+}
+
+// NicStats ethtool -S 的结果, 计数器名称 -> 值
+type NicStats map[string]uint64
+
+// GetNicStats 依次执行 ETHTOOL_GSSET_INFO, ETHTOOL_GSTRINGS, ETHTOOL_GSTATS
+func GetNicStats(ifname string) (NicStats, error) {
+	info := ethtoolssetinfo{
+		cmd:      unix.ETHTOOL_GSSET_INFO,
+		ssetmask: 1 << _ETH_SS_STATS,
+	}
+	if errno := ethtool(ifname, unsafe.Pointer(&info)); errno != 0 {
+		return nil, errors.WithMessage(errno, "ETHTOOL_GSSET_INFO")
+	}
+	if info.ssetmask == 0 || info.data == 0 {
+		return NicStats{}, nil
+	}
+	n := info.data
+
+	// ethtool_gstrings: cmd, string_set, len, data[len*ETH_GSTRING_LEN]
+	strs := make([]uint32, (_ETHTOOL_HDR_SIZE+int(n)*_ETH_GSTRING_LEN+3)/4)
+	strs[0] = unix.ETHTOOL_GSTRINGS
+	strs[1] = _ETH_SS_STATS
+	strs[2] = n
+	if errno := ethtool(ifname, unsafe.Pointer(&strs[0])); errno != 0 {
+		return nil, errors.WithMessage(errno, "ETHTOOL_GSTRINGS")
+	}
+	names := unsafe.Slice((*byte)(unsafe.Pointer(&strs[0])), len(strs)*4)[_ETHTOOL_HDR_SIZE:]
+
+	// ethtool_stats: cmd, n_stats, data[n_stats]uint64
+	vals := make([]uint64, 1+n)
+	*(*uint32)(unsafe.Pointer(&vals[0])) = unix.ETHTOOL_GSTATS
+	*(*uint32)(unsafe.Add(unsafe.Pointer(&vals[0]), 4)) = n
+	if errno := ethtool(ifname, unsafe.Pointer(&vals[0])); errno != 0 {
+		return nil, errors.WithMessage(errno, "ETHTOOL_GSTATS")
+	}
+
+	stats := make(NicStats, n)
+	for i := uint32(0); i < n; i++ {
+		name := cstring(names[i*_ETH_GSTRING_LEN : (i+1)*_ETH_GSTRING_LEN])
+		stats[name] = vals[1+i]
+	}
+	return stats, nil
+}
+
+// 各驱动的队列计数器命名不同, 例如:
+//
+//	mlx5: rx0_xdp_drop   i40e: rx-0.packets   ice/virtio/veth: rx_queue_0_xdp_drops
+//	ena: queue_0_rx_cnt  bnxt: [0]: rx_ucast_packets
+//
+// 队列号只认紧跟在 queue_ 或 rx/tx/ch/xdp/xsk 之后的数字, 不把 rx_64_to_127_bytes 等长度区间计数器当作队列
+var (
+	queueStatRe   = regexp.MustCompile(`^((?:[a-z]+_)*queue)_(\d+)_(.+)$`)
+	channelStatRe = regexp.MustCompile(`^(rx|tx|ch|xdp|xsk)-?(\d+)[_.](.+)$`)
+	bnxtStatRe    = regexp.MustCompile(`^\[(\d+)\]:\s*(.+)$`)
+)
+
+// splitQueueStat 拆出计数器名中的队列号, 返回去掉队列号后的名称
+func splitQueueStat(name string) (string, int, bool) {
+	if m := bnxtStatRe.FindStringSubmatch(name); m != nil {
+		q, _ := strconv.Atoi(m[1])
+		return m[2], q, true
+	}
+	m := queueStatRe.FindStringSubmatch(name)
+	if m == nil {
+		m = channelStatRe.FindStringSubmatch(name)
+	}
+	if m != nil {
+		q, _ := strconv.Atoi(m[2])
+		return m[1] + "_" + m[3], q, true
+	}
+	return "", 0, false
+}
+
+// Queue 返回指定队列的计数器, 名称中的队列号被去掉, 如 rx_queue_3_xdp_drops -> rx_queue_xdp_drops.
+// 依赖计数器命名, 不同驱动可能有误判
+func (s NicStats) Queue(queue int) NicStats {
+	out := make(NicStats)
+	for name, v := range s {
+		key, q, ok := splitQueueStat(name)
+		if ok && q == queue {
+			out[key] = v
+		}
+	}
+	return out
+}
+
+// XDP 返回名称中含 xdp 或 xsk 的计数器
+func (s NicStats) XDP() NicStats {
+	out := make(NicStats)
+	for name, v := range s {
+		lower := strings.ToLower(name)
+		if strings.Contains(lower, "xdp") || strings.Contains(lower, "xsk") {
+			out[name] = v
+		}
+	}
+	return out
+}
+
+// QueueXDP 指定队列上的 XDP/XSK 计数器
+func (s NicStats) QueueXDP(queue int) NicStats {
+	return s.Queue(queue).XDP()
+}
+
+// Missed 网卡层面的丢包计数器(rx_missed, rx_dropped 等), AF_XDP 统计看不到这部分.
+// 许多驱动的 rx_dropped 已包含 missed, 各计数器可能重叠, 不宜直接相加
+func (s NicStats) Missed() NicStats {
+	out := make(NicStats)
+	for name, v := range s {
+		if _, _, ok := splitQueueStat(name); ok {
+			continue
+		}
+		lower := strings.ToLower(name)
+		if strings.Contains(lower, "missed") || strings.Contains(lower, "rx_dropped") ||
+			strings.Contains(lower, "rx_discards") || strings.Contains(lower, "no_buffer") {
+			out[name] = v
+		}
+	}
+	return out
+}
@@ -0,0 +1,81 @@
+package xdp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitQueueStat(t *testing.T) {
+	tests := []struct {
+		name  string
+		key   string // 为空时不应识别为队列计数器
+		queue int
+	}{
+		// mlx5
+		{"rx0_xdp_drop", "rx_xdp_drop", 0},
+		{"rx12_xsk_buff_alloc_err", "rx_xsk_buff_alloc_err", 12},
+		{"tx3_xdp_xmit", "tx_xdp_xmit", 3},
+		{"ch5_poll", "ch_poll", 5},
+		{"xsk1_rx_packets", "xsk_rx_packets", 1},
+		// i40e, ice
+		{"rx-0.packets", "rx_packets", 0},
+		{"tx-15.bytes", "tx_bytes", 15},
+		// ice, virtio, veth
+		{"rx_queue_0_xdp_drops", "rx_queue_xdp_drops", 0},
+		{"tx_queue_7_xdp_tx", "tx_queue_xdp_tx", 7},
+		{"rx_queue_3_packets", "rx_queue_packets", 3},
+		// ena
+		{"queue_0_rx_cnt", "queue_rx_cnt", 0},
+		{"queue_2_tx_bytes", "queue_tx_bytes", 2},
+		// bnxt
+		{"[0]: rx_ucast_packets", "rx_ucast_packets", 0},
+		{"[11]:tx_bytes", "tx_bytes", 11},
+
+		// 长度区间与其它不含队列号的计数器
+		{"rx_64_to_127_bytes", "", 0},
+		{"tx_1024_to_1518_bytes", "", 0},
+		{"rx_size_64", "", 0},
+		{"port.rx_size_127", "", 0},
+		{"rx_packets", "", 0},
+		{"rx_xdp_drop", "", 0},
+		{"rx_queue_full", "", 0},
+		{"rx0", "", 0},
+		{"rx-0", "", 0},
+		{"vport_rx_1_packets", "", 0},
+		{"veth_rx_queue", "", 0},
+		{"[x]: rx_bytes", "", 0},
+	}
+	for _, tt := range tests {
+		key, q, ok := splitQueueStat(tt.name)
+		if tt.key == "" {
+			if ok {
+				t.Errorf("%q: queue %d %q, want no queue", tt.name, q, key)
+			}
+			continue
+		}
+		if !ok || key != tt.key || q != tt.queue {
+			t.Errorf("%q: %q %d %v, want %q %d", tt.name, key, q, ok, tt.key, tt.queue)
+		}
+	}
+}
+
+func TestNicStatsQueue(t *testing.T) {
+	s := NicStats{
+		"rx_queue_0_xdp_drops": 1,
+		"rx_queue_1_xdp_drops": 2,
+		"rx_queue_1_packets":   3,
+		"rx_64_to_127_bytes":   4,
+		"rx_missed_errors":     5,
+		"rx_dropped":           6,
+		"rx1_xsk_drop":         7,
+	}
+	if got, want := s.Queue(1), (NicStats{"rx_queue_xdp_drops": 2, "rx_queue_packets": 3, "rx_xsk_drop": 7}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Queue(1) = %v, want %v", got, want)
+	}
+	if got, want := s.QueueXDP(1), (NicStats{"rx_queue_xdp_drops": 2, "rx_xsk_drop": 7}); !reflect.DeepEqual(got, want) {
+		t.Errorf("QueueXDP(1) = %v, want %v", got, want)
+	}
+	if got, want := s.Missed(), (NicStats{"rx_missed_errors": 5, "rx_dropped": 6}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Missed() = %v, want %v", got, want)
+	}
+}
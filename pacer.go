@@ -0,0 +1,277 @@
+package xdp
+
+import (
+	"math"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// PacerConfig PPS 与 BPS 都为 0 时不限速
+type PacerConfig struct {
+	PPS      float64 // 包速率上限
+	BPS      float64 // 比特率上限, 按帧长加 Overhead 计算
+	Overhead int     // 每帧额外计入 BPS 的字节数, 如以太网前导码+帧间隔+FCS 为 24
+
+	// Burst 空闲后允许连续发送的包数, 也是一次 Write 到 TX ring 的最大批量, 默认 16.
+	// BurstBytes BPS 的桶容量, 默认 Burst 个 1514 字节的帧
+	Burst      int
+	BurstBytes int
+
+	// LaunchTime 为 true 时 WriteDescs 不在用户态等到计划时间, 而是用 TX metadata 给每帧设置发送时间 (CLOCK_TAI),
+	// 最多提前 LaunchLead (默认 1ms) 写入 TX ring, 由网卡按时发送. 需要 UmemConfig.TxMetadataLen >= 24,
+	// 网卡支持 launch time 且 PHC 与 CLOCK_TAI 同步. 不限速时不设置, Write 仍在用户态等待
+	LaunchTime bool
+	LaunchLead time.Duration
+}
+
+const (
+	defaultPacerBurst = 16
+	defaultLaunchLead = time.Millisecond
+	pacerMaxFrame     = 1514
+	pacerSpan         = 50 * time.Microsecond  // 一批帧最多覆盖的计划发送时间, 限制批量带来的抖动
+	pacerSpin         = 100 * time.Microsecond // 剩余等待时间小于此值时忙等, sleep 的精度不够
+)
+
+type PacerStats struct {
+	Packets uint64
+	Bytes   uint64
+	Elapsed time.Duration // NewPacer 起的时间
+
+	PPS, BPS             float64 // 实际速率, BPS 含 Overhead
+	TargetPPS, TargetBPS float64
+
+	MaxLate time.Duration // 一批帧实际写入 TX ring 晚于计划时间 (LaunchTime 时为计划时间前 LaunchLead) 的最大值
+}
+
+// Pacer 在 Socket 的 Write/WriteDesc 前按令牌桶限速: 包与字节各一个 GCRA 桶, 帧按计划时间分成小批写入 TX ring.
+// 不可并发使用
+type Pacer struct {
+	sock *Socket
+	cfg  PacerConfig
+
+	// 以下时间均为相对 start 的纳秒
+	pktT, pktTau    float64   // 每包间隔与容差
+	byteT, byteTau  float64   // 每字节间隔与容差
+	pktTAT, byteTAT float64   // 下一个帧的理论发送时间
+	due             []float64 // group 取出的每帧的计划发送时间
+
+	start   time.Time
+	taiBase int64 // start 时的 CLOCK_TAI
+	packets uint64
+	bytes   uint64
+	maxLate int64
+
+	// 测试时替换为假时钟
+	elapsed func() time.Duration
+	wait    func(due float64) float64
+}
+
+func NewPacer(s *Socket, cfg *PacerConfig) (*Pacer, error) {
+	if s.tx == nil {
+		return nil, errors.New("pacer: socket has no TX ring")
+	}
+	p := &Pacer{sock: s}
+	if cfg != nil {
+		p.cfg = *cfg
+	}
+	c := &p.cfg
+	if c.PPS < 0 || c.BPS < 0 || c.Overhead < 0 {
+		return nil, errors.Errorf("pacer: bad rate %v pps %v bps", c.PPS, c.BPS)
+	}
+	if c.Burst <= 0 {
+		c.Burst = defaultPacerBurst
+	}
+	if c.BurstBytes <= 0 {
+		c.BurstBytes = c.Burst * (pacerMaxFrame + c.Overhead)
+	}
+	if c.LaunchTime {
+		if n := s.umem.config.TxMetadataLen; n < txMetaLaunchLen {
+			return nil, errors.Errorf("pacer: launch time requires TxMetadataLen >= %d, have %d", txMetaLaunchLen, n)
+		}
+		if c.LaunchLead <= 0 {
+			c.LaunchLead = defaultLaunchLead
+		}
+	}
+	if c.PPS > 0 {
+		p.pktT = 1e9 / c.PPS
+		p.pktTau = float64(c.Burst-1) * p.pktT
+	}
+	if c.BPS > 0 {
+		p.byteT = 8e9 / c.BPS
+		p.byteTau = float64(c.BurstBytes) * p.byteT
+	}
+	p.due = make([]float64, 0, c.Burst)
+	// 先取 start, 换算出的发送时间只会偏晚
+	p.start = time.Now()
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_TAI, &ts); err != nil {
+		return nil, errors.WithMessage(err, "pacer: clock_gettime")
+	}
+	p.taiBase = ts.Nano()
+	p.elapsed = func() time.Duration { return time.Since(p.start) }
+	p.wait = p.sleep
+	return p, nil
+}
+
+func (p *Pacer) now() float64 {
+	return float64(p.elapsed())
+}
+
+func (p *Pacer) cost(size int) float64 {
+	return float64(size+p.cfg.Overhead) * p.byteT
+}
+
+// Write 按速率发送 bs, 等待到期后写入 TX ring. 返回已发送的个数, TX ring 或 frame 不足时提前返回
+func (p *Pacer) Write(bs ...[]byte) uint32 {
+	return p.pace(len(bs), func(i int) int { return len(bs[i]) }, func(lo, hi int) uint32 {
+		return p.sock.Write(bs[lo:hi]...)
+	}, nil)
+}
+
+// WriteDescs 同 Write, 未发送的 desc 仍归调用者. LaunchTime 时在 ds 上设置 TX metadata,
+// 保留已用 SetTxMetadata 写入的其它请求; desc 的数据之前没有 metadata 的空间时在此停止
+func (p *Pacer) WriteDescs(ds ...unix.XDPDesc) uint32 {
+	var stamp func(i int, due float64) bool
+	if p.cfg.LaunchTime {
+		stamp = func(i int, due float64) bool {
+			return p.sock.umem.setLaunchTime(&ds[i], uint64(p.taiBase+int64(due))) == nil
+		}
+	}
+	return p.pace(len(ds), func(i int) int { return int(ds[i].Len) }, func(lo, hi int) uint32 {
+		return p.sock.WriteDescs(ds[lo:hi]...)
+	}, stamp)
+}
+
+// WriteDesc 同 Socket.WriteDesc, TX ring 满时回收 frame
+func (p *Pacer) WriteDesc(d unix.XDPDesc) {
+	if p.WriteDescs(d) == 0 {
+		p.sock.umem.putFrame(d.Addr)
+	}
+}
+
+// pace stamp 非 nil 时只等到计划时间前 LaunchLead, 由 stamp 给每帧设置计划发送时间, 失败时在此帧停止
+func (p *Pacer) pace(n int, size func(int) int, send func(lo, hi int) uint32, stamp func(i int, due float64) bool) uint32 {
+	if p.pktT == 0 && p.byteT == 0 {
+		sent := int(send(0, n))
+		p.account(0, sent, size)
+		return uint32(sent)
+	}
+	sent := 0
+	for sent < n {
+		k, due := p.group(sent, n, size)
+		if stamp != nil {
+			due -= float64(p.cfg.LaunchLead)
+		}
+		now := p.now()
+		if due > now {
+			now = p.wait(due)
+			if late := int64(now - due); late > atomic.LoadInt64(&p.maxLate) {
+				atomic.StoreInt64(&p.maxLate, late)
+			}
+		}
+		if stamp != nil {
+			for i := 0; i < k; i++ {
+				if !stamp(sent+i, math.Max(p.due[i], now)) {
+					k = i
+					break
+				}
+			}
+			if k == 0 {
+				break
+			}
+		}
+		p.pktTAT = math.Max(p.pktTAT, now)
+		p.byteTAT = math.Max(p.byteTAT, now)
+		var costs float64
+		for i := sent; i < sent+k; i++ {
+			costs += p.cost(size(i))
+		}
+		p.pktTAT += float64(k) * p.pktT
+		p.byteTAT += costs
+		m := int(send(sent, sent+k))
+		p.account(sent, sent+m, size)
+		// 未发送的帧退回令牌
+		for i := sent + m; i < sent+k; i++ {
+			p.pktTAT -= p.pktT
+			p.byteTAT -= p.cost(size(i))
+		}
+		sent += m
+		if m < k {
+			break
+		}
+	}
+	return uint32(sent)
+}
+
+// group 从 lo 开始取一批帧, 返回个数与最后一帧的计划发送时间, 每帧的计划发送时间存入 p.due.
+// 同一时刻发送时第 j 帧须满足 t >= tat+j*T-tau, 字节桶计入第 j 帧本身的开销, 连续发送的字节数不超过 BurstBytes.
+// 批次不超过 Burst 个, 覆盖的计划时间不超过 pacerSpan
+func (p *Pacer) group(lo, hi int, size func(int) int) (int, float64) {
+	now := p.now()
+	pkt := math.Max(p.pktTAT, now) - p.pktTau
+	byt := math.Max(p.byteTAT, now) - p.byteTau
+	var first, due float64
+	k := 0
+	p.due = p.due[:0]
+	for lo+k < hi && k < p.cfg.Burst {
+		c := p.cost(size(lo + k))
+		d := math.Max(math.Max(pkt, byt+c), now)
+		if k == 0 {
+			first = d
+		} else if d > first+float64(pacerSpan) {
+			break
+		}
+		due = math.Max(due, d)
+		p.due = append(p.due, due)
+		pkt += p.pktT
+		byt += c
+		k++
+	}
+	return k, due
+}
+
+// sleep 等到 due, 返回当时的时间. 最后 pacerSpin 忙等
+func (p *Pacer) sleep(due float64) float64 {
+	for {
+		now := p.now()
+		left := time.Duration(due - now)
+		if left <= 0 {
+			return now
+		}
+		if left > pacerSpin {
+			time.Sleep(left - pacerSpin)
+		} else {
+			runtime.Gosched()
+		}
+	}
+}
+
+func (p *Pacer) account(lo, hi int, size func(int) int) {
+	var bytes uint64
+	for i := lo; i < hi; i++ {
+		bytes += uint64(size(i))
+	}
+	atomic.AddUint64(&p.packets, uint64(hi-lo))
+	atomic.AddUint64(&p.bytes, bytes)
+}
+
+// Stats 可在其他 goroutine 中调用
+func (p *Pacer) Stats() PacerStats {
+	st := PacerStats{
+		Packets:   atomic.LoadUint64(&p.packets),
+		Bytes:     atomic.LoadUint64(&p.bytes),
+		Elapsed:   p.elapsed(),
+		TargetPPS: p.cfg.PPS,
+		TargetBPS: p.cfg.BPS,
+		MaxLate:   time.Duration(atomic.LoadInt64(&p.maxLate)),
+	}
+	if secs := st.Elapsed.Seconds(); secs > 0 {
+		st.PPS = float64(st.Packets) / secs
+		st.BPS = float64(st.Bytes+st.Packets*uint64(p.cfg.Overhead)) * 8 / secs
+	}
+	return st
+}
@@ -0,0 +1,211 @@
+package xdp
+
+import (
+	"encoding/binary"
+	"math"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lixiangzhong/xdp/xdpsim"
+	"golang.org/x/sys/unix"
+)
+
+// LaunchTime 时 WriteDescs 不等待, 每帧的发送时间按速率递增, 保留已有的 metadata 请求
+func TestPacerLaunchTime(t *testing.T) {
+	ucfg := simUmemConfig(16, 8)
+	ucfg.TxMetadataLen = 24
+	// completion 延迟使 metadata 在检查前不被回收
+	_, u, s := newSimSocket(t, &xdpsim.Config{TxDelay: time.Minute}, ucfg, SocketConfig{RxSize: 8, TxSize: 8})
+	const (
+		pps = 100
+		n   = 5
+	)
+	p, err := NewPacer(s, &PacerConfig{PPS: pps, Burst: 1, LaunchTime: true, LaunchLead: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ds []unix.XDPDesc
+	for i := 0; i < n; i++ {
+		b, ok := u.AllocFrame()
+		if !ok {
+			t.Fatal("AllocFrame failed")
+		}
+		b.Append(simFrame(i, 60))
+		ds = append(ds, u.BufferDesc(b))
+	}
+	if err := u.SetTxMetadata(&ds[0], TxMetadata{Timestamp: true}); err != nil {
+		t.Fatal(err)
+	}
+	var ts unix.Timespec
+	unix.ClockGettime(unix.CLOCK_TAI, &ts)
+	start := time.Now()
+	if sent := p.WriteDescs(ds...); sent != n {
+		t.Fatalf("WriteDescs = %d, want %d", sent, n)
+	}
+	if d := time.Since(start); d > (n-1)*time.Second/pps/2 {
+		t.Errorf("WriteDescs waited %v", d)
+	}
+	var prev uint64
+	for i, d := range ds {
+		if d.Options&XDP_TX_METADATA == 0 {
+			t.Fatalf("frame %d: no XDP_TX_METADATA", i)
+		}
+		b := u.data[d.Addr-24 : d.Addr]
+		flags, launch := binary.LittleEndian.Uint64(b), binary.LittleEndian.Uint64(b[16:])
+		if flags&txmdLaunchTime == 0 || (i == 0) != (flags&txmdTimestamp != 0) {
+			t.Errorf("frame %d: flags %#x", i, flags)
+		}
+		if i == 0 {
+			if diff := int64(launch) - ts.Nano(); diff < 0 || diff > int64(time.Second) {
+				t.Errorf("frame 0: launch time %v from now", time.Duration(diff))
+			}
+		} else if gap := launch - prev; gap != uint64(time.Second/pps) {
+			t.Errorf("frame %d: launch %v after previous, want %v", i, time.Duration(gap), time.Second/pps)
+		}
+		prev = launch
+	}
+}
+
+func TestPacerLaunchTimeNeedsMetadata(t *testing.T) {
+	ucfg := simUmemConfig(16, 8)
+	ucfg.TxMetadataLen = 16
+	_, _, s := newSimSocket(t, nil, ucfg, SocketConfig{RxSize: 8, TxSize: 8})
+	if _, err := NewPacer(s, &PacerConfig{PPS: 100, LaunchTime: true}); err == nil {
+		t.Fatal("NewPacer succeeded with TxMetadataLen 16")
+	}
+}
+
+// fakeClock 让 p 使用假时钟, 等待时直接前进到计划时间. check 在每次等待前调用
+func fakeClock(p *Pacer, check func(now time.Duration)) *time.Duration {
+	now := new(time.Duration)
+	p.elapsed = func() time.Duration { return *now }
+	p.wait = func(due float64) float64 {
+		if check != nil {
+			check(*now)
+		}
+		if d := time.Duration(math.Ceil(due)); d > *now {
+			*now = d
+		}
+		return float64(*now)
+	}
+	return now
+}
+
+// pacerSend 经 p 发送所有帧, frame 不足时等待 completion
+func pacerSend(t *testing.T, p *Pacer, frames [][]byte) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for sent := 0; sent < len(frames); {
+		n := int(p.Write(frames[sent:]...))
+		sent += n
+		if n == 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("sent %d of %d frames", sent, len(frames))
+			}
+			time.Sleep(100 * time.Microsecond)
+		}
+	}
+}
+
+func pacerFrames(n, size int) [][]byte {
+	frames := make([][]byte, n)
+	for i := range frames {
+		frames[i] = simFrame(i, size)
+	}
+	return frames
+}
+
+func TestPacerRate(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  PacerConfig
+		n    int
+		size int
+		pps  float64 // 期望的包速率
+	}{
+		{"pps", PacerConfig{PPS: 1e5}, 10000, 60, 1e5},
+		// BurstBytes 较小, 初始突发对平均速率的影响可忽略
+		{"bps", PacerConfig{BPS: 1e8, BurstBytes: 4000}, 2000, 1000, 1e8 / 8 / 1000},
+		{"bps with overhead", PacerConfig{BPS: 1e8, Overhead: 24, BurstBytes: 4000}, 2000, 1000, 1e8 / 8 / 1024},
+		{"pps below bps", PacerConfig{PPS: 5000, BPS: 1e8, Overhead: 24}, 2000, 1000, 5000},
+		{"bps below pps", PacerConfig{PPS: 1e6, BPS: 1e8, Burst: 64, BurstBytes: 4000}, 2000, 1000, 1e8 / 8 / 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, s := newSimSocket(t, nil, simUmemConfig(256, 64), SocketConfig{RxSize: 64, TxSize: 128})
+			p, err := NewPacer(s, &tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := p.cfg
+			// 任何时刻发送的包数与字节数 (含 Overhead) 都不超过桶容量加上按速率累积的令牌
+			fakeClock(p, func(now time.Duration) {
+				pkts := atomic.LoadUint64(&p.packets)
+				wire := float64(atomic.LoadUint64(&p.bytes) + pkts*uint64(c.Overhead))
+				if c.PPS > 0 && float64(pkts) > float64(c.Burst)+c.PPS*now.Seconds()+1e-6 {
+					t.Fatalf("%d packets at %v", pkts, now)
+				}
+				if c.BPS > 0 && wire > float64(c.BurstBytes)+c.BPS/8*now.Seconds()+1e-3 {
+					t.Fatalf("%.0f bytes at %v", wire, now)
+				}
+			})
+			pacerSend(t, p, pacerFrames(tt.n, tt.size))
+			st := p.Stats()
+			if st.Packets != uint64(tt.n) || st.Bytes != uint64(tt.n*tt.size) {
+				t.Errorf("Stats %d packets %d bytes", st.Packets, st.Bytes)
+			}
+			if math.Abs(st.PPS/tt.pps-1) > 0.01 {
+				t.Errorf("%.0f pps, want %.0f", st.PPS, tt.pps)
+			}
+			wantBPS := tt.pps * float64(tt.size+c.Overhead) * 8
+			if math.Abs(st.BPS/wantBPS-1) > 0.01 {
+				t.Errorf("%.0f bps, want %.0f", st.BPS, wantBPS)
+			}
+			if c.BPS > 0 && st.BPS > c.BPS*1.01 {
+				t.Errorf("%.0f bps above target %.0f", st.BPS, c.BPS)
+			}
+			if st.TargetPPS != tt.cfg.PPS || st.TargetBPS != tt.cfg.BPS || st.MaxLate != 0 {
+				t.Errorf("Stats %+v", st)
+			}
+		})
+	}
+}
+
+// 空闲后可立即连续发送 Burst 个包或 BurstBytes 字节, 之后按速率发送
+func TestPacerBurst(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   PacerConfig
+		size  int
+		burst int           // 不等待即可发送的帧数
+		next  time.Duration // 下一帧的等待时间
+	}{
+		{"packets", PacerConfig{PPS: 1000, Burst: 8}, 60, 8, time.Millisecond},
+		{"bytes", PacerConfig{BPS: 8e6, BurstBytes: 3000}, 1000, 3, time.Millisecond},
+		{"bytes with overhead", PacerConfig{BPS: 8e6, BurstBytes: 3000, Overhead: 500}, 1000, 2, 1500 * time.Microsecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, s := newSimSocket(t, nil, simUmemConfig(64, 16), SocketConfig{RxSize: 16, TxSize: 32})
+			p, err := NewPacer(s, &tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			now := fakeClock(p, nil)
+			for round := 0; round < 2; round++ {
+				start := *now
+				pacerSend(t, p, pacerFrames(tt.burst, tt.size))
+				if *now != start {
+					t.Fatalf("round %d: burst of %d waited %v", round, tt.burst, *now-start)
+				}
+				pacerSend(t, p, pacerFrames(1, tt.size))
+				if d := *now - start; d != tt.next {
+					t.Fatalf("round %d: frame after burst waited %v, want %v", round, d, tt.next)
+				}
+				// 空闲足够久后桶重新装满
+				*now += time.Second
+			}
+		})
+	}
+}
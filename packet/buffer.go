@@ -0,0 +1,282 @@
+package packet
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+var ErrNoRoom = errors.New("packet: no room in frame")
+
+// Buffer frame 上的一段数据 [head, tail), 头部留有 headroom, 可以原地压入/弹出协议头.
+// 构造报文时先写 payload, 再由内向外依次 Push 各层头部, 长度与校验和自动填充
+type Buffer struct {
+	frame     []byte
+	head      int
+	tail      int
+	etherType uint16 // 最近压入的 L3 对应的 ethertype
+	proto     uint8  // 最近压入的 L4 协议号
+}
+
+// NewBuffer frame 为整个 umem frame, 数据从 head 开始, 长度 length
+func NewBuffer(frame []byte, head, length int) Buffer {
+	return Buffer{frame: frame, head: head, tail: head + length}
+}
+
+func (b *Buffer) Bytes() []byte { return b.frame[b.head:b.tail] }
+func (b *Buffer) Frame() []byte { return b.frame }
+func (b *Buffer) Len() int      { return b.tail - b.head }
+func (b *Buffer) Headroom() int { return b.head }
+func (b *Buffer) Tailroom() int { return len(b.frame) - b.tail }
+
+// Push 在数据前扩展 n 字节并返回这部分
+func (b *Buffer) Push(n int) ([]byte, error) {
+	if n > b.head {
+		return nil, ErrNoRoom
+	}
+	b.head -= n
+	return b.frame[b.head : b.head+n], nil
+}
+
+// Pull 去掉数据前 n 字节并返回这部分
+func (b *Buffer) Pull(n int) ([]byte, error) {
+	if n > b.Len() {
+		return nil, ErrTruncated
+	}
+	b.head += n
+	return b.frame[b.head-n : b.head], nil
+}
+
+// Extend 在数据后扩展 n 字节并返回这部分
+func (b *Buffer) Extend(n int) ([]byte, error) {
+	if n > b.Tailroom() {
+		return nil, ErrNoRoom
+	}
+	b.tail += n
+	return b.frame[b.tail-n : b.tail], nil
+}
+
+// Append 在数据后追加 p
+func (b *Buffer) Append(p []byte) error {
+	dst, err := b.Extend(len(p))
+	if err != nil {
+		return err
+	}
+	copy(dst, p)
+	return nil
+}
+
+// Trim 截断到 n 字节
+func (b *Buffer) Trim(n int) {
+	if n < b.Len() {
+		b.tail = b.head + n
+	}
+}
+
+// PushUDP 压入 UDP 头, 校验和在 PushIPv4/PushIPv6 时计算
+func (b *Buffer) PushUDP(srcPort, dstPort uint16) error {
+	l := b.Len() + UDPLen
+	h, err := b.Push(UDPLen)
+	if err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint16(h[0:], srcPort)
+	binary.BigEndian.PutUint16(h[2:], dstPort)
+	binary.BigEndian.PutUint16(h[4:], uint16(l))
+	binary.BigEndian.PutUint16(h[6:], 0)
+	b.proto = IPProtocolUDP
+	return nil
+}
+
+type TCPHeader struct {
+	SrcPort uint16
+	DstPort uint16
+	Seq     uint32
+	Ack     uint32
+	Flags   uint8
+	Window  uint16
+	Options []byte // 长度须为 4 的倍数
+}
+
+// PushTCP 压入 TCP 头, 校验和在 PushIPv4/PushIPv6 时计算
+func (b *Buffer) PushTCP(t TCPHeader) error {
+	n := TCPMinLen + len(t.Options)
+	h, err := b.Push(n)
+	if err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint16(h[0:], t.SrcPort)
+	binary.BigEndian.PutUint16(h[2:], t.DstPort)
+	binary.BigEndian.PutUint32(h[4:], t.Seq)
+	binary.BigEndian.PutUint32(h[8:], t.Ack)
+	h[12] = uint8(n/4) << 4
+	h[13] = t.Flags
+	binary.BigEndian.PutUint16(h[14:], t.Window)
+	binary.BigEndian.PutUint32(h[16:], 0) // checksum, urgent
+	copy(h[TCPMinLen:], t.Options)
+	b.proto = IPProtocolTCP
+	return nil
+}
+
+// PushICMP 压入 ICMPv4 头并计算校验和, rest 为 echo 的 id<<16|seq 等
+func (b *Buffer) PushICMP(typ, code uint8, rest uint32) error {
+	h, err := b.Push(ICMPLen)
+	if err != nil {
+		return err
+	}
+	h[0], h[1] = typ, code
+	binary.BigEndian.PutUint16(h[2:], 0)
+	binary.BigEndian.PutUint32(h[4:], rest)
+	binary.BigEndian.PutUint16(h[2:], Checksum(b.Bytes()))
+	b.proto = IPProtocolICMP
+	return nil
+}
+
+// PushICMPv6 压入 ICMPv6 头, 校验和在 PushIPv6 时计算
+func (b *Buffer) PushICMPv6(typ, code uint8, rest uint32) error {
+	h, err := b.Push(ICMPLen)
+	if err != nil {
+		return err
+	}
+	h[0], h[1] = typ, code
+	binary.BigEndian.PutUint16(h[2:], 0)
+	binary.BigEndian.PutUint32(h[4:], rest)
+	b.proto = IPProtocolICMPv6
+	return nil
+}
+
+// setL4Checksum 对当前数据(L4 段)计算带伪首部的校验和
+func (b *Buffer) setL4Checksum(src, dst []byte) {
+	var off int
+	switch b.proto {
+	case IPProtocolTCP:
+		off = 16
+	case IPProtocolUDP:
+		off = 6
+	case IPProtocolICMPv6:
+		off = 2
+	default:
+		return
+	}
+	l4 := b.Bytes()
+	sum := Fold(Sum(l4, PseudoHeaderSum(src, dst, b.proto, len(l4))))
+	if sum == 0 && b.proto == IPProtocolUDP {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(l4[off:], sum)
+}
+
+// PushIPv4 压入 20 字节 IPv4 头, 协议号取最近压入的 L4 (无则为 proto)
+func (b *Buffer) PushIPv4(src, dst net.IP, proto uint8, ttl uint8) error {
+	src4, dst4 := src.To4(), dst.To4()
+	if src4 == nil || dst4 == nil {
+		return errors.New("packet: not an ipv4 address")
+	}
+	if b.proto != 0 {
+		proto = b.proto
+	}
+	b.setL4Checksum(src4, dst4)
+	l := b.Len() + IPv4MinLen
+	h, err := b.Push(IPv4MinLen)
+	if err != nil {
+		return err
+	}
+	h[0] = 0x45
+	h[1] = 0
+	binary.BigEndian.PutUint16(h[2:], uint16(l))
+	binary.BigEndian.PutUint32(h[4:], 0x4000) // id 0, DF
+	h[8] = ttl
+	h[9] = proto
+	binary.BigEndian.PutUint16(h[10:], 0)
+	copy(h[12:16], src4)
+	copy(h[16:20], dst4)
+	binary.BigEndian.PutUint16(h[10:], Checksum(h))
+	b.etherType = EtherTypeIPv4
+	b.proto = 0
+	return nil
+}
+
+// PushIPv6 压入 40 字节 IPv6 头, 协议号取最近压入的 L4 (无则为 next)
+func (b *Buffer) PushIPv6(src, dst net.IP, next uint8, hopLimit uint8) error {
+	src16, dst16 := src.To16(), dst.To16()
+	if src16 == nil || dst16 == nil {
+		return errors.New("packet: not an ipv6 address")
+	}
+	if b.proto != 0 {
+		next = b.proto
+	}
+	b.setL4Checksum(src16, dst16)
+	l := b.Len()
+	h, err := b.Push(IPv6Len)
+	if err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(h[0:], 6<<28)
+	binary.BigEndian.PutUint16(h[4:], uint16(l))
+	h[6] = next
+	h[7] = hopLimit
+	copy(h[8:24], src16)
+	copy(h[24:40], dst16)
+	b.etherType = EtherTypeIPv6
+	b.proto = 0
+	return nil
+}
+
+// PushVLAN 压入 802.1Q tag (TCI + 内层 ethertype), 之后 PushEthernet 的 ethertype 为 0x8100
+func (b *Buffer) PushVLAN(tci uint16) error {
+	h, err := b.Push(VLANLen)
+	if err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint16(h[0:], tci)
+	binary.BigEndian.PutUint16(h[2:], b.etherType)
+	b.etherType = EtherTypeVLAN
+	return nil
+}
+
+// PushEthernet 压入以太网头, etherType 为 0 时使用最近压入的 L3/VLAN
+func (b *Buffer) PushEthernet(dst, src net.HardwareAddr, etherType uint16) error {
+	if etherType == 0 {
+		etherType = b.etherType
+	}
+	h, err := b.Push(EthernetLen)
+	if err != nil {
+		return err
+	}
+	copy(h[0:6], dst)
+	copy(h[6:12], src)
+	binary.BigEndian.PutUint16(h[12:], etherType)
+	return nil
+}
+
+// InsertVLAN 对已有的以太网帧原地插入 VLAN tag (MAC 地址前移 4 字节)
+func (b *Buffer) InsertVLAN(tci uint16) error {
+	if b.Len() < EthernetLen {
+		return ErrTruncated
+	}
+	if _, err := b.Push(VLANLen); err != nil {
+		return err
+	}
+	d := b.Bytes()
+	copy(d[:12], d[VLANLen:VLANLen+12])
+	binary.BigEndian.PutUint16(d[12:], EtherTypeVLAN)
+	binary.BigEndian.PutUint16(d[14:], tci)
+	return nil
+}
+
+// RemoveVLAN 去掉以太网帧最外层的 VLAN tag, 返回其 TCI
+func (b *Buffer) RemoveVLAN() (uint16, error) {
+	d := b.Bytes()
+	if len(d) < EthernetLen+VLANLen {
+		return 0, ErrTruncated
+	}
+	et := binary.BigEndian.Uint16(d[12:])
+	if et != EtherTypeVLAN && et != EtherTypeQinQ && et != EtherTypeQinQ2 {
+		return 0, errors.New("packet: no vlan tag")
+	}
+	tci := binary.BigEndian.Uint16(d[14:])
+	copy(d[VLANLen:VLANLen+12], d[:12])
+	b.head += VLANLen
+	return tci, nil
+}
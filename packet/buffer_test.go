@@ -0,0 +1,172 @@
+package packet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestBufferPush(t *testing.T) {
+	pl := []byte("payload")
+	tests := []struct {
+		name   string
+		layers []layer
+		check  func(t *testing.T, f []byte, p *Packet)
+	}{
+		{"udp4 vlan", []layer{udp, ipv4, vlan(42), eth}, func(t *testing.T, f []byte, p *Packet) {
+			if binary.BigEndian.Uint16(f[12:]) != EtherTypeVLAN || binary.BigEndian.Uint16(f[14:]) != 42 ||
+				binary.BigEndian.Uint16(f[16:]) != EtherTypeIPv4 {
+				t.Errorf("ethernet/vlan % x", f[:18])
+			}
+			ip := p.IPv4()
+			if int(ip.TotalLen()) != IPv4MinLen+UDPLen+len(pl) || ip.Protocol() != IPProtocolUDP || ip.TTL() != 64 ||
+				!ip.Src().Equal(ip4A) || !ip.Dst().Equal(ip4B) || ip.Flags() != 2 {
+				t.Errorf("ipv4 % x", ip[:IPv4MinLen])
+			}
+			if u := p.UDP(); int(u.Length()) != UDPLen+len(pl) || u.SrcPort() != 1234 || u.DstPort() != 53 || u.Checksum() == 0 {
+				t.Errorf("udp % x", u[:UDPLen])
+			}
+		}},
+		{"tcp4 options", []layer{tcp([]byte{2, 4, 5, 0xb4}), ipv4, eth}, func(t *testing.T, f []byte, p *Packet) {
+			tc := p.TCP()
+			if tc.DataOffset() != 24 || string(tc.Options()) != "\x02\x04\x05\xb4" || tc.Flags() != TCPFlagSYN ||
+				tc.Seq() != 1 || tc.Window() != 1024 || p.IPv4().Protocol() != IPProtocolTCP {
+				t.Errorf("tcp % x", tc[:24])
+			}
+		}},
+		{"icmp4", []layer{icmp4, ipv4, eth}, func(t *testing.T, f []byte, p *Packet) {
+			if c := p.ICMP(); c.Type() != ICMPEchoRequest || c.ID() != 0 || c.Seq() != 1 || p.IPv4().Protocol() != IPProtocolICMP {
+				t.Errorf("icmp % x", c[:ICMPLen])
+			}
+		}},
+		{"udp6", []layer{udp, ipv6(0), eth}, func(t *testing.T, f []byte, p *Packet) {
+			ip := p.IPv6()
+			if int(ip.PayloadLen()) != UDPLen+len(pl) || ip.NextHeader() != IPProtocolUDP || ip.HopLimit() != 64 ||
+				ip.Version() != 6 || !ip.Src().Equal(ip6A) || !ip.Dst().Equal(ip6B) {
+				t.Errorf("ipv6 % x", ip[:IPv6Len])
+			}
+		}},
+		{"icmp6", []layer{func(b *Buffer) error { return b.PushICMPv6(ICMPv6EchoReply, 0, 7) }, ipv6(0), eth},
+			func(t *testing.T, f []byte, p *Packet) {
+				if c := p.ICMP(); c.Type() != ICMPv6EchoReply || c.Seq() != 7 || p.IPv6().NextHeader() != IPProtocolICMPv6 {
+					t.Errorf("icmp6 % x", c[:ICMPLen])
+				}
+			}},
+		{"raw ipv6", []layer{ipv6(IPProtocolNoNext), eth}, func(t *testing.T, f []byte, p *Packet) {
+			if p.IPv6().NextHeader() != IPProtocolNoNext || !bytes.Equal(p.Payload(), pl) {
+				t.Errorf("ipv6 next header %d", p.IPv6().NextHeader())
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := build(t, pl, tt.layers...)
+			var p Packet
+			if err := p.Parse(f); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(p.Payload(), pl) {
+				t.Errorf("payload % x", p.Payload())
+			}
+			if ip := p.IPv4(); ip != nil && !ip.ValidChecksum() {
+				t.Error("bad IPv4 header checksum")
+			}
+			if !p.ValidL4Checksum() {
+				t.Error("bad L4 checksum")
+			}
+			tt.check(t, f, &p)
+		})
+	}
+}
+
+func TestBufferRoom(t *testing.T) {
+	frame := make([]byte, 64)
+	b := NewBuffer(frame, 10, 0)
+	if b.Headroom() != 10 || b.Tailroom() != 54 || b.Len() != 0 {
+		t.Fatalf("headroom %d tailroom %d len %d", b.Headroom(), b.Tailroom(), b.Len())
+	}
+	if err := b.Append([]byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Extend(52); err != ErrNoRoom {
+		t.Errorf("Extend past tailroom: %v", err)
+	}
+	tail, err := b.Extend(51)
+	if err != nil || len(tail) != 51 || b.Tailroom() != 0 || b.Len() != 54 {
+		t.Fatalf("Extend to the end: %v, len %d", err, b.Len())
+	}
+	b.Trim(3)
+	if !bytes.Equal(b.Bytes(), []byte{1, 2, 3}) {
+		t.Fatalf("Trim: % x", b.Bytes())
+	}
+	b.Trim(100)
+	if b.Len() != 3 {
+		t.Errorf("Trim longer than data changed length to %d", b.Len())
+	}
+	if err := b.PushUDP(1, 2); err != nil {
+		t.Fatal(err)
+	}
+	// 失败的 Push 不改变数据
+	if err := b.PushIPv4(ip4A, ip4B, 0, 64); err != ErrNoRoom || b.Headroom() != 2 || b.Len() != UDPLen+3 {
+		t.Errorf("PushIPv4 without room: %v, headroom %d len %d", err, b.Headroom(), b.Len())
+	}
+	if err := b.PushIPv4(ip6A, ip4B, 0, 64); err == nil {
+		t.Error("PushIPv4 with an IPv6 address")
+	}
+	h, err := b.Pull(UDPLen)
+	if err != nil || len(h) != UDPLen || !bytes.Equal(b.Bytes(), []byte{1, 2, 3}) {
+		t.Errorf("Pull: %v, % x", err, b.Bytes())
+	}
+	if _, err := b.Pull(4); err != ErrTruncated {
+		t.Errorf("Pull past data: %v", err)
+	}
+	if &b.Frame()[0] != &frame[0] {
+		t.Error("Frame is not the backing frame")
+	}
+}
+
+func TestBufferVLAN(t *testing.T) {
+	orig := build(t, []byte("x"), udp, ipv4, eth)
+	frame := make([]byte, 256)
+	b := NewBuffer(frame, 64, 0)
+	b.Append(orig)
+	if err := b.InsertVLAN(5<<13 | 300); err != nil {
+		t.Fatal(err)
+	}
+	var p Packet
+	if err := p.Parse(b.Bytes()); err != nil || p.NumVLANs != 1 || p.VLANs[0] != 300 || p.EtherType != EtherTypeIPv4 {
+		t.Fatalf("after InsertVLAN: %v, %d vlans %v", err, p.NumVLANs, p.VLANs)
+	}
+	if !bytes.Equal(b.Bytes()[:12], orig[:12]) {
+		t.Errorf("MAC addresses moved: % x", b.Bytes()[:12])
+	}
+	tci, err := b.RemoveVLAN()
+	if err != nil || tci != 5<<13|300 || !bytes.Equal(b.Bytes(), orig) {
+		t.Errorf("RemoveVLAN = %#x, %v, % x", tci, err, b.Bytes())
+	}
+	if _, err := b.RemoveVLAN(); err == nil {
+		t.Error("RemoveVLAN on an untagged frame")
+	}
+	nb := NewBuffer(append([]byte(nil), orig...), 0, len(orig))
+	if err := nb.InsertVLAN(1); err != ErrNoRoom {
+		t.Errorf("InsertVLAN without headroom: %v", err)
+	}
+}
+
+// 在 frame 上构造报文不分配内存
+func TestBufferAllocs(t *testing.T) {
+	frame := make([]byte, 512)
+	pl := []byte("payload")
+	allocs := testing.AllocsPerRun(100, func() {
+		b := NewBuffer(frame, 256, 0)
+		b.Append(pl)
+		b.PushUDP(1, 2)
+		b.PushIPv4(ip4A, ip4B, 0, 64)
+		b.PushVLAN(9)
+		b.PushEthernet(macB, macA, 0)
+		b.RemoveVLAN()
+	})
+	if allocs != 0 {
+		t.Errorf("%v allocations per run", allocs)
+	}
+}
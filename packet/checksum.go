@@ -0,0 +1,69 @@
+package packet
+
+import "encoding/binary"
+
+// Sum 以 16 位大端字为单位累加 b (RFC 1071), 未折叠
+func Sum(b []byte, initial uint32) uint32 {
+	sum := initial
+	n := len(b) &^ 1
+	for i := 0; i < n; i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)&1 != 0 {
+		sum += uint32(b[n]) << 8
+	}
+	return sum
+}
+
+// Fold 折叠进位并取反, 得到写入报文的校验和
+func Fold(sum uint32) uint16 {
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// Checksum Fold(Sum(b, 0))
+func Checksum(b []byte) uint16 {
+	return Fold(Sum(b, 0))
+}
+
+// PseudoHeaderSum TCP/UDP/ICMPv6 伪首部累加值, src/dst 为 4 或 16 字节
+func PseudoHeaderSum(src, dst []byte, proto uint8, length int) uint32 {
+	sum := Sum(src, 0)
+	sum = Sum(dst, sum)
+	sum += uint32(proto)
+	sum += uint32(length)
+	return sum
+}
+
+// ValidChecksum IPv4 头部校验和是否正确
+func (ip IPv4) ValidChecksum() bool {
+	return Checksum(ip[:ip.HeaderLen()]) == 0
+}
+
+// ValidL4Checksum 校验 TCP/UDP/ICMP/ICMPv6 校验和, 其它协议或分片返回 true.
+// UDP over IPv4 校验和为 0 表示未计算, 视为正确
+func (p *Packet) ValidL4Checksum() bool {
+	l4 := p.L4()
+	if l4 == nil || p.Fragment {
+		return true
+	}
+	var sum uint32
+	switch p.L4Proto {
+	case IPProtocolICMP:
+		return Checksum(l4) == 0
+	case IPProtocolUDP:
+		if p.IPv4() != nil && binary.BigEndian.Uint16(l4[6:]) == 0 {
+			return true
+		}
+	}
+	if ip := p.IPv4(); ip != nil {
+		sum = PseudoHeaderSum(ip[12:16], ip[16:20], p.L4Proto, len(l4))
+	} else if ip := p.IPv6(); ip != nil {
+		sum = PseudoHeaderSum(ip[8:24], ip[24:40], p.L4Proto, len(l4))
+	} else {
+		return true
+	}
+	return Fold(Sum(l4, sum)) == 0
+}
@@ -0,0 +1,93 @@
+package packet
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// 以下类型都是 frame 的切片视图, 读写直接作用在 frame 上
+
+type Ethernet []byte
+
+func (e Ethernet) Dst() net.HardwareAddr { return net.HardwareAddr(e[0:6]) }
+func (e Ethernet) Src() net.HardwareAddr { return net.HardwareAddr(e[6:12]) }
+
+// EtherType 紧跟 MAC 地址的 ethertype, 有 VLAN 时为 TPID
+func (e Ethernet) EtherType() uint16 { return binary.BigEndian.Uint16(e[12:]) }
+
+type IPv4 []byte
+
+func (ip IPv4) Version() uint8     { return ip[0] >> 4 }
+func (ip IPv4) HeaderLen() int     { return int(ip[0]&0x0f) * 4 }
+func (ip IPv4) TOS() uint8         { return ip[1] }
+func (ip IPv4) TotalLen() uint16   { return binary.BigEndian.Uint16(ip[2:]) }
+func (ip IPv4) ID() uint16         { return binary.BigEndian.Uint16(ip[4:]) }
+func (ip IPv4) Flags() uint8       { return ip[6] >> 5 }
+func (ip IPv4) FragOffset() uint16 { return binary.BigEndian.Uint16(ip[6:]) & 0x1fff }
+func (ip IPv4) TTL() uint8         { return ip[8] }
+func (ip IPv4) Protocol() uint8    { return ip[9] }
+func (ip IPv4) Checksum() uint16   { return binary.BigEndian.Uint16(ip[10:]) }
+func (ip IPv4) Src() net.IP        { return net.IP(ip[12:16]) }
+func (ip IPv4) Dst() net.IP        { return net.IP(ip[16:20]) }
+func (ip IPv4) Options() []byte    { return ip[IPv4MinLen:ip.HeaderLen()] }
+
+type IPv6 []byte
+
+func (ip IPv6) Version() uint8      { return ip[0] >> 4 }
+func (ip IPv6) TrafficClass() uint8 { return uint8(binary.BigEndian.Uint16(ip[0:]) >> 4) }
+func (ip IPv6) FlowLabel() uint32   { return binary.BigEndian.Uint32(ip[0:]) & 0x000fffff }
+func (ip IPv6) PayloadLen() uint16  { return binary.BigEndian.Uint16(ip[4:]) }
+func (ip IPv6) NextHeader() uint8   { return ip[6] }
+func (ip IPv6) HopLimit() uint8     { return ip[7] }
+func (ip IPv6) Src() net.IP         { return net.IP(ip[8:24]) }
+func (ip IPv6) Dst() net.IP         { return net.IP(ip[24:40]) }
+
+const (
+	TCPFlagFIN = 1 << iota
+	TCPFlagSYN
+	TCPFlagRST
+	TCPFlagPSH
+	TCPFlagACK
+	TCPFlagURG
+	TCPFlagECE
+	TCPFlagCWR
+)
+
+type TCP []byte
+
+func (t TCP) SrcPort() uint16  { return binary.BigEndian.Uint16(t[0:]) }
+func (t TCP) DstPort() uint16  { return binary.BigEndian.Uint16(t[2:]) }
+func (t TCP) Seq() uint32      { return binary.BigEndian.Uint32(t[4:]) }
+func (t TCP) Ack() uint32      { return binary.BigEndian.Uint32(t[8:]) }
+func (t TCP) DataOffset() int  { return int(t[12]>>4) * 4 }
+func (t TCP) Flags() uint8     { return t[13] }
+func (t TCP) Window() uint16   { return binary.BigEndian.Uint16(t[14:]) }
+func (t TCP) Checksum() uint16 { return binary.BigEndian.Uint16(t[16:]) }
+func (t TCP) Urgent() uint16   { return binary.BigEndian.Uint16(t[18:]) }
+func (t TCP) Options() []byte  { return t[TCPMinLen:t.DataOffset()] }
+
+type UDP []byte
+
+func (u UDP) SrcPort() uint16  { return binary.BigEndian.Uint16(u[0:]) }
+func (u UDP) DstPort() uint16  { return binary.BigEndian.Uint16(u[2:]) }
+func (u UDP) Length() uint16   { return binary.BigEndian.Uint16(u[4:]) }
+func (u UDP) Checksum() uint16 { return binary.BigEndian.Uint16(u[6:]) }
+
+const (
+	ICMPEchoReply     = 0
+	ICMPEchoRequest   = 8
+	ICMPv6EchoRequest = 128
+	ICMPv6EchoReply   = 129
+	ICMPv6NeighborSol = 135
+	ICMPv6NeighborAdv = 136
+)
+
+type ICMP []byte
+
+func (c ICMP) Type() uint8      { return c[0] }
+func (c ICMP) Code() uint8      { return c[1] }
+func (c ICMP) Checksum() uint16 { return binary.BigEndian.Uint16(c[2:]) }
+
+// ID/Seq 仅对 echo 类报文有意义
+func (c ICMP) ID() uint16  { return binary.BigEndian.Uint16(c[4:]) }
+func (c ICMP) Seq() uint16 { return binary.BigEndian.Uint16(c[6:]) }
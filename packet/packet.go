@@ -0,0 +1,279 @@
+// Package packet 直接在 frame 的 []byte 上解析以太网/IP/TCP/UDP/ICMP 头部,
+// 只记录各层的偏移, 不做内存分配, 适合在 HandleRecv 中使用
+package packet
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	EtherTypeIPv4  = 0x0800
+	EtherTypeARP   = 0x0806
+	EtherTypeVLAN  = 0x8100
+	EtherTypeQinQ  = 0x88a8
+	EtherTypeIPv6  = 0x86dd
+	EtherTypeQinQ2 = 0x9100
+
+	IPProtocolHopByHop = 0
+	IPProtocolICMP     = 1
+	IPProtocolTCP      = 6
+	IPProtocolUDP      = 17
+	IPProtocolRouting  = 43
+	IPProtocolFragment = 44
+	IPProtocolESP      = 50
+	IPProtocolAH       = 51
+	IPProtocolICMPv6   = 58
+	IPProtocolNoNext   = 59
+	IPProtocolDstOpts  = 60
+
+	EthernetLen = 14
+	VLANLen     = 4
+	IPv4MinLen  = 20
+	IPv6Len     = 40
+	TCPMinLen   = 20
+	UDPLen      = 8
+	ICMPLen     = 8
+
+	MaxVLANs = 2
+)
+
+var (
+	ErrTruncated    = errors.New("packet: truncated")
+	ErrVersion      = errors.New("packet: bad ip version")
+	ErrTooManyVLANs = errors.New("packet: too many vlan tags")
+)
+
+// Packet 解析结果, 偏移为 -1 表示该层不存在
+type Packet struct {
+	Data []byte
+
+	VLANs      [MaxVLANs]uint16 // TCI, 外层在前
+	NumVLANs   int
+	EtherType  uint16 // 去掉 VLAN 后的 ethertype
+	L3Off      int
+	L4Off      int
+	L4Proto    uint8 // 跳过 IPv6 扩展头后的协议号
+	PayloadOff int
+	Fragment   bool // IPv4/IPv6 分片, 非首片时不解析 L4
+}
+
+// Parse 解析 b, 可重复使用同一个 Packet
+func (p *Packet) Parse(b []byte) error {
+	*p = Packet{Data: b, L3Off: -1, L4Off: -1, PayloadOff: -1}
+	if len(b) < EthernetLen {
+		return ErrTruncated
+	}
+	off := 12
+	et := binary.BigEndian.Uint16(b[off:])
+	off += 2
+	for et == EtherTypeVLAN || et == EtherTypeQinQ || et == EtherTypeQinQ2 {
+		if p.NumVLANs == MaxVLANs {
+			return ErrTooManyVLANs
+		}
+		if len(b) < off+VLANLen {
+			return ErrTruncated
+		}
+		p.VLANs[p.NumVLANs] = binary.BigEndian.Uint16(b[off:]) & 0x0fff
+		p.NumVLANs++
+		et = binary.BigEndian.Uint16(b[off+2:])
+		off += VLANLen
+	}
+	p.EtherType = et
+	p.L3Off = off
+	switch et {
+	case EtherTypeIPv4:
+		return p.parseIPv4(off)
+	case EtherTypeIPv6:
+		return p.parseIPv6(off)
+	}
+	p.PayloadOff = off
+	return nil
+}
+
+func (p *Packet) parseIPv4(off int) error {
+	b := p.Data
+	if len(b) < off+IPv4MinLen {
+		return ErrTruncated
+	}
+	if b[off]>>4 != 4 {
+		return ErrVersion
+	}
+	ihl := int(b[off]&0x0f) * 4
+	if ihl < IPv4MinLen || len(b) < off+ihl {
+		return ErrTruncated
+	}
+	p.L4Proto = b[off+9]
+	frag := binary.BigEndian.Uint16(b[off+6:])
+	p.Fragment = frag&0x3fff != 0 // MF 或 offset 非 0
+	if frag&0x1fff != 0 {
+		p.PayloadOff = off + ihl
+		return nil
+	}
+	return p.parseL4(off + ihl)
+}
+
+func (p *Packet) parseIPv6(off int) error {
+	b := p.Data
+	if len(b) < off+IPv6Len {
+		return ErrTruncated
+	}
+	if b[off]>>4 != 6 {
+		return ErrVersion
+	}
+	next := b[off+6]
+	off += IPv6Len
+	for {
+		switch next {
+		case IPProtocolHopByHop, IPProtocolRouting, IPProtocolDstOpts:
+			if len(b) < off+8 {
+				return ErrTruncated
+			}
+			next = b[off]
+			off += (int(b[off+1]) + 1) * 8
+		case IPProtocolAH:
+			if len(b) < off+8 {
+				return ErrTruncated
+			}
+			next = b[off]
+			off += (int(b[off+1]) + 2) * 4
+		case IPProtocolFragment:
+			if len(b) < off+8 {
+				return ErrTruncated
+			}
+			p.Fragment = true
+			fragoff := binary.BigEndian.Uint16(b[off+2:]) &^ 7
+			next = b[off]
+			off += 8
+			if fragoff != 0 {
+				p.L4Proto = next
+				p.PayloadOff = off
+				return nil
+			}
+		default:
+			if len(b) < off {
+				return ErrTruncated
+			}
+			p.L4Proto = next
+			return p.parseL4(off)
+		}
+	}
+}
+
+func (p *Packet) parseL4(off int) error {
+	b := p.Data
+	switch p.L4Proto {
+	case IPProtocolTCP:
+		if len(b) < off+TCPMinLen {
+			return ErrTruncated
+		}
+		doff := int(b[off+12]>>4) * 4
+		if doff < TCPMinLen || len(b) < off+doff {
+			return ErrTruncated
+		}
+		p.L4Off = off
+		p.PayloadOff = off + doff
+	case IPProtocolUDP:
+		if len(b) < off+UDPLen {
+			return ErrTruncated
+		}
+		p.L4Off = off
+		p.PayloadOff = off + UDPLen
+	case IPProtocolICMP, IPProtocolICMPv6:
+		if len(b) < off+4 {
+			return ErrTruncated
+		}
+		p.L4Off = off
+		p.PayloadOff = off + 4
+		if len(b) >= off+ICMPLen {
+			p.PayloadOff = off + ICMPLen
+		}
+	default:
+		p.PayloadOff = off
+	}
+	return nil
+}
+
+// Ethernet 未解析或不足以太网头长度时返回 nil
+func (p *Packet) Ethernet() Ethernet {
+	if len(p.Data) < EthernetLen {
+		return nil
+	}
+	return Ethernet(p.Data[:EthernetLen])
+}
+
+// IPv4 非 IPv4 包返回 nil
+func (p *Packet) IPv4() IPv4 {
+	if p.EtherType != EtherTypeIPv4 || p.L3Off < 0 {
+		return nil
+	}
+	return IPv4(p.Data[p.L3Off:])
+}
+
+// IPv6 非 IPv6 包返回 nil
+func (p *Packet) IPv6() IPv6 {
+	if p.EtherType != EtherTypeIPv6 || p.L3Off < 0 {
+		return nil
+	}
+	return IPv6(p.Data[p.L3Off:])
+}
+
+func (p *Packet) TCP() TCP {
+	if p.L4Proto != IPProtocolTCP || p.L4Off < 0 {
+		return nil
+	}
+	return TCP(p.Data[p.L4Off:])
+}
+
+func (p *Packet) UDP() UDP {
+	if p.L4Proto != IPProtocolUDP || p.L4Off < 0 {
+		return nil
+	}
+	return UDP(p.Data[p.L4Off:])
+}
+
+// ICMP ICMP 与 ICMPv6 共用
+func (p *Packet) ICMP() ICMP {
+	if (p.L4Proto != IPProtocolICMP && p.L4Proto != IPProtocolICMPv6) || p.L4Off < 0 {
+		return nil
+	}
+	return ICMP(p.Data[p.L4Off:])
+}
+
+// Payload L4 之后的数据, L4 未解析时为 L3/L4 头之后的数据
+func (p *Packet) Payload() []byte {
+	if p.PayloadOff < 0 {
+		return nil
+	}
+	end := len(p.Data)
+	// 以太网帧可能有填充, 以 IP 头中的长度为准
+	if ip := p.IPv4(); ip != nil {
+		if e := p.L3Off + int(ip.TotalLen()); e >= p.PayloadOff && e < end {
+			end = e
+		}
+	} else if ip := p.IPv6(); ip != nil {
+		if e := p.L3Off + IPv6Len + int(ip.PayloadLen()); e >= p.PayloadOff && e < end {
+			end = e
+		}
+	}
+	return p.Data[p.PayloadOff:end]
+}
+
+// L4 L4 头开始到 IP 包结尾的数据, 用于计算校验和
+func (p *Packet) L4() []byte {
+	if p.L4Off < 0 {
+		return nil
+	}
+	end := len(p.Data)
+	if ip := p.IPv4(); ip != nil {
+		if e := p.L3Off + int(ip.TotalLen()); e >= p.L4Off && e < end {
+			end = e
+		}
+	} else if ip := p.IPv6(); ip != nil {
+		if e := p.L3Off + IPv6Len + int(ip.PayloadLen()); e >= p.L4Off && e < end {
+			end = e
+		}
+	}
+	return p.Data[p.L4Off:end]
+}
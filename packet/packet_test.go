@@ -0,0 +1,408 @@
+package packet
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+var (
+	macA = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+	macB = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}
+	ip4A = net.IPv4(192, 0, 2, 1)
+	ip4B = net.IPv4(198, 51, 100, 2)
+	ip6A = net.ParseIP("2001:db8::1")
+	ip6B = net.ParseIP("2001:db8::2")
+)
+
+type layer func(b *Buffer) error
+
+// build 写入 payload 后按顺序 (由内向外) 压入各层
+func build(t testing.TB, payload []byte, layers ...layer) []byte {
+	t.Helper()
+	b := NewBuffer(make([]byte, 1024), 512, 0)
+	if err := b.Append(payload); err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range layers {
+		if err := l(&b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return append([]byte(nil), b.Bytes()...)
+}
+
+func udp(b *Buffer) error   { return b.PushUDP(1234, 53) }
+func icmp4(b *Buffer) error { return b.PushICMP(ICMPEchoRequest, 0, 1) }
+func ipv4(b *Buffer) error  { return b.PushIPv4(ip4A, ip4B, 0, 64) }
+func eth(b *Buffer) error   { return b.PushEthernet(macB, macA, 0) }
+
+func tcp(opts []byte) layer {
+	return func(b *Buffer) error {
+		return b.PushTCP(TCPHeader{SrcPort: 40000, DstPort: 80, Seq: 1, Flags: TCPFlagSYN, Window: 1024, Options: opts})
+	}
+}
+
+func ipv6(next uint8) layer {
+	return func(b *Buffer) error { return b.PushIPv6(ip6A, ip6B, next, 64) }
+}
+
+func vlan(tci uint16) layer {
+	return func(b *Buffer) error { return b.PushVLAN(tci) }
+}
+
+func ethType(et uint16) layer {
+	return func(b *Buffer) error { return b.PushEthernet(macB, macA, et) }
+}
+
+// raw 压入 n 字节协议号为 proto 的头部, 内容为 0
+func raw(proto uint8, n int) layer {
+	return func(b *Buffer) error {
+		h, err := b.Push(n)
+		for i := range h {
+			h[i] = 0
+		}
+		b.proto = proto
+		return err
+	}
+}
+
+// ipv4Options IHL 为 ihl 字节的 IPv4 头
+func ipv4Options(ihl int) layer {
+	return func(b *Buffer) error {
+		proto := b.proto
+		l := b.Len() + ihl
+		h, err := b.Push(ihl)
+		if err != nil {
+			return err
+		}
+		for i := range h {
+			h[i] = 0
+		}
+		h[0] = 0x40 | byte(ihl/4)
+		binary.BigEndian.PutUint16(h[2:], uint16(l))
+		h[8], h[9] = 64, proto
+		copy(h[12:16], ip4A.To4())
+		copy(h[16:20], ip4B.To4())
+		IPv4(h).SetChecksum()
+		b.etherType, b.proto = EtherTypeIPv4, 0
+		return nil
+	}
+}
+
+// ext 压入 n 字节的 IPv6 扩展头 (hop-by-hop/routing/dstopts), 之后为 next
+func ext(next uint8, n int) layer {
+	return func(b *Buffer) error {
+		h, err := b.Push(n)
+		if err != nil {
+			return err
+		}
+		for i := range h {
+			h[i] = 0
+		}
+		h[0], h[1] = next, byte(n/8-1)
+		b.proto = 0
+		return nil
+	}
+}
+
+// ah 压入 n 字节的 AH, 长度以 4 字节为单位减 2
+func ah(next uint8, n int) layer {
+	return func(b *Buffer) error {
+		if err := ext(next, n)(b); err != nil {
+			return err
+		}
+		b.Bytes()[1] = byte(n/4 - 2)
+		return nil
+	}
+}
+
+func frag6(next uint8, off uint16, more bool) layer {
+	return func(b *Buffer) error {
+		if err := ext(next, 8)(b); err != nil {
+			return err
+		}
+		v := off << 3
+		if more {
+			v |= 1
+		}
+		binary.BigEndian.PutUint16(b.Bytes()[2:], v)
+		return nil
+	}
+}
+
+// frag4 设置以太网帧中 IPv4 的分片字段并重算头部校验和
+func frag4(f []byte, off uint16, more bool) []byte {
+	ip := IPv4(f[EthernetLen:])
+	v := off
+	if more {
+		v |= 0x2000
+	}
+	binary.BigEndian.PutUint16(ip[6:], v)
+	ip.SetChecksum()
+	return f
+}
+
+func TestParse(t *testing.T) {
+	pl := []byte{1, 2, 3, 4}
+	type want struct {
+		etherType     uint16
+		vlans         []uint16
+		l3, l4, pay   int
+		proto         uint8
+		frag          bool
+		err           error
+		ethernetIsNil bool
+	}
+	tests := []struct {
+		name  string
+		frame []byte
+		want  want
+	}{
+		{"udp4", build(t, pl, udp, ipv4, eth), want{etherType: EtherTypeIPv4, l3: 14, l4: 34, pay: 42, proto: IPProtocolUDP}},
+		{"tcp4 options", build(t, pl, tcp([]byte{1, 1, 1, 0}), ipv4, eth), want{etherType: EtherTypeIPv4, l3: 14, l4: 34, pay: 58, proto: IPProtocolTCP}},
+		{"ipv4 options", build(t, pl, tcp(nil), ipv4Options(24), eth), want{etherType: EtherTypeIPv4, l3: 14, l4: 38, pay: 58, proto: IPProtocolTCP}},
+		{"icmp4", build(t, pl, icmp4, ipv4, eth), want{etherType: EtherTypeIPv4, l3: 14, l4: 34, pay: 42, proto: IPProtocolICMP}},
+		{"icmp4 4 bytes", build(t, nil, raw(IPProtocolICMP, 4), ipv4, eth), want{etherType: EtherTypeIPv4, l3: 14, l4: 34, pay: 38, proto: IPProtocolICMP}},
+		{"vlan", build(t, pl, udp, ipv4, vlan(100), eth),
+			want{etherType: EtherTypeIPv4, vlans: []uint16{100}, l3: 18, l4: 38, pay: 46, proto: IPProtocolUDP}},
+		{"vlan pcp", build(t, pl, udp, ipv4, vlan(5<<13|100), eth),
+			want{etherType: EtherTypeIPv4, vlans: []uint16{100}, l3: 18, l4: 38, pay: 46, proto: IPProtocolUDP}},
+		{"qinq", build(t, pl, udp, ipv4, vlan(20), vlan(10), ethType(EtherTypeQinQ)),
+			want{etherType: EtherTypeIPv4, vlans: []uint16{10, 20}, l3: 22, l4: 42, pay: 50, proto: IPProtocolUDP}},
+		{"qinq 0x9100", build(t, pl, udp, ipv6(0), vlan(20), vlan(10), ethType(EtherTypeQinQ2)),
+			want{etherType: EtherTypeIPv6, vlans: []uint16{10, 20}, l3: 22, l4: 62, pay: 70, proto: IPProtocolUDP}},
+		{"three vlans", build(t, pl, udp, ipv4, vlan(3), vlan(2), vlan(1), eth),
+			want{vlans: []uint16{1, 2}, l3: -1, l4: -1, pay: -1, err: ErrTooManyVLANs}},
+		{"arp", build(t, make([]byte, 28), ethType(EtherTypeARP)), want{etherType: EtherTypeARP, l3: 14, l4: -1, pay: 14}},
+		{"udp6", build(t, pl, udp, ipv6(0), eth), want{etherType: EtherTypeIPv6, l3: 14, l4: 54, pay: 62, proto: IPProtocolUDP}},
+		{"ipv6 hop-by-hop and dstopts", build(t, pl, udp, ext(IPProtocolUDP, 16), ext(IPProtocolDstOpts, 8), ipv6(IPProtocolHopByHop), eth),
+			want{etherType: EtherTypeIPv6, l3: 14, l4: 78, pay: 86, proto: IPProtocolUDP}},
+		{"ipv6 routing", build(t, pl, tcp(nil), ext(IPProtocolTCP, 24), ipv6(IPProtocolRouting), eth),
+			want{etherType: EtherTypeIPv6, l3: 14, l4: 78, pay: 98, proto: IPProtocolTCP}},
+		{"ipv6 ah", build(t, pl, udp, ah(IPProtocolUDP, 24), ipv6(IPProtocolAH), eth),
+			want{etherType: EtherTypeIPv6, l3: 14, l4: 78, pay: 86, proto: IPProtocolUDP}},
+		{"ipv6 no next header", build(t, pl, ipv6(IPProtocolNoNext), eth),
+			want{etherType: EtherTypeIPv6, l3: 14, l4: -1, pay: 54, proto: IPProtocolNoNext}},
+		{"ipv6 esp", build(t, pl, ipv6(IPProtocolESP), eth), want{etherType: EtherTypeIPv6, l3: 14, l4: -1, pay: 54, proto: IPProtocolESP}},
+		{"ipv6 first fragment", build(t, pl, udp, frag6(IPProtocolUDP, 0, true), ipv6(IPProtocolFragment), eth),
+			want{etherType: EtherTypeIPv6, l3: 14, l4: 62, pay: 70, proto: IPProtocolUDP, frag: true}},
+		{"ipv6 non-first fragment", build(t, pl, frag6(IPProtocolUDP, 185, false), ipv6(IPProtocolFragment), eth),
+			want{etherType: EtherTypeIPv6, l3: 14, l4: -1, pay: 62, proto: IPProtocolUDP, frag: true}},
+		{"ipv6 ah then fragment", build(t, pl, frag6(IPProtocolTCP, 1, true), ah(IPProtocolFragment, 16), ipv6(IPProtocolAH), eth),
+			want{etherType: EtherTypeIPv6, l3: 14, l4: -1, pay: 78, proto: IPProtocolTCP, frag: true}},
+		{"ipv4 first fragment", frag4(build(t, pl, udp, ipv4, eth), 0, true),
+			want{etherType: EtherTypeIPv4, l3: 14, l4: 34, pay: 42, proto: IPProtocolUDP, frag: true}},
+		{"ipv4 non-first fragment", frag4(build(t, pl, udp, ipv4, eth), 100, false),
+			want{etherType: EtherTypeIPv4, l3: 14, l4: -1, pay: 34, proto: IPProtocolUDP, frag: true}},
+		{"ipv4 bad version", build(t, pl, udp, ipv6(0), ethType(EtherTypeIPv4)),
+			want{etherType: EtherTypeIPv4, l3: 14, l4: -1, pay: -1, err: ErrVersion}},
+		{"ipv6 bad version", build(t, make([]byte, 20), udp, ipv4, ethType(EtherTypeIPv6)),
+			want{etherType: EtherTypeIPv6, l3: 14, l4: -1, pay: -1, err: ErrVersion}},
+		{"short ethernet", make([]byte, 13), want{l3: -1, l4: -1, pay: -1, err: ErrTruncated, ethernetIsNil: true}},
+		{"empty", nil, want{l3: -1, l4: -1, pay: -1, err: ErrTruncated, ethernetIsNil: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p Packet
+			err := p.Parse(tt.frame)
+			w := tt.want
+			if err != w.err {
+				t.Fatalf("Parse error %v, want %v", err, w.err)
+			}
+			if p.EtherType != w.etherType || p.L3Off != w.l3 || p.L4Off != w.l4 || p.PayloadOff != w.pay ||
+				p.L4Proto != w.proto || p.Fragment != w.frag {
+				t.Errorf("got ethertype %#x L3 %d L4 %d payload %d proto %d frag %v", p.EtherType, p.L3Off, p.L4Off, p.PayloadOff, p.L4Proto, p.Fragment)
+			}
+			if p.NumVLANs != len(w.vlans) {
+				t.Fatalf("%d vlans, want %v", p.NumVLANs, w.vlans)
+			}
+			for i, v := range w.vlans {
+				if p.VLANs[i] != v {
+					t.Errorf("vlan %d = %d, want %d", i, p.VLANs[i], v)
+				}
+			}
+			if (p.Ethernet() == nil) != w.ethernetIsNil {
+				t.Errorf("Ethernet() = %v", p.Ethernet())
+			}
+			// 各层访问器与解析结果一致, 不 panic
+			if (p.IPv4() != nil) != (w.etherType == EtherTypeIPv4 && w.l3 >= 0) ||
+				(p.IPv6() != nil) != (w.etherType == EtherTypeIPv6 && w.l3 >= 0) {
+				t.Errorf("IPv4() %v IPv6() %v", p.IPv4() != nil, p.IPv6() != nil)
+			}
+			l4 := p.TCP() != nil || p.UDP() != nil || p.ICMP() != nil
+			if l4 != (w.l4 >= 0) {
+				t.Errorf("L4 accessors present %v with L4Off %d", l4, w.l4)
+			}
+			if w.err == nil && w.pay >= 0 && len(p.Payload()) != len(tt.frame)-w.pay {
+				t.Errorf("Payload %d bytes, want %d", len(p.Payload()), len(tt.frame)-w.pay)
+			}
+		})
+	}
+}
+
+// 在头部结束之前的任意位置截断都返回 ErrTruncated
+func TestParseTruncated(t *testing.T) {
+	frames := map[string][]byte{
+		"vlan tcp4 options": build(t, nil, tcp([]byte{1, 1, 1, 0}), ipv4Options(28), vlan(7), eth),
+		"qinq udp4":         build(t, nil, udp, ipv4, vlan(20), vlan(10), ethType(EtherTypeQinQ)),
+		"ipv6 ext tcp":      build(t, nil, tcp(nil), frag6(IPProtocolTCP, 0, true), ah(IPProtocolFragment, 16), ext(IPProtocolAH, 8), ipv6(IPProtocolHopByHop), eth),
+		"ipv6 udp":          build(t, nil, udp, ext(IPProtocolUDP, 64), ipv6(IPProtocolDstOpts), eth),
+		"icmp6":             build(t, nil, raw(IPProtocolICMPv6, 4), ipv6(0), eth),
+	}
+	for name, f := range frames {
+		var p Packet
+		if err := p.Parse(f); err != nil || p.PayloadOff != len(f) {
+			t.Fatalf("%s: Parse = %v, PayloadOff %d of %d", name, err, p.PayloadOff, len(f))
+		}
+		for n := 0; n < len(f); n++ {
+			if err := p.Parse(f[:n]); err != ErrTruncated {
+				t.Errorf("%s cut at %d: Parse = %v, want ErrTruncated", name, n, err)
+			}
+		}
+	}
+}
+
+// 以太网填充不属于 Payload/L4, IP 长度超出数据时以数据为准
+func TestPacketPayloadPadding(t *testing.T) {
+	pl := []byte{1, 2, 3, 4}
+	for _, tt := range []struct {
+		name  string
+		frame []byte
+	}{
+		{"ipv4", build(t, pl, udp, ipv4, eth)},
+		{"ipv6", build(t, pl, udp, ipv6(0), eth)},
+	} {
+		var p Packet
+		padded := append(tt.frame, 0xee, 0xee, 0xee)
+		if err := p.Parse(padded); err != nil {
+			t.Fatal(err)
+		}
+		if string(p.Payload()) != string(pl) || len(p.L4()) != UDPLen+len(pl) {
+			t.Errorf("%s padded: Payload % x, L4 %d bytes", tt.name, p.Payload(), len(p.L4()))
+		}
+		short := tt.frame[:len(tt.frame)-2]
+		if err := p.Parse(short); err != nil {
+			t.Fatal(err)
+		}
+		if len(p.Payload()) != len(pl)-2 {
+			t.Errorf("%s truncated: Payload % x", tt.name, p.Payload())
+		}
+	}
+}
+
+func TestPacketEthernet(t *testing.T) {
+	var p Packet
+	if p.Ethernet() != nil {
+		t.Error("Ethernet of an unparsed Packet is not nil")
+	}
+	f := build(t, []byte{1, 2, 3, 4}, udp, ipv4, vlan(9), eth)
+	if err := p.Parse(f); err != nil {
+		t.Fatal(err)
+	}
+	e := p.Ethernet()
+	if e.Dst().String() != macB.String() || e.Src().String() != macA.String() || e.EtherType() != EtherTypeVLAN {
+		t.Errorf("Ethernet %v > %v type %#x", e.Src(), e.Dst(), e.EtherType())
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		b    []byte
+		want uint16
+	}{
+		// RFC 1071 第 3 节的例子, 和为 ddf2
+		{"rfc1071", []byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7}, ^uint16(0xddf2)},
+		{"ipv4 header", []byte{0x45, 0x00, 0x00, 0x73, 0x00, 0x00, 0x40, 0x00, 0x40, 0x11, 0x00, 0x00,
+			0xc0, 0xa8, 0x00, 0x01, 0xc0, 0xa8, 0x00, 0xc7}, 0xb861},
+		{"odd length", []byte{0x01, 0x02, 0x03}, ^uint16(0x0102 + 0x0300)},
+		{"empty", nil, 0xffff},
+		{"carry", []byte{0xff, 0xff, 0xff, 0xff, 0x00, 0x01}, ^uint16(0x0001)},
+	} {
+		if got := Checksum(tt.b); got != tt.want {
+			t.Errorf("%s: Checksum = %#04x, want %#04x", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPseudoHeaderSum(t *testing.T) {
+	// 按 RFC 768/8200 逐字节构造的伪首部
+	v4 := append(append(append([]byte(nil), ip4A.To4()...), ip4B.To4()...), 0, IPProtocolUDP, 0x05, 0xdc)
+	if got, want := Fold(PseudoHeaderSum(ip4A.To4(), ip4B.To4(), IPProtocolUDP, 1500)), Checksum(v4); got != want {
+		t.Errorf("IPv4 pseudo header %#04x, want %#04x", got, want)
+	}
+	v6 := append(append(append([]byte(nil), ip6A...), ip6B...), 0, 0x01, 0x00, 0x00, 0, 0, 0, IPProtocolTCP)
+	if got, want := Fold(PseudoHeaderSum(ip6A, ip6B, IPProtocolTCP, 65536)), Checksum(v6); got != want {
+		t.Errorf("IPv6 pseudo header %#04x, want %#04x", got, want)
+	}
+}
+
+func TestValidChecksum(t *testing.T) {
+	pl := []byte("hello, world!") // 奇数长度
+	frames := map[string][]byte{
+		"udp4":  build(t, pl, udp, ipv4, eth),
+		"tcp4":  build(t, pl, tcp([]byte{2, 4, 5, 0xb4}), ipv4, vlan(1), eth),
+		"icmp4": build(t, pl, icmp4, ipv4, eth),
+		"udp6":  build(t, pl, udp, ipv6(0), eth),
+		"tcp6":  build(t, pl, tcp(nil), ipv6(0), eth),
+		"icmp6": build(t, pl, func(b *Buffer) error { return b.PushICMPv6(ICMPv6EchoRequest, 0, 1) }, ipv6(0), eth),
+	}
+	for name, f := range frames {
+		var p Packet
+		if err := p.Parse(f); err != nil {
+			t.Fatal(err)
+		}
+		if ip := p.IPv4(); ip != nil && !ip.ValidChecksum() {
+			t.Errorf("%s: bad IPv4 header checksum", name)
+		}
+		if !p.ValidL4Checksum() {
+			t.Errorf("%s: bad L4 checksum", name)
+		}
+		f[len(f)-1] ^= 0x40
+		if p.ValidL4Checksum() {
+			t.Errorf("%s: corrupted payload passes L4 checksum", name)
+		}
+		if ip := p.IPv4(); ip != nil {
+			ip[8]--
+			if ip.ValidChecksum() {
+				t.Errorf("%s: corrupted TTL passes header checksum", name)
+			}
+		}
+	}
+	// IPv4 UDP 校验和为 0 表示未计算
+	f := build(t, pl, udp, ipv4, eth)
+	binary.BigEndian.PutUint16(f[34+6:], 0)
+	var p Packet
+	p.Parse(f)
+	if !p.ValidL4Checksum() {
+		t.Error("UDP over IPv4 without checksum is not valid")
+	}
+}
+
+// 解析与读取各层不分配内存
+func TestParseAllocs(t *testing.T) {
+	pl := []byte{1, 2, 3, 4}
+	frames := [][]byte{
+		build(t, pl, udp, ipv4, vlan(5), eth),
+		build(t, pl, tcp(nil), ext(IPProtocolTCP, 8), ipv6(IPProtocolHopByHop), eth),
+		build(t, pl, icmp4, ipv4, eth),
+		frag4(build(t, pl, udp, ipv4, eth), 10, false),
+		make([]byte, 10),
+	}
+	var p Packet
+	var sink int
+	allocs := testing.AllocsPerRun(100, func() {
+		for _, f := range frames {
+			p.Parse(f)
+			sink += len(p.Ethernet()) + len(p.IPv4()) + len(p.IPv6()) + len(p.TCP()) + len(p.UDP()) + len(p.ICMP())
+			sink += len(p.Payload()) + len(p.L4())
+			if p.ValidL4Checksum() {
+				sink++
+			}
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("%v allocations per run", allocs)
+	}
+}
@@ -0,0 +1,205 @@
+package packet
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// UpdateChecksum 16 位字段由 old 改为 new 后增量更新校验和 (RFC 1624 式 3: HC' = ~(~HC + ~m + m'))
+func UpdateChecksum(csum, old, new uint16) uint16 {
+	sum := uint32(^csum) + uint32(^old) + uint32(new)
+	return Fold(sum)
+}
+
+// UpdateChecksum32 32 位字段改变后增量更新校验和
+func UpdateChecksum32(csum uint16, old, new uint32) uint16 {
+	csum = UpdateChecksum(csum, uint16(old>>16), uint16(new>>16))
+	return UpdateChecksum(csum, uint16(old), uint16(new))
+}
+
+// UpdateChecksumBytes 一段偶数长度数据(如 IP 地址)改变后增量更新校验和
+func UpdateChecksumBytes(csum uint16, old, new []byte) uint16 {
+	sum := uint32(^csum)
+	for i := 0; i+1 < len(old) && i+1 < len(new); i += 2 {
+		sum += uint32(^binary.BigEndian.Uint16(old[i:])) + uint32(binary.BigEndian.Uint16(new[i:]))
+	}
+	return Fold(sum)
+}
+
+// SetChecksum 重新计算 IPv4 头部校验和
+func (ip IPv4) SetChecksum() {
+	binary.BigEndian.PutUint16(ip[10:], 0)
+	binary.BigEndian.PutUint16(ip[10:], Checksum(ip[:ip.HeaderLen()]))
+}
+
+// SetL4Checksum 重新计算整个 TCP/UDP/ICMP/ICMPv6 校验和
+func (p *Packet) SetL4Checksum() {
+	l4 := p.L4()
+	if l4 == nil || p.Fragment {
+		return
+	}
+	off := p.l4ChecksumOff()
+	binary.BigEndian.PutUint16(l4[off:], 0)
+	var sum uint32
+	if p.L4Proto != IPProtocolICMP {
+		if ip := p.IPv4(); ip != nil {
+			sum = PseudoHeaderSum(ip[12:16], ip[16:20], p.L4Proto, len(l4))
+		} else if ip := p.IPv6(); ip != nil {
+			sum = PseudoHeaderSum(ip[8:24], ip[24:40], p.L4Proto, len(l4))
+		}
+	}
+	csum := Fold(Sum(l4, sum))
+	if csum == 0 && p.L4Proto == IPProtocolUDP {
+		csum = 0xffff
+	}
+	binary.BigEndian.PutUint16(l4[off:], csum)
+}
+
+// SetL4PseudoChecksum 用于校验和卸载 (CHECKSUM_PARTIAL): TCP/UDP 校验和字段写入伪首部累加值,
+// 由网卡从 start (相对帧起始) 开始计算并写入 start+offset 处. 其它协议或分片返回 false
+func (p *Packet) SetL4PseudoChecksum() (start, offset int, ok bool) {
+	l4 := p.L4()
+	if l4 == nil || p.Fragment || (p.L4Proto != IPProtocolTCP && p.L4Proto != IPProtocolUDP) {
+		return 0, 0, false
+	}
+	var sum uint32
+	if ip := p.IPv4(); ip != nil {
+		sum = PseudoHeaderSum(ip[12:16], ip[16:20], p.L4Proto, len(l4))
+	} else if ip := p.IPv6(); ip != nil {
+		sum = PseudoHeaderSum(ip[8:24], ip[24:40], p.L4Proto, len(l4))
+	} else {
+		return 0, 0, false
+	}
+	offset = p.l4ChecksumOff()
+	// 不取反, 网卡对整个 L4 (含此字段) 求和后取反
+	binary.BigEndian.PutUint16(l4[offset:], ^Fold(sum))
+	return p.L4Off, offset, true
+}
+
+func (p *Packet) l4ChecksumOff() int {
+	switch p.L4Proto {
+	case IPProtocolTCP:
+		return 16
+	case IPProtocolUDP:
+		return 6
+	}
+	return 2
+}
+
+// updateL4Checksum L4 校验和覆盖了 old->new 的改变(端口或伪首部中的地址)
+func (p *Packet) updateL4Checksum(old, new []byte, pseudo bool) {
+	if p.L4Off < 0 || p.Fragment {
+		return
+	}
+	if pseudo && p.L4Proto == IPProtocolICMP {
+		return
+	}
+	l4 := p.Data[p.L4Off:]
+	off := p.l4ChecksumOff()
+	csum := binary.BigEndian.Uint16(l4[off:])
+	if p.L4Proto == IPProtocolUDP && csum == 0 && p.IPv4() != nil {
+		return // 未计算校验和
+	}
+	csum = UpdateChecksumBytes(csum, old, new)
+	if csum == 0 && p.L4Proto == IPProtocolUDP {
+		csum = 0xffff
+	}
+	binary.BigEndian.PutUint16(l4[off:], csum)
+}
+
+// setIP 改写 IP 地址字段并增量更新 IPv4 头与 L4 校验和
+func (p *Packet) setIP(field []byte, addr net.IP) {
+	var tmp [16]byte
+	old := tmp[:len(field)]
+	copy(old, field)
+	copy(field, addr)
+	if ip := p.IPv4(); ip != nil {
+		binary.BigEndian.PutUint16(ip[10:], UpdateChecksumBytes(ip.Checksum(), old, field))
+	}
+	p.updateL4Checksum(old, field, true)
+}
+
+// SetSrcIP 改写源地址, addr 须与包的 IP 版本一致
+func (p *Packet) SetSrcIP(addr net.IP) {
+	if ip := p.IPv4(); ip != nil {
+		p.setIP(ip[12:16], addr.To4())
+	} else if ip := p.IPv6(); ip != nil {
+		p.setIP(ip[8:24], addr.To16())
+	}
+}
+
+// SetDstIP 改写目的地址, addr 须与包的 IP 版本一致
+func (p *Packet) SetDstIP(addr net.IP) {
+	if ip := p.IPv4(); ip != nil {
+		p.setIP(ip[16:20], addr.To4())
+	} else if ip := p.IPv6(); ip != nil {
+		p.setIP(ip[24:40], addr.To16())
+	}
+}
+
+func (p *Packet) setPort(off int, port uint16) {
+	if p.L4Off < 0 || (p.L4Proto != IPProtocolTCP && p.L4Proto != IPProtocolUDP) {
+		return
+	}
+	field := p.Data[p.L4Off+off : p.L4Off+off+2]
+	var old, new [2]byte
+	copy(old[:], field)
+	binary.BigEndian.PutUint16(new[:], port)
+	copy(field, new[:])
+	p.updateL4Checksum(old[:], new[:], false)
+}
+
+func (p *Packet) SetSrcPort(port uint16) { p.setPort(0, port) }
+func (p *Packet) SetDstPort(port uint16) { p.setPort(2, port) }
+
+// DecTTL TTL/HopLimit 减 1, 已为 0 时返回 false
+func (p *Packet) DecTTL() bool {
+	if ip := p.IPv4(); ip != nil {
+		if ip[8] == 0 {
+			return false
+		}
+		old := binary.BigEndian.Uint16(ip[8:])
+		ip[8]--
+		binary.BigEndian.PutUint16(ip[10:], UpdateChecksum(ip.Checksum(), old, binary.BigEndian.Uint16(ip[8:])))
+		return true
+	}
+	if ip := p.IPv6(); ip != nil {
+		if ip[7] == 0 {
+			return false
+		}
+		ip[7]--
+		return true
+	}
+	return false
+}
+
+// SwapMAC 交换源/目的 MAC
+func (p *Packet) SwapMAC() {
+	var tmp [6]byte
+	copy(tmp[:], p.Data[0:6])
+	copy(p.Data[0:6], p.Data[6:12])
+	copy(p.Data[6:12], tmp[:])
+}
+
+// SwapIP 交换源/目的 IP, 校验和不变
+func (p *Packet) SwapIP() {
+	var tmp [16]byte
+	if ip := p.IPv4(); ip != nil {
+		copy(tmp[:4], ip[12:16])
+		copy(ip[12:16], ip[16:20])
+		copy(ip[16:20], tmp[:4])
+	} else if ip := p.IPv6(); ip != nil {
+		copy(tmp[:], ip[8:24])
+		copy(ip[8:24], ip[24:40])
+		copy(ip[24:40], tmp[:])
+	}
+}
+
+// SwapPorts 交换 TCP/UDP 源/目的端口, 校验和不变
+func (p *Packet) SwapPorts() {
+	if p.L4Off < 0 || (p.L4Proto != IPProtocolTCP && p.L4Proto != IPProtocolUDP) {
+		return
+	}
+	l4 := p.Data[p.L4Off:]
+	l4[0], l4[1], l4[2], l4[3] = l4[2], l4[3], l4[0], l4[1]
+}
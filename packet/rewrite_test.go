@@ -0,0 +1,206 @@
+package packet
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+// sameChecksum 0x0000 与 0xffff 在反码运算中都表示 0, 增量更新可能得到其中任一个
+func sameChecksum(a, b uint16) bool {
+	return a == b || (a|b == 0xffff && a&b == 0)
+}
+
+// ipv4Header 随机的 20 字节 IPv4 头, 校验和已填写
+func ipv4Header(r *rand.Rand) IPv4 {
+	h := make(IPv4, IPv4MinLen)
+	r.Read(h)
+	h[0] = 0x45
+	h.SetChecksum()
+	return h
+}
+
+func TestUpdateChecksum(t *testing.T) {
+	// RFC 1624 第 4 节: 式 3 得到 0x0000 而不是式 2 的 0xffff
+	if got := UpdateChecksum(0xdd2f, 0x5555, 0x3285); got != 0x0000 {
+		t.Errorf("RFC 1624 example: %#04x, want 0x0000", got)
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		h := ipv4Header(r)
+		var off int
+		var old, new []byte
+		var got uint16
+		switch i % 3 {
+		case 0: // 16 位字段, 跳过版本/IHL 与校验和本身
+			for off = 2 + 2*r.Intn(9); off == 10; off = 2 + 2*r.Intn(9) {
+			}
+			old = append([]byte(nil), h[off:off+2]...)
+			new = []byte{byte(r.Intn(256)), byte(r.Intn(256))}
+			if i%7 == 0 {
+				new = []byte{0xff, 0xff}
+			}
+			got = UpdateChecksum(h.Checksum(), binary.BigEndian.Uint16(old), binary.BigEndian.Uint16(new))
+		case 1: // 32 位字段: 地址
+			off = 12 + 4*r.Intn(2)
+			old = append([]byte(nil), h[off:off+4]...)
+			new = make([]byte, 4)
+			r.Read(new)
+			got = UpdateChecksum32(h.Checksum(), binary.BigEndian.Uint32(old), binary.BigEndian.Uint32(new))
+		case 2: // 任意偶数长度
+			off = 12
+			old = append([]byte(nil), h[off:off+8]...)
+			new = make([]byte, 8)
+			r.Read(new)
+			got = UpdateChecksumBytes(h.Checksum(), old, new)
+		}
+		copy(h[off:], new)
+		h.SetChecksum()
+		if want := h.Checksum(); !sameChecksum(got, want) {
+			t.Fatalf("case %d: %x -> %x at %d: incremental %#04x, recomputed %#04x", i, old, new, off, got, want)
+		}
+		binary.BigEndian.PutUint16(h[10:], got)
+		if !h.ValidChecksum() {
+			t.Fatalf("case %d: header with incremental checksum %#04x does not verify", i, got)
+		}
+	}
+}
+
+// checkRewrite 校验和都正确, 且与整体重新计算一致
+func checkRewrite(t *testing.T, p *Packet, what string) {
+	t.Helper()
+	if ip := p.IPv4(); ip != nil && !ip.ValidChecksum() {
+		t.Errorf("%s: bad IPv4 header checksum", what)
+	}
+	if !p.ValidL4Checksum() {
+		t.Errorf("%s: bad L4 checksum", what)
+	}
+	l4 := p.L4()
+	if l4 == nil {
+		return
+	}
+	off := p.l4ChecksumOff()
+	got := binary.BigEndian.Uint16(l4[off:])
+	if p.L4Proto == IPProtocolUDP && got == 0 && p.IPv4() != nil {
+		return
+	}
+	p.SetL4Checksum()
+	if want := binary.BigEndian.Uint16(l4[off:]); !sameChecksum(got, want) {
+		t.Errorf("%s: L4 checksum %#04x, recomputed %#04x", what, got, want)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	pl := []byte("rewrite payload")
+	newIP4, newIP6 := net.IPv4(203, 0, 113, 7), net.ParseIP("2001:db8:ffff::77")
+	frames := map[string][]byte{
+		"udp4":  build(t, pl, udp, ipv4, eth),
+		"tcp4":  build(t, pl, tcp([]byte{1, 1, 1, 0}), ipv4, vlan(3), eth),
+		"icmp4": build(t, pl, icmp4, ipv4, eth),
+		"udp6":  build(t, pl, udp, ipv6(0), eth),
+		"tcp6":  build(t, pl, tcp(nil), ext(IPProtocolTCP, 8), ipv6(IPProtocolHopByHop), eth),
+		"icmp6": build(t, pl, func(b *Buffer) error { return b.PushICMPv6(ICMPv6EchoRequest, 0, 1) }, ipv6(0), eth),
+	}
+	for name, f := range frames {
+		var p Packet
+		if err := p.Parse(f); err != nil {
+			t.Fatal(err)
+		}
+		// ext 在 PushIPv6 之前压入, Buffer 计算的 L4 校验和包含了扩展头
+		p.SetL4Checksum()
+		src, dst := newIP4, net.IPv4(203, 0, 113, 8)
+		if p.IPv6() != nil {
+			src, dst = newIP6, net.ParseIP("2001:db8:ffff::78")
+		}
+		p.SetSrcIP(src)
+		checkRewrite(t, &p, name+" SetSrcIP")
+		p.SetDstIP(dst)
+		checkRewrite(t, &p, name+" SetDstIP")
+		if ip4, ip6 := p.IPv4(), p.IPv6(); (ip4 != nil && (!ip4.Src().Equal(src) || !ip4.Dst().Equal(dst))) ||
+			(ip6 != nil && (!ip6.Src().Equal(src) || !ip6.Dst().Equal(dst))) {
+			t.Errorf("%s: addresses not rewritten", name)
+		}
+		p.SetSrcPort(5353)
+		checkRewrite(t, &p, name+" SetSrcPort")
+		p.SetDstPort(0xffff)
+		checkRewrite(t, &p, name+" SetDstPort")
+		if tc := p.TCP(); tc != nil && (tc.SrcPort() != 5353 || tc.DstPort() != 0xffff) {
+			t.Errorf("%s: ports %d %d", name, tc.SrcPort(), tc.DstPort())
+		}
+		if u := p.UDP(); u != nil && (u.SrcPort() != 5353 || u.DstPort() != 0xffff) {
+			t.Errorf("%s: ports %d %d", name, u.SrcPort(), u.DstPort())
+		}
+		if !p.DecTTL() {
+			t.Errorf("%s: DecTTL failed", name)
+		}
+		checkRewrite(t, &p, name+" DecTTL")
+		p.SwapIP()
+		p.SwapPorts()
+		p.SwapMAC()
+		checkRewrite(t, &p, name+" Swap")
+		if e := p.Ethernet(); e.Src().String() != macB.String() || e.Dst().String() != macA.String() {
+			t.Errorf("%s: SwapMAC %v > %v", name, e.Src(), e.Dst())
+		}
+		if ip4 := p.IPv4(); ip4 != nil && !ip4.Src().Equal(dst) {
+			t.Errorf("%s: SwapIP src %v", name, ip4.Src())
+		}
+	}
+}
+
+func TestRewriteUDPNoChecksum(t *testing.T) {
+	f := build(t, []byte{1, 2, 3}, udp, ipv4, eth)
+	var p Packet
+	p.Parse(f)
+	binary.BigEndian.PutUint16(p.UDP()[6:], 0)
+	p.SetSrcIP(net.IPv4(10, 1, 2, 3))
+	p.SetDstPort(99)
+	if c := p.UDP().Checksum(); c != 0 {
+		t.Errorf("UDP checksum %#04x, want 0 to stay uncomputed", c)
+	}
+	if !p.IPv4().ValidChecksum() {
+		t.Error("bad IPv4 header checksum")
+	}
+}
+
+func TestDecTTLZero(t *testing.T) {
+	for _, f := range [][]byte{build(t, nil, udp, ipv4, eth), build(t, nil, udp, ipv6(0), eth)} {
+		var p Packet
+		p.Parse(f)
+		if ip := p.IPv4(); ip != nil {
+			ip[8] = 1
+			ip.SetChecksum()
+		} else {
+			p.IPv6()[7] = 1
+		}
+		if !p.DecTTL() || p.DecTTL() {
+			t.Errorf("DecTTL from 1: want true then false")
+		}
+		checkRewrite(t, &p, "DecTTL")
+	}
+}
+
+// 模拟网卡完成 CHECKSUM_PARTIAL 后校验和正确
+func TestSetL4PseudoChecksum(t *testing.T) {
+	pl := []byte("offload")
+	for name, f := range map[string][]byte{
+		"udp4": build(t, pl, udp, ipv4, eth),
+		"tcp6": build(t, pl, tcp(nil), ipv6(0), vlan(2), eth),
+	} {
+		var p Packet
+		p.Parse(f)
+		start, off, ok := p.SetL4PseudoChecksum()
+		if !ok || start != p.L4Off {
+			t.Fatalf("%s: SetL4PseudoChecksum = %d, %d, %v", name, start, off, ok)
+		}
+		binary.BigEndian.PutUint16(f[start+off:], Checksum(f[start:]))
+		if !p.ValidL4Checksum() {
+			t.Errorf("%s: bad checksum after offload", name)
+		}
+	}
+	var p Packet
+	p.Parse(build(t, nil, icmp4, ipv4, eth))
+	if _, _, ok := p.SetL4PseudoChecksum(); ok {
+		t.Error("SetL4PseudoChecksum ok for ICMP")
+	}
+}
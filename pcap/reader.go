@@ -0,0 +1,289 @@
+package pcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	magicMicro = 0xa1b2c3d4
+	blockSPB   = 0x00000003
+
+	// 文件中的长度不可信, 超过时视为格式错误而不是按其分配内存
+	maxCaplen   = DefaultSnaplen
+	maxBlockLen = DefaultSnaplen + 4096 // EPB 头部与选项
+)
+
+var ErrFormat = errors.New("pcap: unknown file format")
+
+// Packet Data 只在下一次 ReadPacket 之前有效
+type Packet struct {
+	Timestamp time.Time
+	Data      []byte
+	OrigLen   int
+	Interface int // pcapng 的 interface id, pcap 为 0
+}
+
+type ngInterface struct {
+	linkType uint16
+	snaplen  uint32
+	tsresol  uint8
+}
+
+// Reader 读取 pcap (微秒/纳秒, 任意字节序) 或 pcapng 文件
+type Reader struct {
+	r        *bufio.Reader
+	file     *os.File
+	order    binary.ByteOrder
+	ng       bool
+	nano     bool
+	linkType uint16
+	ifaces   []ngInterface
+	hdr      [28]byte
+	buf      []byte
+}
+
+func NewReader(r io.Reader) (*Reader, error) {
+	rd := &Reader{r: bufio.NewReaderSize(r, DefaultBufferSize)}
+	magic, err := rd.r.Peek(4)
+	if err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(magic) == blockSHB {
+		rd.ng = true
+		// 读到第一个 IDB 为止, LinkType 在第一个 ReadPacket 之前即可用
+		for len(rd.ifaces) == 0 {
+			if rd.order != nil {
+				if _, err := rd.r.Peek(1); err == io.EOF {
+					break
+				}
+			}
+			if _, err := rd.readBlock(); err != nil {
+				return nil, err
+			}
+		}
+		return rd, nil
+	}
+	return rd, rd.readFileHeader()
+}
+
+// Open 打开文件, Close 时关闭
+func Open(path string) (*Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, errors.WithMessage(err, path)
+	}
+	r.file = f
+	return r, nil
+}
+
+func (r *Reader) Close() error {
+	if r.file != nil {
+		return r.file.Close()
+	}
+	return nil
+}
+
+// LinkType pcap 的链路类型, pcapng 取第一个接口的
+func (r *Reader) LinkType() uint16 {
+	if r.ng && len(r.ifaces) > 0 {
+		return r.ifaces[0].linkType
+	}
+	return r.linkType
+}
+
+func (r *Reader) readFileHeader() error {
+	h := r.hdr[:24]
+	if _, err := io.ReadFull(r.r, h); err != nil {
+		return err
+	}
+	switch {
+	case binary.LittleEndian.Uint32(h) == magicMicro:
+		r.order = binary.LittleEndian
+	case binary.LittleEndian.Uint32(h) == magicNano:
+		r.order, r.nano = binary.LittleEndian, true
+	case binary.BigEndian.Uint32(h) == magicMicro:
+		r.order = binary.BigEndian
+	case binary.BigEndian.Uint32(h) == magicNano:
+		r.order, r.nano = binary.BigEndian, true
+	default:
+		return ErrFormat
+	}
+	r.linkType = uint16(r.order.Uint32(h[20:]))
+	return nil
+}
+
+func (r *Reader) ReadPacket() (Packet, error) {
+	if r.ng {
+		for {
+			p, err := r.readBlock()
+			if err != nil || p.Data != nil {
+				return p, err
+			}
+		}
+	}
+	h := r.hdr[:16]
+	if _, err := io.ReadFull(r.r, h); err != nil {
+		return Packet{}, err
+	}
+	sec, frac := r.order.Uint32(h[0:]), r.order.Uint32(h[4:])
+	if !r.nano {
+		frac *= 1000
+	}
+	caplen := r.order.Uint32(h[8:])
+	if caplen > maxCaplen {
+		return Packet{}, errors.Errorf("pcap: bad caplen %d", caplen)
+	}
+	data, err := r.read(int(caplen))
+	if err != nil {
+		return Packet{}, err
+	}
+	return Packet{
+		Timestamp: time.Unix(int64(sec), int64(frac)),
+		Data:      data,
+		OrigLen:   int(r.order.Uint32(h[12:])),
+	}, nil
+}
+
+// read 读取 n 字节到复用的缓冲
+func (r *Reader) read(n int) ([]byte, error) {
+	if cap(r.buf) < n {
+		r.buf = make([]byte, n)
+	}
+	b := r.buf[:n]
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+// readBlock 读取一个 pcapng block, 是报文时返回的 Packet.Data 非 nil
+func (r *Reader) readBlock() (Packet, error) {
+	h := r.hdr[:8]
+	if _, err := io.ReadFull(r.r, h); err != nil {
+		return Packet{}, err
+	}
+	typ := binary.LittleEndian.Uint32(h)
+	if typ == blockSHB {
+		// 新的 section, 字节序与接口重新开始
+		bom, err := r.r.Peek(4)
+		if err != nil {
+			return Packet{}, err
+		}
+		switch {
+		case binary.LittleEndian.Uint32(bom) == byteOrderBOM:
+			r.order = binary.LittleEndian
+		case binary.BigEndian.Uint32(bom) == byteOrderBOM:
+			r.order = binary.BigEndian
+		default:
+			return Packet{}, ErrFormat
+		}
+		r.ifaces = r.ifaces[:0]
+	}
+	if r.order == nil {
+		return Packet{}, ErrFormat
+	}
+	typ = r.order.Uint32(h)
+	total := int(r.order.Uint32(h[4:]))
+	if total < 12 || total%4 != 0 || total > maxBlockLen {
+		return Packet{}, errors.Errorf("pcap: bad block length %d", total)
+	}
+	body, err := r.read(total - 8)
+	if err != nil {
+		return Packet{}, err
+	}
+	body = body[:total-12]
+	switch typ {
+	case blockIDB:
+		if len(body) < 8 {
+			return Packet{}, ErrFormat
+		}
+		r.ifaces = append(r.ifaces, ngInterface{
+			linkType: r.order.Uint16(body),
+			snaplen:  r.order.Uint32(body[4:]),
+			tsresol:  r.tsresol(body[8:]),
+		})
+	case blockEPB:
+		if len(body) < 20 {
+			return Packet{}, ErrFormat
+		}
+		id := int(r.order.Uint32(body))
+		if id >= len(r.ifaces) {
+			return Packet{}, errors.Errorf("pcap: unknown interface %d", id)
+		}
+		ts := uint64(r.order.Uint32(body[4:]))<<32 | uint64(r.order.Uint32(body[8:]))
+		caplen := int(r.order.Uint32(body[12:]))
+		if 20+caplen > len(body) {
+			return Packet{}, ErrFormat
+		}
+		return Packet{
+			Timestamp: timestamp(ts, r.ifaces[id].tsresol),
+			Data:      body[20 : 20+caplen],
+			OrigLen:   int(r.order.Uint32(body[16:])),
+			Interface: id,
+		}, nil
+	case blockSPB:
+		if len(body) < 4 || len(r.ifaces) == 0 {
+			return Packet{}, ErrFormat
+		}
+		orig := int(r.order.Uint32(body))
+		caplen := orig
+		if snap := int(r.ifaces[0].snaplen); snap > 0 && caplen > snap {
+			caplen = snap
+		}
+		if 4+caplen > len(body) {
+			caplen = len(body) - 4
+		}
+		return Packet{Data: body[4 : 4+caplen], OrigLen: orig}, nil
+	}
+	return Packet{}, nil
+}
+
+// tsresol 从 IDB 选项中取 if_tsresol, 默认微秒
+func (r *Reader) tsresol(opts []byte) uint8 {
+	for len(opts) >= 4 {
+		code, l := r.order.Uint16(opts), int(r.order.Uint16(opts[2:]))
+		if code == optEndOfOpt || 4+l > len(opts) {
+			break
+		}
+		if code == optTsResol && l >= 1 {
+			return opts[4]
+		}
+		opts = opts[4+pad4(l):]
+	}
+	return 6
+}
+
+// timestamp 按 if_tsresol 换算: 最高位为 0 时单位 10^-v 秒, 否则 2^-v 秒
+func timestamp(ts uint64, resol uint8) time.Time {
+	if resol&0x80 != 0 {
+		shift := resol & 0x7f
+		frac := ts & (1<<shift - 1)
+		return time.Unix(int64(ts>>shift), int64(frac*1e9>>shift))
+	}
+	div := uint64(1)
+	for i := uint8(0); i < resol; i++ {
+		div *= 10
+	}
+	sec, frac := ts/div, ts%div
+	for ; resol < 9; resol++ {
+		frac *= 10
+	}
+	for ; resol > 9; resol-- {
+		frac /= 10
+	}
+	return time.Unix(int64(sec), int64(frac))
+}
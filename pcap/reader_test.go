@@ -0,0 +1,261 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// pcapFile 按 order 构造 pcap 文件, 每帧的时间为 sec 秒加 frac (微秒或纳秒)
+func pcapFile(order binary.ByteOrder, magic uint32, frac uint32, data ...[]byte) []byte {
+	h := make([]byte, 24)
+	order.PutUint32(h[0:], magic)
+	order.PutUint16(h[4:], 2)
+	order.PutUint16(h[6:], 4)
+	order.PutUint32(h[16:], 65535)
+	order.PutUint32(h[20:], LinkTypeEthernet)
+	b := h
+	for i, d := range data {
+		r := make([]byte, 16)
+		order.PutUint32(r[0:], uint32(100+i))
+		order.PutUint32(r[4:], frac)
+		order.PutUint32(r[8:], uint32(len(d)))
+		order.PutUint32(r[12:], uint32(len(d)+4))
+		b = append(append(b, r...), d...)
+	}
+	return b
+}
+
+func TestReaderPcap(t *testing.T) {
+	data := [][]byte{{1, 2, 3}, bytes.Repeat([]byte{0xab}, 60)}
+	tests := []struct {
+		name  string
+		order binary.ByteOrder
+		magic uint32
+		frac  uint32
+		nsec  int
+	}{
+		{"micro le", binary.LittleEndian, magicMicro, 654321, 654321000},
+		{"micro be", binary.BigEndian, magicMicro, 654321, 654321000},
+		{"nano le", binary.LittleEndian, magicNano, 987654321, 987654321},
+		{"nano be", binary.BigEndian, magicNano, 987654321, 987654321},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewReader(bytes.NewReader(pcapFile(tt.order, tt.magic, tt.frac, data...)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.LinkType() != LinkTypeEthernet {
+				t.Errorf("LinkType %d", r.LinkType())
+			}
+			for i, p := range readAll(t, r) {
+				if !bytes.Equal(p.Data, data[i]) || p.OrigLen != len(data[i])+4 {
+					t.Errorf("packet %d: % x orig %d", i, p.Data, p.OrigLen)
+				}
+				if want := time.Unix(int64(100+i), int64(tt.nsec)); !p.Timestamp.Equal(want) {
+					t.Errorf("packet %d: timestamp %v, want %v", i, p.Timestamp, want)
+				}
+			}
+		})
+	}
+	if _, err := NewReader(bytes.NewReader(make([]byte, 24))); err != ErrFormat {
+		t.Errorf("unknown magic: %v", err)
+	}
+}
+
+// ngBuilder 按 order 构造 pcapng 文件
+type ngBuilder struct {
+	order binary.ByteOrder
+	b     []byte
+}
+
+func (w *ngBuilder) block(typ uint32, body []byte) {
+	body = append(body, make([]byte, pad4(len(body))-len(body))...)
+	n := make([]byte, 4)
+	w.order.PutUint32(n, uint32(12+len(body)))
+	t := make([]byte, 4)
+	w.order.PutUint32(t, typ)
+	w.b = append(append(append(append(w.b, t...), n...), body...), n...)
+}
+
+func (w *ngBuilder) shb() {
+	body := make([]byte, 16)
+	w.order.PutUint32(body[0:], byteOrderBOM)
+	w.order.PutUint16(body[4:], 1)
+	binary.LittleEndian.PutUint64(body[8:], ^uint64(0))
+	w.block(blockSHB, body)
+}
+
+// idb resol 为 0 时不带 if_tsresol 选项
+func (w *ngBuilder) idb(snaplen uint32, resol uint8) {
+	body := make([]byte, 8)
+	w.order.PutUint16(body[0:], LinkTypeEthernet)
+	w.order.PutUint32(body[4:], snaplen)
+	if resol != 0 {
+		opt := make([]byte, 8)
+		w.order.PutUint16(opt[0:], optTsResol)
+		w.order.PutUint16(opt[2:], 1)
+		opt[4] = resol
+		body = append(append(body, opt...), 0, 0, 0, 0)
+	}
+	w.block(blockIDB, body)
+}
+
+func (w *ngBuilder) epb(id uint32, ts uint64, data []byte) {
+	body := make([]byte, 20)
+	w.order.PutUint32(body[0:], id)
+	w.order.PutUint32(body[4:], uint32(ts>>32))
+	w.order.PutUint32(body[8:], uint32(ts))
+	w.order.PutUint32(body[12:], uint32(len(data)))
+	w.order.PutUint32(body[16:], uint32(len(data)))
+	w.block(blockEPB, append(body, data...))
+}
+
+func (w *ngBuilder) spb(orig int, data []byte) {
+	body := make([]byte, 4)
+	w.order.PutUint32(body, uint32(orig))
+	w.block(blockSPB, append(body, data...))
+}
+
+func TestReaderPcapng(t *testing.T) {
+	sec := uint64(1700000000)
+	resols := []struct {
+		resol uint8
+		ts    uint64
+		want  time.Time
+	}{
+		{0, sec*1e6 + 250000, time.Unix(int64(sec), 250000000)}, // 默认微秒
+		{6, sec*1e6 + 1, time.Unix(int64(sec), 1000)},
+		{9, sec*1e9 + 123456789, time.Unix(int64(sec), 123456789)},
+		{3, sec*1e3 + 7, time.Unix(int64(sec), 7000000)},
+		{12, 1e6*1e12 + 123456789012, time.Unix(1e6, 123456789)},
+		{0x80 | 20, sec<<20 | 1<<19, time.Unix(int64(sec), 500000000)}, // 2^-20 秒
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		t.Run(order.String(), func(t *testing.T) {
+			w := &ngBuilder{order: order}
+			w.shb()
+			for i, r := range resols {
+				snaplen := uint32(0)
+				if i == 0 {
+					snaplen = 4 // SPB 按第一个接口的 snaplen 截断
+				}
+				w.idb(snaplen, r.resol)
+			}
+			w.block(0x00000004, make([]byte, 8)) // 未知 block 被跳过
+			for i, r := range resols {
+				w.epb(uint32(i), r.ts, []byte{byte(i), 1, 2})
+			}
+			w.spb(10, make([]byte, 10))
+			// 新的 section 换用另一种字节序, 接口重新编号
+			w2 := &ngBuilder{order: binary.BigEndian}
+			if order == binary.BigEndian {
+				w2.order = binary.LittleEndian
+			}
+			w2.shb()
+			w2.idb(0, 9)
+			w2.epb(0, 5, []byte{9})
+
+			r, err := NewReader(bytes.NewReader(append(w.b, w2.b...)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ps := readAll(t, r)
+			if len(ps) != len(resols)+2 {
+				t.Fatalf("%d packets", len(ps))
+			}
+			for i, res := range resols {
+				p := ps[i]
+				if p.Interface != i || !bytes.Equal(p.Data, []byte{byte(i), 1, 2}) || p.OrigLen != 3 {
+					t.Errorf("packet %d: interface %d % x", i, p.Interface, p.Data)
+				}
+				if !p.Timestamp.Equal(res.want) {
+					t.Errorf("if_tsresol %#x: timestamp %v, want %v", res.resol, p.Timestamp, res.want)
+				}
+			}
+			if p := ps[len(resols)]; len(p.Data) != 4 || p.OrigLen != 10 {
+				t.Errorf("SPB: %d/%d bytes", len(p.Data), p.OrigLen)
+			}
+			if p := ps[len(resols)+1]; p.Interface != 0 || !p.Timestamp.Equal(time.Unix(0, 5)) || len(r.ifaces) != 1 {
+				t.Errorf("second section: interface %d timestamp %v, %d interfaces", p.Interface, p.Timestamp, len(r.ifaces))
+			}
+		})
+	}
+	// 只有 SHB 的文件
+	w := &ngBuilder{order: binary.LittleEndian}
+	w.shb()
+	r, err := NewReader(bytes.NewReader(w.b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ReadPacket(); err != io.EOF {
+		t.Errorf("empty section: %v", err)
+	}
+}
+
+// readErr 读取第一帧应当失败, 且不按文件中的长度分配内存
+func readErr(t *testing.T, f []byte) error {
+	t.Helper()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	r, err := NewReader(bytes.NewReader(f))
+	if err == nil {
+		_, err = r.ReadPacket()
+	}
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 2*DefaultBufferSize {
+		t.Errorf("allocated %d bytes", n)
+	}
+	return err
+}
+
+func TestReaderBadLength(t *testing.T) {
+	f := pcapFile(binary.LittleEndian, magicNano, 0, []byte{1})
+	binary.LittleEndian.PutUint32(f[24+8:], 0xfffffff0)
+	if err := readErr(t, f); err == nil {
+		t.Error("pcap caplen 0xfffffff0 accepted")
+	}
+
+	for _, total := range []uint32{8, 30, maxBlockLen + 4, 0xfffffffc} {
+		w := &ngBuilder{order: binary.LittleEndian}
+		w.shb()
+		w.idb(0, 0)
+		w.epb(0, 0, []byte{1, 2, 3, 4})
+		binary.LittleEndian.PutUint32(w.b[len(w.b)-36+4:], total)
+		if err := readErr(t, w.b); err == nil {
+			t.Errorf("block length %d accepted", total)
+		}
+	}
+	// EPB 的 caplen 超出 block
+	w := &ngBuilder{order: binary.LittleEndian}
+	w.shb()
+	w.idb(0, 0)
+	w.epb(0, 0, []byte{1, 2, 3, 4})
+	binary.LittleEndian.PutUint32(w.b[len(w.b)-36+20:], 0xfffffff0)
+	if err := readErr(t, w.b); err != ErrFormat {
+		t.Errorf("EPB caplen beyond block: %v", err)
+	}
+}
+
+func TestReaderAllocs(t *testing.T) {
+	var buf bytes.Buffer
+	w, _ := NewWriter(&buf, &Config{Format: FormatPcapng})
+	for i := 0; i < 200; i++ {
+		w.WritePacket(0, time.Unix(int64(i), 0), make([]byte, 1500))
+	}
+	w.Close()
+	r, _ := NewReader(bytes.NewReader(buf.Bytes()))
+	r.ReadPacket()
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, err := r.ReadPacket(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("%v allocations per ReadPacket", allocs)
+	}
+}
@@ -0,0 +1,213 @@
+package pcap
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/lixiangzhong/xdp"
+)
+
+// ReplayConfig PPS 与 BPS 都为 0 时按文件中的时间间隔发送
+type ReplayConfig struct {
+	Loop      int     // 回放次数, 0 为 1 次, 负数为无限次
+	PPS       float64 // 目标包速率
+	BPS       float64 // 目标比特率(以太网帧长度, 不含前导码与帧间隔)
+	Speed     float64 // 按原始间隔发送时的倍速, 0 为 1
+	Fast      bool    // 忽略时间间隔, 尽可能快地发送
+	BatchSize int     // 每次 Write 的帧数, 0 为 64
+}
+
+type ReplayStats struct {
+	Packets  uint64
+	Bytes    uint64
+	Skipped  uint64 // 超过 Socket.MaxWriteLen 无法放入一个 frame 而跳过的包
+	Loops    int
+	Duration time.Duration
+}
+
+func (s ReplayStats) PPS() float64 {
+	if s.Duration <= 0 {
+		return 0
+	}
+	return float64(s.Packets) / s.Duration.Seconds()
+}
+
+func (s ReplayStats) BPS() float64 {
+	if s.Duration <= 0 {
+		return 0
+	}
+	return float64(s.Bytes) * 8 / s.Duration.Seconds()
+}
+
+func (s ReplayStats) String() string {
+	str := fmt.Sprintf("%d packets %d bytes in %v (%.0f pps, %.0f bps)",
+		s.Packets, s.Bytes, s.Duration, s.PPS(), s.BPS())
+	if s.Skipped > 0 {
+		str += fmt.Sprintf(", %d oversized skipped", s.Skipped)
+	}
+	return str
+}
+
+// Replay 从 sock 的 TX ring 回放文件 path, ctx 取消时提前返回. 帧由 Socket.Write 拷贝到 umem frame,
+// frame 或 TX ring 暂时不足时等待内核完成发送后重试, 不丢包. 超过 Socket.MaxWriteLen 的包跳过, 计入 Skipped
+func Replay(ctx context.Context, sock *xdp.Socket, path string, cfg *ReplayConfig) (ReplayStats, error) {
+	var c ReplayConfig
+	if cfg != nil {
+		c = *cfg
+	}
+	if c.Speed <= 0 {
+		c.Speed = 1
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = 64
+	}
+	rp := &replayer{ctx: ctx, sock: sock, cfg: c}
+	if !c.Fast && (c.PPS > 0 || c.BPS > 0) {
+		var err error
+		rp.pacer, err = xdp.NewPacer(sock, &xdp.PacerConfig{PPS: c.PPS, BPS: c.BPS})
+		if err != nil {
+			return ReplayStats{}, err
+		}
+	}
+	rp.start = time.Now()
+	loops := c.Loop
+	if loops == 0 {
+		loops = 1
+	}
+	var err error
+	for c.Loop < 0 || rp.stats.Loops < loops {
+		if err = rp.replayFile(path); err != nil {
+			break
+		}
+		rp.stats.Loops++
+	}
+	if err == nil {
+		err = rp.flush()
+	}
+	rp.stats.Duration = time.Since(rp.start)
+	return rp.stats, err
+}
+
+type replayer struct {
+	ctx   context.Context
+	sock  *xdp.Socket
+	pacer *xdp.Pacer // 按 PPS/BPS 发送, 否则为 nil
+	cfg   ReplayConfig
+	start time.Time
+	stats ReplayStats
+
+	batch  [][]byte
+	bufs   [][]byte
+	offset time.Duration // 循环回放时之前各轮占用的时间
+	last   time.Duration
+}
+
+func (rp *replayer) replayFile(path string) error {
+	r, err := Open(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	var first time.Time
+	for {
+		p, err := r.ReadPacket()
+		if err == io.EOF {
+			rp.offset += rp.last
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(p.Data) > rp.sock.MaxWriteLen() {
+			rp.stats.Skipped++
+			continue
+		}
+		if first.IsZero() {
+			first = p.Timestamp
+		}
+		rel := p.Timestamp.Sub(first)
+		if rel < 0 {
+			rel = 0
+		}
+		rp.last = rel
+		due := rp.due(rp.offset + rel)
+		if wait := time.Until(due); wait > 0 {
+			if err := rp.flush(); err != nil {
+				return err
+			}
+			if err := rp.sleep(time.Until(due)); err != nil {
+				return err
+			}
+		}
+		rp.queue(p.Data)
+		if len(rp.batch) >= rp.cfg.BatchSize {
+			if err := rp.flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// due 按文件中的时间间隔发送时包的发送时间, Fast 或限速时不等待 (限速由 pacer 完成)
+func (rp *replayer) due(rel time.Duration) time.Time {
+	if rp.cfg.Fast || rp.pacer != nil {
+		return rp.start
+	}
+	return rp.start.Add(time.Duration(float64(rel) / rp.cfg.Speed))
+}
+
+// queue 数据在下一次 ReadPacket 时失效, 先拷贝到复用的缓冲
+func (rp *replayer) queue(data []byte) {
+	i := len(rp.batch)
+	if i == len(rp.bufs) {
+		rp.bufs = append(rp.bufs, make([]byte, 0, len(data)))
+	}
+	rp.bufs[i] = append(rp.bufs[i][:0], data...)
+	rp.batch = append(rp.batch, rp.bufs[i])
+}
+
+func (rp *replayer) flush() error {
+	if err := rp.ctx.Err(); err != nil {
+		return err
+	}
+	pending := rp.batch
+	for len(pending) > 0 {
+		var n uint32
+		if rp.pacer != nil {
+			n = rp.pacer.Write(pending...)
+		} else {
+			n = rp.sock.Write(pending...)
+		}
+		for _, b := range pending[:n] {
+			rp.stats.Packets++
+			rp.stats.Bytes += uint64(len(b))
+		}
+		pending = pending[n:]
+		if len(pending) == 0 {
+			break
+		}
+		if err := rp.ctx.Err(); err != nil {
+			return err
+		}
+		// 等待内核发送完成归还 frame
+		time.Sleep(10 * time.Microsecond)
+	}
+	rp.batch = rp.batch[:0]
+	return nil
+}
+
+func (rp *replayer) sleep(d time.Duration) error {
+	if d <= 0 {
+		return rp.ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-rp.ctx.Done():
+		return rp.ctx.Err()
+	}
+}
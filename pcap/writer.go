@@ -0,0 +1,315 @@
+// Package pcap 把 AF_XDP 收到的帧写入 pcap/pcapng 文件, 以及从文件回放.
+//
+// Writer 直接在 HandleRecv 的 handler 中同步拷贝帧数据到带缓冲的输出, frame 随即可回收:
+//
+//	w, _ := pcap.Create("rx.pcapng", &pcap.Config{Format: pcap.FormatPcapng, RotateSize: 1 << 30})
+//	defer w.Close()
+//	go sock.HandleRecv(w.Handler(queue))
+package pcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+type Format int
+
+const (
+	FormatPcap   Format = iota // 纳秒精度的 pcap (magic 0xa1b23c4d)
+	FormatPcapng               // 每个队列一个 Interface Description Block
+)
+
+const (
+	LinkTypeEthernet = 1
+
+	DefaultSnaplen    = 262144
+	DefaultBufferSize = 1 << 20
+)
+
+const (
+	magicNano    = 0xa1b23c4d
+	blockSHB     = 0x0a0d0d0a
+	blockIDB     = 0x00000001
+	blockEPB     = 0x00000006
+	byteOrderBOM = 0x1a2b3c4d
+
+	optEndOfOpt = 0
+	optIfName   = 2
+	optTsResol  = 9
+)
+
+var ErrClosed = errors.New("pcap: writer closed")
+
+type Config struct {
+	Format     Format
+	Snaplen    uint32 // 超过的部分截断, 0 或大于 DefaultSnaplen 时为 DefaultSnaplen (Reader 能读取的最大长度)
+	LinkType   uint16 // 0 为 LinkTypeEthernet
+	BufferSize int    // 写缓冲大小, 0 为 DefaultBufferSize
+	Interface  string // pcapng IDB 的名字前缀, 为 "eth0" 时队列 3 记为 "eth0:3"
+
+	// 以下只对 Create 有效. 达到大小或时间后关闭当前文件, 新文件名为 path.1 path.2 ...
+	RotateSize     int64
+	RotateInterval time.Duration
+}
+
+// Writer 并发安全, 多个队列的 HandleRecv 可以写同一个 Writer
+type Writer struct {
+	mu     sync.Mutex
+	cfg    Config
+	buf    *bufio.Writer
+	file   *os.File
+	path   string
+	seq    int
+	size   int64
+	opened time.Time
+	ifaces map[int]uint32 // 队列 -> 当前 section 的 interface id
+	hdr    [32]byte
+	closed bool
+
+	Packets uint64 // 已写入的帧数与原始字节数
+	Bytes   uint64
+}
+
+// NewWriter 写入 w, 不做文件轮转. cfg 为 nil 时为 pcap 格式
+func NewWriter(w io.Writer, cfg *Config) (*Writer, error) {
+	wr := newWriter(cfg)
+	wr.buf = bufio.NewWriterSize(w, wr.cfg.BufferSize)
+	if err := wr.writeHeader(); err != nil {
+		return nil, err
+	}
+	return wr, nil
+}
+
+// Create 创建文件 path, 按 RotateSize/RotateInterval 轮转
+func Create(path string, cfg *Config) (*Writer, error) {
+	wr := newWriter(cfg)
+	wr.path = path
+	if err := wr.openFile(); err != nil {
+		return nil, err
+	}
+	return wr, nil
+}
+
+func newWriter(cfg *Config) *Writer {
+	w := new(Writer)
+	if cfg != nil {
+		w.cfg = *cfg
+	}
+	if w.cfg.Snaplen == 0 || w.cfg.Snaplen > DefaultSnaplen {
+		w.cfg.Snaplen = DefaultSnaplen
+	}
+	if w.cfg.LinkType == 0 {
+		w.cfg.LinkType = LinkTypeEthernet
+	}
+	if w.cfg.BufferSize == 0 {
+		w.cfg.BufferSize = DefaultBufferSize
+	}
+	return w
+}
+
+func (w *Writer) openFile() error {
+	name := w.path
+	if w.seq > 0 {
+		name = fmt.Sprintf("%s.%d", w.path, w.seq)
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	w.file = f
+	if w.buf == nil {
+		w.buf = bufio.NewWriterSize(f, w.cfg.BufferSize)
+	} else {
+		w.buf.Reset(f)
+	}
+	return w.writeHeader()
+}
+
+func (w *Writer) rotate() error {
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.seq++
+	return w.openFile()
+}
+
+// writeHeader pcap 文件头或 pcapng SHB, 开始新的 section
+func (w *Writer) writeHeader() error {
+	w.size = 0
+	w.opened = time.Now()
+	w.ifaces = make(map[int]uint32)
+	h := w.hdr[:]
+	le := binary.LittleEndian
+	if w.cfg.Format == FormatPcapng {
+		le.PutUint32(h[0:], blockSHB)
+		le.PutUint32(h[4:], 28)
+		le.PutUint32(h[8:], byteOrderBOM)
+		le.PutUint16(h[12:], 1)
+		le.PutUint16(h[14:], 0)
+		le.PutUint64(h[16:], ^uint64(0)) // section length 未知
+		le.PutUint32(h[24:], 28)
+		return w.write(h[:28])
+	}
+	le.PutUint32(h[0:], magicNano)
+	le.PutUint16(h[4:], 2)
+	le.PutUint16(h[6:], 4)
+	le.PutUint32(h[8:], 0)  // thiszone
+	le.PutUint32(h[12:], 0) // sigfigs
+	le.PutUint32(h[16:], w.cfg.Snaplen)
+	le.PutUint32(h[20:], uint32(w.cfg.LinkType))
+	return w.write(h[:24])
+}
+
+func (w *Writer) write(b []byte) error {
+	n, err := w.buf.Write(b)
+	w.size += int64(n)
+	return err
+}
+
+// writeIDB 队列在当前 section 第一次出现时写入 IDB, 返回 interface id
+func (w *Writer) writeIDB(queue int) (uint32, error) {
+	if id, ok := w.ifaces[queue]; ok {
+		return id, nil
+	}
+	id := uint32(len(w.ifaces))
+	w.ifaces[queue] = id
+	name := fmt.Sprintf("%s:%d", w.cfg.Interface, queue)
+	if w.cfg.Interface == "" {
+		name = fmt.Sprintf("queue%d", queue)
+	}
+	nameLen := pad4(len(name))
+	total := 20 + 4 + nameLen + 4 + 4 + 4
+	b := make([]byte, total)
+	le := binary.LittleEndian
+	le.PutUint32(b[0:], blockIDB)
+	le.PutUint32(b[4:], uint32(total))
+	le.PutUint16(b[8:], w.cfg.LinkType)
+	le.PutUint32(b[12:], w.cfg.Snaplen)
+	off := 16
+	le.PutUint16(b[off:], optIfName)
+	le.PutUint16(b[off+2:], uint16(len(name)))
+	copy(b[off+4:], name)
+	off += 4 + nameLen
+	le.PutUint16(b[off:], optTsResol)
+	le.PutUint16(b[off+2:], 1)
+	b[off+4] = 9 // 10^-9 秒
+	off += 8
+	le.PutUint32(b[off:], optEndOfOpt) // opt_endofopt
+	off += 4
+	le.PutUint32(b[off:], uint32(total))
+	return id, w.write(b)
+}
+
+// WritePacket 写入 queue 上收到的一帧, 超过 Snaplen 的部分截断
+func (w *Writer) WritePacket(queue int, ts time.Time, data []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	caplen := len(data)
+	if caplen > int(w.cfg.Snaplen) {
+		caplen = int(w.cfg.Snaplen)
+	}
+	if w.file != nil && w.size > 0 {
+		if (w.cfg.RotateSize > 0 && w.size+int64(caplen)+32 > w.cfg.RotateSize) ||
+			(w.cfg.RotateInterval > 0 && ts.Sub(w.opened) >= w.cfg.RotateInterval) {
+			if err := w.rotate(); err != nil {
+				return err
+			}
+		}
+	}
+	h := w.hdr[:]
+	le := binary.LittleEndian
+	if w.cfg.Format == FormatPcapng {
+		id, err := w.writeIDB(queue)
+		if err != nil {
+			return err
+		}
+		padded := pad4(caplen)
+		total := uint32(28 + padded + 4)
+		nano := uint64(ts.UnixNano())
+		le.PutUint32(h[0:], blockEPB)
+		le.PutUint32(h[4:], total)
+		le.PutUint32(h[8:], id)
+		le.PutUint32(h[12:], uint32(nano>>32))
+		le.PutUint32(h[16:], uint32(nano))
+		le.PutUint32(h[20:], uint32(caplen))
+		le.PutUint32(h[24:], uint32(len(data)))
+		if err := w.write(h[:28]); err != nil {
+			return err
+		}
+		if err := w.write(data[:caplen]); err != nil {
+			return err
+		}
+		pad := padded - caplen
+		le.PutUint32(h[0:], 0)
+		le.PutUint32(h[pad:], total)
+		if err := w.write(h[:pad+4]); err != nil {
+			return err
+		}
+	} else {
+		le.PutUint32(h[0:], uint32(ts.Unix()))
+		le.PutUint32(h[4:], uint32(ts.Nanosecond()))
+		le.PutUint32(h[8:], uint32(caplen))
+		le.PutUint32(h[12:], uint32(len(data)))
+		if err := w.write(h[:16]); err != nil {
+			return err
+		}
+		if err := w.write(data[:caplen]); err != nil {
+			return err
+		}
+	}
+	w.Packets++
+	w.Bytes += uint64(len(data))
+	return nil
+}
+
+// Handler 用于 Socket.HandleRecv, 记录 queue 上的每一帧后回收 frame. 写入出错时丢弃该帧
+func (w *Writer) Handler(queue int) func(unix.XDPDesc, []byte) bool {
+	return func(_ unix.XDPDesc, data []byte) bool {
+		w.WritePacket(queue, time.Now(), data)
+		return true
+	}
+}
+
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	return w.buf.Flush()
+}
+
+// Close 写出缓冲, Create 打开的文件随之关闭
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	err := w.buf.Flush()
+	if w.file != nil {
+		if e := w.file.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
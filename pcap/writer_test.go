@@ -0,0 +1,202 @@
+package pcap
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testPacket struct {
+	queue int
+	ts    time.Time
+	data  []byte
+}
+
+func testPackets(n, size int) []testPacket {
+	base := time.Unix(1700000000, 123456789)
+	ps := make([]testPacket, n)
+	for i := range ps {
+		data := make([]byte, size+i%5) // 覆盖 pcapng 的各种填充长度
+		for j := range data {
+			data[j] = byte(i + j)
+		}
+		ps[i] = testPacket{queue: []int{0, 3, 0, 5}[i%4], ts: base.Add(time.Duration(i) * 1001 * time.Microsecond), data: data}
+	}
+	return ps
+}
+
+// readAll 读出 r 中的所有帧, Data 为拷贝
+func readAll(t *testing.T, r *Reader) []Packet {
+	t.Helper()
+	var ps []Packet
+	for {
+		p, err := r.ReadPacket()
+		if err == io.EOF {
+			return ps
+		}
+		if err != nil {
+			t.Fatalf("packet %d: %v", len(ps), err)
+		}
+		p.Data = append([]byte(nil), p.Data...)
+		ps = append(ps, p)
+	}
+}
+
+// checkPackets got 与写入的 want 一致, 数据截断到 snaplen
+func checkPackets(t *testing.T, got []Packet, want []testPacket, snaplen int, ng bool) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("read %d packets, want %d", len(got), len(want))
+	}
+	for i, w := range want {
+		g := got[i]
+		data := w.data
+		if len(data) > snaplen {
+			data = data[:snaplen]
+		}
+		if !bytes.Equal(g.Data, data) || g.OrigLen != len(w.data) {
+			t.Errorf("packet %d: %d/%d bytes, want %d/%d", i, len(g.Data), g.OrigLen, len(data), len(w.data))
+		}
+		if !g.Timestamp.Equal(w.ts) {
+			t.Errorf("packet %d: timestamp %v, want %v", i, g.Timestamp, w.ts)
+		}
+		if !ng && g.Interface != 0 {
+			t.Errorf("packet %d: interface %d in a pcap file", i, g.Interface)
+		}
+	}
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	for _, format := range []Format{FormatPcap, FormatPcapng} {
+		ng := format == FormatPcapng
+		t.Run(map[bool]string{false: "pcap", true: "pcapng"}[ng], func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := NewWriter(&buf, &Config{Format: format, Snaplen: 100, Interface: "eth0"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := testPackets(12, 96)
+			for _, p := range want {
+				if err := w.WritePacket(p.queue, p.ts, p.data); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.WritePacket(0, time.Now(), nil); err != ErrClosed {
+				t.Errorf("WritePacket after Close: %v", err)
+			}
+			var bytes uint64
+			for _, p := range want {
+				bytes += uint64(len(p.data))
+			}
+			if w.Packets != uint64(len(want)) || w.Bytes != bytes {
+				t.Errorf("Packets %d Bytes %d", w.Packets, w.Bytes)
+			}
+
+			r, err := NewReader(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.LinkType() != LinkTypeEthernet {
+				t.Errorf("LinkType %d", r.LinkType())
+			}
+			got := readAll(t, r)
+			checkPackets(t, got, want, 100, ng)
+			if !ng {
+				return
+			}
+			// 每个队列一个 IDB, interface id 按第一次出现的顺序分配
+			if len(r.ifaces) != 3 {
+				t.Fatalf("%d interfaces, want 3", len(r.ifaces))
+			}
+			for _, iface := range r.ifaces {
+				if iface.snaplen != 100 || iface.tsresol != 9 {
+					t.Errorf("interface %+v", iface)
+				}
+			}
+			ids := map[int]int{0: 0, 3: 1, 5: 2}
+			for i, p := range want {
+				if got[i].Interface != ids[p.queue] {
+					t.Errorf("packet %d on queue %d: interface %d", i, p.queue, got[i].Interface)
+				}
+			}
+		})
+	}
+}
+
+func TestWriterSnaplen(t *testing.T) {
+	for _, snaplen := range []uint32{0, DefaultSnaplen + 1} {
+		var buf bytes.Buffer
+		w, _ := NewWriter(&buf, &Config{Snaplen: snaplen})
+		data := make([]byte, DefaultSnaplen+10)
+		w.WritePacket(0, time.Unix(1, 0), data)
+		w.Close()
+		r, err := NewReader(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := r.ReadPacket()
+		if err != nil || len(p.Data) != DefaultSnaplen || p.OrigLen != len(data) {
+			t.Errorf("Snaplen %d: %d/%d bytes, %v", snaplen, len(p.Data), p.OrigLen, err)
+		}
+	}
+}
+
+func TestWriterRotate(t *testing.T) {
+	const rotate = 1000
+	for _, format := range []Format{FormatPcap, FormatPcapng} {
+		ng := format == FormatPcapng
+		t.Run(map[bool]string{false: "pcap", true: "pcapng"}[ng], func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "rx")
+			w, err := Create(path, &Config{Format: format, Snaplen: 150, RotateSize: rotate})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := append(testPackets(30, 200), testPacket{ts: time.Unix(1700000001, 0), data: make([]byte, 2000)})
+			for _, p := range want {
+				if err := w.WritePacket(p.queue, p.ts, p.data); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []Packet
+			files := 0
+			for ; ; files++ {
+				name := path
+				if files > 0 {
+					name = fmt.Sprintf("%s.%d", path, files)
+				}
+				fi, err := os.Stat(name)
+				if os.IsNotExist(err) {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if fi.Size() > rotate {
+					t.Errorf("%s: %d bytes", name, fi.Size())
+				}
+				// 每个文件独立可读, pcapng 在新文件中重新写入 IDB
+				r, err := Open(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, readAll(t, r)...)
+				r.Close()
+			}
+			if files < 5 {
+				t.Errorf("%d files", files)
+			}
+			checkPackets(t, got, want, 150, ng)
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package xdp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"runtime"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/link"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	XDP_ABORTED  = 0
+	XDP_DROP     = 1
+	XDP_PASS     = 2
+	XDP_TX       = 3
+	XDP_REDIRECT = 4
+)
+
+// xdp_md 中 rx_queue_index 的偏移
+const xdpMdRxQueueIndex = 16
+
+type ProgramConfig struct {
+	MaxQueues uint32 // XSKMap 大小, 即网卡队列数上限, 0 为 64
+
+	// Rules 为空时重定向全部包; 否则只重定向匹配任一规则的包, 其余 XDP_PASS 交给内核协议栈
+	Rules []Rule
+
+	// Metadata 为 true 时重定向前调用 bpf_xdp_metadata_rx_* kfunc, 把硬件时间戳, RSS 哈希与 VLAN 标签
+	// 写入帧之前的元数据区, 由 Umem.RxMetadata 读取. 需要内核 6.3 及支持的驱动,
+	// 程序绑定到网卡 Ifindex, 只能以驱动模式挂载到该网卡
+	Metadata bool
+	Ifindex  int
+}
+
+var defaultProgramConfig = ProgramConfig{
+	MaxQueues: 64,
+}
+
+// Program 用 asm 生成的重定向程序, 不依赖 clang:
+// rx_queue_index 在 XSKMap 中有 socket 且包匹配 ProgramConfig.Rules 时 bpf_redirect_map, 否则 XDP_PASS
+type Program struct {
+	Program *ebpf.Program
+	Queues  *ebpf.Map // XSKMap, queue id -> socket fd
+
+	metadata bool // ProgramConfig.Metadata
+}
+
+// NewProgram cfg 为 nil 时使用默认配置. 内核 5.11 之前需先调用 rlimit.RemoveMemlock
+func NewProgram(cfg *ProgramConfig) (*Program, error) {
+	if cfg == nil {
+		cfg = &defaultProgramConfig
+	}
+	maxQueues := cfg.MaxQueues
+	if maxQueues == 0 {
+		maxQueues = defaultProgramConfig.MaxQueues
+	}
+	queues, err := ebpf.NewMap(&ebpf.MapSpec{
+		Name:       "xsks_map",
+		Type:       ebpf.XSKMap,
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: maxQueues,
+	})
+	if err != nil {
+		return nil, errors.WithMessage(err, "XSKMap")
+	}
+	var meta *rxKfuncs
+	if cfg.Metadata {
+		if cfg.Ifindex <= 0 {
+			queues.Close()
+			return nil, errors.New("xdp_sock_prog: Metadata requires Ifindex")
+		}
+		if meta, err = loadRxKfuncs(); err != nil {
+			queues.Close()
+			return nil, errors.WithMessage(err, "xdp_sock_prog")
+		}
+	}
+	insns := redirectInstructions(queues.FD(), meta)
+	if len(cfg.Rules) > 0 {
+		if insns, err = ruleInstructions(queues.FD(), cfg.Rules, meta); err != nil {
+			queues.Close()
+			return nil, err
+		}
+	}
+	var prog *ebpf.Program
+	if meta != nil {
+		prog, err = loadDevBound("xdp_sock_prog", insns, cfg.Ifindex)
+	} else {
+		prog, err = ebpf.NewProgram(&ebpf.ProgramSpec{
+			Name:         "xdp_sock_prog",
+			Type:         ebpf.XDP,
+			License:      "GPL",
+			Instructions: insns,
+		})
+	}
+	if err != nil {
+		queues.Close()
+		return nil, errors.WithMessage(err, "xdp_sock_prog")
+	}
+	return &Program{Program: prog, Queues: queues, metadata: meta != nil}, nil
+}
+
+func redirectInstructions(xsks int, meta *rxKfuncs) asm.Instructions {
+	var insns asm.Instructions
+	if meta != nil {
+		insns = append(insns, asm.Mov.Reg(regCtx, asm.R1))
+	}
+	insns = append(insns,
+		// index = ctx->rx_queue_index
+		asm.LoadMem(asm.R2, asm.R1, xdpMdRxQueueIndex, asm.Word),
+		asm.StoreMem(asm.RFP, -4, asm.R2, asm.Word),
+		// if (bpf_map_lookup_elem(&xsks_map, &index))
+		asm.LoadMapPtr(asm.R1, xsks),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -4),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, "pass"),
+	)
+	if meta != nil {
+		insns = append(insns, meta.instructions()...)
+	}
+	return append(insns,
+		// return bpf_redirect_map(&xsks_map, index, 0)
+		asm.LoadMapPtr(asm.R1, xsks),
+		asm.LoadMem(asm.R2, asm.RFP, -4, asm.Word),
+		asm.Mov.Imm(asm.R3, 0),
+		asm.FnRedirectMap.Call(),
+		asm.Return(),
+		// return XDP_PASS
+		asm.Mov.Imm(asm.R0, XDP_PASS).WithSymbol("pass"),
+		asm.Return(),
+	)
+}
+
+const (
+	bpfProgLoad           = 5
+	bpfFXdpDevBoundOnly   = 1 << 6
+	bpfProgLoadLogSize    = 1 << 20
+	bpfProgLoadAttrLength = 72 // 到 expected_attach_type 为止
+)
+
+// bpf_attr 中 BPF_PROG_LOAD 的前一部分
+type progLoadAttr struct {
+	progType           uint32
+	insnCnt            uint32
+	insns              uint64
+	license            uint64
+	logLevel           uint32
+	logSize            uint32
+	logBuf             uint64
+	kernVersion        uint32
+	progFlags          uint32
+	progName           [16]byte
+	progIfindex        uint32
+	expectedAttachType uint32
+}
+
+// loadDevBound 加载绑定到网卡的 XDP 程序 (BPF_F_XDP_DEV_BOUND_ONLY), 元数据 kfunc 只能在这类程序中调用.
+// cilium/ebpf v0.9 的 ProgramSpec 不支持 prog_ifindex, 直接使用 bpf 系统调用
+func loadDevBound(name string, insns asm.Instructions, ifindex int) (*ebpf.Program, error) {
+	var buf bytes.Buffer
+	if err := insns.Marshal(&buf, binary.LittleEndian); err != nil {
+		return nil, errors.WithMessage(err, name)
+	}
+	code := buf.Bytes()
+	license := []byte("GPL\x00")
+	// attr 中只有 uintptr, 两次 progLoad 期间都须保持 code 与 license 存活
+	defer func() {
+		runtime.KeepAlive(code)
+		runtime.KeepAlive(license)
+	}()
+	attr := progLoadAttr{
+		progType:    uint32(ebpf.XDP),
+		insnCnt:     uint32(len(code) / asm.InstructionSize),
+		insns:       uint64(uintptr(unsafe.Pointer(&code[0]))),
+		license:     uint64(uintptr(unsafe.Pointer(&license[0]))),
+		progFlags:   bpfFXdpDevBoundOnly,
+		progIfindex: uint32(ifindex),
+	}
+	copy(attr.progName[:len(attr.progName)-1], name)
+	fd, err := progLoad(&attr)
+	if err != nil {
+		// 带上 verifier 日志重试
+		log := make([]byte, bpfProgLoadLogSize)
+		attr.logLevel = 1
+		attr.logSize = uint32(len(log))
+		attr.logBuf = uint64(uintptr(unsafe.Pointer(&log[0])))
+		if _, err2 := progLoad(&attr); err2 != nil {
+			if i := bytes.IndexByte(log, 0); i >= 0 {
+				log = log[:i]
+			}
+			err = errors.Errorf("%v: %s", err, bytes.TrimSpace(log))
+		}
+		runtime.KeepAlive(log)
+		return nil, errors.WithMessage(err, name)
+	}
+	prog, err := ebpf.NewProgramFromFD(fd)
+	if err != nil {
+		unix.Close(fd)
+		return nil, errors.WithMessage(err, name)
+	}
+	return prog, nil
+}
+
+func progLoad(attr *progLoadAttr) (int, error) {
+	for {
+		fd, _, errno := unix.Syscall(unix.SYS_BPF, bpfProgLoad, uintptr(unsafe.Pointer(attr)), bpfProgLoadAttrLength)
+		if errno == unix.EAGAIN || errno == unix.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return -1, errno
+		}
+		return int(fd), nil
+	}
+}
+
+// Attach 挂载到网卡, flags 为 link.XDPGenericMode/XDPDriverMode, 0 表示由内核选择
+func (p *Program) Attach(ifindex int, flags link.XDPAttachFlags) (link.Link, error) {
+	return link.AttachXDP(link.XDPOptions{
+		Program:   p.Program,
+		Interface: ifindex,
+		Flags:     flags,
+	})
+}
+
+// Register 将 socket 放入 XSKMap, 此后该队列的包被重定向到 socket.
+// 程序启用了 Metadata 时, 之后放入 socket 的 umem 的 fill ring 的 frame 都清除上次的元数据
+func (p *Program) Register(queue int, s *Socket) error {
+	if p.metadata {
+		s.umem.frameLock.Lock()
+		s.umem.rxMeta = true
+		s.umem.frameLock.Unlock()
+	}
+	return p.Queues.Put(uint32(queue), uint32(s.FD()))
+}
+
+func (p *Program) Unregister(queue int) error {
+	return p.Queues.Delete(uint32(queue))
+}
+
+func (p *Program) Close() error {
+	err := p.Program.Close()
+	if e := p.Queues.Close(); err == nil {
+		err = e
+	}
+	return err
+}
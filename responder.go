@@ -0,0 +1,254 @@
+package xdp
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+
+	"github.com/lixiangzhong/xdp/packet"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// ResponderAddr 本机占用的 IP 及其 MAC
+type ResponderAddr struct {
+	IP  net.IP
+	MAC net.HardwareAddr
+}
+
+// ResponderStats 已发送的应答个数
+type ResponderStats struct {
+	ARP  uint64
+	ICMP uint64 // ICMP 与 ICMPv6 echo
+	NDP  uint64
+}
+
+// Responder 代替内核协议栈应答发往本机 IP 的 ARP 请求, ICMP/ICMPv6 echo 与 IPv6 邻居请求.
+// 应答直接改写收到的帧并经同一个 socket 的 TX ring 发回, socket 须有 TX ring
+type Responder struct {
+	sock  *Socket
+	addrs []responderAddr
+	stats ResponderStats
+}
+
+type responderAddr struct {
+	ip  [16]byte
+	v4  bool
+	mac [6]byte
+}
+
+const (
+	arpLen      = 28
+	ndpNALen    = 32   // NA 头部 24 字节加目标链路层地址选项
+	ndpFlagSol  = 0x40 // Solicited
+	ndpFlagOvr  = 0x20 // Override
+	ndpOptSLLA  = 1
+	ndpOptTLLA  = 2
+	ndpHopLimit = 255
+	replyTTL    = 64
+)
+
+var (
+	allNodesIP  = net.ParseIP("ff02::1")
+	allNodesMAC = [6]byte{0x33, 0x33, 0, 0, 0, 1}
+)
+
+func NewResponder(s *Socket, addrs ...ResponderAddr) (*Responder, error) {
+	if s.tx == nil {
+		return nil, errors.New("responder: socket has no TX ring")
+	}
+	r := &Responder{sock: s}
+	for _, a := range addrs {
+		if len(a.MAC) != 6 {
+			return nil, errors.Errorf("responder: bad MAC %v", a.MAC)
+		}
+		var ra responderAddr
+		if ip4 := a.IP.To4(); ip4 != nil {
+			copy(ra.ip[:], ip4)
+			ra.v4 = true
+		} else if ip6 := a.IP.To16(); ip6 != nil {
+			copy(ra.ip[:], ip6)
+		} else {
+			return nil, errors.Errorf("responder: bad IP %v", a.IP)
+		}
+		copy(ra.mac[:], a.MAC)
+		r.addrs = append(r.addrs, ra)
+	}
+	return r, nil
+}
+
+func (r *Responder) lookup(ip []byte) *responderAddr {
+	for i := range r.addrs {
+		a := &r.addrs[i]
+		if a.v4 == (len(ip) == 4) && string(a.ip[:len(ip)]) == string(ip) {
+			return a
+		}
+	}
+	return nil
+}
+
+// Handler 包装 HandleRecv 的 handler, 已应答的帧不再交给 next
+func (r *Responder) Handler(next func(unix.XDPDesc, []byte) bool) func(unix.XDPDesc, []byte) bool {
+	return func(d unix.XDPDesc, data []byte) bool {
+		if r.Handle(d) {
+			return false
+		}
+		return next(d, data)
+	}
+}
+
+// Handle 帧需要应答时原地改写并发送, 返回 true, 此后帧归 TX ring 所有 (TX ring 满时已回收).
+// 返回 false 时帧未改动, 仍归调用者
+func (r *Responder) Handle(d unix.XDPDesc) bool {
+	var p packet.Packet
+	if p.Parse(r.sock.umem.DescData(d)) != nil {
+		return false
+	}
+	var n int
+	switch {
+	case p.EtherType == packet.EtherTypeARP:
+		n = r.arp(&p)
+	case p.L4Proto == packet.IPProtocolICMP && !p.Fragment:
+		n = r.echo4(&p)
+	case p.L4Proto == packet.IPProtocolICMPv6 && !p.Fragment:
+		n = r.icmp6(&p, d)
+	}
+	if n == 0 {
+		return false
+	}
+	d.Len = uint32(n)
+	r.sock.WriteDesc(d)
+	return true
+}
+
+// Stats 已发送的应答个数
+func (r *Responder) Stats() ResponderStats {
+	return ResponderStats{
+		ARP:  atomic.LoadUint64(&r.stats.ARP),
+		ICMP: atomic.LoadUint64(&r.stats.ICMP),
+		NDP:  atomic.LoadUint64(&r.stats.NDP),
+	}
+}
+
+// setEthernet 目的 MAC 改为 dst, 源 MAC 改为本机
+func setEthernet(data []byte, dst []byte, a *responderAddr) {
+	copy(data[0:6], dst)
+	copy(data[6:12], a.mac[:])
+}
+
+// arp 以太网 IPv4 ARP 请求, 返回应答的长度, 0 表示不应答
+func (r *Responder) arp(p *packet.Packet) int {
+	b := p.Data[p.L3Off:]
+	if len(b) < arpLen || binary.BigEndian.Uint16(b[0:]) != 1 || binary.BigEndian.Uint16(b[2:]) != packet.EtherTypeIPv4 ||
+		b[4] != 6 || b[5] != 4 || binary.BigEndian.Uint16(b[6:]) != 1 {
+		return 0
+	}
+	a := r.lookup(b[24:28])
+	if a == nil {
+		return 0
+	}
+	setEthernet(p.Data, b[8:14], a)
+	binary.BigEndian.PutUint16(b[6:], 2)
+	var spa [4]byte
+	copy(spa[:], b[14:18])
+	copy(b[18:24], b[8:14]) // tha = sha
+	copy(b[24:28], spa[:])  // tpa = spa
+	copy(b[8:14], a.mac[:])
+	copy(b[14:18], a.ip[:4])
+	atomic.AddUint64(&r.stats.ARP, 1)
+	return p.L3Off + arpLen
+}
+
+func (r *Responder) echo4(p *packet.Packet) int {
+	ip, icmp := p.IPv4(), p.ICMP()
+	if icmp == nil || icmp.Type() != packet.ICMPEchoRequest {
+		return 0
+	}
+	a := r.lookup(ip.Dst())
+	if a == nil {
+		return 0
+	}
+	// TotalLen 超出收到的数据时应答会带出 frame 中之前的内容, 甚至越过 frame
+	n := p.L3Off + int(ip.TotalLen())
+	if int(ip.TotalLen()) < ip.HeaderLen()+packet.ICMPLen || n > len(p.Data) {
+		return 0
+	}
+	setEthernet(p.Data, p.Data[6:12], a)
+	p.SwapIP()
+	ip[8] = replyTTL
+	ip.SetChecksum()
+	icmp[0] = packet.ICMPEchoReply
+	csum := packet.UpdateChecksum(icmp.Checksum(), packet.ICMPEchoRequest<<8, packet.ICMPEchoReply<<8)
+	binary.BigEndian.PutUint16(icmp[2:], csum)
+	atomic.AddUint64(&r.stats.ICMP, 1)
+	return n
+}
+
+func (r *Responder) icmp6(p *packet.Packet, d unix.XDPDesc) int {
+	ip, icmp := p.IPv6(), p.ICMP()
+	if icmp == nil {
+		return 0
+	}
+	switch icmp.Type() {
+	case packet.ICMPv6EchoRequest:
+		a := r.lookup(ip.Dst())
+		if a == nil {
+			return 0
+		}
+		setEthernet(p.Data, p.Data[6:12], a)
+		p.SwapIP()
+		ip[7] = replyTTL
+		icmp[0] = packet.ICMPv6EchoReply
+		csum := packet.UpdateChecksum(icmp.Checksum(), packet.ICMPv6EchoRequest<<8, packet.ICMPv6EchoReply<<8)
+		binary.BigEndian.PutUint16(icmp[2:], csum)
+		atomic.AddUint64(&r.stats.ICMP, 1)
+		return p.L4Off + len(p.L4())
+	case packet.ICMPv6NeighborSol:
+		return r.ndp(p, d)
+	}
+	return 0
+}
+
+// ndp 邻居请求的目标是本机时原地写 NA, 可能比 NS 长
+func (r *Responder) ndp(p *packet.Packet, d unix.XDPDesc) int {
+	ip, ns := p.IPv6(), p.ICMP()
+	if len(ns) < 24 || ns[1] != 0 || ip.HopLimit() != ndpHopLimit {
+		return 0
+	}
+	a := r.lookup(ns[8:24])
+	if a == nil {
+		return 0
+	}
+	n := p.L3Off + packet.IPv6Len + ndpNALen
+	if base := d.Addr &^ uint64(_DEFAULT_FRAME_SIZE-1); d.Addr+uint64(n) > base+uint64(_DEFAULT_FRAME_SIZE) {
+		return 0
+	}
+	data := r.sock.umem.data[d.Addr : d.Addr+uint64(n)]
+	ip = data[p.L3Off:]
+	// DAD 的 NS 源地址为 ::, 应答发往 ff02::1
+	flags := byte(ndpFlagSol | ndpFlagOvr)
+	dstMAC := p.Data[6:12]
+	if net.IP(ip.Src()).IsUnspecified() {
+		copy(ip[24:40], allNodesIP)
+		dstMAC = allNodesMAC[:]
+		flags = ndpFlagOvr
+	} else {
+		copy(ip[24:40], ip[8:24])
+	}
+	setEthernet(data, dstMAC, a)
+	copy(ip[8:24], a.ip[:])
+	binary.BigEndian.PutUint16(ip[4:], ndpNALen)
+	ip[6] = packet.IPProtocolICMPv6
+	ip[7] = ndpHopLimit
+	na := data[p.L3Off+packet.IPv6Len:]
+	na[0], na[1] = packet.ICMPv6NeighborAdv, 0
+	na[2], na[3] = 0, 0
+	na[4], na[5], na[6], na[7] = flags, 0, 0, 0
+	copy(na[8:24], a.ip[:])
+	na[24], na[25] = ndpOptTLLA, 1
+	copy(na[26:32], a.mac[:])
+	sum := packet.PseudoHeaderSum(ip[8:24], ip[24:40], packet.IPProtocolICMPv6, ndpNALen)
+	binary.BigEndian.PutUint16(na[2:], packet.Fold(packet.Sum(na[:ndpNALen], sum)))
+	atomic.AddUint64(&r.stats.NDP, 1)
+	return n
+}
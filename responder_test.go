@@ -0,0 +1,242 @@
+package xdp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lixiangzhong/xdp/packet"
+	"github.com/lixiangzhong/xdp/xdpsim"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	localMAC  = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+	peerMAC   = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}
+	localIP4  = net.IPv4(10, 0, 0, 1).To4()
+	peerIP4   = net.IPv4(10, 0, 0, 2).To4()
+	otherIP4  = net.IPv4(10, 0, 0, 9).To4()
+	localIP6  = net.ParseIP("2001:db8::1")
+	peerIP6   = net.ParseIP("2001:db8::2")
+	otherIP6  = net.ParseIP("2001:db8::9")
+	echoData  = []byte("0123456789abcdef")
+	solicited = net.ParseIP("ff02::1:ff00:1") // localIP6 的 solicited-node 组播地址
+)
+
+// buildFrame 在临时 frame 中写入 payload 后由 push 由内向外压入各层头部
+func buildFrame(t testing.TB, payload []byte, push func(b *packet.Buffer) error) []byte {
+	t.Helper()
+	b := packet.NewBuffer(make([]byte, 512), 256, 0)
+	if err := b.Append(payload); err != nil {
+		t.Fatal(err)
+	}
+	if err := push(&b); err != nil {
+		t.Fatal(err)
+	}
+	return append([]byte(nil), b.Bytes()...)
+}
+
+func arpRequest(t testing.TB, tpa net.IP) []byte {
+	arp := make([]byte, arpLen)
+	binary.BigEndian.PutUint16(arp[0:], 1)
+	binary.BigEndian.PutUint16(arp[2:], packet.EtherTypeIPv4)
+	arp[4], arp[5] = 6, 4
+	binary.BigEndian.PutUint16(arp[6:], 1)
+	copy(arp[8:14], peerMAC)
+	copy(arp[14:18], peerIP4)
+	copy(arp[24:28], tpa)
+	// 以太网最小帧长的填充不属于应答
+	arp = append(arp, make([]byte, 18)...)
+	return buildFrame(t, arp, func(b *packet.Buffer) error {
+		return b.PushEthernet(net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, peerMAC, packet.EtherTypeARP)
+	})
+}
+
+func echo4Request(t testing.TB, dst net.IP) []byte {
+	return buildFrame(t, echoData, func(b *packet.Buffer) error {
+		if err := b.PushICMP(packet.ICMPEchoRequest, 0, 0x1234<<16|7); err != nil {
+			return err
+		}
+		if err := b.PushIPv4(peerIP4, dst, 0, 32); err != nil {
+			return err
+		}
+		return b.PushEthernet(localMAC, peerMAC, 0)
+	})
+}
+
+// withTotalLen 改写 IPv4 TotalLen 并重算头部校验和
+func withTotalLen(frame []byte, n int) []byte {
+	ip := packet.IPv4(frame[packet.EthernetLen:])
+	binary.BigEndian.PutUint16(ip[2:], uint16(n))
+	ip.SetChecksum()
+	return frame
+}
+
+func echo6Request(t testing.TB, dst net.IP) []byte {
+	return buildFrame(t, echoData, func(b *packet.Buffer) error {
+		if err := b.PushICMPv6(packet.ICMPv6EchoRequest, 0, 0x1234<<16|7); err != nil {
+			return err
+		}
+		if err := b.PushIPv6(peerIP6, dst, 0, 32); err != nil {
+			return err
+		}
+		return b.PushEthernet(localMAC, peerMAC, 0)
+	})
+}
+
+func neighborSol(t testing.TB, src, target net.IP, hopLimit uint8) []byte {
+	ns := append([]byte(nil), target.To16()...)
+	if !src.IsUnspecified() {
+		ns = append(ns, ndpOptSLLA, 1)
+		ns = append(ns, peerMAC...)
+	}
+	return buildFrame(t, ns, func(b *packet.Buffer) error {
+		if err := b.PushICMPv6(packet.ICMPv6NeighborSol, 0, 0); err != nil {
+			return err
+		}
+		if err := b.PushIPv6(src, solicited, 0, hopLimit); err != nil {
+			return err
+		}
+		return b.PushEthernet(net.HardwareAddr{0x33, 0x33, 0xff, 0, 0, 1}, peerMAC, 0)
+	})
+}
+
+func TestResponder(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+		stats ResponderStats           // 为零时不应答
+		check func(*testing.T, []byte) // 检查发出的应答
+	}{
+		{name: "arp", frame: arpRequest(t, localIP4), stats: ResponderStats{ARP: 1}, check: func(t *testing.T, b []byte) {
+			if len(b) != packet.EthernetLen+arpLen {
+				t.Fatalf("reply length %d", len(b))
+			}
+			arp := b[packet.EthernetLen:]
+			if !bytes.Equal(b[0:6], peerMAC) || !bytes.Equal(b[6:12], localMAC) || binary.BigEndian.Uint16(arp[6:]) != 2 ||
+				!bytes.Equal(arp[8:14], localMAC) || !bytes.Equal(arp[14:18], localIP4) ||
+				!bytes.Equal(arp[18:24], peerMAC) || !bytes.Equal(arp[24:28], peerIP4) {
+				t.Errorf("bad ARP reply % x", b)
+			}
+		}},
+		{name: "arp other target", frame: arpRequest(t, otherIP4)},
+		{name: "icmp echo", frame: echo4Request(t, localIP4), stats: ResponderStats{ICMP: 1}, check: func(t *testing.T, b []byte) {
+			var p packet.Packet
+			if err := p.Parse(b); err != nil {
+				t.Fatal(err)
+			}
+			ip, icmp := p.IPv4(), p.ICMP()
+			if len(b) != packet.EthernetLen+packet.IPv4MinLen+packet.ICMPLen+len(echoData) {
+				t.Errorf("reply length %d", len(b))
+			}
+			if !bytes.Equal(b[0:6], peerMAC) || !bytes.Equal(b[6:12], localMAC) ||
+				!ip.Src().Equal(localIP4) || !ip.Dst().Equal(peerIP4) || ip.TTL() != replyTTL {
+				t.Errorf("bad headers % x", b)
+			}
+			if icmp.Type() != packet.ICMPEchoReply || icmp.ID() != 0x1234 || icmp.Seq() != 7 || !bytes.Equal(p.Payload(), echoData) {
+				t.Errorf("bad ICMP % x", icmp)
+			}
+			if !ip.ValidChecksum() || !p.ValidL4Checksum() {
+				t.Error("bad checksum")
+			}
+		}},
+		{name: "icmp echo with padding", frame: append(echo4Request(t, localIP4), 0xee, 0xee), stats: ResponderStats{ICMP: 1},
+			check: func(t *testing.T, b []byte) {
+				if n := packet.EthernetLen + packet.IPv4MinLen + packet.ICMPLen + len(echoData); len(b) != n {
+					t.Errorf("reply length %d, want %d without padding", len(b), n)
+				}
+			}},
+		{name: "icmp echo other target", frame: echo4Request(t, otherIP4)},
+		{name: "icmp echo TotalLen beyond frame", frame: withTotalLen(echo4Request(t, localIP4), 1000)},
+		{name: "icmp echo TotalLen too short", frame: withTotalLen(echo4Request(t, localIP4), packet.IPv4MinLen+4)},
+		{name: "icmpv6 echo", frame: echo6Request(t, localIP6), stats: ResponderStats{ICMP: 1}, check: func(t *testing.T, b []byte) {
+			var p packet.Packet
+			if err := p.Parse(b); err != nil {
+				t.Fatal(err)
+			}
+			ip, icmp := p.IPv6(), p.ICMP()
+			if !bytes.Equal(b[0:6], peerMAC) || !bytes.Equal(b[6:12], localMAC) ||
+				!ip.Src().Equal(localIP6) || !ip.Dst().Equal(peerIP6) || ip.HopLimit() != replyTTL {
+				t.Errorf("bad headers % x", b)
+			}
+			if icmp.Type() != packet.ICMPv6EchoReply || !bytes.Equal(p.Payload(), echoData) || !p.ValidL4Checksum() {
+				t.Errorf("bad ICMPv6 % x", icmp)
+			}
+		}},
+		{name: "icmpv6 echo other target", frame: echo6Request(t, otherIP6)},
+		{name: "neighbor solicitation", frame: neighborSol(t, peerIP6, localIP6, ndpHopLimit), stats: ResponderStats{NDP: 1},
+			check: func(t *testing.T, b []byte) {
+				checkNA(t, b, peerMAC, peerIP6, ndpFlagSol|ndpFlagOvr)
+			}},
+		{name: "duplicate address detection", frame: neighborSol(t, net.IPv6unspecified, localIP6, ndpHopLimit), stats: ResponderStats{NDP: 1},
+			check: func(t *testing.T, b []byte) {
+				checkNA(t, b, allNodesMAC[:], allNodesIP, ndpFlagOvr)
+			}},
+		{name: "neighbor solicitation other target", frame: neighborSol(t, peerIP6, otherIP6, ndpHopLimit)},
+		{name: "neighbor solicitation routed", frame: neighborSol(t, peerIP6, localIP6, 64)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replies := make(chan []byte, 4)
+			kcfg := xdpsim.Config{OnTransmit: func(_, _ int, data []byte) { replies <- data }}
+			k, u, s := newSimSocket(t, &kcfg, simUmemConfig(16, 8), SocketConfig{RxSize: 8, TxSize: 8})
+			free := freeFrames(u)
+			r, err := NewResponder(s,
+				ResponderAddr{IP: localIP4, MAC: localMAC},
+				ResponderAddr{IP: localIP6, MAC: localMAC})
+			if err != nil {
+				t.Fatal(err)
+			}
+			k.Inject(simIfindex, 0, tt.frame)
+			descs := make([]unix.XDPDesc, 1)
+			waitFor(t, "frame", func() bool { return s.Recv(descs) == 1 })
+			want := tt.stats != ResponderStats{}
+			if got := r.Handle(descs[0]); got != want {
+				t.Fatalf("Handle = %v, want %v", got, want)
+			}
+			if r.Stats() != tt.stats {
+				t.Errorf("Stats = %+v, want %+v", r.Stats(), tt.stats)
+			}
+			if !want {
+				s.Release(descs[0])
+				return
+			}
+			select {
+			case b := <-replies:
+				tt.check(t, b)
+			case <-time.After(2 * time.Second):
+				t.Fatal("no reply transmitted")
+			}
+			waitFor(t, "completion", func() bool {
+				s.Write()
+				return freeFrames(u) == free
+			})
+		})
+	}
+}
+
+// checkNA 检查应答 localIP6 的邻居通告
+func checkNA(t *testing.T, b []byte, dstMAC net.HardwareAddr, dst net.IP, flags byte) {
+	t.Helper()
+	if len(b) != packet.EthernetLen+packet.IPv6Len+ndpNALen {
+		t.Fatalf("reply length %d", len(b))
+	}
+	var p packet.Packet
+	if err := p.Parse(b); err != nil {
+		t.Fatal(err)
+	}
+	ip, na := p.IPv6(), p.ICMP()
+	if !bytes.Equal(b[0:6], dstMAC) || !bytes.Equal(b[6:12], localMAC) ||
+		!ip.Src().Equal(localIP6) || !ip.Dst().Equal(dst) || ip.HopLimit() != ndpHopLimit || ip.PayloadLen() != ndpNALen {
+		t.Errorf("bad headers % x", b)
+	}
+	if na.Type() != packet.ICMPv6NeighborAdv || na[4] != flags || !net.IP(na[8:24]).Equal(localIP6) ||
+		na[24] != ndpOptTLLA || na[25] != 1 || !bytes.Equal(na[26:32], localMAC) {
+		t.Errorf("bad NA % x", na)
+	}
+	if !p.ValidL4Checksum() {
+		t.Error("bad checksum")
+	}
+}
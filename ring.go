@@ -57,15 +57,22 @@ func (x *xsk_ring[T]) cons_nb_avail(max uint32) uint32 {
 	return n
 }
 
-// slots  返回 ring 中的可消费的 slot
-func (x *xsk_ring[T]) slots(max uint32) []T {
-	n := x.cons_nb_avail(max)
-	descs := make([]T, n)
+// consume 取出最多 len(dst) 个 slot 并提交, 不分配内存
+func (x *xsk_ring[T]) consume(dst []T) uint32 {
+	n := x.cons_nb_avail(uint32(len(dst)))
 	for i := uint32(0); i < n; i++ {
-		descs[i] = x.Ring[x.CacheCons&x.Mask]
+		dst[i] = x.Ring[x.CacheCons&x.Mask]
 		x.CacheCons++
 	}
-	return descs
+	if n > 0 {
+		x.submit_cons(n)
+	}
+	return n
+}
+
+// needs_wakeup 使用 XDP_USE_NEED_WAKEUP 时, 内核是否需要 sendto/poll 唤醒
+func (x *xsk_ring[T]) needs_wakeup() bool {
+	return atomic.LoadUint32(x.Flags)&unix.XDP_RING_NEED_WAKEUP != 0
 }
 
 // submit_cons 消费完成,移动指针
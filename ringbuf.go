@@ -0,0 +1,163 @@
+package xdp
+
+import (
+	"runtime"
+	"sync/atomic"
+)
+
+// cacheLine 按 64 字节隔开生产者与消费者修改的字段, 避免伪共享
+const cacheLine = 64
+
+func ringSize(size int) uint32 {
+	n := uint32(1)
+	for int(n) < size {
+		n <<= 1
+	}
+	return n
+}
+
+// SPSCRing 单生产者单消费者的无锁 ring, 用于在 goroutine 之间传递 frame 等句柄.
+// 与 xsk_ring 一样, 两端各自缓存对端的指针, 只在缓存不足时读取对端.
+// Enqueue 只能在一个 goroutine 中调用, Dequeue 只能在另一个 goroutine 中调用
+type SPSCRing[T any] struct {
+	_          [cacheLine]byte
+	prod       uint32 // 生产者提交的位置
+	cachedCons uint32 // 生产者缓存的 cons
+	_          [cacheLine - 8]byte
+	cons       uint32 // 消费者提交的位置
+	cachedProd uint32 // 消费者缓存的 prod
+	_          [cacheLine - 8]byte
+	mask       uint32
+	ring       []T
+}
+
+// NewSPSCRing size 向上取 2 的幂
+func NewSPSCRing[T any](size int) *SPSCRing[T] {
+	n := ringSize(size)
+	return &SPSCRing[T]{mask: n - 1, ring: make([]T, n)}
+}
+
+// Enqueue 放入尽可能多的 vs, 返回个数 n (即 vs[:n])
+func (r *SPSCRing[T]) Enqueue(vs ...T) int {
+	size := r.mask + 1
+	free := r.cachedCons + size - r.prod
+	if free < uint32(len(vs)) {
+		r.cachedCons = atomic.LoadUint32(&r.cons)
+		free = r.cachedCons + size - r.prod
+	}
+	n := uint32(len(vs))
+	if n > free {
+		n = free
+	}
+	for i := uint32(0); i < n; i++ {
+		r.ring[(r.prod+i)&r.mask] = vs[i]
+	}
+	atomic.StoreUint32(&r.prod, r.prod+n)
+	return int(n)
+}
+
+// Dequeue 取出最多 len(dst) 个, 返回个数
+func (r *SPSCRing[T]) Dequeue(dst []T) int {
+	avail := r.cachedProd - r.cons
+	if avail < uint32(len(dst)) {
+		r.cachedProd = atomic.LoadUint32(&r.prod)
+		avail = r.cachedProd - r.cons
+	}
+	n := uint32(len(dst))
+	if n > avail {
+		n = avail
+	}
+	dequeue(r.ring, r.mask, r.cons, dst[:n])
+	atomic.StoreUint32(&r.cons, r.cons+n)
+	return int(n)
+}
+
+// Len 当前元素个数, 在两端之外调用时只是近似值
+func (r *SPSCRing[T]) Len() int {
+	return int(atomic.LoadUint32(&r.prod) - atomic.LoadUint32(&r.cons))
+}
+
+func (r *SPSCRing[T]) Cap() int { return len(r.ring) }
+
+// dequeue 拷贝 ring 中从 pos 开始的 len(dst) 个元素并清零, 以免 ring 持有已取出的指针
+func dequeue[T any](ring []T, mask, pos uint32, dst []T) {
+	var zero T
+	for i := range dst {
+		j := (pos + uint32(i)) & mask
+		dst[i] = ring[j]
+		ring[j] = zero
+	}
+}
+
+// MPSCRing 多生产者单消费者的 ring. 生产者用 CAS 预留一段位置, 写入后按预留顺序提交,
+// 先预留的生产者未提交时后面的生产者等待. Enqueue 可在多个 goroutine 中调用, Dequeue 只能在一个 goroutine 中调用
+type MPSCRing[T any] struct {
+	_          [cacheLine]byte
+	prodHead   uint32 // 已预留的位置
+	_          [cacheLine - 4]byte
+	prodTail   uint32 // 已提交的位置, 消费者可读到此处
+	_          [cacheLine - 4]byte
+	cons       uint32
+	cachedProd uint32 // 消费者缓存的 prodTail
+	_          [cacheLine - 8]byte
+	mask       uint32
+	ring       []T
+}
+
+// NewMPSCRing size 向上取 2 的幂
+func NewMPSCRing[T any](size int) *MPSCRing[T] {
+	n := ringSize(size)
+	return &MPSCRing[T]{mask: n - 1, ring: make([]T, n)}
+}
+
+// Enqueue 放入尽可能多的 vs, 返回个数 n (即 vs[:n]). 同一次调用放入的元素连续, 不与其他生产者交错
+func (r *MPSCRing[T]) Enqueue(vs ...T) int {
+	size := r.mask + 1
+	var head, n uint32
+	for {
+		head = atomic.LoadUint32(&r.prodHead)
+		free := atomic.LoadUint32(&r.cons) + size - head
+		n = uint32(len(vs))
+		if n > free {
+			n = free
+		}
+		if n == 0 {
+			return 0
+		}
+		if atomic.CompareAndSwapUint32(&r.prodHead, head, head+n) {
+			break
+		}
+	}
+	for i := uint32(0); i < n; i++ {
+		r.ring[(head+i)&r.mask] = vs[i]
+	}
+	// 等之前预留的生产者提交
+	for atomic.LoadUint32(&r.prodTail) != head {
+		runtime.Gosched()
+	}
+	atomic.StoreUint32(&r.prodTail, head+n)
+	return int(n)
+}
+
+// Dequeue 取出最多 len(dst) 个, 返回个数
+func (r *MPSCRing[T]) Dequeue(dst []T) int {
+	avail := r.cachedProd - r.cons
+	if avail < uint32(len(dst)) {
+		r.cachedProd = atomic.LoadUint32(&r.prodTail)
+		avail = r.cachedProd - r.cons
+	}
+	n := uint32(len(dst))
+	if n > avail {
+		n = avail
+	}
+	dequeue(r.ring, r.mask, r.cons, dst[:n])
+	atomic.StoreUint32(&r.cons, r.cons+n)
+	return int(n)
+}
+
+// Len 已提交的元素个数, 在消费者之外调用时只是近似值
+func (r *MPSCRing[T]) Len() int {
+	return int(atomic.LoadUint32(&r.prodTail) - atomic.LoadUint32(&r.cons))
+}
+
+func (r *MPSCRing[T]) Cap() int { return len(r.ring) }
@@ -0,0 +1,199 @@
+package xdp
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+type testRing[T any] interface {
+	Enqueue(vs ...T) int
+	Dequeue(dst []T) int
+	Len() int
+	Cap() int
+}
+
+// 从 start 开始的 ring, 测试 uint32 位置回绕
+func newSPSCAt[T any](size int, start uint32) (testRing[T], []T) {
+	r := NewSPSCRing[T](size)
+	r.prod, r.cachedCons, r.cons, r.cachedProd = start, start, start, start
+	return r, r.ring
+}
+
+func newMPSCAt[T any](size int, start uint32) (testRing[T], []T) {
+	r := NewMPSCRing[T](size)
+	r.prodHead, r.prodTail, r.cons, r.cachedProd = start, start, start, start
+	return r, r.ring
+}
+
+var testRings = []struct {
+	name string
+	new  func(size int, start uint32) (testRing[*int], []*int)
+}{
+	{"spsc", newSPSCAt[*int]},
+	{"mpsc", newMPSCAt[*int]},
+}
+
+func TestRingCap(t *testing.T) {
+	for _, c := range []struct{ size, cap int }{{0, 1}, {1, 1}, {5, 8}, {8, 8}, {1000, 1024}} {
+		if n := NewSPSCRing[int](c.size).Cap(); n != c.cap {
+			t.Errorf("NewSPSCRing(%d).Cap() = %d, want %d", c.size, n, c.cap)
+		}
+		if n := NewMPSCRing[int](c.size).Cap(); n != c.cap {
+			t.Errorf("NewMPSCRing(%d).Cap() = %d, want %d", c.size, n, c.cap)
+		}
+	}
+}
+
+func TestRing(t *testing.T) {
+	vals := make([]*int, 200)
+	for i := range vals {
+		v := i
+		vals[i] = &v
+	}
+	for _, tr := range testRings {
+		for _, start := range []uint32{0, math.MaxUint32 - 4} {
+			t.Run(fmt.Sprintf("%s/%d", tr.name, start), func(t *testing.T) {
+				r, slots := tr.new(8, start)
+				next, want := 0, 0 // 下一个放入与取出的值
+				dst := make([]*int, 16)
+				check := func(n int) {
+					t.Helper()
+					for i, p := range dst[:n] {
+						if p == nil || *p != want {
+							t.Fatalf("dequeued %v at %d, want %d", p, i, want)
+						}
+						want++
+					}
+				}
+
+				// 满时只放入一部分
+				if n := r.Enqueue(vals[next : next+10]...); n != 8 {
+					t.Fatalf("Enqueue 10 into empty ring of 8 = %d", n)
+				}
+				next += 8
+				if n := r.Enqueue(vals[next]); n != 0 {
+					t.Fatalf("Enqueue into full ring = %d", n)
+				}
+				if r.Len() != 8 {
+					t.Fatalf("Len = %d", r.Len())
+				}
+				n := r.Dequeue(dst[:3])
+				if n != 3 {
+					t.Fatalf("Dequeue 3 = %d", n)
+				}
+				check(n)
+				if n := r.Enqueue(vals[next : next+5]...); n != 3 {
+					t.Fatalf("Enqueue 5 with 3 free = %d", n)
+				}
+				next += 3
+
+				// 取出后 ring 不再持有指针
+				n = r.Dequeue(dst)
+				if n != 8 {
+					t.Fatalf("Dequeue = %d, want 8", n)
+				}
+				check(n)
+				for i, p := range slots {
+					if p != nil {
+						t.Fatalf("slot %d not cleared after Dequeue", i)
+					}
+				}
+				if n := r.Dequeue(dst); n != 0 || r.Len() != 0 {
+					t.Fatalf("Dequeue from empty ring = %d, Len %d", n, r.Len())
+				}
+
+				// 多轮不同大小的批量, 跨过位置回绕
+				for round := 0; round < 20; round++ {
+					k := r.Enqueue(vals[next : next+1+round%5]...)
+					next += k
+					check(r.Dequeue(dst[:1+round%3]))
+					if r.Len() != next-want {
+						t.Fatalf("round %d: Len = %d, want %d", round, r.Len(), next-want)
+					}
+				}
+				check(r.Dequeue(dst))
+				if want != next {
+					t.Fatalf("dequeued %d of %d", want, next)
+				}
+			})
+		}
+	}
+}
+
+// item 压力测试中的元素, call 为生产者的第几次 Enqueue
+type item struct {
+	producer, seq, call int
+}
+
+func TestRingStress(t *testing.T) {
+	const perProducer = 20000
+	for _, c := range []struct {
+		name      string
+		producers int
+		new       func(size int, start uint32) (testRing[item], []item)
+	}{
+		{"spsc", 1, newSPSCAt[item]},
+		{"mpsc", 4, newMPSCAt[item]},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			r, _ := c.new(64, math.MaxUint32-1000)
+			var wg sync.WaitGroup
+			for p := 0; p < c.producers; p++ {
+				wg.Add(1)
+				go func(p int) {
+					defer wg.Done()
+					rnd := rand.New(rand.NewSource(int64(p)))
+					batch := make([]item, 8)
+					for seq, call := 0, 0; seq < perProducer; call++ {
+						k := 1 + rnd.Intn(len(batch))
+						if seq+k > perProducer {
+							k = perProducer - seq
+						}
+						for i := range batch[:k] {
+							batch[i] = item{p, seq + i, call}
+						}
+						// 部分放入时剩余的元素在下一次调用中放入
+						n := r.Enqueue(batch[:k]...)
+						seq += n
+						if n == 0 {
+							runtime.Gosched()
+						}
+					}
+				}(p)
+			}
+			next := make([]int, c.producers)
+			lastCall := make([]int, c.producers)
+			var cur item // 上一个取出的元素
+			cur.producer = -1
+			dst := make([]item, 16)
+			for total := 0; total < c.producers*perProducer; {
+				n := r.Dequeue(dst[:1+total%len(dst)])
+				if n == 0 {
+					runtime.Gosched()
+					continue
+				}
+				for _, it := range dst[:n] {
+					if it.seq != next[it.producer] {
+						t.Fatalf("producer %d: got seq %d, want %d", it.producer, it.seq, next[it.producer])
+					}
+					// 同一次 Enqueue 的元素连续: 切换到其他调用后不会再回来
+					if (it.producer != cur.producer || it.call != cur.call) && next[it.producer] > 0 && lastCall[it.producer] == it.call {
+						t.Fatalf("producer %d call %d interleaved with producer %d", it.producer, it.call, cur.producer)
+					}
+					next[it.producer]++
+					lastCall[it.producer] = it.call
+					cur = it
+				}
+				total += n
+			}
+			wg.Wait()
+			if r.Len() != 0 {
+				t.Errorf("Len = %d after draining", r.Len())
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package xdp
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/lixiangzhong/xdp/packet"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+type DispatcherConfig struct {
+	Workers  int                      // worker goroutine 数, 默认 runtime.NumCPU()
+	RingSize int                      // 每个 worker 的 ring 大小, 默认 1024, 满时丢弃
+	Hash     func(data []byte) uint32 // 选择 worker 的哈希, 默认 FlowHash
+}
+
+const (
+	defaultDispatchRing = 1024
+	dispatchBatch       = 64
+	dispatchSpin        = 64 // worker 空闲时让出 CPU 的次数, 之后休眠等待唤醒
+)
+
+// DispatcherStats 一个 worker 的统计
+type DispatcherStats struct {
+	Packets uint64 // 交给 worker 的帧数
+	Dropped uint64 // worker 的 ring 已满而丢弃的帧数
+}
+
+// Dispatcher 软件 RSS: 在一个 goroutine 中从 socket 收包, 按流哈希分给多个 worker goroutine.
+// 同一个流 (两个方向) 的帧总是交给同一个 worker, 并保持收到的顺序. 用于只有一个队列的网卡
+type Dispatcher struct {
+	sock    *Socket
+	cfg     DispatcherConfig
+	workers []*dispatchWorker
+	closed  int32 // Close 后 dispatch 退出
+	stopped int32 // dispatch 已退出, worker 处理完 ring 中的帧后退出
+	running sync.WaitGroup
+}
+
+type dispatchWorker struct {
+	ring     *SPSCRing[unix.XDPDesc]
+	sleeping int32
+	wake     chan struct{}
+	stats    DispatcherStats
+}
+
+func NewDispatcher(s *Socket, cfg *DispatcherConfig) (*Dispatcher, error) {
+	if s.rx == nil {
+		return nil, errors.New("dispatcher: socket has no RX ring")
+	}
+	d := &Dispatcher{sock: s}
+	if cfg != nil {
+		d.cfg = *cfg
+	}
+	if d.cfg.Workers <= 0 {
+		d.cfg.Workers = runtime.NumCPU()
+	}
+	if d.cfg.RingSize <= 0 {
+		d.cfg.RingSize = defaultDispatchRing
+	}
+	if d.cfg.Hash == nil {
+		d.cfg.Hash = FlowHash
+	}
+	for i := 0; i < d.cfg.Workers; i++ {
+		d.workers = append(d.workers, &dispatchWorker{
+			ring: NewSPSCRing[unix.XDPDesc](d.cfg.RingSize),
+			wake: make(chan struct{}, 1),
+		})
+	}
+	return d, nil
+}
+
+// Run 启动 worker 并在当前 goroutine 收包, Close 后等 worker 处理完已分发的帧再返回.
+// handler 在 worker goroutine 中调用, 约定同 HandleRecv: 返回 true 回收 frame,
+// 返回 false 时 frame 归调用者, 之后用 Release 归还或经 WriteDescs 发送
+func (d *Dispatcher) Run(handler func(worker int, desc unix.XDPDesc, data []byte) bool) {
+	d.running.Add(1)
+	defer d.running.Done()
+	var wg sync.WaitGroup
+	for i, w := range d.workers {
+		wg.Add(1)
+		go func(i int, w *dispatchWorker) {
+			defer wg.Done()
+			d.work(i, w, handler)
+		}(i, w)
+	}
+	d.dispatch()
+	atomic.StoreInt32(&d.stopped, 1)
+	for _, w := range d.workers {
+		w.signal()
+	}
+	wg.Wait()
+}
+
+func (d *Dispatcher) dispatch() {
+	s := d.sock
+	descs := make([]unix.XDPDesc, dispatchBatch)
+	// 按 worker 攒成一批再放入 ring, 减少原子操作
+	pending := make([][]unix.XDPDesc, len(d.workers))
+	for i := range pending {
+		pending[i] = make([]unix.XDPDesc, 0, dispatchBatch)
+	}
+	n := uint32(len(d.workers))
+	for atomic.LoadInt32(&d.closed) == 0 {
+		k := s.Recv(descs)
+		if k == 0 {
+			pollSockets(pollTimeout, s)
+			continue
+		}
+		for _, desc := range descs[:k] {
+			i := d.cfg.Hash(s.umem.DescData(desc)) % n
+			pending[i] = append(pending[i], desc)
+		}
+		for i, w := range d.workers {
+			if len(pending[i]) == 0 {
+				continue
+			}
+			m := w.ring.Enqueue(pending[i]...)
+			s.Release(pending[i][m:]...)
+			atomic.AddUint64(&w.stats.Packets, uint64(m))
+			atomic.AddUint64(&w.stats.Dropped, uint64(len(pending[i])-m))
+			pending[i] = pending[i][:0]
+			if m > 0 && atomic.LoadInt32(&w.sleeping) != 0 {
+				w.signal()
+			}
+		}
+	}
+}
+
+func (w *dispatchWorker) signal() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *Dispatcher) work(id int, w *dispatchWorker, handler func(int, unix.XDPDesc, []byte) bool) {
+	s := d.sock
+	descs := make([]unix.XDPDesc, dispatchBatch)
+	idle := 0
+	for {
+		n := w.ring.Dequeue(descs)
+		for _, desc := range descs[:n] {
+			if handler(id, desc, s.umem.DescData(desc)) {
+				s.umem.putFrame(desc.Addr)
+			}
+		}
+		if n > 0 {
+			idle = 0
+			continue
+		}
+		if atomic.LoadInt32(&d.stopped) != 0 {
+			// dispatch 已退出, ring 中不会再有新的帧
+			if w.ring.Len() == 0 {
+				return
+			}
+			continue
+		}
+		if idle++; idle < dispatchSpin {
+			runtime.Gosched()
+			continue
+		}
+		// 先声明休眠再检查 ring, 与 dispatch 的先放入再检查 sleeping 配对, 不会漏掉唤醒
+		atomic.StoreInt32(&w.sleeping, 1)
+		if w.ring.Len() == 0 && atomic.LoadInt32(&d.stopped) == 0 {
+			<-w.wake
+		}
+		atomic.StoreInt32(&w.sleeping, 0)
+		idle = 0
+	}
+}
+
+// Release 归还 handler 返回 false 时保留的帧, 可在任意 goroutine 中调用
+func (d *Dispatcher) Release(descs ...unix.XDPDesc) {
+	d.sock.Release(descs...)
+}
+
+// Stats 各 worker 的统计
+func (d *Dispatcher) Stats() []DispatcherStats {
+	st := make([]DispatcherStats, len(d.workers))
+	for i, w := range d.workers {
+		st[i] = DispatcherStats{
+			Packets: atomic.LoadUint64(&w.stats.Packets),
+			Dropped: atomic.LoadUint64(&w.stats.Dropped),
+		}
+	}
+	return st
+}
+
+// Close 停止收包并等待 Run 返回, 不关闭 socket
+func (d *Dispatcher) Close() error {
+	atomic.StoreInt32(&d.closed, 1)
+	d.running.Wait()
+	return nil
+}
+
+// toeplitzKey 对称 RSS key: 以 16 位为周期重复, 交换源与目的 (地址与端口的长度都是 16 位的倍数) 后哈希不变
+const toeplitzKey = 0x6d5a6d5a6d5a6d5a
+
+// toeplitzTable 周期为 2 字节, 按字节在周期中的位置各一张表
+var toeplitzTable = func() (t [2][256]uint32) {
+	for pos := range t {
+		for b := 0; b < 256; b++ {
+			var h uint32
+			for bit := 0; bit < 8; bit++ {
+				if b&(0x80>>bit) != 0 {
+					h ^= uint32(uint64(toeplitzKey) << (pos*8 + bit) >> 32)
+				}
+			}
+			t[pos][b] = h
+		}
+	}
+	return
+}()
+
+func toeplitz(h uint32, b []byte) uint32 {
+	for i, v := range b {
+		h ^= toeplitzTable[i&1][v]
+	}
+	return h
+}
+
+// FlowHash 以太网帧的对称 Toeplitz 哈希, 输入与网卡 RSS 相同: 源/目的地址, TCP/UDP 再加源/目的端口.
+// 分片与其他协议只用地址, 同一个流的所有帧哈希相同; 非 IP 帧为 0
+func FlowHash(data []byte) uint32 {
+	var p packet.Packet
+	if p.Parse(data) != nil {
+		return 0
+	}
+	var addrs []byte
+	if ip := p.IPv4(); ip != nil {
+		addrs = ip[12:20]
+	} else if ip := p.IPv6(); ip != nil {
+		addrs = ip[8:40]
+	} else {
+		return 0
+	}
+	h := toeplitz(0, addrs)
+	if p.Fragment || p.L4Off < 0 || (p.L4Proto != packet.IPProtocolTCP && p.L4Proto != packet.IPProtocolUDP) {
+		return h
+	}
+	// 地址长度为偶数字节, 端口在周期中的位置从 0 开始
+	return toeplitz(h, data[p.L4Off:p.L4Off+4])
+}
@@ -0,0 +1,322 @@
+package xdp
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/cilium/ebpf/asm"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Rule 在内核中匹配的规则, 零值字段不参与匹配, 字段之间为"与".
+// Src/Dst 决定匹配 IPv4 还是 IPv6; 端口只对 TCP/UDP/SCTP 的首个分片有效.
+// 只解析一层 VLAN 标签, IPv6 不解析扩展头
+type Rule struct {
+	VLAN     uint16 // 802.1Q VLAN ID
+	Proto    uint8  // IP 协议号, 如 unix.IPPROTO_UDP
+	Src, Dst *net.IPNet
+	SrcPort  PortRange
+	DstPort  PortRange
+}
+
+// PortRange [First, Last], Last 为 0 时只匹配 First, 零值匹配任意端口
+type PortRange struct {
+	First, Last uint16
+}
+
+func (r PortRange) any() bool { return r.First == 0 && r.Last == 0 }
+
+func (r PortRange) last() uint16 {
+	if r.Last == 0 {
+		return r.First
+	}
+	return r.Last
+}
+
+// 规则程序中寄存器与栈的用途
+const (
+	regL3      = asm.R6 // 网络层头部
+	regDataEnd = asm.R7
+	regFamily  = asm.R8 // 0, 4 或 6, 重定向时不再使用, 元数据代码复用为 regFlags
+
+	stackQueue   = -4
+	stackVLAN    = -8
+	stackProto   = -12
+	stackSrcPort = -16
+	stackDstPort = -20
+	stackPorts   = -24 // 1 表示端口有效
+)
+
+// progBuilder 同一条指令只能有一个 symbol, 落在同一位置的标签记为别名
+type progBuilder struct {
+	insns   asm.Instructions
+	pending []string
+	alias   map[string]string
+}
+
+func (b *progBuilder) label(name string) {
+	b.pending = append(b.pending, name)
+}
+
+func (b *progBuilder) emit(insns ...asm.Instruction) {
+	for _, ins := range insns {
+		if len(b.pending) > 0 {
+			ins = ins.WithSymbol(b.pending[0])
+			for _, a := range b.pending[1:] {
+				b.alias[a] = b.pending[0]
+			}
+			b.pending = b.pending[:0]
+		}
+		b.insns = append(b.insns, ins)
+	}
+}
+
+func (b *progBuilder) finish() asm.Instructions {
+	for i, ins := range b.insns {
+		if to, ok := b.alias[ins.Reference()]; ok {
+			b.insns[i] = ins.WithReference(to)
+		}
+	}
+	return b.insns
+}
+
+// ruleInstructions 解析以太网/VLAN/IP/L4 头部, 只重定向匹配任一规则的包, 其余 XDP_PASS
+func ruleInstructions(xsks int, rules []Rule, meta *rxKfuncs) (asm.Instructions, error) {
+	b := &progBuilder{alias: make(map[string]string)}
+	if meta != nil {
+		b.emit(asm.Mov.Reg(regCtx, asm.R1))
+	}
+	b.emit(
+		asm.StoreImm(asm.RFP, stackVLAN, 0, asm.DWord),
+		asm.StoreImm(asm.RFP, stackSrcPort, 0, asm.DWord),
+		asm.StoreImm(asm.RFP, stackPorts, 0, asm.DWord),
+		asm.LoadMem(asm.R2, asm.R1, xdpMdRxQueueIndex, asm.Word),
+		asm.StoreMem(asm.RFP, stackQueue, asm.R2, asm.Word),
+		asm.Mov.Imm(regFamily, 0),
+		// data, data_end
+		asm.LoadMem(asm.R2, asm.R1, 0, asm.Word),
+		asm.LoadMem(regDataEnd, asm.R1, 4, asm.Word),
+		asm.Mov.Reg(regL3, asm.R2),
+		asm.Add.Imm(regL3, 14),
+		asm.JGT.Reg(regL3, regDataEnd, "pass"),
+		asm.LoadMem(asm.R3, asm.R2, 12, asm.Half),
+		asm.HostTo(asm.BE, asm.R3, asm.Half),
+		asm.JEq.Imm(asm.R3, 0x8100, "vlan"),
+		asm.JNE.Imm(asm.R3, 0x88a8, "l3"),
+	)
+	b.label("vlan")
+	b.emit(
+		asm.Mov.Reg(asm.R1, asm.R2),
+		asm.Add.Imm(asm.R1, 18),
+		asm.JGT.Reg(asm.R1, regDataEnd, "pass"),
+		asm.LoadMem(asm.R4, asm.R2, 14, asm.Half),
+		asm.HostTo(asm.BE, asm.R4, asm.Half),
+		asm.And.Imm(asm.R4, 0x0fff),
+		asm.StoreMem(asm.RFP, stackVLAN, asm.R4, asm.Word),
+		asm.LoadMem(asm.R3, asm.R2, 16, asm.Half),
+		asm.HostTo(asm.BE, asm.R3, asm.Half),
+		asm.Mov.Reg(regL3, asm.R1),
+	)
+	b.label("l3")
+	b.emit(
+		asm.JEq.Imm(asm.R3, 0x0800, "ipv4"),
+		asm.JEq.Imm(asm.R3, 0x86dd, "ipv6"),
+		asm.Ja.Label("rules"),
+	)
+	b.label("ipv4")
+	b.emit(
+		asm.Mov.Reg(asm.R1, regL3),
+		asm.Add.Imm(asm.R1, 20),
+		asm.JGT.Reg(asm.R1, regDataEnd, "pass"),
+		asm.Mov.Imm(regFamily, 4),
+		asm.LoadMem(asm.R3, regL3, 9, asm.Byte),
+		asm.StoreMem(asm.RFP, stackProto, asm.R3, asm.Word),
+		// 非首个分片没有端口
+		asm.LoadMem(asm.R4, regL3, 6, asm.Half),
+		asm.HostTo(asm.BE, asm.R4, asm.Half),
+		asm.And.Imm(asm.R4, 0x1fff),
+		asm.JNE.Imm(asm.R4, 0, "rules"),
+		asm.LoadMem(asm.R4, regL3, 0, asm.Byte),
+		asm.And.Imm(asm.R4, 0x0f),
+		asm.LSh.Imm(asm.R4, 2),
+		asm.Mov.Reg(asm.R5, regL3),
+		asm.Add.Reg(asm.R5, asm.R4),
+		asm.Ja.Label("l4"),
+	)
+	b.label("ipv6")
+	b.emit(
+		asm.Mov.Reg(asm.R1, regL3),
+		asm.Add.Imm(asm.R1, 40),
+		asm.JGT.Reg(asm.R1, regDataEnd, "pass"),
+		asm.Mov.Imm(regFamily, 6),
+		asm.LoadMem(asm.R3, regL3, 6, asm.Byte),
+		asm.StoreMem(asm.RFP, stackProto, asm.R3, asm.Word),
+		asm.Mov.Reg(asm.R5, asm.R1),
+	)
+	b.label("l4")
+	b.emit(
+		asm.JEq.Imm(asm.R3, unix.IPPROTO_TCP, "ports"),
+		asm.JEq.Imm(asm.R3, unix.IPPROTO_UDP, "ports"),
+		asm.JNE.Imm(asm.R3, unix.IPPROTO_SCTP, "rules"),
+	)
+	b.label("ports")
+	b.emit(
+		asm.Mov.Reg(asm.R1, asm.R5),
+		asm.Add.Imm(asm.R1, 4),
+		asm.JGT.Reg(asm.R1, regDataEnd, "rules"),
+		asm.LoadMem(asm.R4, asm.R5, 0, asm.Half),
+		asm.HostTo(asm.BE, asm.R4, asm.Half),
+		asm.StoreMem(asm.RFP, stackSrcPort, asm.R4, asm.Word),
+		asm.LoadMem(asm.R4, asm.R5, 2, asm.Half),
+		asm.HostTo(asm.BE, asm.R4, asm.Half),
+		asm.StoreMem(asm.RFP, stackDstPort, asm.R4, asm.Word),
+		asm.StoreImm(asm.RFP, stackPorts, 1, asm.Word),
+	)
+	b.label("rules")
+	for i, r := range rules {
+		next := "pass"
+		if i+1 < len(rules) {
+			next = fmt.Sprintf("rule%d", i+1)
+		}
+		b.label(fmt.Sprintf("rule%d", i))
+		if err := r.compile(b, next); err != nil {
+			return nil, errors.WithMessagef(err, "rule %d", i)
+		}
+		b.emit(asm.Ja.Label("redirect"))
+	}
+	b.label("redirect")
+	b.emit(
+		asm.LoadMapPtr(asm.R1, xsks),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, stackQueue),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, "pass"),
+	)
+	if meta != nil {
+		b.emit(meta.instructions()...)
+	}
+	b.emit(
+		asm.LoadMapPtr(asm.R1, xsks),
+		asm.LoadMem(asm.R2, asm.RFP, stackQueue, asm.Word),
+		asm.Mov.Imm(asm.R3, 0),
+		asm.FnRedirectMap.Call(),
+		asm.Return(),
+	)
+	b.label("pass")
+	b.emit(
+		asm.Mov.Imm(asm.R0, XDP_PASS),
+		asm.Return(),
+	)
+	return b.finish(), nil
+}
+
+func family(n *net.IPNet) int {
+	if n == nil {
+		return 0
+	}
+	if n.IP.To4() != nil {
+		return 4
+	}
+	return 6
+}
+
+// compile 不匹配时跳到 next, 匹配时顺序执行
+func (r Rule) compile(b *progBuilder, next string) error {
+	fam := family(r.Src)
+	if f := family(r.Dst); fam == 0 {
+		fam = f
+	} else if f != 0 && f != fam {
+		return errors.New("Src and Dst address family mismatch")
+	}
+	ports := !r.SrcPort.any() || !r.DstPort.any()
+	if ports && r.Proto != 0 && r.Proto != unix.IPPROTO_TCP && r.Proto != unix.IPPROTO_UDP && r.Proto != unix.IPPROTO_SCTP {
+		return errors.Errorf("protocol %d has no ports", r.Proto)
+	}
+	for _, p := range []PortRange{r.SrcPort, r.DstPort} {
+		if p.First > p.last() {
+			return errors.Errorf("bad port range %d-%d", p.First, p.Last)
+		}
+	}
+
+	if r.VLAN != 0 {
+		b.emit(
+			asm.LoadMem(asm.R0, asm.RFP, stackVLAN, asm.Word),
+			asm.JNE.Imm(asm.R0, int32(r.VLAN), next),
+		)
+	}
+	switch fam {
+	case 0:
+		if r.Proto != 0 || ports {
+			b.emit(asm.JEq.Imm(regFamily, 0, next))
+		}
+	default:
+		b.emit(asm.JNE.Imm(regFamily, int32(fam), next))
+	}
+	if r.Proto != 0 {
+		b.emit(
+			asm.LoadMem(asm.R0, asm.RFP, stackProto, asm.Word),
+			asm.JNE.Imm(asm.R0, int32(r.Proto), next),
+		)
+	}
+	if fam == 4 {
+		matchNet(b, r.Src, 12, next)
+		matchNet(b, r.Dst, 16, next)
+	} else {
+		matchNet(b, r.Src, 8, next)
+		matchNet(b, r.Dst, 24, next)
+	}
+	if ports {
+		b.emit(
+			asm.LoadMem(asm.R0, asm.RFP, stackPorts, asm.Word),
+			asm.JEq.Imm(asm.R0, 0, next),
+		)
+		matchPorts(b, r.SrcPort, stackSrcPort, next)
+		matchPorts(b, r.DstPort, stackDstPort, next)
+	}
+	return nil
+}
+
+// matchNet 逐 32 位比较 L3 头部 off 处地址的前缀
+func matchNet(b *progBuilder, n *net.IPNet, off int16, next string) {
+	if n == nil {
+		return
+	}
+	ip, mask := n.IP.To4(), n.Mask
+	if ip == nil {
+		ip = n.IP.To16()
+	}
+	if len(mask) != len(ip) {
+		mask = mask[len(mask)-len(ip):]
+	}
+	for i := 0; i < len(ip); i += 4 {
+		m := uint32(mask[i])<<24 | uint32(mask[i+1])<<16 | uint32(mask[i+2])<<8 | uint32(mask[i+3])
+		if m == 0 {
+			break
+		}
+		v := (uint32(ip[i])<<24 | uint32(ip[i+1])<<16 | uint32(ip[i+2])<<8 | uint32(ip[i+3])) & m
+		b.emit(
+			asm.LoadMem(asm.R0, regL3, off+int16(i), asm.Word),
+			asm.HostTo(asm.BE, asm.R0, asm.Word),
+		)
+		if m != 0xffffffff {
+			b.emit(asm.And.Imm32(asm.R0, int32(m)))
+		}
+		b.emit(asm.JNE.Imm32(asm.R0, int32(v), next))
+	}
+}
+
+func matchPorts(b *progBuilder, p PortRange, slot int16, next string) {
+	if p.any() {
+		return
+	}
+	b.emit(asm.LoadMem(asm.R0, asm.RFP, slot, asm.Word))
+	if p.First == p.last() {
+		b.emit(asm.JNE.Imm(asm.R0, int32(p.First), next))
+		return
+	}
+	b.emit(
+		asm.JLT.Imm(asm.R0, int32(p.First), next),
+		asm.JGT.Imm(asm.R0, int32(p.last()), next),
+	)
+}
@@ -0,0 +1,79 @@
+package xdp
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func mustCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// 规则的匹配行为由 xdptest 在真实内核中测试, 这里只测试编译期的错误
+func TestRuleCompile(t *testing.T) {
+	tests := []struct {
+		name string
+		rule Rule
+		err  string // 为空时应编译成功
+	}{
+		{"empty", Rule{}, ""},
+		{"ipv4 and ipv6", Rule{Src: mustCIDR("10.0.0.0/8"), Dst: mustCIDR("2001:db8::/32")}, "family mismatch"},
+		{"ipv6 and ipv4", Rule{Src: mustCIDR("2001:db8::/32"), Dst: mustCIDR("10.0.0.0/8")}, "family mismatch"},
+		{"ipv4-mapped dst", Rule{Src: mustCIDR("10.0.0.0/8"), Dst: &net.IPNet{IP: net.IPv4(1, 2, 3, 4), Mask: net.CIDRMask(128, 128)}}, ""},
+		{"icmp with ports", Rule{Proto: unix.IPPROTO_ICMP, DstPort: PortRange{First: 1}}, "protocol 1 has no ports"},
+		{"icmpv6 with src port", Rule{Proto: unix.IPPROTO_ICMPV6, SrcPort: PortRange{First: 1, Last: 2}}, "protocol 58 has no ports"},
+		{"ports without proto", Rule{DstPort: PortRange{First: 53}}, ""},
+		{"sctp ports", Rule{Proto: unix.IPPROTO_SCTP, DstPort: PortRange{First: 38412}}, ""},
+		{"proto without ports", Rule{Proto: unix.IPPROTO_GRE}, ""},
+		{"reversed dst range", Rule{Proto: unix.IPPROTO_UDP, DstPort: PortRange{First: 2000, Last: 1000}}, "bad port range 2000-1000"},
+		{"reversed src range", Rule{SrcPort: PortRange{First: 2, Last: 1}}, "bad port range 2-1"},
+		{"single port range", Rule{SrcPort: PortRange{First: 7, Last: 7}}, ""},
+		{"range from 0", Rule{SrcPort: PortRange{Last: 1023}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rule.compile(&progBuilder{alias: make(map[string]string)}, "pass")
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("compile: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("compile error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+// 出错时指出是第几条规则
+func TestRuleInstructionsError(t *testing.T) {
+	rules := []Rule{{Proto: unix.IPPROTO_UDP}, {Proto: unix.IPPROTO_ICMP, DstPort: PortRange{First: 1}}}
+	_, err := ruleInstructions(0, rules, nil)
+	if err == nil || !strings.HasPrefix(err.Error(), "rule 1: ") {
+		t.Fatalf("ruleInstructions error %v", err)
+	}
+	insns, err := ruleInstructions(0, rules[:1], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 所有跳转目标都已定义
+	syms := make(map[string]bool)
+	for _, ins := range insns {
+		if s := ins.Symbol(); s != "" {
+			syms[s] = true
+		}
+	}
+	for _, ins := range insns {
+		if r := ins.Reference(); r != "" && !syms[r] {
+			t.Errorf("undefined label %q", r)
+		}
+	}
+}
@@ -1,29 +1,69 @@
 package xdp
 
 import (
-	"log"
-	"reflect"
-	"syscall"
-	"unsafe"
+	"sync"
+	"sync/atomic"
 
 	"github.com/pkg/errors"
 	"golang.org/x/sys/unix"
 )
 
 type Socket struct {
-	rx     *xsk_ring_rx
-	tx     *xsk_ring_tx
-	umem   *Umem
-	config SocketConfig
-	fd     int
+	rx      *xsk_ring_rx
+	tx      *xsk_ring_tx
+	umem    *Umem
+	config  SocketConfig
+	fd      int
+	ifindex int
+	rxMap   []byte
+	txMap   []byte
+
+	// 与 umem 的第一个 socket 同网卡同队列时使用 umem 的 fill/comp ring,
+	// 否则使用自己的, 此时 fillMap/compMap 非 nil
+	fill    *xsk_ring_prod
+	comp    *xsk_ring_cons
+	fillMap []byte
+	compMap []byte
+
+	needWakeup bool // 绑定时使用了 XDP_USE_NEED_WAKEUP
+	descs      []unix.XDPDesc
+
+	txMu sync.Mutex // TX ring 只能有一个写者, Write/WriteDescs 整批持有, Close 持有以免释放正在写的 ring
+
+	runMu   sync.Mutex // 保护 closed 的设置与 running.Add, Close 之后 HandleRecv 不再开始
+	closed  int32
+	running sync.WaitGroup // HandleRecv
 }
 
+// pollTimeout HandleRecv 每次 poll 的超时(毫秒), 以便 Close 后退出
+const pollTimeout = 100
+
+// 旧版 x/sys 中没有
+const (
+	SO_PREFER_BUSY_POLL = 0x45
+	SO_BUSY_POLL_BUDGET = 0x46
+)
+
 type SocketConfig struct {
 	RxSize    uint32
 	TxSize    uint32
 	BindFlags uint16 //unix.XDP_COPY unix.XDP_ZEROCOPY unix.XDP_SHARED_UMEM unix.XDP_USE_NEED_WAKEUP
 	QueueID   int
 	Poll      bool
+	BatchSize uint32 // HandleRecv 每次最多处理的帧数, 0 为 RxSize
+
+	// Filter 非 nil 时, 返回 false 的帧在 Recv 中直接归还 fill ring, 不交给调用者.
+	// 可使用 filter.Filter 的 Match
+	Filter func(data []byte) bool
+
+	// BusyPoll 大于 0 时设置 SO_PREFER_BUSY_POLL 与 SO_BUSY_POLL(微秒),
+	// 由 poll/sendto 驱动网卡 NAPI. BusyPollBudget 为 0 时使用内核默认值
+	BusyPoll       int
+	BusyPollBudget int
+
+	// NoMTUCheck 为 true 时不检查网卡 MTU 是否放得下一个 frame, 如在 lo 或巨帧网卡上只收小包.
+	// 超出 frame 的包由内核丢弃
+	NoMTUCheck bool
 }
 
 var defaultSocketConfig = SocketConfig{
@@ -33,20 +73,41 @@ var defaultSocketConfig = SocketConfig{
 	QueueID:   0,
 }
 
-func NewSocket(ifindex int, umem *Umem, cfg *SocketConfig) (*Socket, error) {
-	var err error
-	if cfg == nil {
-		cfg = &defaultSocketConfig
-	}
+// NewSocket cfg 为 nil 时使用默认配置, 并根据网卡能力选择 XDP_ZEROCOPY 或 XDP_COPY
+func NewSocket(ifindex int, umem *Umem, cfg *SocketConfig) (_ *Socket, err error) {
 	if umem == nil {
 		umem, err = NewUmem(nil)
 		if err != nil {
 			return nil, errors.WithMessage(err, "NewUmem")
 		}
 	}
+	b := umem.backend
+	if cfg == nil {
+		c := defaultSocketConfig
+		if isLinuxBackend(b) {
+			if caps, err := probeNetdev(ifindex); err == nil {
+				c.BindFlags = caps.BindFlags()
+			}
+		}
+		cfg = &c
+	}
+	if isLinuxBackend(b) && cfg.RxSize > 0 && !cfg.NoMTUCheck {
+		err = checkMTU(ifindex, umem, cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// 同一 umem 上的 NewSocket 与 Close 串行, refCount 与第一个 socket 的绑定信息不会同时变化
+	umem.refLock.Lock()
+	defer umem.refLock.Unlock()
 	var socket Socket
+	defer func() {
+		if err != nil {
+			socket.close()
+		}
+	}()
 	if umem.refCount > 0 {
-		fd, err := syscall.Socket(unix.AF_XDP, unix.SOCK_RAW|unix.SOCK_CLOEXEC, 0)
+		fd, err := b.Socket()
 		if err != nil {
 			return nil, errors.WithMessage(err, "AF_XDP")
 		}
@@ -56,102 +117,195 @@ func NewSocket(ifindex int, umem *Umem, cfg *SocketConfig) (*Socket, error) {
 	}
 	socket.umem = umem
 	socket.config = *cfg
-	off, err := xsk_get_mmap_offsets(socket.fd)
+	socket.ifindex = ifindex
+	socket.fill, socket.comp = umem.fill, umem.comp
+	if umem.refCount > 0 && (umem.ifindex != ifindex || umem.queue != cfg.QueueID) {
+		socket.fill, socket.comp, socket.fillMap, socket.compMap, err = umem.fillCompRings(socket.fd)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if socket.config.BusyPoll > 0 && isLinuxBackend(b) {
+		err = setBusyPoll(socket.fd, socket.config.BusyPoll, socket.config.BusyPollBudget)
+		if err != nil {
+			return nil, err
+		}
+	}
+	off, err := b.MmapOffsets(socket.fd)
 	if err != nil {
 		return nil, err
 	}
 	if socket.config.RxSize > 0 {
-		err = syscall.SetsockoptInt(socket.fd, unix.SOL_XDP, unix.XDP_RX_RING, int(socket.config.RxSize))
+		err = b.SetRingSize(socket.fd, unix.XDP_RX_RING, socket.config.RxSize)
 		if err != nil {
 			return nil, errors.WithMessage(err, "XDP_RX_RING")
 		}
-		b, err := syscall.Mmap(
-			socket.fd,
-			unix.XDP_PGOFF_RX_RING,
-			int(off.Rx.Desc)+int(socket.config.RxSize*uint32(unsafe.Sizeof(unix.XDPDesc{}))),
-			unix.PROT_READ|unix.PROT_WRITE,
-			unix.MAP_SHARED|unix.MAP_POPULATE)
+		socket.rx, socket.rxMap, err = mmapRing[unix.XDPDesc](b, socket.fd, unix.XDP_PGOFF_RX_RING, off.Rx, socket.config.RxSize)
 		if err != nil {
-			return nil, errors.WithMessage(err, "Mmap RxRing")
-		}
-		rx := new(xsk_ring_rx)
-		rx.Mask = socket.config.RxSize - 1
-		rx.Size = socket.config.RxSize
-		rx.Producer = (*uint32)(unsafe.Pointer(&b[off.Rx.Producer]))
-		rx.Consumer = (*uint32)(unsafe.Pointer(&b[off.Rx.Consumer]))
-		rx.Flags = (*uint32)(unsafe.Pointer(&b[off.Rx.Flags]))
-		ring := (*reflect.SliceHeader)(unsafe.Pointer(&rx.Ring))
-		ring.Data = uintptr(unsafe.Pointer(&b[off.Rx.Desc]))
-		ring.Len = int(socket.config.RxSize)
-		ring.Cap = ring.Len
-		socket.rx = rx
+			return nil, errors.WithMessage(err, "RxRing")
+		}
 	}
 	if socket.config.TxSize > 0 {
-		err = syscall.SetsockoptInt(socket.fd, unix.SOL_XDP, unix.XDP_TX_RING, int(socket.config.TxSize))
+		err = b.SetRingSize(socket.fd, unix.XDP_TX_RING, socket.config.TxSize)
 		if err != nil {
 			return nil, errors.WithMessage(err, "XDP_TX_RING")
 		}
-		b, err := syscall.Mmap(
-			socket.fd,
-			unix.XDP_PGOFF_TX_RING,
-			int(off.Tx.Desc)+int(socket.config.TxSize*uint32(unsafe.Sizeof(unix.XDPDesc{}))),
-			unix.PROT_READ|unix.PROT_WRITE,
-			unix.MAP_SHARED|unix.MAP_POPULATE)
+		socket.tx, socket.txMap, err = mmapRing[unix.XDPDesc](b, socket.fd, unix.XDP_PGOFF_TX_RING, off.Tx, socket.config.TxSize)
 		if err != nil {
-			return nil, errors.WithMessage(err, "Mmap TxRing")
-		}
-		tx := new(xsk_ring_tx)
-		tx.Mask = socket.config.TxSize - 1
-		tx.Size = socket.config.TxSize
-		tx.Producer = (*uint32)(unsafe.Pointer(&b[off.Tx.Producer]))
-		tx.Consumer = (*uint32)(unsafe.Pointer(&b[off.Tx.Consumer]))
-		tx.Flags = (*uint32)(unsafe.Pointer(&b[off.Tx.Flags]))
-		ring := (*reflect.SliceHeader)(unsafe.Pointer(&tx.Ring))
-		ring.Data = uintptr(unsafe.Pointer(&b[off.Tx.Desc]))
-		ring.Len = int(socket.config.TxSize)
-		ring.Cap = ring.Len
-		socket.tx = tx
+			return nil, errors.WithMessage(err, "TxRing")
+		}
 	}
 	var sxdp = unix.SockaddrXDP{
 		QueueID: uint32(socket.config.QueueID),
 		Ifindex: uint32(ifindex),
 	}
 	if umem.refCount > 0 {
-		sxdp.Flags |= unix.XDP_SHARED_UMEM
+		// 共享 umem 时不能再指定其他标志, 沿用第一个 socket 的
+		sxdp.Flags = unix.XDP_SHARED_UMEM
 		sxdp.SharedUmemFD = uint32(umem.fd)
+		socket.needWakeup = umem.bindFlags&unix.XDP_USE_NEED_WAKEUP != 0
 	} else {
 		sxdp.Flags = socket.config.BindFlags
+		if socket.config.Poll {
+			sxdp.Flags |= unix.XDP_USE_NEED_WAKEUP
+		}
+		socket.needWakeup = sxdp.Flags&unix.XDP_USE_NEED_WAKEUP != 0
 	}
-	if socket.config.Poll {
-		sxdp.Flags |= unix.XDP_USE_NEED_WAKEUP
-	}
-	err = unix.Bind(socket.fd, &sxdp)
+	err = b.Bind(socket.fd, &sxdp)
 	if err != nil {
-		log.Println(int(err.(syscall.Errno)))
 		return nil, errors.WithMessage(err, "Bind")
 	}
+	if umem.refCount == 0 {
+		umem.bindFlags = sxdp.Flags
+		umem.ifindex, umem.queue = ifindex, socket.config.QueueID
+	}
+	batch := socket.config.BatchSize
+	if batch == 0 || batch > socket.config.RxSize {
+		batch = socket.config.RxSize
+	}
+	socket.descs = make([]unix.XDPDesc, batch)
 	umem.refCount++
 	return &socket, nil
 }
 
-// HandleRecv  handler 返回false时表示已将此frame直接放入Tx队列,不回收frame
+func setBusyPoll(fd int, usecs, budget int) error {
+	err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, SO_PREFER_BUSY_POLL, 1)
+	if err != nil {
+		return errors.WithMessage(err, "SO_PREFER_BUSY_POLL")
+	}
+	err = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_BUSY_POLL, usecs)
+	if err != nil {
+		return errors.WithMessage(err, "SO_BUSY_POLL")
+	}
+	if budget > 0 {
+		err = unix.SetsockoptInt(fd, unix.SOL_SOCKET, SO_BUSY_POLL_BUDGET, budget)
+		if err != nil {
+			return errors.WithMessage(err, "SO_BUSY_POLL_BUDGET")
+		}
+	}
+	return nil
+}
+
+// Close 关闭 socket, 不释放 umem. 等待 HandleRecv 与进行中的 Write/WriteDescs 返回, 不能在 handler 中调用.
+// 之后的 Write/WriteDescs 返回 0; Recv 不可与 Close 并发
+func (s *Socket) Close() error {
+	s.runMu.Lock()
+	if !atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
+		s.runMu.Unlock()
+		return nil
+	}
+	s.runMu.Unlock()
+	s.running.Wait()
+	s.txMu.Lock()
+	s.close()
+	s.txMu.Unlock()
+	s.umem.refLock.Lock()
+	s.umem.refCount--
+	s.umem.refLock.Unlock()
+	return nil
+}
+
+func (s *Socket) close() {
+	if s.umem == nil {
+		return
+	}
+	b := s.umem.backend
+	if s.rxMap != nil {
+		b.Munmap(s.rxMap)
+		s.rxMap = nil
+	}
+	if s.txMap != nil {
+		b.Munmap(s.txMap)
+		s.txMap = nil
+	}
+	if s.fd != s.umem.fd {
+		b.Close(s.fd)
+	}
+	if s.fillMap != nil {
+		// socket 已关闭, 内核不再读取 fill ring, 未被取走的 frame 归还 umem
+		for i := atomic.LoadUint32(s.fill.Consumer); i != s.fill.CachedProd; i++ {
+			s.umem.putFrame(s.fill.Ring[i&s.fill.Mask])
+		}
+		b.Munmap(s.fillMap)
+		s.fillMap = nil
+	}
+	if s.compMap != nil {
+		b.Munmap(s.compMap)
+		s.compMap = nil
+	}
+}
+
+// HandleRecv  handler 返回false时表示已将此frame直接放入Tx队列,不回收frame. Close 后返回, Close 之后调用立即返回
 func (s *Socket) HandleRecv(handler func(unix.XDPDesc, []byte) bool) {
-	fds := make([]unix.PollFd, 1)
-	fds[0].Fd = int32(s.fd)
-	fds[0].Events = unix.POLLIN
-	for {
+	s.runMu.Lock()
+	if atomic.LoadInt32(&s.closed) != 0 {
+		s.runMu.Unlock()
+		return
+	}
+	s.running.Add(1)
+	s.runMu.Unlock()
+	defer s.running.Done()
+	for atomic.LoadInt32(&s.closed) == 0 {
 		if s.config.Poll {
-			unix.Poll(fds, -1)
-		}
-		descs := s.rx.slots(s.rx.Size)
-		s.umem.fill_fr()
-		for i := range descs {
-			data := s.umem.DescData(descs[i])
-			if handler(descs[i], data) {
-				s.umem.putFrame(descs[i].Addr)
+			s.umem.backend.Poll(s.fd, unix.POLLIN, pollTimeout)
+		}
+		n := s.Recv(s.descs)
+		for _, d := range s.descs[:n] {
+			if handler(d, s.umem.DescData(d)) {
+				s.umem.putFrame(d.Addr)
+			}
+		}
+	}
+}
+
+// Recv 不阻塞地取出最多 len(descs) 个收到的帧, 返回个数, 并补充 fill ring.
+// 每个帧之后须 Release 归还或经 WriteDescs 发送. RX ring 只有一个读者, Recv 与 HandleRecv 不可并发调用,
+// Release 与 Write 可在其他 goroutine 中调用
+func (s *Socket) Recv(descs []unix.XDPDesc) int {
+	n := s.rx.consume(descs)
+	if f := s.config.Filter; f != nil {
+		m := uint32(0)
+		for _, d := range descs[:n] {
+			if f(s.umem.DescData(d)) {
+				descs[m] = d
+				m++
+			} else {
+				s.umem.putFrame(d.Addr)
 			}
 		}
-		s.rx.submit_cons(uint32(len(descs)))
+		n = m
+	}
+	s.umem.fill_fr(s.fill)
+	if n == 0 && !s.config.Poll && s.needWakeup && s.fill.needs_wakeup() {
+		s.umem.backend.Poll(s.fd, unix.POLLIN, 0)
+	}
+	return int(n)
+}
+
+// Release 归还 Recv 得到的帧
+func (s *Socket) Release(descs ...unix.XDPDesc) {
+	for _, d := range descs {
+		s.umem.putFrame(d.Addr)
 	}
 }
 
@@ -160,7 +314,9 @@ func (s *Socket) write(b []byte) bool {
 	if !ok {
 		return false
 	}
-	desc := unix.XDPDesc{Addr: addr, Len: _DEFAULT_FRAME_SIZE}
+	// 内核要求 addr 之前留有 TxMetadataLen 字节, 即使不带 XDP_TX_METADATA
+	off := s.umem.config.TxMetadataLen
+	desc := unix.XDPDesc{Addr: addr + uint64(off), Len: _DEFAULT_FRAME_SIZE - off}
 	frame := s.umem.DescData(desc)
 	n := copy(frame, b)
 	desc.Len = uint32(n)
@@ -168,37 +324,81 @@ func (s *Socket) write(b []byte) bool {
 	return true
 }
 
+// Write 拷贝到空闲 frame 后发送, 返回实际发送的个数 n (即 bs[:n]). 超过 MaxWriteLen 的帧被截断.
+// TX ring 已满或 umem 没有空闲 frame 时 n < len(bs), 可稍后重试剩余部分.
+// 可在多个 goroutine 中并发调用, 同一次调用的帧在 TX ring 中连续, 按 bs 的顺序发送
 func (s *Socket) Write(bs ...[]byte) uint32 {
-	s.umem.cons_cr()
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+	if atomic.LoadInt32(&s.closed) != 0 {
+		return 0
+	}
+	s.umem.cons_cr(s.comp)
+	free := s.tx.prod_nb_free(uint32(len(bs)))
 	var n uint32
 	for _, b := range bs {
-		if s.write(b) {
-			n++
+		if n == free || !s.write(b) {
+			break
 		}
+		n++
 	}
 	if n > 0 {
 		s.tx.submit_prod(n)
-		sendto(s.fd)
+		s.kick()
 	}
 	return n
 }
 
+// MaxWriteLen Write 单个帧的最大长度: FrameSize 减去 UmemConfig.TxMetadataLen
+func (s *Socket) MaxWriteLen() int {
+	return int(_DEFAULT_FRAME_SIZE - s.umem.config.TxMetadataLen)
+}
+
+// kick 通知内核发送, 使用 need_wakeup 时只在内核要求时才系统调用
+func (s *Socket) kick() {
+	if s.needWakeup && !s.tx.needs_wakeup() {
+		return
+	}
+	s.umem.backend.Wakeup(s.fd)
+}
+
 func (s *Socket) FD() int {
 	return s.fd
 }
 
-// WriteDesc 包已写入umem ,直接把desc加入tx队列发送
+// WriteDesc 包已写入umem ,直接把desc加入tx队列发送. TX ring 已满时丢弃并回收 frame
 func (s *Socket) WriteDesc(d unix.XDPDesc) {
-	s.tx.fill_slot(d)
-	s.tx.submit_prod(1)
-	sendto(s.fd)
+	if s.WriteDescs(d) == 0 {
+		s.umem.putFrame(d.Addr)
+	}
 }
 
-func (s *Socket) Stats() (unix.XDPStatistics, error) {
-	var stats unix.XDPStatistics
-	_, _, errno := syscall.Syscall6(unix.SYS_GETSOCKOPT, uintptr(s.fd), unix.SOL_XDP, unix.XDP_STATISTICS, uintptr(unsafe.Pointer(&stats)), 48, 0)
-	if errno != 0 {
-		return stats, errno
+// WriteDescs 批量发送已写入 umem 的帧, 返回放入 TX ring 的个数 n (即 ds[:n]),
+// 其余的帧仍归调用者所有. 同时回收已发送完成的 frame. 并发调用的保证同 Write
+func (s *Socket) WriteDescs(ds ...unix.XDPDesc) uint32 {
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+	if atomic.LoadInt32(&s.closed) != 0 {
+		return 0
 	}
-	return stats, nil
+	s.umem.cons_cr(s.comp)
+	n := s.tx.prod_nb_free(uint32(len(ds)))
+	if n > uint32(len(ds)) {
+		n = uint32(len(ds))
+	}
+	for _, d := range ds[:n] {
+		if d.Options&XDP_TX_METADATA != 0 && s.umem.txMeta != nil {
+			s.umem.txMeta[d.Addr/uint64(_DEFAULT_FRAME_SIZE)] = true
+		}
+		s.tx.fill_slot(d)
+	}
+	if n > 0 {
+		s.tx.submit_prod(n)
+		s.kick()
+	}
+	return n
+}
+
+func (s *Socket) Stats() (unix.XDPStatistics, error) {
+	return s.umem.backend.Statistics(s.fd)
 }
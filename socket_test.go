@@ -0,0 +1,435 @@
+package xdp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lixiangzhong/xdp/xdpsim"
+	"golang.org/x/sys/unix"
+)
+
+const simIfindex = 1
+
+// newSimSocket 在 xdpsim 上创建 umem 与 socket, 测试结束时释放
+func newSimSocket(t testing.TB, kcfg *xdpsim.Config, ucfg UmemConfig, scfg SocketConfig) (*xdpsim.Kernel, *Umem, *Socket) {
+	t.Helper()
+	k := xdpsim.New(kcfg)
+	ucfg.Backend = k
+	u, err := NewUmem(&ucfg)
+	if err != nil {
+		k.Stop()
+		t.Fatalf("NewUmem: %v", err)
+	}
+	s, err := NewSocket(simIfindex, u, &scfg)
+	if err != nil {
+		u.Close()
+		k.Stop()
+		t.Fatalf("NewSocket: %v", err)
+	}
+	t.Cleanup(func() {
+		s.Close()
+		u.Close()
+		k.Stop()
+	})
+	return k, u, s
+}
+
+func simUmemConfig(frames, fill uint32) UmemConfig {
+	return UmemConfig{
+		FillSize: fill,
+		CompSize: fill,
+		Size:     frames * _DEFAULT_FRAME_SIZE,
+	}
+}
+
+// waitFor 等待 cond 成立, 超时失败
+func waitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func simFrame(i, size int) []byte {
+	b := make([]byte, size)
+	for j := range b {
+		b[j] = byte(i + j)
+	}
+	return b
+}
+
+func freeFrames(u *Umem) uint32 {
+	u.frameLock.Lock()
+	defer u.frameLock.Unlock()
+	return u.freeFrame
+}
+
+func TestSocketRecv(t *testing.T) {
+	tests := []struct {
+		name   string
+		kernel xdpsim.Config
+		frames uint32 // umem 中的 frame 数, fill ring 同样大小
+		inject int
+		size   int
+		want   int // Recv 得到的帧数
+		stats  unix.XDPStatistics
+	}{
+		{name: "basic", frames: 64, inject: 10, size: 100, want: 10},
+		{name: "delay", kernel: xdpsim.Config{RxDelay: 20 * time.Millisecond}, frames: 64, inject: 5, size: 60, want: 5},
+		{name: "drop", kernel: xdpsim.Config{RxDropRate: 1}, frames: 64, inject: 8, size: 60,
+			stats: unix.XDPStatistics{Rx_dropped: 8}},
+		{name: "fill ring empty", frames: 4, inject: 6, size: 60, want: 4,
+			stats: unix.XDPStatistics{Rx_dropped: 2, Rx_fill_ring_empty_descs: 2}},
+		{name: "oversized", frames: 64, inject: 3, size: 4000,
+			stats: unix.XDPStatistics{Rx_dropped: 3}},
+		{name: "need wakeup", kernel: xdpsim.Config{NeedWakeup: true}, frames: 64, inject: 10, size: 100, want: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kcfg := tt.kernel
+			k, u, s := newSimSocket(t, &kcfg, simUmemConfig(tt.frames, tt.frames),
+				SocketConfig{RxSize: 64, TxSize: 64, BindFlags: unix.XDP_USE_NEED_WAKEUP})
+			start := time.Now()
+			for i := 0; i < tt.inject; i++ {
+				if !k.Inject(simIfindex, 0, simFrame(i, tt.size)) {
+					t.Fatal("Inject: no socket")
+				}
+			}
+			descs := make([]unix.XDPDesc, 64)
+			var got []unix.XDPDesc
+			waitFor(t, "stats", func() bool {
+				n := s.Recv(descs)
+				got = append(got, descs[:n]...)
+				st, _ := s.Stats()
+				return len(got) == tt.want && st.Rx_dropped == tt.stats.Rx_dropped
+			})
+			if len(got) > 0 && tt.kernel.RxDelay > 0 && time.Since(start) < tt.kernel.RxDelay {
+				t.Errorf("frames received before RxDelay")
+			}
+			for i, d := range got {
+				if data := u.DescData(d); !bytes.Equal(data, simFrame(i, tt.size)) {
+					t.Errorf("frame %d: got % x", i, data)
+				}
+			}
+			// 确认没有多余的帧
+			time.Sleep(5 * time.Millisecond)
+			if n := s.Recv(descs); n != 0 {
+				t.Errorf("unexpected %d extra frames", n)
+			}
+			st, err := s.Stats()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if st != tt.stats {
+				t.Errorf("stats: got %+v, want %+v", st, tt.stats)
+			}
+			s.Release(got...)
+			if n := freeFrames(u) + s.fill.CachedProd - atomic.LoadUint32(s.fill.Consumer); n != tt.frames {
+				t.Errorf("frames leaked: %d of %d accounted for", n, tt.frames)
+			}
+		})
+	}
+}
+
+// fill ring 空时丢包, 归还 frame 后 Recv 补充 fill ring 恢复接收
+func TestSocketRecvRefill(t *testing.T) {
+	k, _, s := newSimSocket(t, nil, simUmemConfig(4, 4), SocketConfig{RxSize: 8, TxSize: 8})
+	descs := make([]unix.XDPDesc, 8)
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 6; i++ {
+			k.Inject(simIfindex, 0, simFrame(i, 64))
+		}
+		var got []unix.XDPDesc
+		waitFor(t, "4 frames", func() bool {
+			n := s.Recv(descs)
+			got = append(got, descs[:n]...)
+			return len(got) == 4
+		})
+		s.Release(got...)
+	}
+	st, _ := s.Stats()
+	if st.Rx_fill_ring_empty_descs != 6 || st.Rx_dropped != 6 {
+		t.Errorf("stats: %+v", st)
+	}
+}
+
+func TestSocketWriteCompletion(t *testing.T) {
+	tests := []struct {
+		name   string
+		kernel xdpsim.Config
+		bind   uint16
+		meta   uint32 // UmemConfig.TxMetadataLen
+	}{
+		{name: "basic"},
+		{name: "tx metadata", meta: 24},
+		{name: "need wakeup", kernel: xdpsim.Config{NeedWakeup: true}, bind: unix.XDP_USE_NEED_WAKEUP},
+		{name: "no need wakeup flag", kernel: xdpsim.Config{NeedWakeup: true}},
+		{name: "tx delay", kernel: xdpsim.Config{TxDelay: time.Millisecond}},
+		{name: "tx drop", kernel: xdpsim.Config{TxDropRate: 0.5, Seed: 1}},
+	}
+	const (
+		frames = 16
+		fill   = 8
+		total  = 200
+	)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent int32
+			var bad int32
+			kcfg := tt.kernel
+			kcfg.OnTransmit = func(ifindex, queue int, data []byte) {
+				i := atomic.AddInt32(&sent, 1) - 1
+				if ifindex != simIfindex || queue != 0 || !bytes.Equal(data, simFrame(int(i), 80)) {
+					atomic.AddInt32(&bad, 1)
+				}
+			}
+			ucfg := simUmemConfig(frames, fill)
+			ucfg.TxMetadataLen = tt.meta
+			_, u, s := newSimSocket(t, &kcfg, ucfg, SocketConfig{RxSize: 8, TxSize: 8, BindFlags: tt.bind})
+			if s.needWakeup != (tt.bind&unix.XDP_USE_NEED_WAKEUP != 0) {
+				t.Fatalf("needWakeup = %v", s.needWakeup)
+			}
+			// 只有 frames-fill 个 frame 可用于发送, 必须靠 completion 回收才能发完
+			deadline := time.Now().Add(5 * time.Second)
+			for i := 0; i < total; {
+				if s.Write(simFrame(i, 80)) == 1 {
+					i++
+					continue
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("only %d of %d written, frames not completed", i, total)
+				}
+				time.Sleep(50 * time.Microsecond)
+			}
+			waitFor(t, "completions", func() bool {
+				s.Write() // 只回收 completion ring
+				return freeFrames(u) == frames-fill
+			})
+			n := atomic.LoadInt32(&sent)
+			if tt.kernel.TxDropRate == 0 && n != total {
+				t.Errorf("transmitted %d, want %d", n, total)
+			}
+			if tt.kernel.TxDropRate > 0 && (n == 0 || n == total) {
+				t.Errorf("transmitted %d of %d with drop rate %v", n, total, tt.kernel.TxDropRate)
+			}
+			if tt.kernel.TxDropRate == 0 && atomic.LoadInt32(&bad) != 0 {
+				t.Errorf("%d frames transmitted out of order or corrupted", bad)
+			}
+			if st, _ := s.Stats(); st.Tx_invalid_descs != 0 {
+				t.Errorf("%d invalid TX descs", st.Tx_invalid_descs)
+			}
+		})
+	}
+}
+
+// concFrame 并发写测试的帧: writer, 调用序号, 调用内序号, 之后为可校验的内容
+func concFrame(g, call, idx int) []byte {
+	b := make([]byte, 64)
+	b[0] = byte(g)
+	binary.BigEndian.PutUint32(b[1:], uint32(call))
+	b[5] = byte(idx)
+	for j := 6; j < len(b); j++ {
+		b[j] = byte(g*7 + call + idx*3 + j)
+	}
+	return b
+}
+
+// 多个 goroutine 同时 Write/WriteDescs: 每帧完整发出, 同一次调用的帧在 TX ring 中连续且有序
+func TestSocketConcurrentWrite(t *testing.T) {
+	const (
+		writers   = 4
+		perWriter = 300
+		frames    = 64
+		fill      = 8
+	)
+	var (
+		mu       sync.Mutex
+		sent     [writers]int
+		lastCall [writers]int
+		prev     = [3]int{-1}
+	)
+	kcfg := xdpsim.Config{OnTransmit: func(_, _ int, data []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(data) != 64 || int(data[0]) >= writers {
+			t.Errorf("transmitted bad frame % x", data)
+			return
+		}
+		g, call, idx := int(data[0]), int(binary.BigEndian.Uint32(data[1:])), int(data[5])
+		if !bytes.Equal(data, concFrame(g, call, idx)) {
+			t.Errorf("writer %d call %d frame %d corrupted", g, call, idx)
+		}
+		if idx > 0 && prev != [3]int{g, call, idx - 1} {
+			t.Errorf("writer %d call %d frame %d follows %v", g, call, idx, prev)
+		}
+		if idx == 0 && sent[g] > 0 && call <= lastCall[g] {
+			t.Errorf("writer %d call %d after call %d", g, call, lastCall[g])
+		}
+		prev = [3]int{g, call, idx}
+		lastCall[g] = call
+		sent[g]++
+	}}
+	_, u, s := newSimSocket(t, &kcfg, simUmemConfig(frames, fill), SocketConfig{RxSize: 8, TxSize: 16})
+
+	var wg sync.WaitGroup
+	for g := 0; g < writers; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(g)))
+			for done, call := 0, 0; done < perWriter; call++ {
+				k := 1 + rnd.Intn(6)
+				if done+k > perWriter {
+					k = perWriter - done
+				}
+				var n uint32
+				if g%2 == 0 {
+					bs := make([][]byte, k)
+					for i := range bs {
+						bs[i] = concFrame(g, call, i)
+					}
+					n = s.Write(bs...)
+				} else {
+					var ds []unix.XDPDesc
+					for i := 0; i < k; i++ {
+						b, ok := u.AllocFrame()
+						if !ok {
+							break
+						}
+						b.Append(concFrame(g, call, i))
+						ds = append(ds, u.BufferDesc(b))
+					}
+					// 没有空闲 frame 时也调用, 以回收 completion ring
+					n = s.WriteDescs(ds...)
+					for _, d := range ds[n:] {
+						u.FreeFrame(d.Addr)
+					}
+				}
+				done += int(n)
+				if n == 0 {
+					runtime.Gosched()
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	waitFor(t, "transmit", func() bool {
+		s.Write() // 回收 completion ring
+		mu.Lock()
+		defer mu.Unlock()
+		for _, n := range sent {
+			if n != perWriter {
+				return false
+			}
+		}
+		return freeFrames(u) == frames-fill
+	})
+}
+
+// Close 等待进行中的写入, 之后的 Write/WriteDescs 返回 0
+func TestSocketCloseWhileWriting(t *testing.T) {
+	_, u, s := newSimSocket(t, nil, simUmemConfig(64, 8), SocketConfig{RxSize: 8, TxSize: 16})
+	// 关闭后 TX 中的 frame 不再回收, 事先留一个
+	b, ok := u.AllocFrame()
+	if !ok {
+		t.Fatal("AllocFrame failed")
+	}
+	b.Append(concFrame(0, 0, 0))
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				if s.Write(concFrame(g, i, 0)) == 0 {
+					if atomic.LoadInt32(&s.closed) != 0 {
+						return
+					}
+					runtime.Gosched()
+				}
+			}
+		}(g)
+	}
+	time.Sleep(10 * time.Millisecond)
+	s.Close()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("writers did not stop after Close")
+	}
+	if s.Write(concFrame(0, 0, 0)) != 0 || s.WriteDescs(u.BufferDesc(b)) != 0 {
+		t.Error("write succeeded after Close")
+	}
+}
+
+// HandleRecv 与 Close 并发时, 或在 Close 之后调用时都能返回
+func TestSocketCloseWhileHandling(t *testing.T) {
+	k, u, _ := newSimSocket(t, nil, simUmemConfig(64, 8), SocketConfig{RxSize: 8})
+	for i := 0; i < 100; i++ {
+		s, err := NewSocket(simIfindex, u, &SocketConfig{RxSize: 8, QueueID: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		k.Inject(simIfindex, 1, simFrame(i, 60))
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			s.HandleRecv(func(unix.XDPDesc, []byte) bool { return true })
+		}()
+		if i%2 == 0 {
+			runtime.Gosched()
+		}
+		s.Close()
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("round %d: HandleRecv did not return after Close", i)
+		}
+	}
+}
+
+// 共享 umem 的 socket 在不同 goroutine 中打开与关闭
+func TestSocketSharedUmemConcurrent(t *testing.T) {
+	_, u, _ := newSimSocket(t, nil, simUmemConfig(256, 16), SocketConfig{RxSize: 16})
+	free := freeFrames(u)
+	var wg sync.WaitGroup
+	for q := 1; q <= 4; q++ {
+		wg.Add(1)
+		go func(q int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				s, err := NewSocket(simIfindex, u, &SocketConfig{RxSize: 16, TxSize: 16, QueueID: q})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				s.Close()
+			}
+		}(q)
+	}
+	wg.Wait()
+	u.refLock.Lock()
+	refs := u.refCount
+	u.refLock.Unlock()
+	if refs != 1 {
+		t.Errorf("refCount %d, want 1", refs)
+	}
+	if got := freeFrames(u); got != free {
+		t.Errorf("free frames %d, want %d", got, free)
+	}
+}
@@ -77,6 +77,28 @@ func Posix_memalign(size int) []byte {
 	return b
 }
 
+func free_mem(b []byte) {
+	C.free(unsafe.Pointer(&b[0]))
+}
+
+// GetNicPromisc 网卡是否处于混杂模式, 用于退出时恢复
+func GetNicPromisc(ifname string) (bool, error) {
+	ifreq, err := unix.NewIfreq(ifname)
+	if err != nil {
+		return false, err
+	}
+	fd, err := syscall.Socket(unix.AF_INET, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		return false, err
+	}
+	defer syscall.Close(fd)
+	err = unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifreq)
+	if err != nil {
+		return false, err
+	}
+	return ifreq.Uint16()&unix.IFF_PROMISC != 0, nil
+}
+
 func SetNicPromisc(ifname string, promisc bool) error {
 	ifreq, err := unix.NewIfreq(ifname)
 	if err != nil {
@@ -86,6 +108,7 @@ func SetNicPromisc(ifname string, promisc bool) error {
 	if err != nil {
 		return err
 	}
+	defer syscall.Close(fd)
 	err = unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifreq)
 	if err != nil {
 		return err
@@ -0,0 +1,147 @@
+package xdp
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// AF_XDP TX metadata (Linux 6.8+), 旧版 x/sys 中没有
+const (
+	XDP_TX_METADATA          = 1 << 1 // desc Options: 数据之前有 xsk_tx_metadata
+	XDP_UMEM_TX_SW_CSUM      = 1 << 1 // UmemConfig.Flags: 复制模式下由内核软件计算请求的校验和
+	XDP_UMEM_TX_METADATA_LEN = 1 << 2 // 6.11 起须设置此标志 tx_metadata_len 才生效, NewUmem 自动设置
+)
+
+// struct xsk_tx_metadata: flags u64, 请求时 csum_start u16, csum_offset u16, launch_time u64 (6.15),
+// 完成后 tx_timestamp u64 覆盖请求部分
+const (
+	txmdTimestamp  = 1 << 0
+	txmdChecksum   = 1 << 1
+	txmdLaunchTime = 1 << 2
+
+	txMetaMinLen    = 16 // 6.8 的 xsk_tx_metadata 没有 launch_time
+	txMetaLaunchLen = 24
+	txMetaMaxLen    = 256
+)
+
+// TxMetadata 随一个 TX desc 交给网卡的请求, 需要 UmemConfig.TxMetadataLen.
+// 网卡是否支持见 NicCapabilities.XSKFeatures, 复制模式下由内核处理
+type TxMetadata struct {
+	Timestamp bool // 请求 TX 时间戳, 发送完成后由 Socket.TxTimestamps 取得
+
+	// Checksum 请求网卡计算 L4 校验和: 从 CsumStart (相对数据起始) 到末尾求和, 写入 CsumStart+CsumOffset 处.
+	// 校验和字段须预先写入伪首部累加值, 见 packet.Packet.SetL4PseudoChecksum
+	Checksum   bool
+	CsumStart  uint16
+	CsumOffset uint16
+
+	LaunchTime uint64 // 非 0 时请求在此时间 (纳秒, 网卡时钟) 发送, 需 6.15 且 TxMetadataLen >= 24
+}
+
+// TxTimestamp 一个请求了时间戳的帧的发送完成时间
+type TxTimestamp struct {
+	Addr      uint64 // 发送时 desc 的 Addr
+	Timestamp uint64 // 纳秒. 零拷贝为网卡 PHC 时钟, 复制模式为 CLOCK_TAI; 驱动不支持时无意义
+}
+
+// setUmemTxMetadataLen x/sys 的 XDPUmemReg 末尾 4 字节填充即 6.8 加入的 tx_metadata_len,
+// 旧内核忽略
+func setUmemTxMetadataLen(reg *unix.XDPUmemReg, n uint32) {
+	*(*uint32)(unsafe.Add(unsafe.Pointer(reg), unsafe.Offsetof(reg.Flags)+4)) = n
+}
+
+func checkTxMetadataLen(n uint32) error {
+	if n != 0 && (n%8 != 0 || n < txMetaMinLen || n >= txMetaMaxLen) {
+		return errors.Errorf("TxMetadataLen %d: must be a multiple of 8 in [%d, %d)", n, txMetaMinLen, txMetaMaxLen)
+	}
+	return nil
+}
+
+// SetTxMetadata 在 d 的数据之前写入 m 并设置 XDP_TX_METADATA, 之后用 WriteDescs 发送.
+// d 的数据之前须至少留有 TxMetadataLen 字节, AllocFrame 与 RX 的 desc 都满足
+func (u *Umem) SetTxMetadata(d *unix.XDPDesc, m TxMetadata) error {
+	n := uint64(u.config.TxMetadataLen)
+	if n == 0 {
+		return errors.New("umem has no TX metadata (TxMetadataLen is 0)")
+	}
+	base := d.Addr &^ uint64(_DEFAULT_FRAME_SIZE-1)
+	if d.Addr-base < n {
+		return errors.New("no room for TX metadata before data")
+	}
+	if m.LaunchTime != 0 && n < txMetaLaunchLen {
+		return errors.Errorf("launch time requires TxMetadataLen >= %d", txMetaLaunchLen)
+	}
+	b := u.data[d.Addr-n : d.Addr]
+	for i := range b[:txMetaMinLen] {
+		b[i] = 0
+	}
+	var flags uint64
+	if m.Timestamp {
+		flags |= txmdTimestamp
+	}
+	if m.Checksum {
+		flags |= txmdChecksum
+		binary.LittleEndian.PutUint16(b[8:], m.CsumStart)
+		binary.LittleEndian.PutUint16(b[10:], m.CsumOffset)
+	}
+	if n >= txMetaLaunchLen {
+		binary.LittleEndian.PutUint64(b[16:], m.LaunchTime)
+		if m.LaunchTime != 0 {
+			flags |= txmdLaunchTime
+		}
+	}
+	binary.LittleEndian.PutUint64(b, flags)
+	d.Options |= XDP_TX_METADATA
+	return nil
+}
+
+// setLaunchTime 设置 d 的发送时间 (纳秒), 保留已用 SetTxMetadata 写入的其它请求
+func (u *Umem) setLaunchTime(d *unix.XDPDesc, t uint64) error {
+	n := uint64(u.config.TxMetadataLen)
+	if d.Options&XDP_TX_METADATA == 0 || n < txMetaLaunchLen {
+		return u.SetTxMetadata(d, TxMetadata{LaunchTime: t})
+	}
+	b := u.data[d.Addr-n : d.Addr]
+	binary.LittleEndian.PutUint64(b[16:], t)
+	binary.LittleEndian.PutUint64(b, binary.LittleEndian.Uint64(b)|txmdLaunchTime)
+	return nil
+}
+
+// txCompleted 在 cons_cr 中对每个完成的 addr 调用, 持有 frameLock.
+// 只解析带 XDP_TX_METADATA 发送的 frame, 其它 frame 数据之前的字节可能是任意内容
+func (u *Umem) txCompleted(addr uint64) {
+	i := addr / uint64(_DEFAULT_FRAME_SIZE)
+	if !u.txMeta[i] {
+		return
+	}
+	u.txMeta[i] = false
+	n := uint64(u.config.TxMetadataLen)
+	base := addr &^ uint64(_DEFAULT_FRAME_SIZE-1)
+	if addr-base < n {
+		return
+	}
+	b := u.data[addr-n : addr]
+	if binary.LittleEndian.Uint64(b)&txmdTimestamp != 0 {
+		// frameLock 保证同时只有一个生产者; ring 满时丢弃
+		u.txTimestamps.Enqueue(TxTimestamp{Addr: addr, Timestamp: binary.LittleEndian.Uint64(b[8:])})
+	}
+}
+
+// TxTimestamps 回收已发送完成的 frame, 取出请求了时间戳的帧的 TX 时间戳, 返回个数.
+// 时间戳按完成顺序保存在 umem 中, 共享 umem 的 socket 共用, 未及时取出时丢弃较新的.
+// 只能在一个 goroutine 中调用, 可与 Write/WriteDescs 并发
+func (s *Socket) TxTimestamps(dst []TxTimestamp) int {
+	if s.umem.txTimestamps == nil {
+		return 0
+	}
+	s.txMu.Lock()
+	if atomic.LoadInt32(&s.closed) == 0 {
+		s.umem.cons_cr(s.comp)
+	}
+	s.txMu.Unlock()
+	return s.umem.txTimestamps.Dequeue(dst)
+}
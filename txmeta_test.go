@@ -0,0 +1,122 @@
+package xdp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/lixiangzhong/xdp/xdpsim"
+	"golang.org/x/sys/unix"
+)
+
+// 只有带 XDP_TX_METADATA 发送的帧产生 TX 时间戳, 其它帧数据之前的残留不被当作 metadata
+func TestTxTimestampsOnlyWithMetadata(t *testing.T) {
+	ucfg := simUmemConfig(16, 8)
+	ucfg.TxMetadataLen = 24
+	_, u, s := newSimSocket(t, nil, ucfg, SocketConfig{RxSize: 8, TxSize: 8})
+	free := freeFrames(u)
+	// alloc 取得 addr 所在的 frame, addr 为 0 时取任意一个
+	alloc := func(addr uint64) unix.XDPDesc {
+		t.Helper()
+		var skipped []uint64
+		defer func() {
+			for _, a := range skipped {
+				u.FreeFrame(a)
+			}
+		}()
+		for {
+			b, ok := u.AllocFrame()
+			if !ok {
+				t.Fatalf("frame %#x not free", addr)
+			}
+			b.Append(simFrame(0, 60))
+			d := u.BufferDesc(b)
+			if addr == 0 || d.Addr == addr {
+				return d
+			}
+			skipped = append(skipped, d.Addr)
+		}
+	}
+	send := func(ds ...unix.XDPDesc) []TxTimestamp {
+		t.Helper()
+		if n := s.WriteDescs(ds...); int(n) != len(ds) {
+			t.Fatalf("WriteDescs = %d", n)
+		}
+		var got []TxTimestamp
+		dst := make([]TxTimestamp, 4)
+		waitFor(t, "completions", func() bool {
+			got = append(got, dst[:s.TxTimestamps(dst)]...)
+			return freeFrames(u) == free
+		})
+		return got
+	}
+
+	withMeta := alloc(0)
+	if err := u.SetTxMetadata(&withMeta, TxMetadata{Timestamp: true}); err != nil {
+		t.Fatal(err)
+	}
+	// 模拟内核在完成时写入的时间戳
+	binary.LittleEndian.PutUint64(u.data[withMeta.Addr-16:], 777)
+	// 数据之前像是请求了时间戳的残留
+	stale := alloc(0)
+	binary.LittleEndian.PutUint64(u.data[stale.Addr-24:], txmdTimestamp)
+	binary.LittleEndian.PutUint64(u.data[stale.Addr-16:], 999)
+
+	got := send(withMeta, stale)
+	if want := []TxTimestamp{{Addr: withMeta.Addr, Timestamp: 777}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("TxTimestamps %+v, want %+v", got, want)
+	}
+
+	// 同一个 frame 再次不带 metadata 发送, metadata 区仍是上次的内容
+	again := alloc(withMeta.Addr)
+	if again.Options != 0 {
+		t.Fatalf("Options %#x", again.Options)
+	}
+	if got := send(again); len(got) != 0 {
+		t.Errorf("TxTimestamps %+v for a frame sent without metadata", got)
+	}
+}
+
+// TxMetadataLen 非 0 时内核拒绝 addr 之前没有留出 metadata 的 desc, Write 须留出并相应截断
+func TestTxMetadataRoom(t *testing.T) {
+	var sent [][]byte
+	var mu sync.Mutex
+	kcfg := xdpsim.Config{OnTransmit: func(_, _ int, data []byte) {
+		mu.Lock()
+		sent = append(sent, data)
+		mu.Unlock()
+	}}
+	ucfg := simUmemConfig(16, 8)
+	ucfg.TxMetadataLen = 24
+	_, u, s := newSimSocket(t, &kcfg, ucfg, SocketConfig{RxSize: 8, TxSize: 8})
+	if s.MaxWriteLen() != FrameSize()-24 {
+		t.Fatalf("MaxWriteLen = %d", s.MaxWriteLen())
+	}
+	free := freeFrames(u)
+
+	big := simFrame(0, FrameSize())
+	if s.Write(big) != 1 {
+		t.Fatal("Write failed")
+	}
+	// frame 起始处的 desc 没有 metadata 的空间
+	addr, _ := u.getFrame()
+	if s.WriteDescs(unix.XDPDesc{Addr: addr, Len: 60}) != 1 {
+		t.Fatal("WriteDescs failed")
+	}
+	waitFor(t, "TX", func() bool {
+		st, _ := s.Stats()
+		mu.Lock()
+		defer mu.Unlock()
+		return len(sent) == 1 && st.Tx_invalid_descs == 1
+	})
+	if !bytes.Equal(sent[0], big[:s.MaxWriteLen()]) {
+		t.Errorf("transmitted %d bytes, want the first %d", len(sent[0]), s.MaxWriteLen())
+	}
+	// 与内核相同, 无效的 desc 不进入 completion ring
+	waitFor(t, "completion", func() bool {
+		s.Write()
+		return freeFrames(u) == free-1
+	})
+}
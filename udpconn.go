@@ -0,0 +1,427 @@
+package xdp
+
+import (
+	"hash/fnv"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lixiangzhong/xdp/packet"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+type UDPConfig struct {
+	LocalAddr *net.UDPAddr     // 本机 IP 与端口, IP 必须指定
+	MAC       net.HardwareAddr // 本机 MAC, 默认取第一个 socket 所在网卡的地址
+
+	// Neighbors 解析下一跳 MAC, 收到的 ARP/NDP 会交给它学习. 其 Send 可直接使用同一个 socket 的 Write.
+	// 为 nil 时自建一个不读取内核表的: Network 为本机所在子网, 子网外的目的地址经 Gateway 发送,
+	// 未设置 Gateway 时所有目的地址都视为直连
+	Neighbors *Neighbors
+	Network   *net.IPNet
+	Gateway   net.IP
+
+	ReadQueue      int           // 等待 ReadFrom 的报文个数, 默认 1024, 满时丢弃
+	ResolveTimeout time.Duration // 解析下一跳 MAC 的超时, 默认 1s, 受写超时限制
+}
+
+const defaultUDPReadQueue = 1024
+
+// UDPConn 基于一组 AF_XDP socket 的 net.PacketConn, 收发 LocalAddr 上的 UDP 报文.
+// 每个 socket 一个 goroutine 收包, 同时应答本机 IP 的 ARP/ICMP echo/NDP, 并从 ARP/NDP 学习邻居 MAC.
+// socket 须有 RX 与 TX ring, 绑定在不同的队列, 且不能再用于 HandleRecv; 先关闭 UDPConn 再关闭 socket
+type UDPConn struct {
+	socks    []*Socket
+	local    net.UDPAddr
+	ip       net.IP // v4 为 4 字节
+	mac      net.HardwareAddr
+	neigh    *Neighbors
+	ownNeigh bool
+	resolve  time.Duration
+	resps    []*Responder
+
+	rx      chan udpDatagram
+	dropped uint64
+
+	readDeadline  deadline
+	writeDeadline deadline
+	done          chan struct{}
+	closeOnce     sync.Once
+	running       sync.WaitGroup
+}
+
+type udpDatagram struct {
+	sock     *Socket
+	desc     unix.XDPDesc
+	off, n   int
+	from     [16]byte
+	fromPort uint16
+}
+
+func NewUDPConn(socks []*Socket, cfg *UDPConfig) (*UDPConn, error) {
+	if len(socks) == 0 {
+		return nil, errors.New("udp: no socket")
+	}
+	if cfg == nil || cfg.LocalAddr == nil {
+		return nil, errors.New("udp: no local address")
+	}
+	c := &UDPConn{
+		socks:         socks,
+		local:         *cfg.LocalAddr,
+		mac:           cfg.MAC,
+		neigh:         cfg.Neighbors,
+		resolve:       cfg.ResolveTimeout,
+		readDeadline:  makeDeadline(),
+		writeDeadline: makeDeadline(),
+		done:          make(chan struct{}),
+	}
+	if c.ip = c.local.IP.To4(); c.ip == nil {
+		c.ip = c.local.IP.To16()
+	}
+	if c.ip == nil || c.ip.IsUnspecified() {
+		return nil, errors.Errorf("udp: bad local address %v", cfg.LocalAddr)
+	}
+	if c.mac == nil {
+		iface, err := net.InterfaceByIndex(socks[0].ifindex)
+		if err != nil {
+			return nil, errors.WithMessage(err, "udp")
+		}
+		c.mac = iface.HardwareAddr
+	}
+	if len(c.mac) != 6 {
+		return nil, errors.Errorf("udp: bad MAC %v", c.mac)
+	}
+	if c.resolve == 0 {
+		c.resolve = defaultResolve
+	}
+	qlen := cfg.ReadQueue
+	if qlen == 0 {
+		qlen = defaultUDPReadQueue
+	}
+	c.rx = make(chan udpDatagram, qlen)
+	if c.neigh == nil {
+		if err := c.newNeighbors(cfg); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range socks {
+		r, err := NewResponder(s, ResponderAddr{IP: c.ip, MAC: c.mac})
+		if err != nil {
+			c.Close()
+			return nil, errors.WithMessage(err, "udp")
+		}
+		c.resps = append(c.resps, r)
+	}
+	for i := range socks {
+		i := i
+		c.running.Add(1)
+		go func() {
+			defer c.running.Done()
+			c.recvLoop(c.socks[i], c.resps[i])
+		}()
+	}
+	return c, nil
+}
+
+// newNeighbors 按 Network/Gateway 建立路由, 经第一个 socket 主动解析
+func (c *UDPConn) newNeighbors(cfg *UDPConfig) error {
+	gw := cfg.Gateway
+	if gw != nil && c.family(gw) == nil {
+		return errors.Errorf("udp: bad gateway %v", gw)
+	}
+	n, err := NewNeighbors(&NeighborConfig{
+		NoKernel: true,
+		Addrs:    []net.IP{c.ip},
+		MAC:      c.mac,
+		Send: func(frame []byte) bool {
+			return c.socks[0].Write(frame) == 1
+		},
+	})
+	if err != nil {
+		return errors.WithMessage(err, "udp")
+	}
+	if gw != nil {
+		if cfg.Network != nil {
+			n.AddRoute(cfg.Network, nil)
+		}
+		n.AddRoute(&net.IPNet{IP: make(net.IP, len(c.ip)), Mask: make(net.IPMask, len(c.ip))}, gw)
+	} else if cfg.Network != nil {
+		// 子网只用于识别广播地址, 其它目的地址仍视为直连
+		n.AddRoute(cfg.Network, nil)
+		n.AddRoute(&net.IPNet{IP: make(net.IP, len(c.ip)), Mask: make(net.IPMask, len(c.ip))}, nil)
+	}
+	c.neigh, c.ownNeigh = n, true
+	return nil
+}
+
+// family ip 与本机地址同族时返回 4 或 16 字节的形式, 否则返回 nil
+func (c *UDPConn) family(ip net.IP) net.IP {
+	if len(c.ip) == net.IPv4len {
+		return ip.To4()
+	}
+	if ip.To4() != nil {
+		return nil
+	}
+	return ip.To16()
+}
+
+func (c *UDPConn) recvLoop(s *Socket, r *Responder) {
+	descs := make([]unix.XDPDesc, len(s.descs))
+	for {
+		select {
+		case <-c.done:
+			return
+		default:
+		}
+		n := s.Recv(descs)
+		if n == 0 {
+			pollSockets(pollTimeout, s)
+			continue
+		}
+		for _, d := range descs[:n] {
+			if c.input(s, r, d) {
+				s.Release(d)
+			}
+		}
+	}
+}
+
+// input 处理收到的一帧, 返回 true 表示帧可以回收
+func (c *UDPConn) input(s *Socket, r *Responder, d unix.XDPDesc) bool {
+	var p packet.Packet
+	if p.Parse(s.umem.DescData(d)) != nil || p.NumVLANs > 0 {
+		return true
+	}
+	switch {
+	case p.EtherType == packet.EtherTypeARP:
+		c.neigh.inputARP(&p)
+	case p.L4Proto == packet.IPProtocolICMPv6 && !p.Fragment:
+		c.neigh.inputNDP(&p)
+	case p.L4Proto == packet.IPProtocolUDP && !p.Fragment:
+		return c.inputUDP(s, d, &p)
+	}
+	return !r.Handle(d)
+}
+
+func (c *UDPConn) inputUDP(s *Socket, d unix.XDPDesc, p *packet.Packet) bool {
+	var src, dst []byte
+	if ip := p.IPv4(); ip != nil {
+		src, dst = ip[12:16], ip[16:20]
+	} else if ip := p.IPv6(); ip != nil {
+		src, dst = ip[8:24], ip[24:40]
+	}
+	udp := p.UDP()
+	if len(dst) != len(c.ip) || string(dst) != string(c.ip) || int(udp.DstPort()) != c.local.Port {
+		return true
+	}
+	l4 := p.L4()
+	if int(udp.Length()) < packet.UDPLen || int(udp.Length()) > len(l4) || !p.ValidL4Checksum() {
+		return true
+	}
+	// 直连的对端回包时无需再解析
+	if c.neigh.onLink(src) {
+		c.neigh.set(src, p.Data[6:12], neighLearned)
+	}
+	dg := udpDatagram{
+		sock:     s,
+		desc:     d,
+		off:      p.PayloadOff,
+		n:        int(udp.Length()) - packet.UDPLen,
+		fromPort: udp.SrcPort(),
+	}
+	copy(dg.from[:], src)
+	select {
+	case c.rx <- dg:
+		return false
+	default:
+		atomic.AddUint64(&c.dropped, 1)
+		return true
+	}
+}
+
+// ReadFrom 读取一个 UDP 报文, b 不够长时截断
+func (c *UDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case <-c.done:
+		return 0, nil, c.opError("read", nil, net.ErrClosed)
+	default:
+	}
+	select {
+	case dg := <-c.rx:
+		data := dg.sock.umem.DescData(dg.desc)
+		n := copy(b, data[dg.off:dg.off+dg.n])
+		addr := &net.UDPAddr{IP: make(net.IP, len(c.ip)), Port: int(dg.fromPort)}
+		copy(addr.IP, dg.from[:])
+		dg.sock.Release(dg.desc)
+		return n, addr, nil
+	case <-c.readDeadline.wait():
+		return 0, nil, c.opError("read", nil, os.ErrDeadlineExceeded)
+	case <-c.done:
+		return 0, nil, c.opError("read", nil, net.ErrClosed)
+	}
+}
+
+// WriteTo 向 addr 发送一个 UDP 报文, 报文须能放入一个 frame, 不分片
+func (c *UDPConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.done:
+		return 0, c.opError("write", addr, net.ErrClosed)
+	case <-c.writeDeadline.wait():
+		return 0, c.opError("write", addr, os.ErrDeadlineExceeded)
+	default:
+	}
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, c.opError("write", addr, unix.EINVAL)
+	}
+	dst := c.family(ua.IP)
+	if dst == nil {
+		return 0, c.opError("write", addr, unix.EAFNOSUPPORT)
+	}
+	mac, err := c.neigh.resolve(dst, c.resolve, c.writeDeadline.wait(), c.done)
+	if err != nil {
+		return 0, c.opError("write", addr, err)
+	}
+	s := c.socks[0]
+	if len(c.socks) > 1 {
+		h := fnv.New32a()
+		h.Write(dst)
+		s = c.socks[int(h.Sum32()+uint32(ua.Port))%len(c.socks)]
+	}
+	buf, ok := s.umem.AllocFrame()
+	if !ok {
+		return 0, c.opError("write", addr, unix.ENOBUFS)
+	}
+	err = buf.Append(b)
+	if err == nil {
+		err = buf.PushUDP(uint16(c.local.Port), uint16(ua.Port))
+	}
+	if err == nil {
+		if len(dst) == net.IPv4len {
+			err = buf.PushIPv4(c.ip, dst, 0, replyTTL)
+		} else {
+			err = buf.PushIPv6(c.ip, dst, 0, replyTTL)
+		}
+	}
+	if err == nil {
+		err = buf.PushEthernet(mac[:], c.mac, 0)
+	}
+	d := s.umem.BufferDesc(buf)
+	if err != nil {
+		s.umem.FreeFrame(d.Addr)
+		return 0, c.opError("write", addr, unix.EMSGSIZE)
+	}
+	if s.WriteDescs(d) == 0 {
+		s.umem.FreeFrame(d.Addr)
+		return 0, c.opError("write", addr, unix.ENOBUFS)
+	}
+	return len(b), nil
+}
+
+func (c *UDPConn) opError(op string, addr net.Addr, err error) error {
+	return &net.OpError{Op: op, Net: "udp", Source: &c.local, Addr: addr, Err: err}
+}
+
+// Close 停止收包并归还未读取的报文, 不关闭 socket
+func (c *UDPConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.running.Wait()
+		if c.ownNeigh {
+			c.neigh.Close()
+		}
+		for {
+			select {
+			case dg := <-c.rx:
+				dg.sock.Release(dg.desc)
+			default:
+				return
+			}
+		}
+	})
+	return nil
+}
+
+func (c *UDPConn) LocalAddr() net.Addr {
+	a := c.local
+	return &a
+}
+
+func (c *UDPConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *UDPConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *UDPConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// Dropped 读队列满而丢弃的报文个数
+func (c *UDPConn) Dropped() uint64 {
+	return atomic.LoadUint64(&c.dropped)
+}
+
+// deadline 到期时关闭 cancel, 与 net.Pipe 的实现相同
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func makeDeadline() deadline {
+	return deadline{cancel: make(chan struct{})}
+}
+
+// set 零值表示不超时, 已过去的时间立即到期
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // 等 AfterFunc 关闭 cancel
+	}
+	d.timer = nil
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		d.timer = time.AfterFunc(dur, func() {
+			close(d.cancel)
+		})
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,190 @@
+package xdp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lixiangzhong/xdp/packet"
+	"github.com/lixiangzhong/xdp/xdpsim"
+	"golang.org/x/sys/unix"
+)
+
+// udpFrame src:sport -> dst:dport 的 UDP 帧, 地址族由 src 决定
+func udpFrame(t testing.TB, src, dst net.IP, sport, dport uint16, payload []byte) []byte {
+	return buildFrame(t, payload, func(b *packet.Buffer) error {
+		if err := b.PushUDP(sport, dport); err != nil {
+			return err
+		}
+		var err error
+		if src.To4() != nil {
+			err = b.PushIPv4(src, dst, 0, 64)
+		} else {
+			err = b.PushIPv6(src, dst, 0, 64)
+		}
+		if err != nil {
+			return err
+		}
+		return b.PushEthernet(localMAC, peerMAC, 0)
+	})
+}
+
+// arpReply peerIP4 在 peerMAC 的 ARP 应答
+func arpReply(t testing.TB) []byte {
+	arp := make([]byte, arpLen)
+	binary.BigEndian.PutUint16(arp[0:], 1)
+	binary.BigEndian.PutUint16(arp[2:], packet.EtherTypeIPv4)
+	arp[4], arp[5] = 6, 4
+	binary.BigEndian.PutUint16(arp[6:], 2)
+	copy(arp[8:14], peerMAC)
+	copy(arp[14:18], peerIP4)
+	copy(arp[18:24], localMAC)
+	copy(arp[24:28], localIP4)
+	return buildFrame(t, arp, func(b *packet.Buffer) error {
+		return b.PushEthernet(localMAC, peerMAC, packet.EtherTypeARP)
+	})
+}
+
+// neighborAdv peerIP6 在 peerMAC 的 NA
+func neighborAdv(t testing.TB) []byte {
+	na := append(append([]byte(nil), peerIP6.To16()...), ndpOptTLLA, 1)
+	na = append(na, peerMAC...)
+	return buildFrame(t, na, func(b *packet.Buffer) error {
+		if err := b.PushICMPv6(packet.ICMPv6NeighborAdv, 0, 0x60000000); err != nil {
+			return err
+		}
+		if err := b.PushIPv6(peerIP6, localIP6, 0, ndpHopLimit); err != nil {
+			return err
+		}
+		return b.PushEthernet(localMAC, peerMAC, 0)
+	})
+}
+
+// newSimUDPConn 对端 peerIP4/peerIP6 应答 ARP 请求与 NS, 其余发出的帧交给返回的 channel
+func newSimUDPConn(t *testing.T, local net.IP) (*xdpsim.Kernel, *Umem, *Socket, *UDPConn, chan []byte) {
+	t.Helper()
+	out := make(chan []byte, 64)
+	var k *xdpsim.Kernel
+	kcfg := &xdpsim.Config{OnTransmit: func(ifindex, queue int, data []byte) {
+		var p packet.Packet
+		if p.Parse(data) == nil {
+			switch {
+			case p.EtherType == packet.EtherTypeARP && bytes.Equal(data[p.L3Off+24:p.L3Off+28], peerIP4):
+				k.Inject(ifindex, queue, arpReply(t))
+				return
+			case p.L4Proto == packet.IPProtocolICMPv6 && p.ICMP().Type() == packet.ICMPv6NeighborSol:
+				if net.IP(p.ICMP()[8:24]).Equal(peerIP6) {
+					k.Inject(ifindex, queue, neighborAdv(t))
+				}
+				return
+			}
+		}
+		out <- data
+	}}
+	k, u, s := newSimSocket(t, kcfg, simUmemConfig(64, 32), SocketConfig{RxSize: 32, TxSize: 32})
+	c, err := NewUDPConn([]*Socket{s}, &UDPConfig{
+		LocalAddr:      &net.UDPAddr{IP: local, Port: 5000},
+		MAC:            localMAC,
+		ReadQueue:      4,
+		ResolveTimeout: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return k, u, s, c, out
+}
+
+func TestUDPConn(t *testing.T) {
+	for _, v := range []struct {
+		name               string
+		local, peer, other net.IP
+	}{
+		{"ipv4", localIP4, peerIP4, otherIP4},
+		{"ipv6", localIP6, peerIP6, otherIP6},
+	} {
+		t.Run(v.name, func(t *testing.T) {
+			k, u, s, c, out := newSimUDPConn(t, v.local)
+			free := freeFrames(u)
+			peer := &net.UDPAddr{IP: v.peer, Port: 6000}
+
+			// WriteTo 先解析对端 MAC
+			if n, err := c.WriteTo([]byte("hello"), peer); n != 5 || err != nil {
+				t.Fatalf("WriteTo = %d, %v", n, err)
+			}
+			select {
+			case f := <-out:
+				var p packet.Packet
+				if err := p.Parse(f); err != nil {
+					t.Fatal(err)
+				}
+				udp := p.UDP()
+				if !bytes.Equal(f[0:6], peerMAC) || !bytes.Equal(f[6:12], localMAC) || udp == nil ||
+					udp.SrcPort() != 5000 || udp.DstPort() != 6000 || string(p.Payload()) != "hello" || !p.ValidL4Checksum() {
+					t.Errorf("sent % x", f)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("no frame sent")
+			}
+
+			// 目的 IP 或端口不符与校验和错误的报文被丢弃
+			k.Inject(simIfindex, 0, udpFrame(t, v.peer, v.other, 6000, 5000, []byte("other ip")))
+			k.Inject(simIfindex, 0, udpFrame(t, v.peer, v.local, 6000, 5001, []byte("other port")))
+			bad := udpFrame(t, v.peer, v.local, 6000, 5000, []byte("bad checksum"))
+			bad[len(bad)-1] ^= 1
+			k.Inject(simIfindex, 0, bad)
+			k.Inject(simIfindex, 0, udpFrame(t, v.peer, v.local, 6000, 5000, []byte("world")))
+			k.Inject(simIfindex, 0, udpFrame(t, v.peer, v.local, 6001, 5000, []byte("truncated")))
+
+			b := make([]byte, 100)
+			n, addr, err := c.ReadFrom(b)
+			if err != nil || string(b[:n]) != "world" || !addr.(*net.UDPAddr).IP.Equal(v.peer) || addr.(*net.UDPAddr).Port != 6000 {
+				t.Fatalf("ReadFrom = %q, %v, %v", b[:n], addr, err)
+			}
+			n, addr, err = c.ReadFrom(b[:5])
+			if err != nil || string(b[:n]) != "trunc" || addr.(*net.UDPAddr).Port != 6001 {
+				t.Fatalf("ReadFrom = %q, %v, %v", b[:n], addr, err)
+			}
+
+			c.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+			if _, _, err := c.ReadFrom(b); !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Errorf("ReadFrom after deadline: %v", err)
+			}
+			c.SetReadDeadline(time.Time{})
+
+			// 对端不应答时解析超时
+			if _, err := c.WriteTo([]byte("x"), &net.UDPAddr{IP: v.other, Port: 1}); err == nil {
+				t.Error("WriteTo an unresolved address")
+			}
+			family := localIP6
+			if v.local.To4() == nil {
+				family = localIP4
+			}
+			if _, err := c.WriteTo([]byte("x"), &net.UDPAddr{IP: family, Port: 1}); !errors.Is(err, unix.EAFNOSUPPORT) {
+				t.Errorf("WriteTo another family: %v", err)
+			}
+
+			// 读队列满时丢弃, Close 归还未读取的报文
+			for i := 0; i < 6; i++ {
+				k.Inject(simIfindex, 0, udpFrame(t, v.peer, v.local, 6000, 5000, []byte{byte(i)}))
+			}
+			waitFor(t, "dropped datagrams", func() bool { return c.Dropped() == 2 })
+			c.Close()
+			if _, _, err := c.ReadFrom(b); !errors.Is(err, net.ErrClosed) {
+				t.Errorf("ReadFrom after Close: %v", err)
+			}
+			if _, err := c.WriteTo(b, peer); !errors.Is(err, net.ErrClosed) {
+				t.Errorf("WriteTo after Close: %v", err)
+			}
+			waitFor(t, "returned frames", func() bool {
+				s.Write() // 回收 completion ring
+				s.Recv(make([]unix.XDPDesc, 1))
+				return freeFrames(u) == free
+			})
+		})
+	}
+}
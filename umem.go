@@ -2,34 +2,49 @@ package xdp
 
 import (
 	"math"
-	"reflect"
 	"sync"
-	"syscall"
 	"unsafe"
 
+	"github.com/lixiangzhong/xdp/packet"
 	"github.com/pkg/errors"
 	"golang.org/x/sys/unix"
 )
 
 type Umem struct {
-	fill     *xsk_ring_prod
-	comp     *xsk_ring_cons
-	data     []byte
-	config   UmemConfig
-	fd       int
-	refCount int
+	fill      *xsk_ring_prod
+	comp      *xsk_ring_cons
+	data      []byte
+	config    UmemConfig
+	fd        int
+	refLock   sync.Mutex // 保护 refCount bindFlags ifindex queue
+	refCount  int
+	bindFlags uint16 // 第一个 socket 绑定时的标志, 共享 umem 的 socket 沿用
+	ifindex   int    // 第一个 socket 绑定的网卡与队列
+	queue     int
+	fillMap   []byte
+	compMap   []byte
+	backend   Backend
 
 	frameLock  sync.Mutex
 	freeFrame  uint32
 	framesAddr []uint64
+	rxMeta     bool // 已注册到启用 Metadata 的程序, fill_fr 清除 RX 元数据的 flags
+
+	txTimestamps *SPSCRing[TxTimestamp] // TxMetadataLen 非 0 时由 cons_cr 放入
+	txMeta       []bool                 // 按 frame 序号, 带 XDP_TX_METADATA 放入 TX ring 且未完成的 frame
 }
 
 type UmemConfig struct {
 	FillSize      uint32
 	CompSize      uint32
 	Size          uint32
-	FrameHeadroom uint32
-	Flags         uint32
+	FrameHeadroom uint32  // 每个 frame 中 XDP_PACKET_HEADROOM 之前额外预留的字节数, RX 元数据 (见 RxMetadata) 不占用
+	Flags         uint32  // XDP_UMEM_REG 的 flags, 如 XDP_UMEM_TX_SW_CSUM
+	Backend       Backend // nil 为 Linux 系统调用
+
+	// TxMetadataLen 非 0 时每个 TX 帧数据之前预留的 TX metadata 长度 (Linux 6.8+), 8 的倍数,
+	// 通常为 24. 用于 SetTxMetadata 请求校验和卸载与 TX 时间戳
+	TxMetadataLen uint32
 }
 
 var defaultUmemConfig = UmemConfig{
@@ -40,17 +55,30 @@ var defaultUmemConfig = UmemConfig{
 	Flags:         0,
 }
 
-func NewUmem(config *UmemConfig) (*Umem, error) {
+func NewUmem(config *UmemConfig) (_ *Umem, err error) {
 	umem := new(Umem)
 	if config == nil {
 		config = &defaultUmemConfig
 	}
 	umem.config = *config
-	var err error
-	umem.fd, err = syscall.Socket(unix.AF_XDP, unix.SOCK_RAW, 0)
+	umem.backend = umem.config.Backend
+	if umem.backend == nil {
+		umem.backend = linuxBackend{}
+	}
+	b := umem.backend
+	err = checkTxMetadataLen(umem.config.TxMetadataLen)
 	if err != nil {
 		return nil, err
 	}
+	umem.fd, err = b.Socket()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			umem.Close()
+		}
+	}()
 	umem.data = Posix_memalign(int(umem.config.Size))
 	framenum := umem.config.Size / _DEFAULT_FRAME_SIZE
 	umem.framesAddr = make([]uint64, framenum)
@@ -61,66 +89,28 @@ func NewUmem(config *UmemConfig) (*Umem, error) {
 		Addr:     uint64(uintptr(unsafe.Pointer(&umem.data[0]))),
 		Len:      uint64(len(umem.data)),
 		Size:     _DEFAULT_FRAME_SIZE,
-		Headroom: 0,
-		Flags:    0,
+		Headroom: umem.config.FrameHeadroom,
+		Flags:    umem.config.Flags,
 	}
-	_, _, errno := unix.Syscall6(syscall.SYS_SETSOCKOPT, uintptr(umem.fd),
-		unix.SOL_XDP, unix.XDP_UMEM_REG,
-		uintptr(unsafe.Pointer(&mr)), unsafe.Sizeof(mr), 0,
-	)
-	if errno != 0 {
-		return nil, errors.WithMessage(errno, "XDP_UMEM_REG")
+	if umem.config.TxMetadataLen > 0 {
+		mr.Flags |= XDP_UMEM_TX_METADATA_LEN
+		setUmemTxMetadataLen(&mr, umem.config.TxMetadataLen)
+		umem.txTimestamps = NewSPSCRing[TxTimestamp](int(umem.config.CompSize))
+		umem.txMeta = make([]bool, umem.config.Size/_DEFAULT_FRAME_SIZE)
 	}
-	err = syscall.SetsockoptInt(umem.fd, unix.SOL_XDP, unix.XDP_UMEM_FILL_RING, int(umem.config.FillSize))
-	if err != nil {
-		return nil, err
+	err = b.RegisterUmem(umem.fd, umem.data, mr)
+	if err == unix.EINVAL && mr.Flags&XDP_UMEM_TX_METADATA_LEN != 0 {
+		// 6.8-6.10 没有此标志, 总是使用 tx_metadata_len
+		mr.Flags &^= XDP_UMEM_TX_METADATA_LEN
+		err = b.RegisterUmem(umem.fd, umem.data, mr)
 	}
-	err = unix.SetsockoptInt(umem.fd, unix.SOL_XDP, unix.XDP_UMEM_COMPLETION_RING, int(umem.config.CompSize))
 	if err != nil {
-		return nil, err
+		return nil, errors.WithMessage(err, "XDP_UMEM_REG")
 	}
-	off, err := xsk_get_mmap_offsets(umem.fd)
+	umem.fill, umem.comp, umem.fillMap, umem.compMap, err = umem.fillCompRings(umem.fd)
 	if err != nil {
 		return nil, err
 	}
-	fillBuffer, err := syscall.Mmap(umem.fd, unix.XDP_UMEM_PGOFF_FILL_RING,
-		int(off.Fr.Desc)+int(umem.config.FillSize*uint32(unsafe.Sizeof(uint64(0)))),
-		syscall.PROT_READ|syscall.PROT_WRITE,
-		syscall.MAP_SHARED|syscall.MAP_POPULATE,
-	)
-	if err != nil {
-		return nil, err
-	}
-	umem.fill = new(xsk_ring_prod)
-	umem.fill.Mask = umem.config.FillSize - 1
-	umem.fill.Size = umem.config.FillSize
-	umem.fill.Producer = (*uint32)(unsafe.Pointer(uintptr(unsafe.Pointer(&fillBuffer[0])) + uintptr(off.Fr.Producer)))
-	umem.fill.Consumer = (*uint32)(unsafe.Pointer(uintptr(unsafe.Pointer(&fillBuffer[0])) + uintptr(off.Fr.Consumer)))
-	umem.fill.Flags = (*uint32)(unsafe.Pointer(uintptr(unsafe.Pointer(&fillBuffer[0])) + uintptr(off.Fr.Flags)))
-	umem.fill.CacheCons = umem.config.FillSize
-	(*reflect.SliceHeader)(unsafe.Pointer(&umem.fill.Ring)).Data = uintptr(unsafe.Pointer(uintptr(unsafe.Pointer(&fillBuffer[0])) + uintptr(off.Fr.Desc)))
-	(*reflect.SliceHeader)(unsafe.Pointer(&umem.fill.Ring)).Len = int(umem.config.FillSize)
-	(*reflect.SliceHeader)(unsafe.Pointer(&umem.fill.Ring)).Cap = int(umem.config.FillSize)
-
-	umem.fill_fr()
-
-	compBuffer, err := syscall.Mmap(umem.fd, unix.XDP_UMEM_PGOFF_COMPLETION_RING,
-		int(off.Cr.Desc)+int(umem.config.CompSize*uint32(unsafe.Sizeof(uint64(0)))),
-		syscall.PROT_READ|syscall.PROT_WRITE,
-		syscall.MAP_SHARED|syscall.MAP_POPULATE,
-	)
-	if err != nil {
-		return nil, err
-	}
-	umem.comp = new(xsk_ring_cons)
-	umem.comp.Mask = umem.config.CompSize - 1
-	umem.comp.Size = umem.config.CompSize
-	umem.comp.Producer = (*uint32)(unsafe.Pointer(uintptr(unsafe.Pointer(&compBuffer[0])) + uintptr(off.Cr.Producer)))
-	umem.comp.Consumer = (*uint32)(unsafe.Pointer(uintptr(unsafe.Pointer(&compBuffer[0])) + uintptr(off.Cr.Consumer)))
-	umem.comp.Flags = (*uint32)(unsafe.Pointer(uintptr(unsafe.Pointer(&compBuffer[0])) + uintptr(off.Cr.Flags)))
-	(*reflect.SliceHeader)(unsafe.Pointer(&umem.comp.Ring)).Data = uintptr(unsafe.Pointer(uintptr(unsafe.Pointer(&compBuffer[0])) + uintptr(off.Cr.Desc)))
-	(*reflect.SliceHeader)(unsafe.Pointer(&umem.comp.Ring)).Len = int(umem.config.CompSize)
-	(*reflect.SliceHeader)(unsafe.Pointer(&umem.comp.Ring)).Cap = int(umem.config.CompSize)
 	// go func() {
 	// 	// runtime.LockOSThread()
 	// 	for {
@@ -131,6 +121,59 @@ func NewUmem(config *UmemConfig) (*Umem, error) {
 	return umem, nil
 }
 
+// Close 释放 umem, 需先关闭所有使用此 umem 的 Socket
+func (u *Umem) Close() error {
+	u.refLock.Lock()
+	defer u.refLock.Unlock()
+	if u.refCount > 0 {
+		return errors.New("umem still in use")
+	}
+	if u.fillMap != nil {
+		u.backend.Munmap(u.fillMap)
+		u.fillMap = nil
+	}
+	if u.compMap != nil {
+		u.backend.Munmap(u.compMap)
+		u.compMap = nil
+	}
+	err := u.backend.Close(u.fd)
+	if u.data != nil {
+		free_mem(u.data)
+		u.data = nil
+	}
+	return err
+}
+
+// fillCompRings 在 fd 上创建 fill/comp ring 并填满 fill ring.
+// 共享 umem 的 socket 绑定到不同网卡或队列时也需要自己的一组
+func (u *Umem) fillCompRings(fd int) (fill *xsk_ring_prod, comp *xsk_ring_cons, fillMap, compMap []byte, err error) {
+	b := u.backend
+	err = b.SetRingSize(fd, unix.XDP_UMEM_FILL_RING, u.config.FillSize)
+	if err != nil {
+		return nil, nil, nil, nil, errors.WithMessage(err, "XDP_UMEM_FILL_RING")
+	}
+	err = b.SetRingSize(fd, unix.XDP_UMEM_COMPLETION_RING, u.config.CompSize)
+	if err != nil {
+		return nil, nil, nil, nil, errors.WithMessage(err, "XDP_UMEM_COMPLETION_RING")
+	}
+	off, err := b.MmapOffsets(fd)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	fill, fillMap, err = mmapRing[uint64](b, fd, unix.XDP_UMEM_PGOFF_FILL_RING, off.Fr, u.config.FillSize)
+	if err != nil {
+		return nil, nil, nil, nil, errors.WithMessage(err, "FillRing")
+	}
+	fill.CacheCons = u.config.FillSize
+	u.fill_fr(fill)
+	comp, compMap, err = mmapRing[uint64](b, fd, unix.XDP_UMEM_PGOFF_COMPLETION_RING, off.Cr, u.config.CompSize)
+	if err != nil {
+		b.Munmap(fillMap)
+		return nil, nil, nil, nil, errors.WithMessage(err, "CompRing")
+	}
+	return fill, comp, fillMap, compMap, nil
+}
+
 func (u *Umem) getFrame() (uint64, bool) {
 	u.frameLock.Lock()
 	defer u.frameLock.Unlock()
@@ -148,24 +191,33 @@ func (u *Umem) getFrame() (uint64, bool) {
 func (u *Umem) putFrame(addr uint64) {
 	u.frameLock.Lock()
 	defer u.frameLock.Unlock()
-	u.framesAddr[u.freeFrame] = addr
+	// RX desc 的地址带有 headroom 偏移, 归还时对齐到 frame 起始
+	u.framesAddr[u.freeFrame] = addr &^ uint64(_DEFAULT_FRAME_SIZE-1)
 	u.freeFrame++
 }
 
-// 填满fill ring
-func (u *Umem) fill_fr() {
-	n := u.fill.prod_nb_free(u.freeFrame)
-	if n > 0 {
-		var prod uint32
-		for i := uint32(0); i < n; i++ {
-			addr, ok := u.getFrame()
-			if !ok {
-				break
-			}
-			u.fill.fill_slot(addr)
-			prod++
+// 填满fill ring. 整批持有 frameLock, 可与其他 goroutine 的 getFrame/putFrame 并发.
+// rxMeta 时同时清零 RX 元数据的 flags, 程序没有为新收到的帧写入元数据时 RxMetadata 不会读到 frame 上次的残留;
+// 否则不写 frame, headroom 归使用者所有
+func (u *Umem) fill_fr(fill *xsk_ring_prod) {
+	u.frameLock.Lock()
+	defer u.frameLock.Unlock()
+	n := fill.prod_nb_free(u.freeFrame)
+	if n > u.freeFrame {
+		n = u.freeFrame
+	}
+	metaFlags := uint64(u.config.FrameHeadroom) + XDP_PACKET_HEADROOM - 4
+	for i := uint32(0); i < n; i++ {
+		u.freeFrame--
+		addr := u.framesAddr[u.freeFrame]
+		if u.rxMeta {
+			*(*uint32)(unsafe.Pointer(&u.data[addr+metaFlags])) = 0
 		}
-		u.fill.submit_prod(prod)
+		fill.fill_slot(addr)
+		u.framesAddr[u.freeFrame] = math.MaxUint64
+	}
+	if n > 0 {
+		fill.submit_prod(n)
 	}
 }
 
@@ -173,13 +225,53 @@ func (u *Umem) DescData(d unix.XDPDesc) []byte {
 	return u.data[d.Addr : d.Addr+uint64(d.Len)]
 }
 
-// 消费comp ring
-func (u *Umem) cons_cr() {
-	addrs := u.comp.slots(u.config.CompSize)
-	if n := uint32(len(addrs)); n > 0 {
-		for _, addr := range addrs {
-			u.putFrame(addr)
+// Buffer 返回 desc 所在的整个 frame, 数据之前的 headroom 可用于原地压入协议头
+func (u *Umem) Buffer(d unix.XDPDesc) packet.Buffer {
+	base := d.Addr &^ uint64(_DEFAULT_FRAME_SIZE-1)
+	frame := u.data[base : base+uint64(_DEFAULT_FRAME_SIZE)]
+	return packet.NewBuffer(frame, int(d.Addr-base), int(d.Len))
+}
+
+// BufferDesc Buffer 修改后对应的 desc, 可直接用于 WriteDesc
+func (u *Umem) BufferDesc(b packet.Buffer) unix.XDPDesc {
+	base := uintptr(unsafe.Pointer(&b.Frame()[0])) - uintptr(unsafe.Pointer(&u.data[0]))
+	return unix.XDPDesc{
+		Addr: uint64(base) + uint64(b.Headroom()),
+		Len:  uint32(b.Len()),
+	}
+}
+
+// AllocFrame 取一个空闲 frame 用于构造发送的报文, 数据从 FrameHeadroom+XDP_PACKET_HEADROOM 处开始, 长度为 0.
+// 发送用 WriteDesc(BufferDesc(b)), 不发送时用 FreeFrame 归还
+func (u *Umem) AllocFrame() (packet.Buffer, bool) {
+	addr, ok := u.getFrame()
+	if !ok {
+		return packet.Buffer{}, false
+	}
+	return u.Buffer(unix.XDPDesc{Addr: addr + uint64(u.config.FrameHeadroom) + XDP_PACKET_HEADROOM}), true
+}
+
+// FreeFrame 归还 AllocFrame 取得的 frame
+func (u *Umem) FreeFrame(addr uint64) {
+	u.putFrame(addr)
+}
+
+// 消费comp ring. 同 fill_fr 整批持有 frameLock, 共享 comp ring 的 socket 可在不同 goroutine 中发送
+func (u *Umem) cons_cr(comp *xsk_ring_cons) {
+	u.frameLock.Lock()
+	defer u.frameLock.Unlock()
+	n := comp.cons_nb_avail(u.config.CompSize)
+	if n == 0 {
+		return
+	}
+	for i := uint32(0); i < n; i++ {
+		addr := comp.Ring[comp.CacheCons&comp.Mask]
+		if u.txTimestamps != nil {
+			u.txCompleted(addr)
 		}
-		u.comp.submit_cons(n)
+		u.framesAddr[u.freeFrame] = addr &^ uint64(_DEFAULT_FRAME_SIZE-1)
+		u.freeFrame++
+		comp.CacheCons++
 	}
+	comp.submit_cons(n)
 }
@@ -0,0 +1,133 @@
+package xdp
+
+import (
+	"testing"
+
+	"github.com/lixiangzhong/xdp/xdpsim"
+)
+
+// countBackend 记录未关闭的 fd 与未解除的映射
+type countBackend struct {
+	*xdpsim.Kernel
+	fds, maps int
+}
+
+func (b *countBackend) Socket() (int, error) {
+	fd, err := b.Kernel.Socket()
+	if err == nil {
+		b.fds++
+	}
+	return fd, err
+}
+
+func (b *countBackend) Close(fd int) error {
+	b.fds--
+	return b.Kernel.Close(fd)
+}
+
+func (b *countBackend) Mmap(fd int, pgoff int64, length int) ([]byte, error) {
+	m, err := b.Kernel.Mmap(fd, pgoff, length)
+	if err == nil {
+		b.maps++
+	}
+	return m, err
+}
+
+func (b *countBackend) Munmap(m []byte) error {
+	b.maps--
+	return b.Kernel.Munmap(m)
+}
+
+func TestNewUmemConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     UmemConfig
+		wantErr bool
+	}{
+		{name: "default", cfg: simUmemConfig(64, 32)},
+		{name: "headroom", cfg: UmemConfig{FillSize: 32, CompSize: 32, Size: 64 * _DEFAULT_FRAME_SIZE, FrameHeadroom: 128}},
+		{name: "headroom too large", cfg: UmemConfig{FillSize: 32, CompSize: 32, Size: 64 * _DEFAULT_FRAME_SIZE, FrameHeadroom: _DEFAULT_FRAME_SIZE}, wantErr: true},
+		{name: "fill ring not power of 2", cfg: simUmemConfig(64, 30), wantErr: true},
+		{name: "comp ring not power of 2", cfg: UmemConfig{FillSize: 32, CompSize: 30, Size: 64 * _DEFAULT_FRAME_SIZE}, wantErr: true},
+		{name: "tx metadata", cfg: UmemConfig{FillSize: 32, CompSize: 32, Size: 64 * _DEFAULT_FRAME_SIZE, TxMetadataLen: 24}},
+		{name: "tx metadata unaligned", cfg: UmemConfig{FillSize: 32, CompSize: 32, Size: 64 * _DEFAULT_FRAME_SIZE, TxMetadataLen: 20}, wantErr: true},
+		{name: "tx metadata too short", cfg: UmemConfig{FillSize: 32, CompSize: 32, Size: 64 * _DEFAULT_FRAME_SIZE, TxMetadataLen: 8}, wantErr: true},
+		{name: "tx metadata too long", cfg: UmemConfig{FillSize: 32, CompSize: 32, Size: 64 * _DEFAULT_FRAME_SIZE, TxMetadataLen: 256}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := xdpsim.New(nil)
+			defer k.Stop()
+			b := &countBackend{Kernel: k}
+			cfg := tt.cfg
+			cfg.Backend = b
+			u, err := NewUmem(&cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewUmem: err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				// 出错时关闭 socket 并解除映射
+				if b.fds != 0 || b.maps != 0 {
+					t.Errorf("%d fds and %d mappings left open", b.fds, b.maps)
+				}
+				return
+			}
+			defer u.Close()
+			// fill ring 已填满, 其余 frame 空闲
+			if got, want := freeFrames(u), cfg.Size/_DEFAULT_FRAME_SIZE-cfg.FillSize; got != want {
+				t.Errorf("free frames = %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestUmemAllocFrame(t *testing.T) {
+	k := xdpsim.New(nil)
+	defer k.Stop()
+	cfg := UmemConfig{FillSize: 4, CompSize: 4, Size: 12 * _DEFAULT_FRAME_SIZE, FrameHeadroom: 64, Backend: k}
+	u, err := NewUmem(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	seen := make(map[uint64]bool)
+	var addrs []uint64
+	for {
+		b, ok := u.AllocFrame()
+		if !ok {
+			break
+		}
+		if b.Headroom() != int(cfg.FrameHeadroom)+XDP_PACKET_HEADROOM || b.Len() != 0 {
+			t.Fatalf("headroom %d len %d", b.Headroom(), b.Len())
+		}
+		if err := b.Append([]byte("payload")); err != nil {
+			t.Fatal(err)
+		}
+		d := u.BufferDesc(b)
+		if string(u.DescData(d)) != "payload" {
+			t.Fatalf("DescData = %q", u.DescData(d))
+		}
+		base := d.Addr &^ uint64(_DEFAULT_FRAME_SIZE-1)
+		if seen[base] {
+			t.Fatalf("frame %#x allocated twice", base)
+		}
+		seen[base] = true
+		addrs = append(addrs, d.Addr)
+	}
+	if len(addrs) != 8 {
+		t.Fatalf("allocated %d frames, want 8", len(addrs))
+	}
+	// 归还带偏移的地址时对齐到 frame 起始
+	for _, a := range addrs {
+		u.FreeFrame(a)
+	}
+	if n := freeFrames(u); n != 8 {
+		t.Fatalf("free frames = %d after FreeFrame", n)
+	}
+	for i := 0; i < 8; i++ {
+		b, _ := u.AllocFrame()
+		if d := u.BufferDesc(b); !seen[d.Addr&^uint64(_DEFAULT_FRAME_SIZE-1)] || d.Addr%uint64(_DEFAULT_FRAME_SIZE) != uint64(b.Headroom()) {
+			t.Fatalf("reallocated frame %#x not aligned", d.Addr)
+		}
+	}
+}
@@ -8,8 +8,15 @@ const (
 	DEFAULT_FRAME_NUM = DEFAULT_FILL_SIZE + DEFAULT_COMP_SIZE
 	DEFAULT_RX_SIZE   = 2048
 	DEFAULT_TX_SIZE   = 2048
+
+	XDP_PACKET_HEADROOM = 256 // 内核在每个 frame 前预留的 headroom
 )
 
 var (
 	_DEFAULT_FRAME_SIZE = uint32(os.Getpagesize())
 )
+
+// FrameSize umem 中每个 frame 的大小 (页大小), TxMetadataLen 为 0 时也是 Socket.Write 单个帧的最大长度
+func FrameSize() int {
+	return int(_DEFAULT_FRAME_SIZE)
+}
@@ -0,0 +1,589 @@
+// Package xdpsim 进程内模拟的 AF_XDP 内核, 实现 xdp.Backend.
+//
+// 一个 goroutine 扮演内核: 从 fill ring 取 frame 放入注入的包并产生 RX desc,
+// 消费 TX ring 并把 frame 放回 completion ring. 可配置丢包, need_wakeup 与延迟,
+// 使 Umem/Socket 的完整收发流程可以在普通用户下用 go test 运行.
+//
+//	k := xdpsim.New(nil)
+//	defer k.Stop()
+//	umem, _ := xdp.NewUmem(&xdp.UmemConfig{..., Backend: k})
+//	sock, _ := xdp.NewSocket(1, umem, &xdp.SocketConfig{...})
+//	k.Inject(1, 0, frame)
+package xdpsim
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// XDP_UMEM_TX_METADATA_LEN, 旧版 x/sys 中没有
+const umemTxMetadataLen = 1 << 2
+
+// 所有 ring 使用相同的布局
+const (
+	offProducer = 0
+	offConsumer = 64
+	offFlags    = 128
+	offDesc     = 192
+)
+
+type Config struct {
+	RxDropRate float64       // 注入的包被丢弃的概率, 计入 Rx_dropped
+	TxDropRate float64       // 发送时丢弃的概率, frame 仍会进入 completion ring
+	NeedWakeup bool          // 置 need_wakeup 标志, TX 只在 Wakeup/Poll 之后处理
+	RxDelay    time.Duration // 注入到出现在 RX ring 的延迟
+	TxDelay    time.Duration // 从 TX ring 取出到进入 completion ring 的延迟
+	Interval   time.Duration // 内核 goroutine 的轮询间隔, 默认 50µs
+	Seed       int64
+
+	// OnTransmit 每个发出的包调用一次, data 为拷贝. 在内核 goroutine 中调用, 可在其中 Inject
+	OnTransmit func(ifindex, queue int, data []byte)
+}
+
+type Kernel struct {
+	cfg  Config
+	rand *rand.Rand
+
+	mu     sync.Mutex
+	nextFd int
+	socks  map[int]*sock
+
+	kick chan struct{}
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+type ring struct {
+	m     []byte
+	size  uint32
+	entry uintptr
+}
+
+func (r *ring) ok() bool       { return r.m != nil }
+func (r *ring) prod() *uint32  { return (*uint32)(unsafe.Pointer(&r.m[offProducer])) }
+func (r *ring) cons() *uint32  { return (*uint32)(unsafe.Pointer(&r.m[offConsumer])) }
+func (r *ring) flags() *uint32 { return (*uint32)(unsafe.Pointer(&r.m[offFlags])) }
+func (r *ring) slot(i uint32) unsafe.Pointer {
+	return unsafe.Pointer(&r.m[offDesc+uintptr(i&(r.size-1))*r.entry])
+}
+
+// 内核作为消费者: fill, tx
+func (r *ring) avail() uint32 {
+	return atomic.LoadUint32(r.prod()) - atomic.LoadUint32(r.cons())
+}
+
+// 内核作为生产者: rx, completion
+func (r *ring) free() uint32 {
+	return r.size - (atomic.LoadUint32(r.prod()) - atomic.LoadUint32(r.cons()))
+}
+
+type umem struct {
+	data     []byte
+	chunk    uint64
+	headroom uint64
+	txMeta   uint64 // tx_metadata_len
+	fill     ring
+	comp     ring
+}
+
+type pending struct {
+	data []byte
+	addr uint64
+	due  time.Time
+}
+
+type sock struct {
+	fd      int
+	reg     *umem // 在此 fd 上注册的 umem
+	umem    *umem // bind 之后实际使用的 umem
+	rx, tx  ring
+	fq, cq  ring // 共享 umem 且设备或队列不同时 socket 自己的 fill/comp ring
+	rxSize  uint32
+	txSize  uint32
+	ifindex int
+	queue   int
+	bound   bool
+	wake    bool
+	stats   unix.XDPStatistics
+	rxReady chan struct{}
+	rxq     []pending
+	compq   []pending
+}
+
+// New cfg 为 nil 时使用默认配置, 返回的 Kernel 已在运行
+func New(cfg *Config) *Kernel {
+	k := &Kernel{
+		nextFd: 1000,
+		socks:  make(map[int]*sock),
+		kick:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	if cfg != nil {
+		k.cfg = *cfg
+	}
+	if k.cfg.Interval <= 0 {
+		k.cfg.Interval = 50 * time.Microsecond
+	}
+	k.rand = rand.New(rand.NewSource(k.cfg.Seed))
+	k.wg.Add(1)
+	go k.run()
+	return k
+}
+
+// Stop 停止内核 goroutine
+func (k *Kernel) Stop() {
+	select {
+	case <-k.done:
+	default:
+		close(k.done)
+	}
+	k.wg.Wait()
+}
+
+// Inject 模拟网卡在 ifindex/queue 上收到一个包, 返回 false 表示没有绑定的 socket
+func (k *Kernel) Inject(ifindex, queue int, data []byte) bool {
+	k.mu.Lock()
+	s := k.lookup(ifindex, queue)
+	if s == nil {
+		k.mu.Unlock()
+		return false
+	}
+	s.rxq = append(s.rxq, pending{
+		data: append([]byte(nil), data...),
+		due:  time.Now().Add(k.cfg.RxDelay),
+	})
+	k.mu.Unlock()
+	k.signal()
+	return true
+}
+
+// lookup 找到 ifindex/queue 上可接收的 socket
+func (k *Kernel) lookup(ifindex, queue int) *sock {
+	var found *sock
+	for _, s := range k.socks {
+		if s.bound && s.ifindex == ifindex && s.queue == queue && s.rx.ok() {
+			if found == nil || s.fd < found.fd {
+				found = s
+			}
+		}
+	}
+	return found
+}
+
+func (k *Kernel) signal() {
+	select {
+	case k.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (k *Kernel) run() {
+	defer k.wg.Done()
+	t := time.NewTicker(k.cfg.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-k.done:
+			return
+		case <-k.kick:
+		case <-t.C:
+		}
+		k.step()
+	}
+}
+
+type txpkt struct {
+	ifindex, queue int
+	data           []byte
+}
+
+func (k *Kernel) step() {
+	now := time.Now()
+	var sent []txpkt
+	k.mu.Lock()
+	for _, s := range k.socks {
+		if !s.bound {
+			continue
+		}
+		sent = k.stepTx(s, now, sent)
+		k.stepComp(s, now)
+		k.stepRx(s, now)
+	}
+	k.mu.Unlock()
+	if k.cfg.OnTransmit != nil {
+		for _, p := range sent {
+			k.cfg.OnTransmit(p.ifindex, p.queue, p.data)
+		}
+	}
+}
+
+func (k *Kernel) stepTx(s *sock, now time.Time, sent []txpkt) []txpkt {
+	if !s.tx.ok() {
+		return sent
+	}
+	if k.cfg.NeedWakeup {
+		atomic.StoreUint32(s.tx.flags(), unix.XDP_RING_NEED_WAKEUP)
+		if !s.wake {
+			return sent
+		}
+		s.wake = false
+	}
+	n := s.tx.avail()
+	if n == 0 {
+		if k.cfg.NeedWakeup {
+			s.stats.Tx_ring_empty_descs++
+		}
+		return sent
+	}
+	cons := atomic.LoadUint32(s.tx.cons())
+	for i := uint32(0); i < n; i++ {
+		d := *(*unix.XDPDesc)(s.tx.slot(cons + i))
+		if !s.umem.validTx(d) {
+			s.stats.Tx_invalid_descs++
+			continue
+		}
+		if k.cfg.TxDropRate == 0 || k.rand.Float64() >= k.cfg.TxDropRate {
+			data := append([]byte(nil), s.umem.data[d.Addr:d.Addr+uint64(d.Len)]...)
+			sent = append(sent, txpkt{s.ifindex, s.queue, data})
+		}
+		s.compq = append(s.compq, pending{addr: d.Addr, due: now.Add(k.cfg.TxDelay)})
+	}
+	atomic.StoreUint32(s.tx.cons(), cons+n)
+	return sent
+}
+
+func (k *Kernel) stepComp(s *sock, now time.Time) {
+	comp := s.compRing()
+	prod := atomic.LoadUint32(comp.prod())
+	free := comp.free()
+	n := 0
+	for n < len(s.compq) && uint32(n) < free && !s.compq[n].due.After(now) {
+		*(*uint64)(comp.slot(prod)) = s.compq[n].addr
+		prod++
+		n++
+	}
+	if n > 0 {
+		atomic.StoreUint32(comp.prod(), prod)
+		s.compq = s.compq[n:]
+	}
+}
+
+func (k *Kernel) stepRx(s *sock, now time.Time) {
+	if !s.rx.ok() {
+		return
+	}
+	u, fill := s.umem, s.fillRing()
+	if k.cfg.NeedWakeup {
+		atomic.StoreUint32(fill.flags(), unix.XDP_RING_NEED_WAKEUP)
+	}
+	var produced uint32
+	fillCons := atomic.LoadUint32(fill.cons())
+	fillAvail := fill.avail()
+	rxProd := atomic.LoadUint32(s.rx.prod())
+	rxFree := s.rx.free()
+	room := u.chunk - u.headroom - 256 // XDP_PACKET_HEADROOM
+	n := 0
+	for ; n < len(s.rxq) && !s.rxq[n].due.After(now); n++ {
+		p := s.rxq[n]
+		if k.cfg.RxDropRate > 0 && k.rand.Float64() < k.cfg.RxDropRate {
+			s.stats.Rx_dropped++
+			continue
+		}
+		if uint64(len(p.data)) > room {
+			// 与内核 __xsk_rcv 一样: 放不进一个 frame 时只计入 rx_dropped, 不取 fill ring
+			s.stats.Rx_dropped++
+			continue
+		}
+		if rxFree == 0 {
+			s.stats.Rx_ring_full++
+			s.stats.Rx_dropped++
+			continue
+		}
+		if fillAvail == 0 {
+			s.stats.Rx_fill_ring_empty_descs++
+			s.stats.Rx_dropped++
+			continue
+		}
+		base := *(*uint64)(fill.slot(fillCons)) &^ (u.chunk - 1)
+		fillCons++
+		fillAvail--
+		off := base + u.headroom + 256
+		copy(u.data[off:], p.data)
+		*(*unix.XDPDesc)(s.rx.slot(rxProd + produced)) = unix.XDPDesc{Addr: off, Len: uint32(len(p.data))}
+		produced++
+		rxFree--
+	}
+	if n == 0 {
+		return
+	}
+	s.rxq = s.rxq[n:]
+	atomic.StoreUint32(fill.cons(), fillCons)
+	if produced > 0 {
+		atomic.StoreUint32(s.rx.prod(), rxProd+produced)
+		select {
+		case s.rxReady <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// validTx 与内核 xp_aligned_validate_desc 相同: addr 之前须留有 tx_metadata_len 字节,
+// 且连同 metadata 不跨 frame
+func (u *umem) validTx(d unix.XDPDesc) bool {
+	off := d.Addr & (u.chunk - 1)
+	return d.Len != 0 && d.Addr < uint64(len(u.data)) && off >= u.txMeta && off+uint64(d.Len) <= u.chunk
+}
+
+func (s *sock) fillRing() *ring {
+	if s.fq.ok() {
+		return &s.fq
+	}
+	return &s.umem.fill
+}
+
+func (s *sock) compRing() *ring {
+	if s.cq.ok() {
+		return &s.cq
+	}
+	return &s.umem.comp
+}
+
+func (k *Kernel) get(fd int) (*sock, error) {
+	s, ok := k.socks[fd]
+	if !ok {
+		return nil, unix.EBADF
+	}
+	return s, nil
+}
+
+func (k *Kernel) Socket() (int, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.nextFd++
+	fd := k.nextFd
+	k.socks[fd] = &sock{fd: fd, rxReady: make(chan struct{}, 1)}
+	return fd, nil
+}
+
+func (k *Kernel) RegisterUmem(fd int, data []byte, reg unix.XDPUmemReg) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	s, err := k.get(fd)
+	if err != nil {
+		return err
+	}
+	if s.reg != nil {
+		return unix.EBUSY
+	}
+	if reg.Size == 0 || reg.Size&(reg.Size-1) != 0 || uint64(len(data)) < reg.Len {
+		return unix.EINVAL
+	}
+	if uint64(reg.Headroom)+256 >= uint64(reg.Size) {
+		return unix.EINVAL
+	}
+	s.reg = &umem{data: data[:reg.Len], chunk: uint64(reg.Size), headroom: uint64(reg.Headroom)}
+	if reg.Flags&umemTxMetadataLen != 0 {
+		// tx_metadata_len 位于 x/sys 的 XDPUmemReg 末尾的填充中
+		s.reg.txMeta = uint64(*(*uint32)(unsafe.Add(unsafe.Pointer(&reg), unsafe.Offsetof(reg.Flags)+4)))
+	}
+	return nil
+}
+
+func (k *Kernel) SetRingSize(fd int, which int, size uint32) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	s, err := k.get(fd)
+	if err != nil {
+		return err
+	}
+	if size == 0 || size&(size-1) != 0 {
+		return unix.EINVAL
+	}
+	switch which {
+	case unix.XDP_RX_RING:
+		s.rxSize = size
+	case unix.XDP_TX_RING:
+		s.txSize = size
+	case unix.XDP_UMEM_FILL_RING:
+		if s.reg == nil {
+			s.fq.size = size
+		} else {
+			s.reg.fill.size = size
+		}
+	case unix.XDP_UMEM_COMPLETION_RING:
+		if s.reg == nil {
+			s.cq.size = size
+		} else {
+			s.reg.comp.size = size
+		}
+	default:
+		return unix.ENOPROTOOPT
+	}
+	return nil
+}
+
+func (k *Kernel) MmapOffsets(fd int) (unix.XDPMmapOffsets, error) {
+	off := unix.XDPRingOffset{Producer: offProducer, Consumer: offConsumer, Flags: offFlags, Desc: offDesc}
+	return unix.XDPMmapOffsets{Rx: off, Tx: off, Fr: off, Cr: off}, nil
+}
+
+func (k *Kernel) Mmap(fd int, pgoff int64, length int) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	s, err := k.get(fd)
+	if err != nil {
+		return nil, err
+	}
+	var r *ring
+	var size uint32
+	entry := unsafe.Sizeof(unix.XDPDesc{})
+	switch pgoff {
+	case unix.XDP_PGOFF_RX_RING:
+		r, size = &s.rx, s.rxSize
+	case unix.XDP_PGOFF_TX_RING:
+		r, size = &s.tx, s.txSize
+	case unix.XDP_UMEM_PGOFF_FILL_RING, unix.XDP_UMEM_PGOFF_COMPLETION_RING:
+		fill, comp := &s.fq, &s.cq
+		if s.reg != nil {
+			fill, comp = &s.reg.fill, &s.reg.comp
+		}
+		r = fill
+		if pgoff == unix.XDP_UMEM_PGOFF_COMPLETION_RING {
+			r = comp
+		}
+		size = r.size
+		entry = unsafe.Sizeof(uint64(0))
+	default:
+		return nil, unix.EINVAL
+	}
+	if size == 0 || length > int(offDesc+uintptr(size)*entry) {
+		return nil, unix.EINVAL
+	}
+	// []uint64 保证 producer/consumer 8 字节对齐
+	words := make([]uint64, (offDesc+uintptr(size)*entry+7)/8)
+	*r = ring{
+		m:     unsafe.Slice((*byte)(unsafe.Pointer(&words[0])), len(words)*8),
+		size:  size,
+		entry: entry,
+	}
+	return r.m, nil
+}
+
+func (k *Kernel) Munmap(b []byte) error {
+	return nil
+}
+
+func (k *Kernel) Bind(fd int, sa *unix.SockaddrXDP) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	s, err := k.get(fd)
+	if err != nil {
+		return err
+	}
+	if s.bound {
+		return unix.EINVAL
+	}
+	if !s.rx.ok() && !s.tx.ok() {
+		return unix.EINVAL
+	}
+	if sa.Flags&unix.XDP_SHARED_UMEM != 0 {
+		owner, err := k.get(int(sa.SharedUmemFD))
+		if err != nil || owner.reg == nil || !owner.bound {
+			return unix.EBADF
+		}
+		// 与内核相同: 设备或队列不同时须有自己的 fill/comp ring, 相同时不能有
+		own := s.fq.ok() && s.cq.ok()
+		same := owner.ifindex == int(sa.Ifindex) && owner.queue == int(sa.QueueID)
+		if same == own || s.fq.ok() != s.cq.ok() {
+			return unix.EINVAL
+		}
+		s.umem = owner.reg
+	} else {
+		if s.reg == nil || !s.reg.fill.ok() || !s.reg.comp.ok() {
+			return unix.EINVAL
+		}
+		s.umem = s.reg
+	}
+	if s.rx.ok() {
+		for _, o := range k.socks {
+			if o.bound && o.rx.ok() && o.ifindex == int(sa.Ifindex) && o.queue == int(sa.QueueID) && o.umem != s.umem {
+				return unix.EBUSY
+			}
+		}
+	}
+	s.ifindex = int(sa.Ifindex)
+	s.queue = int(sa.QueueID)
+	s.bound = true
+	if k.cfg.NeedWakeup && s.tx.ok() {
+		// 与内核相同: 第一次发送总要唤醒
+		atomic.StoreUint32(s.tx.flags(), unix.XDP_RING_NEED_WAKEUP)
+	}
+	return nil
+}
+
+func (k *Kernel) Wakeup(fd int) {
+	k.mu.Lock()
+	if s, ok := k.socks[fd]; ok {
+		s.wake = true
+	}
+	k.mu.Unlock()
+	k.signal()
+}
+
+// Poll 只支持 POLLIN (等待 RX ring 非空) 与 POLLOUT (立即返回)
+func (k *Kernel) Poll(fd int, events int16, timeout int) error {
+	k.mu.Lock()
+	s, err := k.get(fd)
+	if err == nil {
+		s.wake = true
+	}
+	k.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	k.signal()
+	if events&unix.POLLIN == 0 || !s.rx.ok() {
+		return nil
+	}
+	var deadline <-chan time.Time
+	if timeout >= 0 {
+		t := time.NewTimer(time.Duration(timeout) * time.Millisecond)
+		defer t.Stop()
+		deadline = t.C
+	}
+	for s.rx.avail() == 0 {
+		select {
+		case <-s.rxReady:
+		case <-deadline:
+			return nil
+		case <-k.done:
+			return unix.EBADF
+		}
+	}
+	return nil
+}
+
+func (k *Kernel) Statistics(fd int) (unix.XDPStatistics, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	s, err := k.get(fd)
+	if err != nil {
+		return unix.XDPStatistics{}, err
+	}
+	return s.stats, nil
+}
+
+func (k *Kernel) Close(fd int) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, err := k.get(fd); err != nil {
+		return err
+	}
+	delete(k.socks, fd)
+	return nil
+}
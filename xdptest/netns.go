@@ -0,0 +1,111 @@
+package xdptest
+
+import (
+	"os"
+	"runtime"
+	"unsafe"
+
+	"github.com/lixiangzhong/xdp/internal/netlink"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	veth_INFO_PEER = 1 // 旧版 x/sys 中没有 VETH_INFO_PEER
+
+	threadNetns = "/proc/thread-self/ns/net"
+)
+
+// newNetns 创建新的 network namespace, 返回其 fd. 调用线程的 namespace 不变
+func newNetns() (int, error) {
+	return inThread(func() (int, error) {
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			return -1, errors.WithMessage(err, "unshare")
+		}
+		return unix.Open(threadNetns, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	})
+}
+
+// inNetns 在 ns 中执行 fn. ns 中创建的 socket 在切回后仍属于 ns
+func inNetns(ns int, fn func() error) error {
+	_, err := inThread(func() (int, error) {
+		if err := unix.Setns(ns, unix.CLONE_NEWNET); err != nil {
+			return 0, errors.WithMessage(err, "setns")
+		}
+		return 0, fn()
+	})
+	return err
+}
+
+// inThread 在锁定的独立线程上执行 fn, 结束后恢复线程原来的 namespace,
+// 无法恢复时不解锁, goroutine 退出后该线程随之销毁
+func inThread(fn func() (int, error)) (int, error) {
+	type result struct {
+		v   int
+		err error
+	}
+	c := make(chan result, 1)
+	go func() {
+		runtime.LockOSThread()
+		orig, err := unix.Open(threadNetns, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			runtime.UnlockOSThread()
+			c <- result{-1, err}
+			return
+		}
+		defer unix.Close(orig)
+		v, err := fn()
+		if unix.Setns(orig, unix.CLONE_NEWNET) == nil {
+			runtime.UnlockOSThread()
+		}
+		c <- result{v, err}
+	}()
+	r := <-c
+	return r.v, r.err
+}
+
+// rtnl 最小的 rtnetlink 客户端, 只用于创建 veth 与 up 网卡
+type rtnl struct {
+	*netlink.Conn
+}
+
+func newRtnl() (*rtnl, error) {
+	c, err := netlink.Dial(unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	return &rtnl{c}, nil
+}
+
+// request 发送请求并等待 ack
+func (c *rtnl) request(typ, flags uint16, payload []byte) error {
+	_, err := c.Request(typ, unix.NLM_F_ACK|flags, payload)
+	return err
+}
+
+func ifinfomsg(index int32, flags, change uint32) []byte {
+	msg := unix.IfInfomsg{Family: unix.AF_UNSPEC, Index: index, Flags: flags, Change: change}
+	return append([]byte(nil), (*[unix.SizeofIfInfomsg]byte)(unsafe.Pointer(&msg))[:]...)
+}
+
+// addVeth ip link add name type veth peer name peer
+func (c *rtnl) addVeth(name, peer string) error {
+	peerInfo := netlink.AppendAttrString(ifinfomsg(0, 0, 0), unix.IFLA_IFNAME, peer)
+	data := netlink.AppendAttr(nil, veth_INFO_PEER, peerInfo)
+	linkinfo := netlink.AppendAttrString(nil, unix.IFLA_INFO_KIND, "veth")
+	linkinfo = netlink.AppendAttr(linkinfo, unix.IFLA_INFO_DATA, data)
+	req := netlink.AppendAttrString(ifinfomsg(0, 0, 0), unix.IFLA_IFNAME, name)
+	req = netlink.AppendAttr(req, unix.IFLA_LINKINFO, linkinfo)
+	return errors.WithMessage(c.request(unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL, req), "RTM_NEWLINK veth")
+}
+
+// setUp ip link set dev up
+func (c *rtnl) setUp(ifindex int) error {
+	req := ifinfomsg(int32(ifindex), unix.IFF_UP, unix.IFF_UP)
+	return errors.WithMessage(c.request(unix.RTM_NEWLINK, 0, req), "RTM_NEWLINK up")
+}
+
+// disableIPv6 避免内核在网卡 up 后发送 RS/MLD 等报文干扰测试, 失败时忽略
+func disableIPv6(name string) {
+	os.WriteFile("/proc/sys/net/ipv6/conf/"+name+"/disable_ipv6", []byte("1"), 0644)
+}
@@ -0,0 +1,269 @@
+package xdptest_test
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lixiangzhong/xdp"
+	"github.com/lixiangzhong/xdp/packet"
+	"github.com/lixiangzhong/xdp/xdptest"
+	"golang.org/x/sys/unix"
+)
+
+type layer func(b *packet.Buffer) error
+
+var (
+	peer6  = net.ParseIP("2001:db8:1:ffff::2")
+	local6 = net.ParseIP("2001:db8::1")
+)
+
+func udp(src, dst uint16) layer { return func(b *packet.Buffer) error { return b.PushUDP(src, dst) } }
+
+func tcp(src, dst uint16) layer {
+	return func(b *packet.Buffer) error {
+		return b.PushTCP(packet.TCPHeader{SrcPort: src, DstPort: dst, Flags: packet.TCPFlagSYN})
+	}
+}
+
+func icmp(b *packet.Buffer) error { return b.PushICMP(packet.ICMPEchoRequest, 0, 1) }
+
+func icmp6(b *packet.Buffer) error { return b.PushICMPv6(packet.ICMPv6EchoRequest, 0, 1) }
+
+func ipv4(src, dst string) layer {
+	return func(b *packet.Buffer) error { return b.PushIPv4(net.ParseIP(src), net.ParseIP(dst), 0, 64) }
+}
+
+// ipv4Proto 没有 L4 头时指定协议号
+func ipv4Proto(proto uint8) layer {
+	return func(b *packet.Buffer) error { return b.PushIPv4(xdptest.PeerIP, xdptest.IP, proto, 64) }
+}
+
+func ipv6(src, dst net.IP) layer {
+	return func(b *packet.Buffer) error { return b.PushIPv6(src, dst, 0, 64) }
+}
+
+// frag 改写刚压入的 IPv4 头的分片字段, off 以 8 字节为单位
+func frag(off uint16, more bool) layer {
+	return func(b *packet.Buffer) error {
+		ip := packet.IPv4(b.Bytes())
+		v := off
+		if more {
+			v |= 0x2000
+		}
+		binary.BigEndian.PutUint16(ip[6:], v)
+		ip.SetChecksum()
+		return nil
+	}
+}
+
+func vlan(tci uint16) layer { return func(b *packet.Buffer) error { return b.PushVLAN(tci) } }
+
+// eth 以 etherType 压入以太网头, 为 0 时取内层
+func eth(e *xdptest.Env, etherType uint16) layer {
+	return func(b *packet.Buffer) error { return b.PushEthernet(e.MAC, e.PeerMAC, etherType) }
+}
+
+func build(t *testing.T, payload []byte, layers ...layer) []byte {
+	t.Helper()
+	b := packet.NewBuffer(make([]byte, 512), 256, 0)
+	if err := b.Append(payload); err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range layers {
+		if err := l(&b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return append([]byte(nil), b.Bytes()...)
+}
+
+func arp() []byte {
+	a := make([]byte, 28)
+	binary.BigEndian.PutUint16(a[0:], 1)
+	binary.BigEndian.PutUint16(a[2:], packet.EtherTypeIPv4)
+	a[4], a[5] = 6, 4
+	binary.BigEndian.PutUint16(a[6:], 1)
+	copy(a[14:18], xdptest.PeerIP.To4())
+	copy(a[24:28], xdptest.IP.To4())
+	return a
+}
+
+func cidr(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+type ruleFrame struct {
+	name  string
+	frame []byte
+	match bool // 应被重定向到 socket
+}
+
+// 规则程序在真实内核中运行: 匹配的帧到达 socket, 其余 XDP_PASS
+func TestRules(t *testing.T) {
+	pl := []byte("rule test payload")
+	tests := []struct {
+		name   string
+		rules  []xdp.Rule
+		frames func(e *xdptest.Env) []ruleFrame
+	}{
+		{"vlan", []xdp.Rule{{VLAN: 100}}, func(e *xdptest.Env) []ruleFrame {
+			return []ruleFrame{
+				{"vlan 100", build(t, pl, udp(1, 2), ipv4("10.0.0.2", "10.0.0.1"), vlan(100), eth(e, 0)), true},
+				{"vlan 100 with priority", build(t, pl, icmp6, ipv6(peer6, local6), vlan(5<<13|100), eth(e, 0)), true},
+				{"802.1ad vlan 100", build(t, pl, udp(1, 2), ipv4("10.0.0.2", "10.0.0.1"), vlan(100), eth(e, 0x88a8)), true},
+				{"vlan 100 arp", build(t, arp(), vlan(100), eth(e, 0)), true},
+				{"vlan 200", build(t, pl, udp(1, 2), ipv4("10.0.0.2", "10.0.0.1"), vlan(200), eth(e, 0)), false},
+				{"untagged", build(t, pl, udp(1, 2), ipv4("10.0.0.2", "10.0.0.1"), eth(e, 0)), false},
+			}
+		}},
+		{"port range", []xdp.Rule{{Proto: unix.IPPROTO_UDP, SrcPort: xdp.PortRange{First: 53}, DstPort: xdp.PortRange{First: 1000, Last: 2000}}},
+			func(e *xdptest.Env) []ruleFrame {
+				f := func(proto layer, ip layer) []byte { return build(t, pl, proto, ip, eth(e, 0)) }
+				v4, v6 := ipv4("10.0.0.2", "10.0.0.1"), ipv6(peer6, local6)
+				return []ruleFrame{
+					{"dport 999", f(udp(53, 999), v4), false},
+					{"dport 1000", f(udp(53, 1000), v4), true},
+					{"dport 1500 ipv6", f(udp(53, 1500), v6), true},
+					{"dport 2000", f(udp(53, 2000), v4), true},
+					{"dport 2001", f(udp(53, 2001), v4), false},
+					{"sport 54", f(udp(54, 1500), v4), false},
+					{"tcp", f(tcp(53, 1500), v4), false},
+				}
+			}},
+		{"fragments", []xdp.Rule{{Proto: unix.IPPROTO_UDP, DstPort: xdp.PortRange{First: 53}}}, func(e *xdptest.Env) []ruleFrame {
+			v4 := ipv4("10.0.0.2", "10.0.0.1")
+			return []ruleFrame{
+				{"unfragmented", build(t, pl, udp(1, 53), v4, eth(e, 0)), true},
+				{"first fragment", build(t, pl, udp(2, 53), v4, frag(0, true), eth(e, 0)), true},
+				// 非首个分片中与 UDP 头同一位置的字节不是端口
+				{"non-first fragment", build(t, pl, udp(3, 53), v4, frag(8, true), eth(e, 0)), false},
+				{"last fragment", build(t, pl, udp(4, 53), v4, frag(8, false), eth(e, 0)), false},
+				{"truncated udp", build(t, []byte{0, 1}, ipv4Proto(unix.IPPROTO_UDP), eth(e, 0)), false},
+			}
+		}},
+		{"proto without ports", []xdp.Rule{{Proto: unix.IPPROTO_UDP}, {Proto: unix.IPPROTO_ICMPV6}}, func(e *xdptest.Env) []ruleFrame {
+			v4 := ipv4("10.0.0.2", "10.0.0.1")
+			return []ruleFrame{
+				{"udp", build(t, pl, udp(1, 2), v4, eth(e, 0)), true},
+				{"non-first fragment", build(t, pl, udp(3, 4), v4, frag(100, false), eth(e, 0)), true},
+				{"truncated udp", build(t, []byte{0, 1}, ipv4Proto(unix.IPPROTO_UDP), eth(e, 0)), true},
+				{"icmpv6", build(t, pl, icmp6, ipv6(peer6, local6), eth(e, 0)), true},
+				{"tcp", build(t, pl, tcp(1, 2), v4, eth(e, 0)), false},
+				{"icmp", build(t, pl, icmp, v4, eth(e, 0)), false},
+				{"arp", build(t, arp(), eth(e, packet.EtherTypeARP)), false},
+			}
+		}},
+		{"ipv4 prefix", []xdp.Rule{{Src: cidr("10.1.0.0/16"), Dst: cidr("192.168.1.128/25")}}, func(e *xdptest.Env) []ruleFrame {
+			f := func(src, dst string) []byte { return build(t, pl, udp(1, 2), ipv4(src, dst), eth(e, 0)) }
+			return []ruleFrame{
+				{"match", f("10.1.2.3", "192.168.1.200"), true},
+				{"match edges", f("10.1.255.255", "192.168.1.128"), true},
+				{"src outside", f("10.2.0.1", "192.168.1.200"), false},
+				{"dst outside", f("10.1.2.3", "192.168.1.127"), false},
+				{"ipv6", build(t, pl, udp(1, 2), ipv6(peer6, local6), eth(e, 0)), false},
+			}
+		}},
+		{"ipv4 any", []xdp.Rule{{Dst: cidr("0.0.0.0/0")}}, func(e *xdptest.Env) []ruleFrame {
+			return []ruleFrame{
+				{"ipv4", build(t, pl, icmp, ipv4("1.2.3.4", "5.6.7.8"), eth(e, 0)), true},
+				{"ipv6", build(t, pl, icmp6, ipv6(peer6, local6), eth(e, 0)), false},
+				{"arp", build(t, arp(), eth(e, packet.EtherTypeARP)), false},
+			}
+		}},
+		{"ipv6 prefix", []xdp.Rule{
+			{Src: cidr("2001:db8:1::/48"), Dst: cidr("2001:db8::/35")},
+			{Dst: cidr("2001:db8:ffff::1/128"), Proto: unix.IPPROTO_TCP, DstPort: xdp.PortRange{First: 443}},
+		}, func(e *xdptest.Env) []ruleFrame {
+			f := func(src, dst string, l4 layer) []byte {
+				return build(t, pl, l4, ipv6(net.ParseIP(src), net.ParseIP(dst)), eth(e, 0))
+			}
+			return []ruleFrame{
+				{"/48 and /35", f("2001:db8:1:ffff::2", "2001:db8:1fff::1", udp(1, 2)), true},
+				{"src outside /48", f("2001:db8:2::2", "2001:db8::1", udp(1, 2)), false},
+				{"dst outside /35", f("2001:db8:1::2", "2001:db8:2000::1", udp(1, 2)), false},
+				{"/128 tcp 443", f("2001:db8:9::2", "2001:db8:ffff::1", tcp(1, 443)), true},
+				{"/128 other address", f("2001:db8:9::2", "2001:db8:ffff::2", tcp(1, 443)), false},
+				{"/128 other port", f("2001:db8:9::2", "2001:db8:ffff::1", tcp(1, 80)), false},
+				{"ipv4", build(t, pl, udp(1, 2), ipv4("10.0.0.2", "10.0.0.1"), eth(e, 0)), false},
+			}
+		}},
+		// 16 字节掩码的 IPv4 网段
+		{"ipv4 with 16-byte mask", []xdp.Rule{{Src: &net.IPNet{IP: net.IPv4(10, 9, 0, 0), Mask: net.CIDRMask(112, 128)}}},
+			func(e *xdptest.Env) []ruleFrame {
+				return []ruleFrame{
+					{"match", build(t, pl, udp(1, 2), ipv4("10.9.1.1", "10.0.0.1"), eth(e, 0)), true},
+					{"outside", build(t, pl, udp(1, 2), ipv4("10.8.1.1", "10.0.0.1"), eth(e, 0)), false},
+				}
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := xdptest.New(t, &xdptest.Config{Program: &xdp.ProgramConfig{Rules: tt.rules}})
+			s := e.NewSocket(nil, nil)
+			frames := tt.frames(e)
+			want := make(map[string]string)
+			names := make(map[string]string)
+			for _, f := range frames {
+				names[string(f.frame)] = f.name
+				if f.match {
+					want[string(f.frame)] = f.name
+				}
+			}
+			var mu sync.Mutex
+			got := make(map[string]bool)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				s.HandleRecv(func(_ unix.XDPDesc, b []byte) bool {
+					mu.Lock()
+					got[string(b)] = true
+					mu.Unlock()
+					return true
+				})
+			}()
+			defer func() {
+				s.Close()
+				<-done
+			}()
+			for _, f := range frames {
+				e.Inject(f.frame)
+			}
+			received := func() int {
+				mu.Lock()
+				defer mu.Unlock()
+				n := 0
+				for f := range want {
+					if got[f] {
+						n++
+					}
+				}
+				return n
+			}
+			deadline := time.Now().Add(2 * time.Second)
+			for received() < len(want) && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			// 等待可能被错误重定向的帧
+			time.Sleep(50 * time.Millisecond)
+			mu.Lock()
+			defer mu.Unlock()
+			for f, name := range want {
+				if !got[f] {
+					t.Errorf("%s: not redirected", name)
+				}
+			}
+			for f := range got {
+				if name, ok := names[f]; ok && want[f] == "" {
+					t.Errorf("%s: redirected", name)
+				}
+			}
+		})
+	}
+}
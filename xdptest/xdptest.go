@@ -0,0 +1,285 @@
+// Package xdptest 在独立的 network namespace 中建立 veth 对, 用真实内核做 AF_XDP 端到端测试,
+// 不需要物理网卡:
+//
+//	func TestRecv(t *testing.T) {
+//		env := xdptest.New(t, nil)
+//		s := env.NewSocket(nil, nil)
+//		go s.HandleRecv(func(d unix.XDPDesc, b []byte) bool { ...; return true })
+//		env.Inject(env.UDP(1000, 2000, []byte("hello")))
+//	}
+//
+// veth 上以 generic 模式挂载 xdp.Program, 从 peer 端用 AF_PACKET 注入/读取报文.
+// 非 root 或无法创建 namespace 时跳过测试, 所有资源在 tb.Cleanup 中释放
+package xdptest
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/rlimit"
+	"github.com/lixiangzhong/xdp"
+	"github.com/lixiangzhong/xdp/packet"
+	"golang.org/x/sys/unix"
+)
+
+type Config struct {
+	Name     string             // 挂载程序的一端, 默认 xdp0
+	PeerName string             // 注入报文的一端, 默认 xdp1
+	Program  *xdp.ProgramConfig // Program.Metadata 时 Ifindex 自动设为 Name 的 ifindex
+
+	// AttachFlags 挂载模式, 默认 XDPGenericMode. Program.Metadata 的程序只能以 XDPDriverMode 挂载
+	AttachFlags link.XDPAttachFlags
+}
+
+var defaultConfig = Config{
+	Name:     "xdp0",
+	PeerName: "xdp1",
+}
+
+var (
+	IP     = net.IPv4(10, 0, 0, 1) // UDP 构造报文的目的地址
+	PeerIP = net.IPv4(10, 0, 0, 2)
+)
+
+// Env 一个 namespace 及其中的 veth 对
+type Env struct {
+	Name        string
+	PeerName    string
+	Ifindex     int
+	PeerIfindex int
+	MAC         net.HardwareAddr
+	PeerMAC     net.HardwareAddr
+	Program     *xdp.Program
+
+	tb      testing.TB
+	ns      int
+	link    link.Link
+	peer    int // peer 上的 AF_PACKET socket
+	closers []func()
+}
+
+// New 创建 namespace 与 veth 对并挂载程序, cfg 为 nil 时使用默认配置
+func New(tb testing.TB, cfg *Config) *Env {
+	tb.Helper()
+	if os.Geteuid() != 0 {
+		tb.Skip("xdptest: requires root")
+	}
+	if cfg == nil {
+		cfg = &defaultConfig
+	}
+	e := &Env{tb: tb, Name: cfg.Name, PeerName: cfg.PeerName, ns: -1, peer: -1}
+	if e.Name == "" {
+		e.Name = defaultConfig.Name
+	}
+	if e.PeerName == "" {
+		e.PeerName = defaultConfig.PeerName
+	}
+	if err := rlimit.RemoveMemlock(); err != nil {
+		tb.Skipf("xdptest: RemoveMemlock: %v", err)
+	}
+	ns, err := newNetns()
+	if err != nil {
+		tb.Skipf("xdptest: %v", err)
+	}
+	e.ns = ns
+	tb.Cleanup(e.Close)
+
+	err = e.Do(func() error {
+		c, err := newRtnl()
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		if err := c.addVeth(e.Name, e.PeerName); err != nil {
+			return err
+		}
+		disableIPv6(e.Name)
+		disableIPv6(e.PeerName)
+		ifi, err := net.InterfaceByName(e.Name)
+		if err != nil {
+			return err
+		}
+		peer, err := net.InterfaceByName(e.PeerName)
+		if err != nil {
+			return err
+		}
+		e.Ifindex, e.MAC = ifi.Index, ifi.HardwareAddr
+		e.PeerIfindex, e.PeerMAC = peer.Index, peer.HardwareAddr
+		if err := c.setUp(e.Ifindex); err != nil {
+			return err
+		}
+		if err := c.setUp(e.PeerIfindex); err != nil {
+			return err
+		}
+		e.peer, err = unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, int(htons(unix.ETH_P_ALL)))
+		if err != nil {
+			return err
+		}
+		err = unix.Bind(e.peer, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: e.PeerIfindex})
+		if err != nil {
+			return err
+		}
+		pcfg := cfg.Program
+		if pcfg != nil && pcfg.Metadata && pcfg.Ifindex == 0 {
+			c := *pcfg
+			c.Ifindex = e.Ifindex
+			pcfg = &c
+		}
+		e.Program, err = xdp.NewProgram(pcfg)
+		if err != nil {
+			return err
+		}
+		flags := cfg.AttachFlags
+		if flags == 0 {
+			flags = link.XDPGenericMode
+		}
+		e.link, err = e.Program.Attach(e.Ifindex, flags)
+		return err
+	})
+	if err != nil {
+		tb.Fatalf("xdptest: %v", err)
+	}
+	return e
+}
+
+// Do 在 namespace 中执行 fn, 用于创建 socket 或查询网卡等
+func (e *Env) Do(fn func() error) error {
+	return inNetns(e.ns, fn)
+}
+
+// NewUmem cfg 为 nil 时使用默认配置, 测试结束时释放
+func (e *Env) NewUmem(cfg *xdp.UmemConfig) *xdp.Umem {
+	e.tb.Helper()
+	var umem *xdp.Umem
+	err := e.Do(func() (err error) {
+		umem, err = xdp.NewUmem(cfg)
+		return err
+	})
+	if err != nil {
+		e.tb.Fatalf("xdptest: NewUmem: %v", err)
+	}
+	e.closers = append(e.closers, func() { umem.Close() })
+	return umem
+}
+
+// NewSocket 在 Name 上打开 socket 并注册到程序的 XSKMap. umem 为 nil 时新建,
+// cfg 为 nil 时使用 XDP_COPY 与 Poll, 测试结束时关闭
+func (e *Env) NewSocket(umem *xdp.Umem, cfg *xdp.SocketConfig) *xdp.Socket {
+	e.tb.Helper()
+	if umem == nil {
+		umem = e.NewUmem(nil)
+	}
+	if cfg == nil {
+		cfg = &xdp.SocketConfig{
+			RxSize:    xdp.DEFAULT_RX_SIZE,
+			TxSize:    xdp.DEFAULT_TX_SIZE,
+			BindFlags: unix.XDP_COPY,
+			Poll:      true,
+		}
+	}
+	var s *xdp.Socket
+	err := e.Do(func() (err error) {
+		s, err = xdp.NewSocket(e.Ifindex, umem, cfg)
+		return err
+	})
+	if err != nil {
+		e.tb.Fatalf("xdptest: NewSocket: %v", err)
+	}
+	e.closers = append(e.closers, func() { s.Close() })
+	if err := e.Program.Register(cfg.QueueID, s); err != nil {
+		e.tb.Fatalf("xdptest: Register: %v", err)
+	}
+	return s
+}
+
+// Inject 从 peer 发送以太网帧, 到达 Name 后被程序重定向到 socket
+func (e *Env) Inject(frames ...[]byte) {
+	e.tb.Helper()
+	for _, f := range frames {
+		if _, err := unix.Write(e.peer, f); err != nil {
+			e.tb.Fatalf("xdptest: Inject: %v", err)
+		}
+	}
+}
+
+// ReadPeer 读取 peer 收到的一个帧(即 socket 发出的帧), 超时返回 nil
+func (e *Env) ReadPeer(timeout time.Duration) []byte {
+	e.tb.Helper()
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 1<<16)
+	for {
+		left := time.Until(deadline)
+		if left <= 0 {
+			return nil
+		}
+		fds := []unix.PollFd{{Fd: int32(e.peer), Events: unix.POLLIN}}
+		n, err := unix.Poll(fds, int(left/time.Millisecond)+1)
+		if err == unix.EINTR || n == 0 {
+			continue
+		}
+		if err != nil {
+			e.tb.Fatalf("xdptest: poll: %v", err)
+		}
+		n, from, err := unix.Recvfrom(e.peer, buf, unix.MSG_DONTWAIT)
+		if err != nil {
+			continue
+		}
+		// 忽略 Inject 自己发出的帧
+		if ll, ok := from.(*unix.SockaddrLinklayer); ok && ll.Pkttype == unix.PACKET_OUTGOING {
+			continue
+		}
+		return append([]byte(nil), buf[:n]...)
+	}
+}
+
+// UDP 构造一个 PeerIP:srcPort -> IP:dstPort 的以太网帧, 可直接用于 Inject
+func (e *Env) UDP(srcPort, dstPort uint16, payload []byte) []byte {
+	e.tb.Helper()
+	frame := make([]byte, 128+len(payload))
+	b := packet.NewBuffer(frame, 128, 0)
+	err := b.Append(payload)
+	if err == nil {
+		err = b.PushUDP(srcPort, dstPort)
+	}
+	if err == nil {
+		err = b.PushIPv4(PeerIP, IP, 0, 64)
+	}
+	if err == nil {
+		err = b.PushEthernet(e.MAC, e.PeerMAC, 0)
+	}
+	if err != nil {
+		e.tb.Fatalf("xdptest: UDP: %v", err)
+	}
+	return b.Bytes()
+}
+
+// Close 释放全部资源, namespace 随最后一个引用关闭而销毁. New 已注册到 tb.Cleanup
+func (e *Env) Close() {
+	for i := len(e.closers) - 1; i >= 0; i-- {
+		e.closers[i]()
+	}
+	e.closers = nil
+	if e.link != nil {
+		e.link.Close()
+		e.link = nil
+	}
+	if e.Program != nil {
+		e.Program.Close()
+		e.Program = nil
+	}
+	if e.peer >= 0 {
+		unix.Close(e.peer)
+		e.peer = -1
+	}
+	if e.ns >= 0 {
+		unix.Close(e.ns)
+		e.ns = -1
+	}
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
@@ -0,0 +1,168 @@
+package xdptest_test
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lixiangzhong/xdp"
+	"github.com/lixiangzhong/xdp/packet"
+	"github.com/lixiangzhong/xdp/xdptest"
+	"golang.org/x/sys/unix"
+)
+
+// HandleRecv 收到 peer 注入的 UDP, 原样交换地址后经 TX ring 发回 peer
+func TestHandleRecvEcho(t *testing.T) {
+	e := xdptest.New(t, nil)
+	s := e.NewSocket(nil, nil)
+
+	var received int32
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.HandleRecv(func(d unix.XDPDesc, b []byte) bool {
+			atomic.AddInt32(&received, 1)
+			var p packet.Packet
+			if p.Parse(b) != nil {
+				return true
+			}
+			p.SwapMAC()
+			p.SwapIP()
+			p.SwapPorts()
+			if s.Write(b) != 1 {
+				t.Errorf("Write failed")
+			}
+			return true
+		})
+	}()
+
+	const n = 20
+	for i := 0; i < n; i++ {
+		payload := []byte{byte(i), 'x', 'd', 'p'}
+		e.Inject(e.UDP(1000+uint16(i), 2000, payload))
+		reply := e.ReadPeer(2 * time.Second)
+		if reply == nil {
+			t.Fatalf("frame %d: no reply", i)
+		}
+		var p packet.Packet
+		if err := p.Parse(reply); err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		l4 := p.L4()
+		if p.L4Proto != packet.IPProtocolUDP || len(l4) < 8 {
+			t.Fatalf("frame %d: not UDP", i)
+		}
+		if src, dst := uint16(l4[0])<<8|uint16(l4[1]), uint16(l4[2])<<8|uint16(l4[3]); src != 2000 || dst != 1000+uint16(i) {
+			t.Errorf("frame %d: ports %d -> %d", i, src, dst)
+		}
+		if !bytes.Equal(l4[8:], payload) {
+			t.Errorf("frame %d: payload % x", i, l4[8:])
+		}
+		if !p.ValidL4Checksum() {
+			t.Errorf("frame %d: bad checksum", i)
+		}
+	}
+	if got := atomic.LoadInt32(&received); got != n {
+		t.Errorf("HandleRecv got %d frames, want %d", got, n)
+	}
+	st, err := s.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Rx_dropped != 0 || st.Rx_invalid_descs != 0 || st.Tx_invalid_descs != 0 {
+		t.Errorf("stats: %+v", st)
+	}
+	s.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("HandleRecv did not return after Close")
+	}
+}
+
+// umem 的 fill ring 用尽时内核计入 rx_fill_ring_empty_descs 与 rx_dropped
+func TestStatsFillRingEmpty(t *testing.T) {
+	e := xdptest.New(t, nil)
+	s := e.NewSocket(nil, nil)
+	descs := make([]unix.XDPDesc, 64)
+	var held []unix.XDPDesc
+	const n = 2048 + 16 // 默认 fill ring 2048
+	for i := 0; i < n; i++ {
+		e.Inject(e.UDP(1000, 2000, []byte{byte(i)}))
+	}
+	// 注入期间不调用 Recv, fill ring 得不到补充
+	deadline := time.Now().Add(2 * time.Second)
+	var st unix.XDPStatistics
+	for time.Now().Before(deadline) {
+		st, _ = s.Stats()
+		if st.Rx_dropped > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st.Rx_dropped == 0 {
+		t.Fatalf("no drops: %+v", st)
+	}
+	if st.Rx_fill_ring_empty_descs == 0 && st.Rx_ring_full == 0 {
+		t.Errorf("drops not attributed: %+v", st)
+	}
+	for {
+		k := s.Recv(descs)
+		if k == 0 {
+			break
+		}
+		held = append(held, descs[:k]...)
+	}
+	if len(held) == 0 || len(held) >= n {
+		t.Errorf("received %d of %d", len(held), n)
+	}
+	s.Release(held...)
+}
+
+// lo 的 MTU 为 65536, RX socket 放不下一个包, TX-only 或 NoMTUCheck 的 socket 不检查
+func TestNewSocketMTU(t *testing.T) {
+	e := xdptest.New(t, nil)
+	open := func(cfg *xdp.SocketConfig) error {
+		lo, err := net.InterfaceByName("lo")
+		if err != nil {
+			return err
+		}
+		// socket 关闭后 umem 仍占用队列, 每次新建
+		umem, err := xdp.NewUmem(nil)
+		if err != nil {
+			return err
+		}
+		defer umem.Close()
+		s, err := xdp.NewSocket(lo.Index, umem, cfg)
+		if err == nil {
+			s.Close()
+		}
+		return err
+	}
+	for _, c := range []struct {
+		name string
+		cfg  xdp.SocketConfig
+		err  string // 为空时应成功
+	}{
+		{"rx", xdp.SocketConfig{RxSize: 64, TxSize: 64, BindFlags: unix.XDP_COPY}, "exceeds frame room"},
+		{"tx only", xdp.SocketConfig{TxSize: 64, BindFlags: unix.XDP_COPY}, ""},
+		{"NoMTUCheck", xdp.SocketConfig{RxSize: 64, BindFlags: unix.XDP_COPY, NoMTUCheck: true}, ""},
+	} {
+		err := e.Do(func() error {
+			err := open(&c.cfg)
+			// 内核延迟释放上一个 socket 占用的队列
+			for i := 0; i < 100 && errors.Is(err, unix.EBUSY); i++ {
+				time.Sleep(10 * time.Millisecond)
+				err = open(&c.cfg)
+			}
+			return err
+		})
+		if c.err == "" && err != nil || c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Errorf("%s: NewSocket on lo: %v", c.name, err)
+		}
+	}
+}